@@ -0,0 +1,32 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// artifactCmd represents the artifact command
+var artifactCmd = &cobra.Command{
+	Use:   "artifact",
+	Short: "Encrypt, push and pull artifacts other than images.",
+	Long: `artifact encrypts and pushes, or pulls and decrypts, OCI artifacts of any type, such
+as helm charts, WASM modules or files pushed with oras, using the same key handling
+as images.`,
+}
+
+func init() {
+	rootCmd.AddCommand(artifactCmd)
+}
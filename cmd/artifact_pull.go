@@ -0,0 +1,61 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+var outputDir string
+
+// artifactPullCmd represents the artifact pull command
+var artifactPullCmd = &cobra.Command{
+	Use:   "pull [OPTIONS] NAME[:TAG]",
+	Short: "Download an artifact from a remote repository, decrypting its files if necessary.",
+	Long: `artifact pull downloads the blobs of an artifact, decrypts those that are encrypted
+and writes them to files in the output directory named by their titles.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.Flags().VisitAll(checkFlagsPull)
+		return runArtifactPull(args[0], &opts)
+	},
+	Args: cobra.ExactArgs(1),
+}
+
+func runArtifactPull(remote string, opts *crypto.Opts) error {
+	ref, err := names.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+	log.Info().Msgf("Obtaining manifest for artifact: %s", ref)
+	return images.PullEncryptedArtifact(ref, outputDir, opts, tempDir)
+}
+
+func init() {
+	artifactCmd.AddCommand(artifactPullCmd)
+
+	artifactPullCmd.Flags().StringVarP(
+		&outputDir,
+		"output",
+		"o",
+		".",
+		"The directory to write the files of the artifact to",
+	)
+}
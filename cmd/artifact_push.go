@@ -0,0 +1,115 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+var (
+	artifactPushType      string
+	artifactPushMediaType string
+	artifactPushFiles     []string
+)
+
+// artifactPushCmd represents the artifact push command
+var artifactPushCmd = &cobra.Command{
+	Use:   "push [OPTIONS] NAME[:TAG]",
+	Short: "Encrypt files as an artifact and push it to a remote repository.",
+	Long: `artifact push encrypts each file as a blob of an artifact of the given type and
+uploads it to a remote repository under the tag. The wrapped key of each blob is
+stored in an annotation on its descriptor.`,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		opts.Algos, err = crypto.ValidateAlgos(typeStr)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(opts.EncryptedSuffix, "+") {
+			return errors.Errorf("the media type suffix must begin with a +: %s", opts.EncryptedSuffix)
+		}
+		cmd.Flags().VisitAll(checkFlagsPush)
+		return runArtifactPush(args[0], &opts)
+	},
+	Args: cobra.ExactArgs(1),
+}
+
+func runArtifactPush(remote string, opts *crypto.Opts) error {
+	if artifactPushType == "" {
+		return errors.New("the artifact type must be specified")
+	}
+
+	if len(artifactPushFiles) == 0 {
+		return errors.New("at least one file must be specified")
+	}
+
+	ref, err := names.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+
+	log.Info().Msgf("Pushing artifact: %s.", ref)
+	desc, err := images.PushEncryptedArtifact(ref, artifactPushType, artifactPushMediaType, artifactPushFiles, opts, tempDir)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Successfully uploaded artifact: %s.", desc.Digest)
+	return nil
+}
+
+func init() {
+	artifactCmd.AddCommand(artifactPushCmd)
+
+	artifactPushCmd.Flags().StringVar(
+		&artifactPushType,
+		"artifact-type",
+		"",
+		"The type of the artifact, e.g. application/vnd.cncf.helm.config.v1+json",
+	)
+	artifactPushCmd.Flags().StringVar(
+		&artifactPushMediaType,
+		"media-type",
+		"application/octet-stream",
+		"The media type of the files before they are encrypted",
+	)
+	artifactPushCmd.Flags().StringSliceVarP(
+		&artifactPushFiles,
+		"file",
+		"f",
+		nil,
+		"A file to include in the artifact. May be repeated.",
+	)
+	artifactPushCmd.Flags().StringVar(
+		&opts.EncryptedSuffix,
+		"media-type-suffix",
+		crypto.DefaultMediaTypeSuffix,
+		"the suffix appended to the media type of the encrypted files",
+	)
+	artifactPushCmd.Flags().StringVarP(
+		&typeStr,
+		"type",
+		"t",
+		string(crypto.Pbkdf2Aes256Gcm),
+		"Specifies the type of encryption to use.",
+	)
+}
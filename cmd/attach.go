@@ -0,0 +1,90 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+var (
+	artifactType  string
+	blobMediaType string
+	artifactFiles []string
+)
+
+// attachCmd represents the attach command
+var attachCmd = &cobra.Command{
+	Use:   "attach [OPTIONS] NAME[:TAG]",
+	Short: "Attach an artifact such as a signature or an SBOM to an image in a remote repository.",
+	Long: `attach uploads files as an artifact that refers to an image in a remote repository
+through its subject. Registries without the referrers API are supported using the
+referrers tag scheme. The image itself is not modified.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAttach(args[0])
+	},
+	Args: cobra.ExactArgs(1),
+}
+
+func runAttach(remote string) error {
+	if artifactType == "" {
+		return errors.New("the artifact type must be specified")
+	}
+
+	if len(artifactFiles) == 0 {
+		return errors.New("at least one file must be specified")
+	}
+
+	ref, err := names.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+
+	desc, err := images.AttachArtifact(ref, artifactType, blobMediaType, artifactFiles, tempDir)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Successfully attached artifact: %s.", desc.Digest)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(attachCmd)
+
+	attachCmd.Flags().StringVar(
+		&artifactType,
+		"artifact-type",
+		"",
+		"The type of the artifact, e.g. application/spdx+json",
+	)
+	attachCmd.Flags().StringVar(
+		&blobMediaType,
+		"media-type",
+		"application/octet-stream",
+		"The media type of the files",
+	)
+	attachCmd.Flags().StringSliceVarP(
+		&artifactFiles,
+		"file",
+		"f",
+		nil,
+		"A file to include in the artifact. May be repeated.",
+	)
+}
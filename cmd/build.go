@@ -0,0 +1,79 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// buildCmd represents the build command
+var buildCmd = &cobra.Command{
+	Use:   "build [OPTIONS] NAME[:TAG] [CONTEXT] [-- BUILD OPTIONS]",
+	Short: "Build an image then encrypt it and push it to a remote repository.",
+	Long: `build builds an image with the build command of the container runtime (docker,
+podman or nerdctl), then encrypts the marked layers and pushes it as push does, so
+that CI may go from a Dockerfile to an encrypted image in one step. The context is
+the current directory if it is absent, and the options after -- are passed to the
+build command, e.g. crypto-cli build NAME:TAG . -- --file Dockerfile.prod`,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if err = checkEncryptOpts(); err != nil {
+			return err
+		}
+
+		positional, buildArgs := args, []string(nil)
+		if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+			positional, buildArgs = args[:dash], args[dash:]
+		}
+		if len(positional) < 1 || len(positional) > 2 {
+			return errors.New("build requires NAME[:TAG] and an optional CONTEXT")
+		}
+
+		contextDir := "."
+		if len(positional) == 2 {
+			contextDir = positional[1]
+		}
+
+		cmd.Flags().VisitAll(checkFlagsPush)
+		return runBuild(positional[0], contextDir, buildArgs)
+	},
+}
+
+func runBuild(remote, contextDir string, buildArgs []string) error {
+	ref, err := names.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+
+	if runtimeName == "" {
+		runtimeName = images.DetectRuntime()
+	}
+
+	if err = images.Build(runtimeName, namespace, reference.TagNameOnly(ref), contextDir, buildArgs); err != nil {
+		return err
+	}
+
+	return runPush([]string{remote}, &opts)
+}
+
+func init() {
+	rootCmd.AddCommand(buildCmd)
+
+	addEncryptFlags(buildCmd.Flags())
+}
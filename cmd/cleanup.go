@@ -0,0 +1,94 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+var cleanupDryRun bool
+
+// cleanupCmd represents the cleanup command
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup [OPTIONS]",
+	Short: "Remove the temporary files left behind by runs that crashed.",
+	Long: `cleanup removes the temporary files of runs that did not end cleanly, such as
+those that crashed or were killed, which may hold decrypted layers. The files of
+runs that are still in progress are kept, as are any files in the directory that
+this program did not make. The directory of --temp is swept, and that of --scratch
+on each tmpfs. The files are listed and removed once confirmed, or with --yes.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		roots := []string{tempRoot}
+		for _, d := range utils.MemoryDirs() {
+			roots = append(roots, filepath.Join(d, tempName))
+		}
+		return runCleanup(roots)
+	},
+	Args: cobra.NoArgs,
+}
+
+func runCleanup(roots []string) error {
+	// the files are listed first, so that exactly those that are confirmed are removed
+	var removed []string
+	for _, root := range roots {
+		files, err := utils.Sweep(root, true)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, files...)
+	}
+
+	if len(removed) == 0 {
+		log.Info().Msg("Nothing to clean up.")
+		return nil
+	}
+	for _, fn := range removed {
+		log.Info().Msgf("Would remove %s.", fn)
+	}
+	if cleanupDryRun {
+		return nil
+	}
+
+	ok, err := confirmAction("Remove the files listed above?", false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.WithStack(images.ErrNotConfirmed)
+	}
+	if err = utils.RemoveAll(removed); err != nil {
+		return err
+	}
+	log.Info().Msgf("Removed %d temporary files.", len(removed))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(cleanupCmd)
+
+	cleanupCmd.Flags().BoolVar(
+		&cleanupDryRun,
+		"dry-run",
+		false,
+		"list the files that would be removed without removing them",
+	)
+}
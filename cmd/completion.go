@@ -0,0 +1,284 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// completionCmd represents the completion command
+var completionCmd = &cobra.Command{
+	Use:   "completion SHELL",
+	Short: "Print the completion script of a shell.",
+	Long: `completion prints the script that completes the commands and options of
+crypto-cli in bash, zsh, fish or PowerShell, which completes the names of local
+images to push from the daemon as well. To load it in every bash session:
+
+  crypto-cli completion bash > /etc/bash_completion.d/crypto-cli
+
+in zsh, in ~/.zshrc:
+
+  source <(crypto-cli completion zsh)
+
+or in fish:
+
+  crypto-cli completion fish > ~/.config/fish/completions/crypto-cli.fish
+
+or in PowerShell, in $PROFILE:
+
+  crypto-cli completion powershell | Out-String | Invoke-Expression`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runCompletion(os.Stdout, args[0])
+	},
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"bash", "zsh", "fish", "powershell"},
+}
+
+// completeImagesCmd prints the names of local images for the completion scripts
+var completeImagesCmd = &cobra.Command{
+	Use:    "__images",
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		d, err := localDaemon()
+		if err != nil {
+			return err
+		}
+
+		names, err := d.ListNames()
+		if err != nil {
+			return err
+		}
+
+		for _, n := range names {
+			fmt.Println(n)
+		}
+		return nil
+	},
+	Args: cobra.NoArgs,
+}
+
+// bashCompletionFunction completes the arguments of push with the names of local
+// images, which cobra calls when nothing else completes
+const bashCompletionFunction = `
+__custom_func() {
+    case ${last_command} in
+        crypto-cli_push)
+            COMPREPLY=( $(compgen -W "$(crypto-cli __images 2>/dev/null)" -- "$cur") )
+            ;;
+    esac
+}
+`
+
+func runCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		return rootCmd.GenBashCompletion(w)
+	case "zsh":
+		// the zsh completion of cobra completes no options, so that of bash is used
+		if _, err := io.WriteString(w, "autoload -U +X bashcompinit && bashcompinit\n\n"); err != nil {
+			return errors.WithStack(err)
+		}
+		return rootCmd.GenBashCompletion(w)
+	case "fish":
+		return genFishCompletion(w, rootCmd)
+	case "powershell":
+		return genPowerShellCompletion(w, rootCmd)
+	default:
+		return errors.Errorf("completion is not supported for %s, only for bash, zsh, fish and powershell", shell)
+	}
+}
+
+// genFishCompletion writes the fish completion of the commands under root, and of
+// their options
+func genFishCompletion(w io.Writer, root *cobra.Command) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "complete -c %s -f\n", root.Name())
+	writeFishFlags(&b, root, "", root.PersistentFlags())
+
+	var walk func(c *cobra.Command, condition string)
+	walk = func(c *cobra.Command, condition string) {
+		for _, sub := range c.Commands() {
+			if !sub.IsAvailableCommand() {
+				continue
+			}
+			fmt.Fprintf(&b, "complete -c %s -n '%s' -a %s -d %s\n",
+				root.Name(), condition, sub.Name(), fishQuote(sub.Short))
+
+			subCondition := "__fish_seen_subcommand_from " + sub.Name()
+			writeFishFlags(&b, root, subCondition, sub.LocalFlags())
+			walk(sub, subCondition)
+		}
+	}
+	walk(root, "__fish_use_subcommand")
+
+	// the names of local images are completed for push, but not for artifact push
+	fmt.Fprintf(&b, "complete -c %[1]s -n '__fish_seen_subcommand_from push; and not __fish_seen_subcommand_from %[2]s' -a '(%[1]s __images 2>/dev/null)'\n",
+		root.Name(), artifactCmd.Name())
+
+	_, err := io.WriteString(w, b.String())
+	return errors.WithStack(err)
+}
+
+// writeFishFlags writes the completion of flags, when condition holds if it is
+// not empty
+func writeFishFlags(b *strings.Builder, root *cobra.Command, condition string, flags *pflag.FlagSet) {
+	var lines []string
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Hidden || f.Deprecated != "" {
+			return
+		}
+
+		line := "complete -c " + root.Name()
+		if condition != "" {
+			line += " -n '" + condition + "'"
+		}
+		line += " -l " + f.Name
+		if f.Shorthand != "" {
+			line += " -s " + f.Shorthand
+		}
+		if f.Value.Type() != "bool" {
+			line += " -r -F"
+		}
+		usage := strings.SplitN(f.Usage, "\n", 2)[0]
+		lines = append(lines, line+" -d "+fishQuote(usage))
+	})
+	sort.Strings(lines)
+
+	for _, l := range lines {
+		b.WriteString(l + "\n")
+	}
+}
+
+// fishQuote quotes s for fish, in single quotes
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+// powerShellCompleter finds the command being completed from the words before the
+// cursor, then completes the word at the cursor with the subcommands and options of
+// that command in $completions, or the names of local images for push
+const powerShellCompleter = `    }
+
+    $path = '%[1]s'
+    foreach ($element in $commandAst.CommandElements | Select-Object -Skip 1) {
+        if ($element.Extent.EndOffset -ge $cursorPosition) {
+            break
+        }
+        $next = $path + ' ' + $element.ToString()
+        if ($completions.ContainsKey($next)) {
+            $path = $next
+        }
+    }
+
+    $candidates = @($completions[$path])
+    if ($path -eq '%[1]s push') {
+        foreach ($image in & '%[1]s' __images 2>$null) {
+            $candidates += ,@($image, $image)
+        }
+    }
+
+    foreach ($candidate in $candidates) {
+        if ($candidate[0] -like "$wordToComplete*") {
+            $type = if ($candidate[0] -like '-*') { 'ParameterName' } else { 'ParameterValue' }
+            [System.Management.Automation.CompletionResult]::new($candidate[0], $candidate[0], $type, $candidate[1])
+        }
+    }
+}
+`
+
+// genPowerShellCompletion writes the PowerShell completion of the commands under
+// root, and of their options, as an argument completer of the native command
+func genPowerShellCompletion(w io.Writer, root *cobra.Command) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Register-ArgumentCompleter -Native -CommandName %s -ScriptBlock {\n", psQuote(root.Name()))
+	b.WriteString("    param($wordToComplete, $commandAst, $cursorPosition)\n\n")
+	b.WriteString("    $completions = @{\n")
+
+	var walk func(c *cobra.Command, path string)
+	walk = func(c *cobra.Command, path string) {
+		fmt.Fprintf(&b, "        %s = @(\n", psQuote(path))
+		for _, sub := range c.Commands() {
+			if sub.IsAvailableCommand() {
+				writePowerShellCandidate(&b, sub.Name(), sub.Short)
+			}
+		}
+		writePowerShellFlags(&b, c.LocalFlags())
+		writePowerShellFlags(&b, c.InheritedFlags())
+		b.WriteString("        )\n")
+
+		for _, sub := range c.Commands() {
+			if sub.IsAvailableCommand() {
+				walk(sub, path+" "+sub.Name())
+			}
+		}
+	}
+	walk(root, root.Name())
+
+	fmt.Fprintf(&b, powerShellCompleter, root.Name())
+
+	_, err := io.WriteString(w, b.String())
+	return errors.WithStack(err)
+}
+
+// writePowerShellFlags writes the candidates of the names of flags
+func writePowerShellFlags(b *strings.Builder, flags *pflag.FlagSet) {
+	var names, usages []string
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Hidden || f.Deprecated != "" {
+			return
+		}
+
+		usage := strings.SplitN(f.Usage, "\n", 2)[0]
+		names = append(names, "--"+f.Name)
+		usages = append(usages, usage)
+		if f.Shorthand != "" {
+			names = append(names, "-"+f.Shorthand)
+			usages = append(usages, usage)
+		}
+	})
+
+	for i := range names {
+		writePowerShellCandidate(b, names[i], usages[i])
+	}
+}
+
+// writePowerShellCandidate writes a candidate with its description, which may not
+// be empty as it is the tooltip of its completion
+func writePowerShellCandidate(b *strings.Builder, name, description string) {
+	if description == "" {
+		description = name
+	}
+	fmt.Fprintf(b, "            ,@(%s, %s)\n", psQuote(name), psQuote(description))
+}
+
+// psQuote quotes s for PowerShell, in single quotes
+func psQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func init() {
+	rootCmd.AddCommand(completionCmd)
+	rootCmd.AddCommand(completeImagesCmd)
+	rootCmd.BashCompletionFunction = bashCompletionFunction
+}
@@ -0,0 +1,126 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompletion(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, shell := range []string{"bash", "zsh", "fish", "powershell"} {
+		b := &bytes.Buffer{}
+		if assert.NoError(runCompletion(b, shell), shell) {
+			assert.Contains(b.String(), "crypto-cli", shell)
+		}
+	}
+	assert.Error(runCompletion(&bytes.Buffer{}, "tcsh"))
+}
+
+// psKeyRegexp matches the keys of the completions of each command
+var psKeyRegexp = regexp.MustCompile(`(?m)^        ('(?:[^']|'')*') = @\($`)
+
+func TestPowerShellCompletion(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	b := &bytes.Buffer{}
+	require.NoError(runCompletion(b, "powershell"))
+	script := b.String()
+
+	// every command has its completions, under a key of its own, as a hashtable
+	// with a key twice does not parse
+	seen := make(map[string]bool)
+	for _, m := range psKeyRegexp.FindAllStringSubmatch(script, -1) {
+		assert.False(seen[m[1]], "%s is repeated", m[1])
+		seen[m[1]] = true
+	}
+	for _, key := range []string{"'crypto-cli'", "'crypto-cli push'", "'crypto-cli artifact push'"} {
+		assert.True(seen[key], "%s is missing", key)
+	}
+	assert.Contains(script, ",@('--yes', ")
+	assert.Contains(script, ",@('-y', ")
+	assert.NotContains(script, "'__images'")
+
+	assert.NoError(psBalanced(script))
+
+	// the script is parsed by PowerShell itself where it is installed
+	pwsh, err := exec.LookPath("pwsh")
+	if err != nil {
+		t.Log("pwsh is not installed, the completion is not parsed by PowerShell")
+		return
+	}
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+	fn := filepath.Join(dir, "completion.ps1")
+	require.NoError(ioutil.WriteFile(fn, b.Bytes(), 0600))
+
+	out, err := exec.Command(pwsh, "-NoProfile", "-Command", // #nosec
+		`$errors = $null; [System.Management.Automation.Language.Parser]::ParseFile('`+fn+`', [ref]$null, [ref]$errors) | Out-Null; $errors | ForEach-Object { $_.Message }`,
+	).CombinedOutput()
+	require.NoError(err, string(out))
+	assert.Empty(strings.TrimSpace(string(out)))
+}
+
+// psBalanced checks that the brackets of a PowerShell script are balanced outside of
+// its strings, which are in single quotes, where a quote is doubled, or in double
+// quotes
+func psBalanced(script string) error {
+	pairs := map[rune]rune{')': '(', '}': '{', ']': '['}
+	var stack []rune
+	var quote rune
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'' && r == '\'' && i+1 < len(runes) && runes[i+1] == '\'':
+			i++
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(' || r == '{' || r == '[':
+			stack = append(stack, r)
+		case pairs[r] != 0:
+			if len(stack) == 0 || stack[len(stack)-1] != pairs[r] {
+				return errors.Errorf("unbalanced %c at %d", r, i)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if quote != 0 {
+		return errors.Errorf("unterminated string")
+	}
+	if len(stack) != 0 {
+		return errors.Errorf("unclosed %s", string(stack))
+	}
+	return nil
+}
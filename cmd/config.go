@@ -0,0 +1,341 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/homedir"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+)
+
+// registriesSection is the section of the configuration file with the settings of
+// each registry
+const registriesSection = "registries"
+
+var configFile = filepath.Join(homedir.Get(), ".crypto-cli", "config.yaml")
+
+// configured are the names of the flags that were set from the configuration file,
+// which are changed as those given on the command line are, but were not given
+var configured = make(map[string]bool)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(
+		&configFile,
+		"config",
+		configFile,
+		`The configuration file with the defaults of options, for every command and for each
+command in a section of its name, and the settings of each registry.`,
+	)
+}
+
+// initConfig gives the options that were not given on the command line their
+// values in the configuration file, if there is one
+func initConfig() {
+	cmd := executingCommand(rootCmd)
+	if cmd == nil {
+		return
+	}
+
+	conf, err := readConfig(configFile)
+	if os.IsNotExist(errors.Cause(err)) && !cmd.Flags().Changed("config") {
+		return
+	}
+	if err == nil {
+		err = checkConfig(rootCmd, settings(conf))
+	}
+	if err == nil {
+		err = applyConfig(cmd, conf)
+	}
+	if err != nil {
+		log.Fatal().Msgf("%v", err)
+	}
+}
+
+// readConfig reads the configuration file filename with viper, in the format of
+// its extension, or as YAML if it has none
+func readConfig(filename string) (*viper.Viper, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	conf := viper.New()
+	conf.SetConfigFile(filename)
+	if filepath.Ext(filename) == "" {
+		conf.SetConfigType("yaml")
+	}
+	if err := conf.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "could not read %s", filename)
+	}
+	return conf, nil
+}
+
+// settings are the settings in conf, as nested maps. The hosts of the registries
+// are kept whole, as viper would split them at their dots.
+func settings(conf *viper.Viper) map[string]interface{} {
+	all := conf.AllSettings()
+	if conf.IsSet(registriesSection) {
+		all[registriesSection] = conf.Get(registriesSection)
+	}
+	return all
+}
+
+// executingCommand is the command under c whose flags were parsed, which is the one
+// that is being run
+func executingCommand(c *cobra.Command) *cobra.Command {
+	for _, sub := range c.Commands() {
+		if cmd := executingCommand(sub); cmd != nil {
+			return cmd
+		}
+	}
+	if c.Flags().Parsed() {
+		return c
+	}
+	return nil
+}
+
+// applyConfig sets the options of cmd that were not given on the command line to
+// their values in conf. Those in the section of cmd take precedence over those of
+// its parents, and those at the top over none.
+func applyConfig(cmd *cobra.Command, conf *viper.Viper) error {
+	var path []string
+	for c := cmd; c != rootCmd && c != nil; c = c.Parent() {
+		path = append([]string{c.Name()}, path...)
+	}
+
+	// the sections of cmd and of its parents, with the most precedence first
+	prefixes := []string{""}
+	for i := range path {
+		prefixes = append([]string{strings.Join(path[:i+1], ".") + "."}, prefixes...)
+	}
+
+	for _, prefix := range prefixes {
+		if err := setFlags(cmd, conf, prefix); err != nil {
+			return err
+		}
+	}
+
+	if conf.IsSet(registriesSection) {
+		return applyRegistries(conf.Get(registriesSection))
+	}
+	return nil
+}
+
+// checkConfig checks that the keys of section, which belongs to the command c, are
+// options of c or of a command under it, or sections of the commands under it
+func checkConfig(c *cobra.Command, section map[string]interface{}) error {
+	for _, key := range sortedKeys(section) {
+		sub, ok := section[key].(map[string]interface{})
+		switch {
+		case !ok && !hasFlag(c, key):
+			return errors.Errorf("%s has no option %s in %s", c.Name(), key, configFile)
+		case !ok || c == rootCmd && key == registriesSection:
+			continue
+		}
+
+		cmd := subCommand(c, key)
+		if cmd == nil {
+			return errors.Errorf("%s has no command %s in %s", c.Name(), key, configFile)
+		}
+		if err := checkConfig(cmd, sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFlags sets the flags of cmd that were not given to their values under prefix
+// in conf. Options of other commands are skipped, so that options shared by some
+// commands may be given for all of them.
+func setFlags(cmd *cobra.Command, conf *viper.Viper, prefix string) (err error) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		key := prefix + f.Name
+		if err != nil || f.Changed || !conf.IsSet(key) {
+			return
+		}
+		if _, ok := conf.Get(key).(map[string]interface{}); ok {
+			return
+		}
+		if serr := setFlag(cmd.Flags(), f, conf.Get(key)); serr != nil {
+			err = errors.Wrapf(serr, "invalid %s in %s", key, configFile)
+			return
+		}
+		configured[f.Name] = true
+	})
+	return
+}
+
+// setFlag sets f in flags to value, marking it as changed so that it is not set
+// again from a section with less precedence. Scalars are given to the flag as they
+// would be on the command line, and each item of a list in turn.
+func setFlag(flags *pflag.FlagSet, f *pflag.Flag, value interface{}) error {
+	list, ok := value.([]interface{})
+	if !ok {
+		s, err := cast.ToStringE(value)
+		if err != nil {
+			return errors.Errorf("invalid value of %s", f.Name)
+		}
+		return flags.Set(f.Name, s)
+	}
+
+	if t := f.Value.Type(); !strings.HasSuffix(t, "Slice") && !strings.HasSuffix(t, "Array") {
+		return errors.Errorf("%s takes one value, not a list", f.Name)
+	}
+	for _, item := range list {
+		s, err := cast.ToStringE(item)
+		if err != nil {
+			return errors.Errorf("lists of %s may only hold strings, numbers and booleans", f.Name)
+		}
+		if err = flags.Set(f.Name, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasFlag is whether c or any command under it has the flag name
+func hasFlag(c *cobra.Command, name string) bool {
+	if c.Flags().Lookup(name) != nil || c.PersistentFlags().Lookup(name) != nil {
+		return true
+	}
+	for _, sub := range c.Commands() {
+		if hasFlag(sub, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// subCommand is the command under c named name
+func subCommand(c *cobra.Command, name string) *cobra.Command {
+	for _, sub := range c.Commands() {
+		if sub.Name() == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// applyRegistries applies the settings of each registry in the registries section,
+// which are whether it is insecure, a file of CA certificates to trust for it, and
+// its credentials. Relative paths are relative to the directory of the configuration
+// file. The credentials are used in place of those kept by docker.
+func applyRegistries(value interface{}) error {
+	registries, ok := value.(map[string]interface{})
+	if !ok {
+		return errors.Errorf("%s is not a map of registries in %s", registriesSection, configFile)
+	}
+
+	for _, host := range sortedKeys(registries) {
+		settings, ok := registries[host].(map[string]interface{})
+		if !ok {
+			return errors.Errorf("the settings of %s are not a map in %s", host, configFile)
+		}
+
+		creds := types.AuthConfig{}
+		for _, key := range sortedKeys(settings) {
+			value, err := cast.ToStringE(settings[key])
+			if err != nil {
+				return errors.Errorf("%s of %s is not a value in %s", key, host, configFile)
+			}
+
+			switch key {
+			case "insecure":
+				insecure, err := cast.ToBoolE(value)
+				if err != nil {
+					return errors.Wrapf(err, "invalid insecure of %s in %s", host, configFile)
+				}
+				if insecure {
+					httpclient.InsecureRegistries = append(httpclient.InsecureRegistries, host)
+				}
+			case "ca":
+				if !filepath.IsAbs(value) {
+					value = filepath.Join(filepath.Dir(configFile), value)
+				}
+				httpclient.RegistryCAFiles[host] = value
+			case "username":
+				creds.Username = value
+			case "password":
+				creds.Password = value
+			case "auth":
+				if creds.Username, creds.Password, err = decodeAuth(value); err != nil {
+					return errors.Wrapf(err, "invalid auth of %s in %s", host, configFile)
+				}
+			case "identitytoken":
+				creds.IdentityToken = value
+			default:
+				return errors.Errorf("%s is not a setting of a registry in %s", key, configFile)
+			}
+		}
+
+		if creds != (types.AuthConfig{}) {
+			if err := checkPrivate(configFile); err != nil {
+				return err
+			}
+			auth.ConfigCredentials[host] = creds
+		}
+	}
+	return nil
+}
+
+// decodeAuth decodes the auth of a registry, which is its username and password
+// joined by a colon and base64 encoded, as in the auths of docker
+func decodeAuth(value string) (username, password string, err error) {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("auth is not a username and password")
+	}
+	return parts[0], parts[1], nil
+}
+
+// checkPrivate checks that the configuration file filename, which holds credentials,
+// may not be read by other users
+func checkPrivate(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		log.Warn().Msgf("%s holds credentials but may be read by other users, it should have the mode 0600", filename)
+	}
+	return nil
+}
+
+func sortedKeys(conf map[string]interface{}) []string {
+	keys := make([]string, 0, len(conf))
+	for k := range conf {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,226 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+)
+
+// mkConfigCommands adds a command with a subcommand to rootCmd, which has the
+// options level, tag and force, and returns the subcommand and a function that
+// removes them again
+func mkConfigCommands() (*cobra.Command, func()) {
+	parent := &cobra.Command{Use: "testparent"}
+	child := &cobra.Command{Use: "child"}
+	child.Flags().String("level", "default", "")
+	child.Flags().StringSlice("tag", nil, "")
+	child.Flags().Bool("force", false, "")
+	parent.AddCommand(child)
+	rootCmd.AddCommand(parent)
+	return child, func() { rootCmd.RemoveCommand(parent) }
+}
+
+// writeConfig writes a configuration file named name with the contents data to
+// dir, and makes it the configuration file that is read
+func writeConfig(t *testing.T, dir, name, data string) string {
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	fn := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(fn, []byte(data), 0600))
+	configFile = fn
+	return fn
+}
+
+func TestApplyConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(file string) { configFile = file }(configFile)
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	tests := []struct {
+		name  string
+		data  string
+		args  []string
+		level string
+		tag   []string
+		force bool
+	}{
+		{
+			name:  "top",
+			data:  "level: top\nforce: true\n",
+			level: "top",
+			force: true,
+		},
+		{
+			name:  "section of the parent over top",
+			data:  "level: top\ntestparent:\n  level: parent\n",
+			level: "parent",
+		},
+		{
+			name:  "section of the command over that of its parent",
+			data:  "level: top\ntestparent:\n  level: parent\n  child:\n    level: child\n    tag: [a, b]\n",
+			level: "child",
+			tag:   []string{"a", "b"},
+		},
+		{
+			name:  "command line over every section",
+			data:  "level: top\ntestparent:\n  child:\n    level: child\n    tag: [a, b]\n",
+			args:  []string{"--level", "cli", "--tag", "c"},
+			level: "cli",
+			tag:   []string{"c"},
+		},
+		{
+			name:  "none",
+			data:  "testparent: {}\n",
+			level: "default",
+			tag:   []string{},
+		},
+	}
+
+	for _, test := range tests {
+		cmd, remove := mkConfigCommands()
+		func() {
+			defer remove()
+			require.NoError(cmd.ParseFlags(test.args), test.name)
+
+			conf, err := readConfig(writeConfig(t, dir, "config.yaml", test.data))
+			require.NoError(err, test.name)
+			require.NoError(checkConfig(rootCmd, settings(conf)), test.name)
+			require.NoError(applyConfig(cmd, conf), test.name)
+
+			level, err := cmd.Flags().GetString("level")
+			require.NoError(err)
+			assert.Equal(test.level, level, test.name)
+			tag, err := cmd.Flags().GetStringSlice("tag")
+			require.NoError(err)
+			if test.tag != nil {
+				assert.Equal(test.tag, tag, test.name)
+			}
+			force, err := cmd.Flags().GetBool("force")
+			require.NoError(err)
+			assert.Equal(test.force, force, test.name)
+		}()
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(file string) { configFile = file }(configFile)
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	_, remove := mkConfigCommands()
+	defer remove()
+
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{"level: top\ntestparent:\n  child:\n    tag: [a]\n", true},
+		{"colour: blue\n", false},
+		{"testparent:\n  colour: blue\n", false},
+		{"testparent:\n  stepchild:\n    level: top\n", false},
+		{"registries:\n  registry.example.com:\n    insecure: true\n", true},
+	}
+
+	for _, test := range tests {
+		conf, err := readConfig(writeConfig(t, dir, "config.yaml", test.data))
+		require.NoError(err, test.data)
+		err = checkConfig(rootCmd, settings(conf))
+		if test.ok {
+			assert.NoError(err, test.data)
+		} else {
+			assert.Error(err, test.data)
+		}
+	}
+
+	// the format is that of the extension of the file, or YAML if it has none
+	for name, data := range map[string]string{
+		"config.json": `{"testparent": {"child": {"level": "json"}}}`,
+		"config":      "testparent:\n  child:\n    level: yaml\n",
+	} {
+		conf, err := readConfig(writeConfig(t, dir, name, data))
+		require.NoError(err, name)
+		assert.NoError(checkConfig(rootCmd, settings(conf)), name)
+	}
+
+	_, err := readConfig(filepath.Join(dir, "missing.yaml"))
+	assert.True(os.IsNotExist(errors.Cause(err)))
+}
+
+func TestApplyConfigRegistries(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(file string, insecure []string) {
+		configFile, httpclient.InsecureRegistries = file, insecure
+	}(configFile, httpclient.InsecureRegistries)
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	cmd, remove := mkConfigCommands()
+	defer remove()
+
+	data := `registries:
+  "registry.example.com:5000":
+    insecure: true
+    ca: certs/ca.pem
+    username: user
+    password: secret
+  other.example.com:
+    auth: ` + base64.StdEncoding.EncodeToString([]byte("other:pass:word")) + `
+  token.example.com:
+    identitytoken: token
+`
+	conf, err := readConfig(writeConfig(t, dir, "config.yaml", data))
+	require.NoError(err)
+	require.NoError(checkConfig(rootCmd, settings(conf)))
+	require.NoError(applyConfig(cmd, conf))
+
+	hosts := []string{"registry.example.com:5000", "other.example.com", "token.example.com"}
+	defer func() {
+		for _, host := range hosts {
+			delete(auth.ConfigCredentials, host)
+			delete(httpclient.RegistryCAFiles, host)
+		}
+	}()
+
+	// the hosts are kept whole, for all that they have dots
+	assert.Contains(httpclient.InsecureRegistries, hosts[0])
+	assert.Equal(filepath.Join(dir, "certs", "ca.pem"), httpclient.RegistryCAFiles[hosts[0]])
+	assert.Equal(types.AuthConfig{Username: "user", Password: "secret"}, auth.ConfigCredentials[hosts[0]])
+	assert.Equal(types.AuthConfig{Username: "other", Password: "pass:word"}, auth.ConfigCredentials[hosts[1]])
+	assert.Equal(types.AuthConfig{IdentityToken: "token"}, auth.ConfigCredentials[hosts[2]])
+
+	// settings that registries do not have are errors
+	conf, err = readConfig(writeConfig(t, dir, "config.yaml", "registries:\n  registry.example.com:\n    colour: blue\n"))
+	require.NoError(err)
+	assert.Error(applyConfig(cmd, conf))
+}
@@ -0,0 +1,78 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/Senetas/crypto-cli/images"
+)
+
+var assumeYes bool
+
+func init() {
+	rootCmd.PersistentFlags().BoolVarP(
+		&assumeYes,
+		"yes",
+		"y",
+		false,
+		`Go ahead with operations that cannot be undone, such as overwriting the tags of images
+or deleting them, without asking. Without a terminal to ask on, deletions fail unless it
+is given, while pushes go ahead as they always have.`,
+	)
+
+	images.Confirm = confirmAction
+	images.Forced = confirmForced
+}
+
+// confirmForced is whether confirmAction answers yes without asking
+func confirmForced(fallback bool) bool {
+	return assumeYes || fallback && !terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// confirmAction asks the user on the terminal whether to go ahead with what the
+// question describes, unless --yes was given. Without a terminal, it answers
+// fallback, or fails if that would be to decline, so that a script is told why.
+func confirmAction(question string, fallback bool) (bool, error) {
+	if assumeYes {
+		return true, nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		if !fallback {
+			return false, errors.Errorf("could not ask %q without a terminal, give --yes to go ahead", question)
+		}
+		log.Debug().Msgf("going ahead without a terminal to ask %q on", question)
+		return true, nil
+	}
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
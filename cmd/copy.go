@@ -0,0 +1,58 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// copyCmd represents the copy command
+var copyCmd = &cobra.Command{
+	Use:   "copy SOURCE[:TAG|@DIGEST] DESTINATION[:TAG]",
+	Short: "Copy an encrypted image between remote repositories without decrypting it.",
+	Long: `copy copies an encrypted image from one remote repository to another, which may
+be in another registry, so that images may be promoted between environments. The
+encrypted layers are streamed from one registry to the other as they are, and the
+manifest, its keys and the artifacts attached to it, such as detached keys, are
+copied unchanged, so the copy has the digest of the source, and nothing is ever
+decrypted. The destination is tagged with the tag of the source if it has none.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runCopy(args[0], args[1])
+	},
+	Args: cobra.ExactArgs(2),
+}
+
+func runCopy(source, destination string) error {
+	src, err := names.ParseNormalizedNamed(source)
+	if err != nil {
+		return errors.Wrapf(err, "source = %s", source)
+	}
+
+	dst, err := names.ParseNormalizedNamed(destination)
+	if err != nil {
+		return errors.Wrapf(err, "destination = %s", destination)
+	}
+
+	_, err = images.CopyImage(src, dst)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(copyCmd)
+}
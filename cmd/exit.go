@@ -0,0 +1,86 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// The exit statuses of the classes of failure, so that scripts may tell them apart
+const (
+	exitFailure = 1
+	exitAuth    = 2
+	exitLabel   = 3
+	exitDecrypt = 4
+	exitNetwork = 5
+	exitDaemon  = 6
+)
+
+var exitStatuses = map[utils.Class]int{
+	utils.ClassAuth:    exitAuth,
+	utils.ClassLabel:   exitLabel,
+	utils.ClassDecrypt: exitDecrypt,
+	utils.ClassNetwork: exitNetwork,
+	utils.ClassDaemon:  exitDaemon,
+}
+
+// exitStatus is the exit status of a run that failed with err
+func exitStatus(err error) int {
+	class := utils.ClassOf(err)
+	if class == utils.ClassOther {
+		class = requestClass(err)
+	}
+	if status, ok := exitStatuses[class]; ok {
+		return status
+	}
+	return exitFailure
+}
+
+// requestClass is the class of the failure of a request to a registry, which is
+// known from the error that the request failed with rather than being marked
+func requestClass(err error) utils.Class {
+	cause := errors.Cause(err)
+	if errs, ok := cause.(utils.Errors); ok {
+		for _, err := range errs {
+			if c := requestClass(err); c != utils.ClassOther {
+				return c
+			}
+		}
+		return utils.ClassOther
+	}
+
+	switch e := cause.(type) {
+	case *httpclient.StatusError:
+		switch {
+		case e.StatusCode == http.StatusUnauthorized, e.StatusCode == http.StatusForbidden:
+			return utils.ClassAuth
+		case e.StatusCode >= http.StatusInternalServerError:
+			return utils.ClassNetwork
+		}
+	case *httpclient.RateLimitError, net.Error:
+		// net.Error includes the *url.Error of a request that could not be sent
+		return utils.ClassNetwork
+	}
+	if cause == httpclient.ErrStalled {
+		return utils.ClassNetwork
+	}
+	return utils.ClassOther
+}
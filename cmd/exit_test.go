@@ -0,0 +1,76 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+)
+
+func TestExitStatusOfRegistry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(insecure []string, retries int, dir, out string) {
+		httpclient.InsecureRegistries, httpclient.Retries, tempDir, output = insecure, retries, dir, out
+	}(httpclient.InsecureRegistries, httpclient.Retries, tempDir, output)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	tempDir = dir
+	output = filepath.Join(dir, "image.tar")
+	httpclient.Retries = 0
+
+	tests := []struct {
+		status int
+		exit   int
+	}{
+		{http.StatusUnauthorized, exitAuth},
+		{http.StatusForbidden, exitAuth},
+		{http.StatusNotFound, exitFailure},
+		{http.StatusInternalServerError, exitNetwork},
+		{http.StatusServiceUnavailable, exitNetwork},
+	}
+
+	for _, test := range tests {
+		// the registry challenges no one, and fails the request for the manifest
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/v2/" {
+				return
+			}
+			rw.WriteHeader(test.status)
+		}))
+		u, err := url.Parse(server.URL)
+		require.NoError(err)
+		httpclient.InsecureRegistries = []string{u.Host}
+
+		err = runPull(u.Host+"/repo:latest", false, &crypto.Opts{})
+		server.Close()
+		if assert.Error(err, "%d", test.status) {
+			assert.Equal(test.exit, exitStatus(err), "%d: %v", test.status, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/images"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+var (
+	format string
+
+	resultsMu sync.Mutex
+	results   = []*images.Result{}
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(
+		&format,
+		"format",
+		formatText,
+		`The format of the output of push, pull, re-encrypt, inspect, list and verify, text for the logs
+alone, or json for a JSON document of the images on stdout as well, such as their digests and sizes.`,
+	)
+}
+
+// initFormat collects the results of images to print if they are to be printed as
+// JSON
+func initFormat() {
+	switch format {
+	case formatText:
+	case formatJSON:
+		images.Report = func(r *images.Result) {
+			resultsMu.Lock()
+			defer resultsMu.Unlock()
+			results = append(results, r)
+		}
+	default:
+		log.Fatal().Msgf("invalid format: %s", format)
+	}
+}
+
+// printResults prints the results of the images of a command as JSON on stdout, with
+// err if it failed, which is returned so that the run still fails, if the format
+// is json
+func printResults(err error) error {
+	if format != formatJSON {
+		return err
+	}
+
+	out := struct {
+		Images []*images.Result `json:"images"`
+		Error  string           `json:"error,omitempty"`
+	}{Images: results}
+	if err != nil {
+		out.Error = err.Error()
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if jerr := enc.Encode(out); jerr != nil && err == nil {
+		err = errors.WithStack(jerr)
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/images"
+)
+
+// imagesCmd represents the images command
+var imagesCmd = &cobra.Command{
+	Use:   "images [OPTIONS]",
+	Short: "List the local images that are marked for encryption.",
+	Long: `images lists the images in docker or podman that were built with the LABEL, and
+the positions of the layers of each that push would encrypt, counting the lowest
+as 0, so that they may be checked before they are pushed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runImages()
+	},
+	Args: cobra.NoArgs,
+}
+
+func runImages() error {
+	d, err := localDaemon()
+	if err != nil {
+		return err
+	}
+
+	list, err := d.ListEncryptable(&opts)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tIMAGE ID\tLAYERS\tENCRYPTED LAYERS")
+	for _, i := range list {
+		encrypt := make([]string, len(i.Encrypt))
+		for j, p := range i.Encrypt {
+			encrypt[j] = strconv.Itoa(p)
+		}
+		encrypted := strings.Join(encrypt, ",")
+		if i.Err != nil {
+			encrypted = "error: " + i.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", i.Name, shortID(i.ID), i.Layers, encrypted)
+	}
+	return w.Flush()
+}
+
+// localDaemon is the docker or podman daemon of the selected runtime, whose images
+// may be listed
+func localDaemon() (*images.Daemon, error) {
+	if runtimeName == "" {
+		runtimeName = images.DetectRuntime()
+	}
+
+	switch runtimeName {
+	case images.RuntimeDocker:
+		return &images.Daemon{}, nil
+	case images.RuntimePodman:
+		return images.NewPodman()
+	default:
+		return nil, errors.Errorf("images may only be listed from docker or podman, not %s", runtimeName)
+	}
+}
+
+// shortID abbreviates the ID of an image as docker images does
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func init() {
+	rootCmd.AddCommand(imagesCmd)
+
+	imagesCmd.Flags().StringSliceVar(
+		&opts.Labels,
+		"label",
+		[]string{crypto.DefaultLabel},
+		`the name of a label that marks layers for encryption, may be repeated`,
+	)
+}
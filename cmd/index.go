@@ -0,0 +1,65 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// indexCmd represents the index command
+var indexCmd = &cobra.Command{
+	Use:   "index NAME[:TAG] SOURCE[:TAG]...",
+	Short: "Combine encrypted single platform images into a multi-platform image.",
+	Long: `index publishes an OCI image index under NAME[:TAG] that combines images
+for different platforms that have already been encrypted and pushed to the same
+repository, such as by separate CI jobs on each architecture. The platform of
+each SOURCE is read from the unencrypted fields of its config.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runIndex(args[0], args[1:])
+	},
+	Args: cobra.MinimumNArgs(2),
+}
+
+func runIndex(remote string, srcs []string) error {
+	ref, err := names.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+
+	sources := make([]reference.Named, len(srcs))
+	for i, s := range srcs {
+		if sources[i], err = names.ParseNormalizedNamed(s); err != nil {
+			return errors.Wrapf(err, "source = %s", s)
+		}
+	}
+
+	desc, err := images.CreateIndex(ref, sources, tempDir)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Successfully uploaded index: %s.", desc.Digest)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(indexCmd)
+}
@@ -0,0 +1,125 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+var inspectJSON bool
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [OPTIONS] NAME[:TAG|@DIGEST]",
+	Short: "Describe how an image in a remote repository is encrypted.",
+	Long: `inspect fetches the manifest of an image in a remote repository, without any of
+its blobs, and shows which of its layers are encrypted, with the algorithms, key
+derivation parameters and key ID of each, and their sizes and media types. No
+passphrase is needed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runInspect(args[0])
+	},
+	Args: cobra.ExactArgs(1),
+}
+
+func runInspect(remote string) error {
+	ref, err := names.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+
+	info, err := images.InspectImage(ref)
+	if err != nil {
+		return err
+	}
+
+	if inspectJSON || format == formatJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(info))
+	}
+
+	fmt.Printf("Name:       %s\n", ref)
+	fmt.Printf("Digest:     %s\n", info.Digest)
+	fmt.Printf("Media type: %s\n", info.MediaType)
+
+	blobs := append([]distribution.BlobInfo{info.Config}, info.Layers...)
+	for _, b := range blobs {
+		if b.Cipher != "" {
+			fmt.Printf("Cipher:     %s\n", b.Cipher)
+			fmt.Printf("KDF:        %s\n", b.KDF)
+			fmt.Printf("Key wrap:   %s\n", b.KeyWrap)
+			break
+		}
+	}
+	for _, e := range info.KeyEnvelopes {
+		fmt.Printf("Keys:       %s\n", e.Digest)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BLOB\tDIGEST\tMEDIA TYPE\tSIZE\tENCRYPTED\tALGOS\tKDF ITERATIONS\tKEY ID")
+	for i, b := range blobs {
+		name := "config"
+		if i > 0 {
+			name = "layer " + strconv.Itoa(i-1)
+		}
+		iters := ""
+		if b.KDFIterations != 0 {
+			iters = strconv.Itoa(b.KDFIterations)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			name, b.Digest, b.MediaType, b.Size, encryption(b), b.Algos, iters, b.KeyID)
+	}
+	return w.Flush()
+}
+
+// encryption says whether a blob is encrypted, and where its key is
+func encryption(b distribution.BlobInfo) string {
+	switch {
+	case !b.Encrypted:
+		return "no"
+	case b.Detached:
+		return "yes (detached key)"
+	case b.Compat:
+		return "yes (compat)"
+	case b.Chunks > 0:
+		return fmt.Sprintf("yes (%d chunks)", b.Chunks)
+	default:
+		return "yes"
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().BoolVar(
+		&inspectJSON,
+		"json",
+		false,
+		"Print the description as JSON, as --format=json does",
+	)
+}
@@ -0,0 +1,131 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+)
+
+var (
+	kubePrefix      string
+	kubeTagSuffix   string
+	kubePin         bool
+	kubeFromRuntime bool
+	kubeDryRun      bool
+)
+
+// kubeCmd represents the kube command
+var kubeCmd = &cobra.Command{
+	Use:     "kube [OPTIONS] FILE...",
+	Aliases: []string{"k8s"},
+	Short:   "Encrypt the images of Kubernetes manifests and rewrite their references.",
+	Long: `kube encrypts and pushes every image referred to by the containers in the
+Kubernetes manifests in the files, then rewrites the image fields of the files
+to refer to the encrypted images, so that a repository of manifests may be moved
+to encrypted images at once. Each image is pushed to the repository of the same
+path under --prefix, with its tag followed by --tag-suffix, and is read from the
+registry it is referred to in unless --from-runtime is given.
+
+The files are not parsed as YAML: any line of the form image: x is taken to be
+an image field. The lines found are listed and must be confirmed before anything
+is pushed, or --yes given, and --dry-run lists them without pushing.`,
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if kubePrefix == "" && kubeTagSuffix == "" {
+			return errors.New("at least one of --prefix and --tag-suffix must be given, so that the images are not pushed over")
+		}
+		if bundle || ociLayout != "" {
+			return errors.New("--bundle and --oci-layout may not be used with kube")
+		}
+		if err = checkEncryptOpts(); err != nil {
+			return err
+		}
+		// nothing is encrypted on a dry run, so no passphrase is needed
+		if !kubeDryRun {
+			cmd.Flags().VisitAll(checkFlagsPush)
+		}
+		return runKube(args)
+	},
+	Args: cobra.MinimumNArgs(1),
+}
+
+func runKube(filenames []string) (err error) {
+	switch images.Existing(existing) {
+	case images.ExistingOverwrite, images.ExistingSkip, images.ExistingReencrypt:
+	default:
+		return errors.Errorf("invalid --existing: %s", existing)
+	}
+
+	var src images.Source
+	if kubeFromRuntime {
+		if src, _, err = containerRuntime(); err != nil {
+			return err
+		}
+	}
+
+	target := func(ref reference.Named) (reference.NamedTagged, error) {
+		return images.KubeTarget(ref, kubePrefix, kubeTagSuffix)
+	}
+
+	return images.EncryptKubeImages(filenames, target, src, images.Existing(existing), kubePin, kubeDryRun, &opts, tempDir)
+}
+
+func init() {
+	rootCmd.AddCommand(kubeCmd)
+
+	addEncryptFlags(kubeCmd.Flags())
+	kubeCmd.Flags().StringVar(
+		&kubePrefix,
+		"prefix",
+		"",
+		`the registry and namespace that the encrypted images are pushed under, such as
+registry.example.com/encrypted, in place of the registry and namespace of each image`,
+	)
+	kubeCmd.Flags().StringVar(
+		&kubeTagSuffix,
+		"tag-suffix",
+		"",
+		"appended to the tag of each image for the tag of its encrypted image, such as -enc",
+	)
+	kubeCmd.Flags().BoolVar(
+		&kubePin,
+		"pin",
+		false,
+		`pin the rewritten references to the digests of the encrypted images, as references
+that are already pinned to digests always are`,
+	)
+	kubeCmd.Flags().BoolVar(
+		&kubeFromRuntime,
+		"from-runtime",
+		false,
+		"read the images from the container runtime instead of their registries",
+	)
+	kubeCmd.Flags().BoolVar(
+		&kubeDryRun,
+		"dry-run",
+		false,
+		"list the image fields that would be rewritten and what to, without pushing or rewriting anything",
+	)
+	kubeCmd.Flags().StringVar(
+		&existing,
+		"existing",
+		string(images.ExistingOverwrite),
+		`what to do when the reference already holds an encrypted image, overwrite it with the
+encrypted source, skip it, or reencrypt it with new keys in place of the source`,
+	)
+}
@@ -0,0 +1,108 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list [OPTIONS] NAME",
+	Short: "List the tags of a remote repository and whether each is encrypted.",
+	Long: `list lists the tags of a repository in a registry, and fetches the manifest of the
+image of each to show whether it is encrypted, how many of its layers are, with
+which ciphers, and its size, so that the encryption of a repository may be audited.
+Only manifests are fetched, and no passphrase is needed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runList(args[0])
+	},
+	Args: cobra.ExactArgs(1),
+}
+
+func runList(remote string) error {
+	ref, err := names.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+
+	tags, err := images.ListRemoteTags(ref)
+	if err != nil {
+		return err
+	}
+
+	encrypted := 0
+	for _, t := range tags {
+		if t.Encrypted {
+			encrypted++
+		}
+	}
+
+	if format == formatJSON {
+		out := struct {
+			Repository string              `json:"repository"`
+			Tags       []*images.RemoteTag `json:"tags"`
+		}{Repository: ref.Name(), Tags: tags}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(out))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TAG\tDIGEST\tENCRYPTED\tLAYERS\tSIZE\tCIPHERS")
+	for _, t := range tags {
+		if t.Error != "" {
+			fmt.Fprintf(w, "%s\t\terror: %s\t\t\t\n", t.Tag, t.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%s\t%s\n",
+			t.Tag, t.Digest, tagEncryption(t), t.EncryptedLayers, t.Layers,
+			units.HumanSize(float64(t.Size)), strings.Join(t.Ciphers, ", "))
+	}
+	if err = w.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Info().Msgf("%d of the %d tags of %s are encrypted.", encrypted, len(tags), ref.Name())
+	return nil
+}
+
+// tagEncryption says whether the image of a tag is encrypted, and where its keys are
+func tagEncryption(t *images.RemoteTag) string {
+	switch {
+	case !t.Encrypted:
+		return "no"
+	case t.Detached:
+		return "yes (detached keys)"
+	default:
+		return "yes"
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,118 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	passFile  string
+	passEnv   string
+	passStdin bool
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(
+		&passFile,
+		"pass-file",
+		"",
+		`A file to read the passphrase from, such as a mounted secret, in place of --pass.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&passEnv,
+		"pass-env",
+		"",
+		`The name of an environment variable to read the passphrase from, in place of --pass.`,
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&passStdin,
+		"pass-stdin",
+		false,
+		`Read the passphrase from stdin, in place of --pass.`,
+	)
+}
+
+// givenPassphrase returns the passphrase that was given by --pass, if passChanged,
+// or read as --pass-file, --pass-env or --pass-stdin ask, and whether one was given.
+// Those given on the command line take precedence over those in the configuration
+// file, so only one of either may be given. A newline that ends a file or stdin is
+// not part of the passphrase.
+func givenPassphrase(passChanged bool) (string, bool, error) {
+	sources := []struct {
+		name  string
+		given bool
+	}{
+		{"pass", passChanged},
+		{"pass-file", passFile != ""},
+		{"pass-env", passEnv != ""},
+		{"pass-stdin", passStdin},
+	}
+
+	var given []string
+	for _, fromConfig := range []bool{false, true} {
+		for _, source := range sources {
+			if source.given && configured[source.name] == fromConfig {
+				given = append(given, source.name)
+			}
+		}
+		if len(given) > 0 {
+			break
+		}
+	}
+
+	switch {
+	case len(given) > 1:
+		return "", false, errors.New("only one of --pass, --pass-file, --pass-env and --pass-stdin may be given")
+	case len(given) == 0:
+		return "", false, nil
+	}
+
+	switch given[0] {
+	case "pass":
+		return passphrase, true, nil
+	case "pass-file":
+		// passFile is supplied by the user
+		data, err := ioutil.ReadFile(passFile) // #nosec
+		if err != nil {
+			return "", false, errors.Wrapf(err, "could not read the passphrase")
+		}
+		return checkPassphrase(string(data), passFile)
+	case "pass-env":
+		return checkPassphrase(os.Getenv(passEnv), "$"+passEnv)
+	default:
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return "", false, errors.Wrapf(err, "could not read the passphrase")
+		}
+		return checkPassphrase(string(data), "stdin")
+	}
+}
+
+// checkPassphrase trims the newline that ends a passphrase read from source, which
+// must not then be empty
+func checkPassphrase(pass, source string) (string, bool, error) {
+	pass = strings.TrimSuffix(strings.TrimSuffix(pass, "\n"), "\r")
+	if pass == "" {
+		return "", false, errors.Errorf("the passphrase in %s is empty", source)
+	}
+	return pass, true, nil
+}
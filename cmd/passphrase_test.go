@@ -0,0 +1,174 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetPassFlags restores the passphrase flags, and the record of those that were
+// set from the configuration file, to their defaults
+func resetPassFlags(t *testing.T) {
+	for _, name := range []string{"pass", "pass-file", "pass-env", "pass-stdin"} {
+		f := rootCmd.PersistentFlags().Lookup(name)
+		require.NoError(t, f.Value.Set(f.DefValue))
+		f.Changed = false
+	}
+	passphrase, passFile, passEnv, passStdin = "", "", "", false
+	configured = make(map[string]bool)
+}
+
+func TestGivenPassphrase(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+	file := filepath.Join(dir, "pass")
+	require.NoError(ioutil.WriteFile(file, []byte("from file\n"), 0600))
+	empty := filepath.Join(dir, "empty")
+	require.NoError(ioutil.WriteFile(empty, []byte("\r\n"), 0600))
+	stdin := filepath.Join(dir, "stdin")
+	require.NoError(ioutil.WriteFile(stdin, []byte("from stdin\r\n"), 0600))
+
+	const env = "CRYPTO_CLI_TEST_PASS"
+	defer func() { assert.NoError(os.Unsetenv(env)) }()
+	require.NoError(os.Setenv(env, "from env"))
+
+	defer func(in *os.File) { os.Stdin = in }(os.Stdin)
+	defer resetPassFlags(t)
+
+	tests := []struct {
+		name       string
+		pass       bool
+		file       string
+		env        string
+		stdin      bool
+		configured []string
+		given      string
+		ok         bool
+		err        bool
+	}{
+		{name: "none"},
+		{name: "pass", pass: true, given: "from pass", ok: true},
+		{name: "pass-file", file: file, given: "from file", ok: true},
+		{name: "pass-env", env: env, given: "from env", ok: true},
+		{name: "pass-stdin", stdin: true, given: "from stdin", ok: true},
+		{name: "missing file", file: filepath.Join(dir, "missing"), err: true},
+		{name: "empty file", file: empty, err: true},
+		{name: "empty env", env: "CRYPTO_CLI_TEST_UNSET", err: true},
+		{name: "pass and pass-file", pass: true, file: file, err: true},
+		{name: "pass-env and pass-stdin", env: env, stdin: true, err: true},
+		{name: "all", pass: true, file: file, env: env, stdin: true, err: true},
+		{
+			name:       "pass over pass-file in the config",
+			pass:       true,
+			file:       file,
+			configured: []string{"pass-file"},
+			given:      "from pass",
+			ok:         true,
+		},
+		{
+			name:       "pass-env over pass in the config",
+			pass:       true,
+			env:        env,
+			configured: []string{"pass"},
+			given:      "from env",
+			ok:         true,
+		},
+		{
+			name:       "pass-file in the config",
+			file:       file,
+			configured: []string{"pass-file"},
+			given:      "from file",
+			ok:         true,
+		},
+		{
+			name:       "pass-file and pass-env in the config",
+			file:       file,
+			env:        env,
+			configured: []string{"pass-file", "pass-env"},
+			err:        true,
+		},
+	}
+
+	for _, test := range tests {
+		resetPassFlags(t)
+		passphrase, passFile, passEnv, passStdin = "from pass", test.file, test.env, test.stdin
+		for _, name := range test.configured {
+			configured[name] = true
+		}
+		in, err := os.Open(stdin)
+		require.NoError(err)
+		os.Stdin = in
+
+		given, ok, err := givenPassphrase(test.pass)
+		assert.NoError(in.Close())
+		if test.err {
+			assert.Error(err, test.name)
+			continue
+		}
+		if assert.NoError(err, test.name) {
+			assert.Equal(test.ok, ok, test.name)
+			assert.Equal(test.given, given, test.name)
+		}
+	}
+}
+
+func TestGivenPassphraseConfig(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(file string) { configFile = file }(configFile)
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	defer resetPassFlags(t)
+
+	fn := writeConfig(t, dir, "pass", "from file\n")
+	conf, err := readConfig(writeConfig(t, dir, "config.yaml", "pass-file: "+fn+"\n"))
+	require.NoError(err)
+
+	// the passphrase in the file of the configuration is read if none is given on the
+	// command line, and --pass is used in its place if it is
+	for _, test := range []struct {
+		args  []string
+		given string
+	}{
+		{nil, "from file"},
+		{[]string{"--pass", "from pass"}, "from pass"},
+	} {
+		resetPassFlags(t)
+		cmd, remove := mkConfigCommands()
+		func() {
+			defer remove()
+			require.NoError(cmd.ParseFlags(test.args))
+			require.NoError(applyConfig(cmd, conf))
+			assert.Equal(fn, passFile)
+
+			given, ok, err := givenPassphrase(cmd.Flags().Changed("pass"))
+			require.NoError(err, "%v", test.args)
+			assert.True(ok)
+			assert.Equal(test.given, given)
+		}()
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/images"
+)
+
+// imagePlan is what push would do with an image
+type imagePlan struct {
+	Image    string                     `json:"image"`
+	Mirrors  []string                   `json:"mirrors,omitempty"`
+	Manifest *distribution.ManifestPlan `json:"manifest"`
+}
+
+// printPlans prints what pushing refs from src would encrypt, and where each would
+// be pushed, without pushing them
+func printPlans(refs []reference.Named, src images.Source, opts *crypto.Opts) error {
+	plans := make([]imagePlan, len(refs))
+	for i, ref := range refs {
+		plan, err := images.PlanImage(ref, src, opts, tempDir)
+		if err != nil {
+			return err
+		}
+		plans[i] = imagePlan{Image: ref.String(), Manifest: plan}
+		for _, m := range mirrors {
+			mirrored, err := images.MirrorReference(ref, m)
+			if err != nil {
+				return err
+			}
+			plans[i].Mirrors = append(plans[i].Mirrors, mirrored.String())
+		}
+	}
+
+	if format == formatJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return errors.WithStack(enc.Encode(plans))
+	}
+
+	for i, p := range plans {
+		if i > 0 {
+			fmt.Println()
+		}
+		printPlan(p)
+	}
+	return nil
+}
+
+func printPlan(p imagePlan) {
+	encrypted := 0
+	for _, l := range p.Manifest.Layers {
+		if l.Encrypt {
+			encrypted++
+		}
+	}
+
+	fmt.Printf("Name:       %s\n", p.Image)
+	for _, m := range p.Mirrors {
+		fmt.Printf("Mirror:     %s\n", m)
+	}
+	fmt.Printf("Media type: %s\n", p.Manifest.MediaType)
+	fmt.Printf("Encrypted:  %d of %d layers\n", encrypted, len(p.Manifest.Layers))
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BLOB\tDIGEST\tSIZE\tACTION\tMEDIA TYPE")
+	blobs := append([]distribution.BlobPlan{p.Manifest.Config}, p.Manifest.Layers...)
+	for i, b := range blobs {
+		name := "config"
+		if i > 0 {
+			name = "layer " + strconv.Itoa(i-1)
+		}
+		action := "compress"
+		if b.Encrypt {
+			action = "encrypt"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", name, b.Digest, b.Size, action, b.MediaType)
+	}
+	_ = w.Flush()
+}
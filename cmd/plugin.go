@@ -0,0 +1,90 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+)
+
+const (
+	// pluginName is the name of the command that docker runs crypto-cli as, when
+	// it is installed as a docker CLI plugin named docker-crypto
+	pluginName = "crypto"
+
+	// pluginMetadataCommand is run by docker to find the metadata of a plugin
+	pluginMetadataCommand = "docker-cli-plugin-metadata"
+)
+
+// Version is the version of crypto-cli, which is set when it is built with
+// -ldflags "-X github.com/Senetas/crypto-cli/cmd.Version=VERSION"
+var Version = "dev"
+
+// pluginMetadata is the metadata that docker reads from a CLI plugin
+type pluginMetadata struct {
+	SchemaVersion    string
+	Vendor           string
+	Version          string
+	ShortDescription string
+	URL              string
+}
+
+// pluginMetadataCmd prints the metadata of crypto-cli as a docker CLI plugin
+var pluginMetadataCmd = &cobra.Command{
+	Use:    pluginMetadataCommand,
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "     ")
+		return errors.WithStack(enc.Encode(pluginMetadata{
+			SchemaVersion:    "0.1.0",
+			Vendor:           "Senetas",
+			Version:          Version,
+			ShortDescription: "Encrypt and decrypt images and store them in registries",
+			URL:              "https://github.com/Senetas/crypto-cli",
+		}))
+	},
+	Args: cobra.NoArgs,
+}
+
+// isPlugin reports whether crypto-cli was run by docker as a CLI plugin, which it
+// is if its binary is named as a plugin, such as docker-crypto
+func isPlugin() bool {
+	return strings.HasPrefix(filepath.Base(os.Args[0]), "docker-")
+}
+
+// initPlugin sets up crypto-cli to run as a docker CLI plugin. Docker runs docker
+// crypto push NAME:TAG as docker-crypto crypto push NAME:TAG, so the commands are
+// put under a docker command, as they are named in the usage of docker. Images are
+// read from and loaded into docker unless another runtime is given.
+func initPlugin() {
+	rootCmd.Use = pluginName + " [OPTIONS] [command]"
+
+	docker := &cobra.Command{
+		Use:           "docker",
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	docker.AddCommand(rootCmd, pluginMetadataCmd)
+
+	runtimeName = images.RuntimeDocker
+}
@@ -0,0 +1,223 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	units "github.com/docker/go-units"
+	spinner "github.com/janeczku/go-spinner"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh/terminal"
+	pb "gopkg.in/cheggaaa/pb.v1"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+const (
+	progressAuto  = "auto"
+	progressTTY   = "tty"
+	progressPlain = "plain"
+	progressNone  = "none"
+
+	// plainInterval is how often plain progress is logged
+	plainInterval = 10 * time.Second
+)
+
+var (
+	progress     string
+	progressJSON string
+	quiet        bool
+)
+
+// initProgress selects how progress is shown. Bars are only shown on a terminal,
+// so that they do not garble the logs of CI, which are shown plain progress instead.
+func initProgress() {
+	if quiet {
+		progress = progressNone
+	}
+	if progress == progressAuto {
+		progress = progressPlain
+		if terminal.IsTerminal(int(os.Stdout.Fd())) {
+			progress = progressTTY
+		}
+	}
+
+	var r utils.ProgressReporter
+	switch progress {
+	case progressTTY:
+		r = barReporter{}
+	case progressPlain:
+		r = plainReporter{}
+	case progressNone:
+	default:
+		log.Fatal().Msgf("invalid progress: %s", progress)
+	}
+
+	// the events are streamed whatever progress is shown
+	if progressJSON != "" {
+		var err error
+		if progressEvents, err = openProgressEvents(progressJSON); err != nil {
+			log.Fatal().Msgf("%v", err)
+		}
+		r = utils.TeeProgress(r, progressEvents)
+	}
+	utils.SetProgressReporter(r)
+}
+
+// barReporter shows a progress bar for each transfer and extraction of an image.
+// The progress of other operations, such as encryption and compression, is not
+// shown, but a spinner is while the images package encrypts or decrypts. The blobs of an image
+// that are transferred together are each shown by a bar of their own under a bar
+// of their total, like docker push and pull.
+type barReporter struct{}
+
+func (barReporter) Start(op, name string, total int64) utils.Progress {
+	switch op {
+	case utils.ProgressUpload, utils.ProgressDownload, utils.ProgressExtract:
+	default:
+		return nopBar{}
+	}
+
+	bar := pb.New64(total).SetUnits(pb.U_BYTES)
+	bar.Start()
+	return progressBar{bar}
+}
+
+func (r barReporter) StartGroup(op, name string, total int64) utils.ProgressGroup {
+	bar := pb.New64(total).SetUnits(pb.U_BYTES).Prefix(fmt.Sprintf("%-12s ", "Total"))
+	bar.ShowSpeed = true
+
+	// the bars of the blobs can only be shown on a terminal
+	pool, err := pb.StartPool(bar)
+	if err != nil {
+		return totalBar{r.Start(op, name, total)}
+	}
+	return &poolBars{progressBar: progressBar{bar}, pool: pool}
+}
+
+func (barReporter) StartSpinner(title string) utils.Progress {
+	return progressSpinner{spinner.StartNew(title)}
+}
+
+type progressBar struct{ *pb.ProgressBar }
+
+func (b progressBar) Add(n int64) { b.Add64(n) }
+func (b progressBar) Done()       { b.Finish() }
+
+// totalBar shows only the total of a group
+type totalBar struct{ utils.Progress }
+
+func (t totalBar) Start(name string, total int64) utils.Progress {
+	return utils.GroupMember(nopBar{}, t.Progress)
+}
+
+// poolBars shows the bars of the blobs of a group under the bar of their total
+type poolBars struct {
+	progressBar
+	pool *pb.Pool
+}
+
+func (p *poolBars) Start(name string, total int64) utils.Progress {
+	// blobs are named by the start of their digest, as by docker
+	if d, err := digest.Parse(name); err == nil && len(d.Encoded()) > 12 {
+		name = d.Encoded()[:12]
+	}
+
+	bar := pb.New64(total).SetUnits(pb.U_BYTES).Prefix(fmt.Sprintf("%-12s ", name))
+	p.pool.Add(bar)
+	return utils.GroupMember(progressBar{bar}, p.progressBar)
+}
+
+func (p *poolBars) Done() {
+	p.progressBar.Done()
+	_ = p.pool.Stop()
+}
+
+type progressSpinner struct{ *spinner.Spinner }
+
+func (progressSpinner) Add(n int64) {}
+func (s progressSpinner) Done()     { s.Stop() }
+
+type nopBar struct{}
+
+func (nopBar) Add(n int64) {}
+func (nopBar) Done()       {}
+
+// plainReporter logs the progress of each transfer and extraction every
+// plainInterval, and when it ends. The blobs of an image that are transferred
+// together are only logged as their total.
+type plainReporter struct{}
+
+func (plainReporter) Start(op, name string, total int64) utils.Progress {
+	switch op {
+	case utils.ProgressUpload, utils.ProgressDownload, utils.ProgressExtract:
+	default:
+		return nopBar{}
+	}
+	return &plainProgress{op: op, name: name, total: total, logged: time.Now()}
+}
+
+type plainProgress struct {
+	sync.Mutex
+	op, name string
+	total, n int64
+	logged   time.Time
+}
+
+func (p *plainProgress) Add(n int64) {
+	p.Lock()
+	defer p.Unlock()
+	p.n += n
+	if time.Since(p.logged) >= plainInterval {
+		p.logged = time.Now()
+		log.Info().Msgf("%s: %s.", p.subject(progressVerbs[p.op][0]), p.status())
+	}
+}
+
+func (p *plainProgress) Done() {
+	p.Lock()
+	defer p.Unlock()
+	log.Info().Msgf("%s: %s.", p.subject(progressVerbs[p.op][1]), units.HumanSize(float64(p.n)))
+}
+
+// progressVerbs are the verbs of operations while they run and once they are done
+var progressVerbs = map[string][2]string{
+	utils.ProgressUpload:   {"Uploading", "Uploaded"},
+	utils.ProgressDownload: {"Downloading", "Downloaded"},
+	utils.ProgressExtract:  {"Extracting", "Extracted"},
+}
+
+// subject is what the operation does with verb, such as Uploading NAME. Images are
+// extracted into temporary directories, whose names mean nothing to the user.
+func (p *plainProgress) subject(verb string) string {
+	if p.op == utils.ProgressExtract {
+		return verb + " the image"
+	}
+	return verb + " " + p.name
+}
+
+// status is how much of the operation is done, as a percentage if the total is known
+func (p *plainProgress) status() string {
+	if p.total <= 0 {
+		return units.HumanSize(float64(p.n))
+	}
+	return fmt.Sprintf("%s of %s (%d%%)",
+		units.HumanSize(float64(p.n)), units.HumanSize(float64(p.total)), p.n*100/p.total)
+}
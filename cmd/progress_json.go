@@ -0,0 +1,159 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// eventInterval is how often progress events are written for each operation, so
+// that a fast transfer does not flood the program that reads them
+const eventInterval = 200 * time.Millisecond
+
+// The events that are written by --progress-json
+const (
+	eventStart    = "start"
+	eventProgress = "progress"
+	eventDone     = "done"
+	eventError    = "error"
+)
+
+// progressEvents is where the events are written, if they are
+var progressEvents *eventReporter
+
+// progressEvent is a line of --progress-json. Group is the name of the operation
+// on several blobs that a blob is part of, such as the image it is uploaded with.
+type progressEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Op      string    `json:"op,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Group   string    `json:"group,omitempty"`
+	Current int64     `json:"current,omitempty"`
+	Total   int64     `json:"total,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// openProgressEvents opens the file descriptor or file that the events are written to
+func openProgressEvents(target string) (*eventReporter, error) {
+	fd, err := strconv.Atoi(target)
+	if err != nil {
+		// target is supplied by the user
+		fh, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600) // #nosec
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open the file of --progress-json")
+		}
+		return newEventReporter(fh), nil
+	}
+
+	switch {
+	case fd == 1 && format == formatJSON:
+		return nil, errors.New("the events of --progress-json may not be written to stdout with --format=json")
+	case fd < 0:
+		return nil, errors.Errorf("invalid file descriptor: %d", fd)
+	}
+	fh := os.NewFile(uintptr(fd), "progress-json")
+	if _, err = fh.Stat(); err != nil {
+		return nil, errors.Wrapf(err, "the file descriptor %d of --progress-json is not open", fd)
+	}
+	return newEventReporter(fh), nil
+}
+
+// eventReporter writes a JSON event on a line of its own when each operation
+// starts and ends, and at most every eventInterval in between
+type eventReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newEventReporter(w io.Writer) *eventReporter {
+	return &eventReporter{enc: json.NewEncoder(w)}
+}
+
+func (r *eventReporter) write(e progressEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Time = time.Now().UTC()
+	// the reader of the events may have gone away, which must not fail the command
+	_ = r.enc.Encode(e)
+}
+
+// failed writes an error event for err, if the events are written
+func (r *eventReporter) failed(err error) {
+	if r == nil {
+		return
+	}
+	r.write(progressEvent{Event: eventError, Error: err.Error()})
+}
+
+func (r *eventReporter) Start(op, name string, total int64) utils.Progress {
+	return r.start(op, name, "", total)
+}
+
+func (r *eventReporter) StartGroup(op, name string, total int64) utils.ProgressGroup {
+	return &eventGroup{eventOperation: r.start(op, name, "", total)}
+}
+
+func (r *eventReporter) start(op, name, group string, total int64) *eventOperation {
+	p := &eventOperation{r: r, op: op, name: name, group: group, total: total, written: time.Now()}
+	r.write(p.event(eventStart))
+	return p
+}
+
+type eventOperation struct {
+	sync.Mutex
+	r               *eventReporter
+	op, name, group string
+	total, n        int64
+	written         time.Time
+}
+
+func (p *eventOperation) Add(n int64) {
+	p.Lock()
+	defer p.Unlock()
+	p.n += n
+	if time.Since(p.written) >= eventInterval {
+		p.written = time.Now()
+		p.r.write(p.event(eventProgress))
+	}
+}
+
+func (p *eventOperation) Done() {
+	p.Lock()
+	defer p.Unlock()
+	p.r.write(p.event(eventDone))
+}
+
+func (p *eventOperation) event(event string) progressEvent {
+	return progressEvent{Event: event, Op: p.op, Name: p.name, Group: p.group, Current: p.n, Total: p.total}
+}
+
+// eventGroup writes the events of each blob of a group as well as of its total
+type eventGroup struct {
+	*eventOperation
+}
+
+func (g *eventGroup) Start(name string, total int64) utils.Progress {
+	return utils.GroupMember(g.r.start(g.op, name, g.name, total), g)
+}
@@ -15,14 +15,31 @@
 package cmd
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
 	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/pkg/homedir"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
 	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+var (
+	rename       string
+	renameConfig string
+	loadTo       []string
+	output       string
+	platform     string
 )
 
 // pullCmd represents the pull command
@@ -31,10 +48,10 @@ var pullCmd = &cobra.Command{
 	Short: "Download an image from a remote repository, decrypting if necessary.",
 	Long: `pull is used to download an image from a repository, decrypt it if necessary and
 load that images into the local docker engine. It is then available to be run under the same
-name as it was downloaded.`,
+name as it was downloaded, unless it is renamed.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cmd.Flags().VisitAll(checkFlagsPull)
-		return runPull(args[0], &opts)
+		return printResults(runPull(args[0], cmd.Flags().Changed("rename-config"), &opts))
 	},
 	Args: cobra.ExactArgs(1),
 }
@@ -42,22 +59,164 @@ name as it was downloaded.`,
 func checkFlagsPull(f *pflag.Flag) {
 	switch f.Name {
 	case "pass":
-		if f.Changed {
-			opts.SetPassphrase(passphrase)
+		given, ok, err := givenPassphrase(f.Changed)
+		if err != nil {
+			log.Fatal().Msgf("%v", err)
+		}
+		if ok {
+			opts.SetPassphrase(given)
 		}
 	default:
 	}
 }
 
-func runPull(remote string, opts *crypto.Opts) error {
-	ref, err := reference.ParseNormalizedNamed(remote)
+func runPull(remote string, mustRename bool, opts *crypto.Opts) error {
+	ref, err := names.ParseNormalizedNamed(remote)
 	if err != nil {
 		return errors.Wrapf(err, "remote = %s", remote)
 	}
+
+	if platform != "" {
+		if registry.Platform, err = distribution.ParsePlatform(platform); err != nil {
+			return err
+		}
+	}
+
+	sink, err := pullSink()
+	if err != nil {
+		return err
+	}
+
+	name, err := loadName(ref, mustRename)
+	if err != nil {
+		return err
+	}
+	if name != nil {
+		log.Info().Msgf("The image will be loaded as: %s", name)
+		sink = images.RenameSink(sink, name)
+	}
 	log.Info().Msgf("Obtaining manifest for image: %s", ref)
-	return images.PullImage(ref, opts, tempDir)
+	if bundle {
+		return images.PullBundle(ref, sink, opts, tempDir)
+	}
+	return images.PullImage(ref, sink, opts, tempDir)
+}
+
+// pullSink is what the pulled image is loaded with: the file of --output, the
+// docker daemons of --load-to, which are used whatever the container runtime, or
+// else the container runtime
+func pullSink() (images.Sink, error) {
+	switch {
+	case output != "" && len(loadTo) > 0:
+		return nil, errors.New("--output and --load-to may not be used together")
+	case output == "-" && format == formatJSON:
+		return nil, errors.New("the image may not be written to stdout with --format=json")
+	case output != "":
+		return images.FileSink(output), nil
+	case len(loadTo) > 0:
+		return images.DaemonsSink(loadTo...), nil
+	default:
+		_, sink, err := containerRuntime()
+		return sink, err
+	}
+}
+
+// loadName returns the name that the image ref is loaded under, which is given
+// by --rename, or else the rename config, or nil if ref is not renamed. The tag
+// of ref is kept if the new name has none.
+func loadName(ref reference.Named, mustRename bool) (reference.NamedTagged, error) {
+	newName := rename
+	if newName == "" {
+		renames, err := readRenameConfig(renameConfig, mustRename)
+		if err != nil {
+			return nil, err
+		}
+		if newName = renames[ref.Name()]; newName == "" {
+			newName = renames[reference.FamiliarName(ref)]
+		}
+		if newName == "" {
+			return nil, nil
+		}
+	}
+
+	named, err := names.ParseNormalizedNamed(newName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "rename = %s", newName)
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return nil, errors.Errorf("an image may not be renamed to a digest: %s", newName)
+	}
+	if tagged, ok := named.(reference.NamedTagged); ok {
+		return tagged, nil
+	}
+
+	tag := "latest"
+	if tagged, ok := ref.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	return reference.WithTag(named, tag)
+}
+
+// readRenameConfig reads the names images are renamed to on pull, keyed by the
+// names of their repositories. The file need not exist unless it was given.
+func readRenameConfig(filename string, mustExist bool) (renames map[string]string, err error) {
+	// filename is supplied by the user
+	data, err := ioutil.ReadFile(filename) // #nosec
+	if os.IsNotExist(err) && !mustExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = json.Unmarshal(data, &renames); err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", filename)
+	}
+	return renames, nil
 }
 
 func init() {
 	rootCmd.AddCommand(pullCmd)
+
+	pullCmd.Flags().StringVar(
+		&rename,
+		"rename",
+		"",
+		`load the decrypted image as this name, such as myapp:1.0, instead of the name it was
+pulled by, keeping the tag that was pulled if none is given`,
+	)
+	pullCmd.Flags().StringVar(
+		&renameConfig,
+		"rename-config",
+		filepath.Join(homedir.Get(), ".crypto-cli", "rename.json"),
+		`a JSON file of the names that images are loaded as, keyed by the repositories they
+are pulled from, used when --rename is absent`,
+	)
+	pullCmd.Flags().StringArrayVar(
+		&loadTo,
+		"load-to",
+		nil,
+		`load the decrypted image into the docker daemon at this address, such as ssh://user@host,
+instead of the container runtime, may be repeated to load it into several at once`,
+	)
+	pullCmd.Flags().StringVar(
+		&output,
+		"output",
+		"",
+		`write the decrypted image to this file, or to stdout if it is -, as an archive that
+docker load accepts, instead of loading it into the container runtime`,
+	)
+
+	pullCmd.Flags().StringVar(
+		&platform,
+		"platform",
+		"",
+		`pull the image of this platform, such as linux/arm64 or linux/arm/v7, if the image
+is a multi-platform one, instead of that of linux on the architecture of this machine`,
+	)
+
+	pullCmd.Flags().BoolVar(
+		&bundle,
+		"bundle",
+		false,
+		"pull an image that was pushed with --bundle",
+	)
 }
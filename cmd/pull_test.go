@@ -0,0 +1,92 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullSink(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(o string, l []string, f, r string) {
+		output, loadTo, format, runtimeName = o, l, f, r
+	}(output, loadTo, format, runtimeName)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	// a docker daemon that the image is loaded into with --load-to
+	var loaded []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || !strings.HasSuffix(req.URL.Path, "/images/load") {
+			// such as the ping that the client may send first
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(err)
+		loaded = append(loaded, string(body))
+		rw.Header().Set("Content-Type", "application/json")
+		_, err = rw.Write([]byte(`{"stream":"Loaded image: repo:latest\n"}`))
+		assert.NoError(err)
+	}))
+	defer server.Close()
+	daemon := "tcp://" + strings.TrimPrefix(server.URL, "http://")
+
+	// the daemons of --load-to are used whatever the container runtime, which is not
+	// looked for
+	output, loadTo, format, runtimeName = "", []string{daemon}, formatText, "unknown"
+	sink, err := pullSink()
+	require.NoError(err)
+	require.NoError(sink(strings.NewReader("archive")))
+	assert.Equal([]string{"archive"}, loaded)
+
+	// as is the file of --output
+	output, loadTo = filepath.Join(dir, "image.tar"), nil
+	sink, err = pullSink()
+	require.NoError(err)
+	require.NoError(sink(strings.NewReader("archive")))
+	data, err := ioutil.ReadFile(output)
+	require.NoError(err)
+	assert.Equal("archive", string(data))
+	assert.Len(loaded, 1)
+
+	// while without either the container runtime is
+	output = ""
+	_, err = pullSink()
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "unknown runtime: unknown")
+	}
+
+	// and --output may not be used with --load-to, nor write to stdout with JSON
+	output, loadTo = filepath.Join(dir, "image.tar"), []string{daemon}
+	_, err = pullSink()
+	assert.Error(err)
+	output, loadTo, format = "-", nil, formatJSON
+	_, err = pullSink()
+	assert.Error(err)
+}
@@ -15,39 +15,101 @@
 package cmd
 
 import (
+	"path/filepath"
+	"strings"
+
 	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"github.com/Senetas/crypto-cli/crypto"
 	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+var (
+	ociArchive string
+	archive    string
+	fromRemote string
+	ociLayout  string
+	fromLayout string
+	baseImage  string
+	existing   string
+	mirrors    []string
+	resume     bool
+	pushDryRun bool
 )
 
 // pushCmd represents the push command
 var pushCmd = &cobra.Command{
-	Use:   "push [OPTIONS] NAME[:TAG]",
+	Use:   "push [OPTIONS] NAME[:TAG] [NAME[:TAG]...]",
 	Short: "Encrypt an image and then pushed it to a remote repository.",
 	Long: `push will encrypt a docker images and upload it
 to a remote repository. It may be used to distribute docker images
-confidentially. It does not sign images so cannot guarantee identities.`,
+confidentially. It does not sign images so cannot guarantee identities.
+When several images are given, the layers they share are encrypted and
+uploaded only once.`,
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
-		opts.Algos, err = crypto.ValidateAlgos(typeStr)
-		if err != nil {
+		// an image in a layout is already encrypted, so no passphrase is needed
+		if fromLayout != "" {
+			if len(args) > 1 {
+				return errors.New("only one image may be pushed from an OCI layout")
+			}
+			if pushDryRun {
+				return errors.New("--dry-run may not be used with --from-oci-layout, whose image is already encrypted")
+			}
+			return runPushLayout(args[0])
+		}
+		if err = checkEncryptOpts(); err != nil {
 			return err
 		}
+		// nothing is encrypted on a dry run, so no passphrase is needed
+		if pushDryRun {
+			return runPush(args, &opts)
+		}
 		cmd.Flags().VisitAll(checkFlagsPush)
-		return runPush(args[0], &opts)
+		return printResults(runPush(args, &opts))
 	},
-	Args: cobra.ExactArgs(1),
+	Args: cobra.MinimumNArgs(1),
+}
+
+// checkEncryptOpts validates the options set by the flags of addEncryptFlags
+func checkEncryptOpts() (err error) {
+	opts.Algos, err = crypto.ValidateAlgos(typeStr)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(opts.EncryptedSuffix, "+") {
+		return errors.Errorf("the media type suffix must begin with a +: %s", opts.EncryptedSuffix)
+	}
+	if opts.ChunkSize < 0 || opts.ChunkSize > 0 && (opts.Compat || bundle) {
+		return errors.New("layers may only be split into chunks of a positive size, without --compat or --bundle")
+	}
+	if opts.BaseLayers != 0 && !opts.EncryptAll && len(opts.EncryptPaths) == 0 {
+		return errors.New("--base-layers may only be used with --encrypt-all or --encrypt-path")
+	}
+	for _, l := range opts.Labels {
+		if l == "" || strings.ContainsAny(l, "= \t\"") {
+			return errors.Errorf("invalid label name: %q", l)
+		}
+	}
+	return nil
 }
 
 func checkFlagsPush(f *pflag.Flag) {
 	switch f.Name {
 	case "pass":
 		if opts.Algos != crypto.None {
-			if !f.Changed {
-				var err error
+			given, ok, err := givenPassphrase(f.Changed)
+			if err != nil {
+				log.Fatal().Msgf("%v", err)
+			}
+			if ok {
+				passphrase = given
+			} else {
 				passphrase, err = crypto.GetPassSTDIN("Enter passphrase: ", crypto.StdinPassReader)
 				if err != nil {
 					log.Fatal().Err(err).Msgf("Could not obtain passphrase")
@@ -68,26 +130,275 @@ func checkFlagsPush(f *pflag.Flag) {
 	}
 }
 
-func runPush(remote string, opts *crypto.Opts) error {
-	ref, err := reference.ParseNormalizedNamed(remote)
+func runPush(remotes []string, opts *crypto.Opts) (err error) {
+	refs := make([]reference.Named, len(remotes))
+	for i, remote := range remotes {
+		if refs[i], err = names.ParseNormalizedNamed(remote); err != nil {
+			return err
+		}
+	}
+
+	if baseImage != "" {
+		if opts.BaseLayers != 0 {
+			return errors.New("only one of --base and --base-layers may be given")
+		}
+		baseRef, err := names.ParseNormalizedNamed(baseImage)
+		if err != nil {
+			return errors.Wrapf(err, "base = %s", baseImage)
+		}
+		if opts.BaseDiffIDs, err = images.BaseDiffIDs(baseRef, tempDir); err != nil {
+			return err
+		}
+		opts.EncryptAll = true
+	}
+
+	var src images.Source
+	switch {
+	case countSet(ociArchive, archive, fromRemote) > 1:
+		return errors.New("only one of --oci-archive, --from-archive and --from-registry may be given")
+	case fromRemote != "":
+		srcRef, err := names.ParseNormalizedNamed(fromRemote)
+		if err != nil {
+			return errors.Wrapf(err, "source = %s", fromRemote)
+		}
+		src = images.RegistrySource(srcRef)
+	case ociArchive != "":
+		src = images.OCIArchiveSource(ociArchive)
+	case archive != "":
+		src = images.ArchiveSource(archive)
+	default:
+		if src, _, err = containerRuntime(); err != nil {
+			return err
+		}
+	}
+
+	if len(refs) > 1 && (ociLayout != "" || bundle || fromRemote != "") {
+		return errors.New("only one image may be pushed with --oci-layout, --bundle or --from-registry")
+	}
+	if len(mirrors) > 0 && (ociLayout != "" || bundle) {
+		return errors.New("--mirror may not be used with --oci-layout or --bundle")
+	}
+	if resume && (ociLayout != "" || bundle) {
+		return errors.New("--resume may not be used with --oci-layout or --bundle")
+	}
+
+	if pushDryRun {
+		return printPlans(refs, src, opts)
+	}
+
+	// the layers are encrypted as they are read, unless the image is resumed rather
+	// than encrypted, or bundled rather than encrypted layer by layer
+	opts.Stream = !resume && !bundle
+
+	if ociLayout != "" {
+		log.Info().Msgf("Saving image: %s.", refs[0])
+		return images.SaveImage(refs[0], src, ociLayout, opts, tempDir)
+	}
+
+	if bundle {
+		log.Info().Msgf("Pushing image: %s.", refs[0])
+		return images.PushBundle(refs[0], src, opts, tempDir)
+	}
+
+	switch images.Existing(existing) {
+	case images.ExistingOverwrite, images.ExistingSkip, images.ExistingReencrypt:
+	default:
+		return errors.Errorf("invalid --existing: %s", existing)
+	}
+
+	if resume {
+		images.ResumeDir = filepath.Join(tempRoot, utils.ResumeDir)
+	}
+
+	for _, ref := range refs {
+		log.Info().Msgf("Pushing image: %s.", ref)
+	}
+	return images.PushImages(refs, mirrors, src, images.Existing(existing), opts, tempDir)
+}
+
+// countSet returns the number of the strings that are not empty
+func countSet(ss ...string) (n int) {
+	for _, s := range ss {
+		if s != "" {
+			n++
+		}
+	}
+	return
+}
+
+func runPushLayout(remote string) error {
+	ref, err := names.ParseNormalizedNamed(remote)
 	if err != nil {
 		return err
 	}
-	log.Info().Msgf("Pushing image: %s.", ref)
-	return images.PushImage(ref, opts, tempDir)
+	log.Info().Msgf("Pushing image: %s from %s.", ref, fromLayout)
+	return images.PushOCILayout(ref, fromLayout)
 }
 
 func init() {
 	rootCmd.AddCommand(pushCmd)
 
+	addEncryptFlags(pushCmd.Flags())
+	pushCmd.Flags().StringVar(
+		&archive,
+		"from-archive",
+		"",
+		`read the image from an image archive made by docker save instead of a container
+runtime, which need not be installed`,
+	)
+	pushCmd.Flags().StringVar(
+		&fromRemote,
+		"from-registry",
+		"",
+		`read a plain image from this reference in a registry, such as docker.io/library/alpine:3,
+instead of a container runtime, so it may be encrypted into another registry`,
+	)
+	pushCmd.Flags().StringVar(
+		&ociArchive,
+		"oci-archive",
+		"",
+		`read the image from an OCI archive (such as one made by podman save --format oci-archive)
+instead of the docker daemon`,
+	)
+	pushCmd.Flags().StringVar(
+		&existing,
+		"existing",
+		string(images.ExistingOverwrite),
+		`what to do when the reference already holds an encrypted image, overwrite it with the
+encrypted source, skip it, or reencrypt it with new keys in place of the source`,
+	)
+	pushCmd.Flags().StringArrayVar(
+		&mirrors,
+		"mirror",
+		nil,
+		`also push the encrypted image to the same repository path in this registry, such as
+registry.example.com or registry.example.com/team, at the same time, may be repeated`,
+	)
 	pushCmd.Flags().BoolVar(
+		&resume,
+		"resume",
+		false,
+		`keep each encrypted image until it has been pushed, and push the one that an earlier
+push with --resume left behind if it failed, instead of encrypting the image again`,
+	)
+	pushCmd.Flags().BoolVar(
+		&pushDryRun,
+		"dry-run",
+		false,
+		`print which layers would be encrypted and which only compressed, their sizes, and
+where the image would be pushed, then exit without encrypting or pushing anything`,
+	)
+	pushCmd.Flags().StringVar(
+		&fromLayout,
+		"from-oci-layout",
+		"",
+		`push an image that has already been encrypted from the OCI image layout in this
+directory, as written by --oci-layout`,
+	)
+}
+
+// addEncryptFlags adds the flags that control how images are encrypted, which
+// are shared by the commands that push images
+func addEncryptFlags(flags *pflag.FlagSet) {
+	flags.BoolVar(
 		&opts.Compat,
 		"compat",
 		false,
 		`whether manifests should be compatible with the Docker image manifest schema v2.2
 or a slight modfication of it`,
 	)
-	pushCmd.Flags().StringVarP(
+	flags.BoolVar(
+		&bundle,
+		"bundle",
+		false,
+		`pack the whole image into a single encrypted blob that is pushed as an
+artifact, for registries that mangle encrypted image manifests`,
+	)
+	flags.Int64Var(
+		&opts.ChunkSize,
+		"chunk-size",
+		0,
+		`split encrypted layers larger than this many bytes into chunks of at most this
+size, for registries that limit the size of a blob`,
+	)
+	flags.BoolVar(
+		&opts.DetachKeys,
+		"detach-keys",
+		false,
+		`store the wrapped keys in a separate artifact that refers to the image
+manifest, so that the manifest itself remains standard`,
+	)
+	flags.StringVar(
+		&opts.EncryptedSuffix,
+		"media-type-suffix",
+		crypto.DefaultMediaTypeSuffix,
+		`the suffix appended to the media type of encrypted layers and configs,
+ignored for compat manifests`,
+	)
+	flags.BoolVar(
+		&opts.EncryptAll,
+		"encrypt-all",
+		false,
+		`encrypt every layer of the image, whether or not it was built with the LABEL,
+so that images built by others may be encrypted`,
+	)
+	flags.IntVar(
+		&opts.BaseLayers,
+		"base-layers",
+		0,
+		`the number of lowest layers, such as those of the base image, to leave
+unencrypted with --encrypt-all`,
+	)
+	flags.StringVar(
+		&baseImage,
+		"base",
+		"",
+		`encrypt every layer above those of this base image, such as nginx:1.25 or
+nginx@sha256:..., whether or not the image was built with the LABEL`,
+	)
+	flags.IntSliceVar(
+		&opts.EncryptLayers,
+		"encrypt-layers",
+		nil,
+		`the positions of the layers to encrypt, counting the lowest as 0, such as 3,4, in
+place of the LABEL, for images whose history does not match their layers`,
+	)
+	flags.StringArrayVar(
+		&opts.EncryptPaths,
+		"encrypt-path",
+		nil,
+		`a glob of the paths of files to encrypt, such as /opt/secret/**, each layer is split
+into a plain layer and an encrypted layer of the files that match, may be repeated`,
+	)
+	flags.BoolVar(
+		&opts.Squash,
+		"squash",
+		false,
+		`squash each run of consecutive layers to encrypt into a single layer, to need fewer
+keys and hide the layer structure of the encrypted part of the image`,
+	)
+	flags.BoolVar(
+		&opts.EncryptAttestations,
+		"encrypt-attestations",
+		false,
+		`encrypt the attestations of the image, such as the provenance and SBOM made by
+BuildKit, which are otherwise attached to the encrypted image as they are`,
+	)
+	flags.StringSliceVar(
+		&opts.Labels,
+		"label",
+		[]string{crypto.DefaultLabel},
+		`the name of a label that marks the layers after it in the Dockerfile for encryption
+when true and no encryption when false, may be repeated to toggle on any of several labels`,
+	)
+	flags.StringVar(
+		&ociLayout,
+		"oci-layout",
+		"",
+		`write the encrypted image to the OCI image layout in this directory
+instead of pushing it to a registry`,
+	)
+	flags.StringVarP(
 		&typeStr,
 		"type",
 		"t",
@@ -0,0 +1,133 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+var newPassphrase string
+
+// reencryptCmd represents the re-encrypt command
+var reencryptCmd = &cobra.Command{
+	Use:   "re-encrypt [OPTIONS] NAME[:TAG] [NAME[:TAG]]",
+	Short: "Encrypt an encrypted image in a remote repository again with new keys.",
+	Long: `re-encrypt downloads and decrypts an encrypted image, encrypts every layer that
+was encrypted again with newly generated keys, and pushes it back over the image, or
+to the second reference if it is given, so that keys that may have been compromised
+no longer decrypt it. The passphrase may be changed with --new-pass and the cipher
+with --type. Nothing is written to a container runtime.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkEncryptOpts(); err != nil {
+			return err
+		}
+		cmd.Flags().VisitAll(checkFlagsPull)
+		return printResults(runReencrypt(args, cmd.Flags().Changed("new-pass"), &opts))
+	},
+	Args: cobra.RangeArgs(1, 2),
+}
+
+func runReencrypt(remotes []string, newPass bool, opts *crypto.Opts) error {
+	src, err := names.ParseNormalizedNamed(remotes[0])
+	if err != nil {
+		return errors.Wrapf(err, "source = %s", remotes[0])
+	}
+
+	dst := src
+	if len(remotes) > 1 {
+		if dst, err = names.ParseNormalizedNamed(remotes[1]); err != nil {
+			return errors.Wrapf(err, "destination = %s", remotes[1])
+		}
+	}
+	if _, ok := dst.(reference.Digested); ok {
+		return errors.Errorf("the image may not be pushed to the digest %s, as it gets a new one, so a tag must be given", dst)
+	}
+
+	// the image is decrypted with the passphrase it was encrypted with, which is
+	// also that of the new keys unless another is given
+	decOpts := opts
+	if newPass {
+		if newPassphrase == "" {
+			return errors.New("the new passphrase may not be empty")
+		}
+		old := *opts
+		decOpts = &old
+		opts.SetPassphrase(newPassphrase)
+	}
+
+	log.Info().Msgf("Encrypting %s again with new keys as %s.", src, dst)
+	return images.PushImages(
+		[]reference.Named{dst},
+		nil,
+		images.ReencryptSource(src, decOpts),
+		images.ExistingOverwrite,
+		opts,
+		tempDir,
+	)
+}
+
+func init() {
+	rootCmd.AddCommand(reencryptCmd)
+
+	reencryptCmd.Flags().StringVar(
+		&newPassphrase,
+		"new-pass",
+		"",
+		`the passphrase that the new keys are encrypted with, instead of the passphrase that the
+image was encrypted with`,
+	)
+	reencryptCmd.Flags().StringVarP(
+		&typeStr,
+		"type",
+		"t",
+		string(crypto.Pbkdf2Aes256Gcm),
+		"Specifies the type of encryption to use.",
+	)
+	reencryptCmd.Flags().BoolVar(
+		&opts.Compat,
+		"compat",
+		false,
+		`whether manifests should be compatible with the Docker image manifest schema v2.2
+or a slight modfication of it`,
+	)
+	reencryptCmd.Flags().BoolVar(
+		&opts.DetachKeys,
+		"detach-keys",
+		false,
+		`store the wrapped keys in a separate artifact that refers to the image
+manifest, so that the manifest itself remains standard`,
+	)
+	reencryptCmd.Flags().Int64Var(
+		&opts.ChunkSize,
+		"chunk-size",
+		0,
+		`split encrypted layers larger than this many bytes into chunks of at most this
+size, for registries that limit the size of a blob`,
+	)
+	reencryptCmd.Flags().StringVar(
+		&opts.EncryptedSuffix,
+		"media-type-suffix",
+		crypto.DefaultMediaTypeSuffix,
+		`the suffix appended to the media type of encrypted layers and configs,
+ignored for compat manifests`,
+	)
+}
@@ -0,0 +1,71 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+var filterType string
+
+// referrersCmd represents the referrers command
+var referrersCmd = &cobra.Command{
+	Use:   "referrers [OPTIONS] NAME[:TAG]",
+	Short: "List the artifacts that are attached to an image in a remote repository.",
+	Long: `referrers lists the artifacts, such as key envelopes, signatures and SBOMs,
+whose subject is an image in a remote repository.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runReferrers(args[0])
+	},
+	Args: cobra.ExactArgs(1),
+}
+
+func runReferrers(remote string) error {
+	ref, err := names.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+
+	referrers, err := images.ListReferrers(ref, filterType)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "DIGEST\tARTIFACT TYPE\tSIZE")
+	for _, r := range referrers {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", r.Digest, r.ArtifactType, r.Size)
+	}
+	return w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(referrersCmd)
+
+	referrersCmd.Flags().StringVar(
+		&filterType,
+		"artifact-type",
+		"",
+		"Only list artifacts of this type",
+	)
+}
@@ -0,0 +1,55 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// rmCmd represents the rm command
+var rmCmd = &cobra.Command{
+	Use:   "rm NAME[:TAG|@DIGEST] [NAME[:TAG|@DIGEST]...]",
+	Short: "Delete encrypted images from a remote repository.",
+	Long: `rm deletes images from remote repositories, so that stale encrypted images may be
+cleaned up. The manifest that each tag refers to is deleted by its digest, which
+also removes every other tag of the same manifest. The registry must allow
+deletion, which registry:2 only does if REGISTRY_STORAGE_DELETE_ENABLED is set.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runRm(args)
+	},
+	Args: cobra.MinimumNArgs(1),
+}
+
+func runRm(remotes []string) error {
+	for _, remote := range remotes {
+		ref, err := names.ParseNormalizedNamed(remote)
+		if err != nil {
+			return errors.Wrapf(err, "remote = %s", remote)
+		}
+
+		if _, err = images.DeleteImage(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(rmCmd)
+}
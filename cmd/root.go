@@ -15,8 +15,11 @@
 package cmd
 
 import (
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
@@ -24,15 +27,28 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
 	"github.com/Senetas/crypto-cli/utils"
 )
 
 var (
-	typeStr    string
-	tempDir    string
-	passphrase string
-	debug      bool
-	opts       = crypto.Opts{
+	typeStr     string
+	tempRoot    string
+	tempDir     string
+	passphrase  string
+	debug       bool
+	bundle      bool
+	runtimeName string
+	namespace   string
+	scratch     string
+	logLevel    string
+	logFile     string
+	session     *utils.Session
+	opts        = crypto.Opts{
 		Algos:  crypto.Pbkdf2Aes256Gcm,
 		Compat: false,
 	}
@@ -56,12 +72,19 @@ downloading them.`,
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	if isPlugin() {
+		initPlugin()
+	}
+
+	if err := endSession(rootCmd.Execute()); err != nil {
+		progressEvents.failed(err)
 		c, ok := errors.Cause(err).(utils.Error)
 		if debug && (!ok || c.HasStack) {
-			log.Fatal().Msgf("%+v", err)
+			log.Error().Msgf("%+v", err)
+		} else {
+			log.Error().Msgf("%v", err)
 		}
-		log.Fatal().Msgf("%v", err)
+		os.Exit(exitStatus(err))
 	}
 }
 
@@ -69,7 +92,7 @@ func init() {
 	// use a prettier logger, <nil> timestamp
 	log.Logger = zerolog.New(ConsoleWriter{Out: os.Stderr}).With().Logger()
 
-	cobra.OnInitialize(initLogging)
+	cobra.OnInitialize(initConfig, initLogging, initFormat, initProgress, initScratch, initSession)
 
 	rootCmd.PersistentFlags().StringVarP(
 		&passphrase,
@@ -89,18 +112,418 @@ If absent, a prompt will be presented.`,
 	)
 
 	rootCmd.PersistentFlags().StringVar(
-		&tempDir,
+		&logLevel,
+		"log-level",
+		"",
+		`The least level of the logs that are shown, debug, info, warn or error.
+If absent, it is debug with --verbose, warn with --quiet, and info otherwise.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&logFile,
+		"log-file",
+		"",
+		`A file that every log is appended to as JSON, with debug logs and timestamps,
+whatever the level of the logs that are shown.`,
+	)
+
+	rootCmd.PersistentFlags().BoolVarP(
+		&quiet,
+		"quiet",
+		"q",
+		false,
+		"Show no progress, and log only warnings and errors",
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&progress,
+		"progress",
+		progressAuto,
+		`How progress is shown, tty for progress bars, plain for lines logged every 10 seconds,
+none for no progress, or auto for tty on a terminal and plain otherwise.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&progressJSON,
+		"progress-json",
+		"",
+		`A file descriptor, such as 3, or a file that a JSON event is written to on a line of its
+own each time an operation on a blob starts, progresses or ends, or the command fails.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&runtimeName,
+		"runtime",
+		"",
+		`The container runtime to read images from and load them into, docker, podman or containerd.
+If absent, it is detected from the sockets that exist.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&distribution.DockerAPIVersion,
+		"docker-api-version",
+		"",
+		`The version of the docker API to use, such as 1.37.
+If absent, it is negotiated with the daemon.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&distribution.DockerHost,
+		"docker-host",
+		"",
+		`The address of the docker daemon, such as unix:///run/user/1000/docker.sock or ssh://user@host.
+If absent, it is $DOCKER_HOST, the docker context in use, or the socket of rootless docker.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&httpclient.CertsDir,
+		"certs-dir",
+		httpclient.CertsDir,
+		`The directory with the TLS certificates of registries, in a subdirectory for each
+registry host as for docker, such as client.cert and client.key for mutual TLS.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&httpclient.CAFile,
+		"registry-ca",
+		"",
+		`A PEM file of CA certificates to trust for every registry, as well as those of the system.`,
+	)
+
+	rootCmd.PersistentFlags().StringArrayVar(
+		&httpclient.InsecureRegistries,
+		"insecure-registry",
+		nil,
+		`A registry that may be reached over plain HTTP or with a certificate that is not verified,
+given as a host, with its port if not the default, or a CIDR of addresses. May be repeated.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&httpclient.Proxy,
+		"proxy",
+		"",
+		`The URL of the proxy that requests to registries are sent through.
+If absent, it is $HTTPS_PROXY or $HTTP_PROXY.`,
+	)
+
+	rootCmd.PersistentFlags().StringSliceVar(
+		&httpclient.NoProxy,
+		"no-proxy",
+		nil,
+		`Hosts that are reached without the proxy, as domains, IP addresses or CIDRs,
+or * for every host. If absent, they are $NO_PROXY.`,
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&auth.ECRCreateRepository,
+		"ecr-create-repository",
+		false,
+		`Create the repository that is pushed to in a registry of Amazon ECR if it does not exist.`,
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&auth.HarborCreateProject,
+		"harbor-create-project",
+		false,
+		`Create the project that is pushed to in a registry of Harbor if it does not exist.`,
+	)
+
+	rootCmd.PersistentFlags().BoolVar(
+		&httpclient.DebugHTTP,
+		"debug-http",
+		false,
+		`Log every request to a registry with its status, how long it took and a request ID,
+which is sent to the registry in the X-Request-ID header. Credentials are redacted.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&httpclient.UserAgent,
+		"user-agent",
+		"crypto-cli/"+Version,
+		`The User-Agent of the requests to registries.`,
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&httpclient.DefaultClient.Timeout,
+		"request-timeout",
+		httpclient.DefaultClient.Timeout,
+		`The longest that a request to a registry, other than the transfer of a blob, may take.`,
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&httpclient.DialTimeout,
+		"dial-timeout",
+		httpclient.DialTimeout,
+		`The longest that opening a connection to a registry or proxy may take.`,
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&httpclient.TLSHandshakeTimeout,
+		"tls-handshake-timeout",
+		httpclient.TLSHandshakeTimeout,
+		`The longest that the TLS handshake with a registry may take.`,
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&httpclient.ResponseHeaderTimeout,
+		"response-header-timeout",
+		httpclient.ResponseHeaderTimeout,
+		`The longest that a registry may take to respond once a request is sent, after
+which the request is retried. 0 waits for as long as it takes.`,
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&httpclient.IdleConnTimeout,
+		"idle-conn-timeout",
+		httpclient.IdleConnTimeout,
+		`How long an idle connection to a registry is kept open to be used again.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&httpclient.MaxIdleConnsPerHost,
+		"max-idle-conns-per-host",
+		httpclient.MaxIdleConnsPerHost,
+		`How many idle connections to each registry are kept open to be used again.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&httpclient.MaxConnsPerHost,
+		"max-conns-per-host",
+		httpclient.MaxConnsPerHost,
+		`The most connections that are opened to each registry. 0 is no limit.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&httpclient.Retries,
+		"retries",
+		httpclient.Retries,
+		`How many times a request to a registry that fails transiently, with a server error,
+a reset connection or a timeout, is retried, waiting exponentially longer each time.`,
+	)
+
+	rootCmd.PersistentFlags().DurationVar(
+		&httpclient.MaxRateLimitWait,
+		"max-rate-limit-wait",
+		httpclient.MaxRateLimitWait,
+		`The longest to wait to retry a request that a registry has rate limited, as long as
+its Retry-After header asks. Requests that must wait longer fail.`,
+	)
+
+	rootCmd.PersistentFlags().Int64Var(
+		&registry.ChunkSize,
+		"upload-chunk-size",
+		registry.ChunkSize,
+		`The size in bytes of the chunks that larger blobs are uploaded in, so that an upload
+that is interrupted resumes from the last chunk the registry has. 0 uploads blobs whole.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&registry.MaxConcurrentDownloads,
+		"max-concurrent-downloads",
+		registry.MaxConcurrentDownloads,
+		`The most blobs of an image that are downloaded from a registry at once.`,
+	)
+
+	rootCmd.PersistentFlags().IntVar(
+		&registry.MaxConcurrentUploads,
+		"max-concurrent-uploads",
+		registry.MaxConcurrentUploads,
+		`The most blobs of an image that are uploaded to a registry at once.`,
+	)
+
+	rootCmd.PersistentFlags().Int64Var(
+		&distribution.MaxArchiveSize,
+		"max-archive-size",
+		distribution.MaxArchiveSize,
+		`The largest total size in bytes of the files that may be extracted from an image
+archive, so that an archive cannot fill the disk.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&namespace,
+		"namespace",
+		containerdNamespace(),
+		`The containerd namespace of images, when the runtime is containerd,
+such as k8s.io for the images of Kubernetes.`,
+	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&tempRoot,
 		"temp",
-		filepath.Join(os.TempDir(), "com.senetas.crypto"),
+		filepath.Join(os.TempDir(), tempName),
 		`Specifies the directory to store temporary files.`,
 	)
+
+	rootCmd.PersistentFlags().StringVar(
+		&scratch,
+		"scratch",
+		scratchDisk,
+		`Where to store temporary files, disk for the directory of --temp, tmpfs for a memory
+backed filesystem such as /dev/shm, or auto for tmpfs if one with enough space exists.`,
+	)
 }
 
+// initLogging sets the level of the logs on the console, and writes every log to
+// --log-file as JSON as well, if it is given, so that debug logs may be kept for
+// support without showing them
 func initLogging() {
-	// hide debug logs by default
-	if debug {
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	} else {
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	level, err := consoleLevel()
+	if err != nil {
+		log.Fatal().Msgf("%v", err)
+	}
+
+	if logFile == "" {
+		zerolog.SetGlobalLevel(level)
+		return
+	}
+
+	// logFile is supplied by the user
+	fh, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600) // #nosec
+	if err != nil {
+		log.Fatal().Msgf("could not open the log file: %v", err)
+	}
+
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	log.Logger = zerolog.New(zerolog.MultiLevelWriter(
+		levelWriter{Writer: ConsoleWriter{Out: os.Stderr}, level: level},
+		fh,
+	)).With().Timestamp().Logger()
+}
+
+// consoleLevel is the level of the logs on the console, which is that of --log-level
+// if it is given, or else debug for --verbose and warn for --quiet
+func consoleLevel() (zerolog.Level, error) {
+	switch {
+	case logLevel != "":
+		level, err := zerolog.ParseLevel(logLevel)
+		if err != nil || level == zerolog.NoLevel {
+			return level, errors.Errorf("invalid log level: %s", logLevel)
+		}
+		return level, nil
+	case debug:
+		return zerolog.DebugLevel, nil
+	case quiet:
+		return zerolog.WarnLevel, nil
+	default:
+		// hide debug logs by default
+		return zerolog.InfoLevel, nil
+	}
+}
+
+// levelWriter writes the logs of level and above to Writer, and drops the others
+type levelWriter struct {
+	io.Writer
+	level zerolog.Level
+}
+
+func (w levelWriter) WriteLevel(l zerolog.Level, p []byte) (int, error) {
+	if l < w.level {
+		return len(p), nil
+	}
+	return w.Write(p)
+}
+
+const (
+	// tempName is the name of the directory of temporary files in the directory of
+	// the system or a tmpfs
+	tempName = "com.senetas.crypto"
+
+	scratchDisk  = "disk"
+	scratchTmpfs = "tmpfs"
+	scratchAuto  = "auto"
+
+	// minScratchFree is the least space a tmpfs must have free to be used
+	minScratchFree = 1 << 30
+)
+
+// initScratch moves the temporary directory to a tmpfs if --scratch asks for one.
+// Images are extracted and encrypted there without touching the disk, and no
+// more may be extracted than would fill half of it, leaving room for the
+// encrypted copies.
+func initScratch() {
+	tempDir = tempRoot
+
+	switch scratch {
+	case scratchDisk:
+		return
+	case scratchTmpfs, scratchAuto:
+	default:
+		log.Fatal().Msgf("invalid scratch space: %s", scratch)
+	}
+
+	dir, free, ok := utils.FindMemoryDir(minScratchFree, utils.MemoryDirs()...)
+	if !ok {
+		if scratch == scratchTmpfs {
+			log.Fatal().Msgf("no tmpfs with %d bytes free was found", minScratchFree)
+		}
+		log.Debug().Msgf("no tmpfs with %d bytes free, using %s", minScratchFree, tempDir)
+		return
+	}
+
+	tempDir = filepath.Join(dir, tempName)
+	if max := int64(free / 2); max < distribution.MaxArchiveSize {
+		distribution.MaxArchiveSize = max
+	}
+	log.Debug().Msgf("using %s for temporary files", tempDir)
+}
+
+// initSession moves the temporary directory into a directory of this run, which
+// is removed when the run ends, even if it is interrupted. If the run crashes, the
+// directory is left behind, but is recorded in the journal of the temporary
+// directory for cleanup to sweep.
+func initSession() {
+	s, err := utils.StartSession(tempDir)
+	if err != nil {
+		log.Fatal().Msgf("%v", err)
+	}
+	session = s
+	tempDir = s.Dir
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		if err := endSession(nil); err != nil {
+			log.Error().Msgf("%v", err)
+		}
+		log.Fatal().Msgf("%v", sig)
+	}()
+}
+
+// endSession removes the directory of the run, adding any error in doing so to err
+func endSession(err error) error {
+	if session == nil {
+		return err
+	}
+	return session.End(err)
+}
+
+func containerdNamespace() string {
+	if ns := os.Getenv("CONTAINERD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	return "default"
+}
+
+// containerRuntime returns the source and sink of images of the selected runtime
+func containerRuntime() (images.Source, images.Sink, error) {
+	if runtimeName == "" {
+		runtimeName = images.DetectRuntime()
+	}
+
+	switch runtimeName {
+	case images.RuntimeDocker:
+		return images.DaemonSource, images.DaemonSink, nil
+	case images.RuntimePodman:
+		d, err := images.NewPodman()
+		if err != nil {
+			return nil, nil, err
+		}
+		return d.Source(), d.Sink(), nil
+	case images.RuntimeContainerd:
+		c := &images.Containerd{Address: os.Getenv("CONTAINERD_ADDRESS"), Namespace: namespace}
+		return c.Source(), c.Sink(), nil
+	default:
+		return nil, nil, errors.Errorf("unknown runtime: %s", runtimeName)
 	}
 }
@@ -0,0 +1,57 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// tagCmd represents the tag command
+var tagCmd = &cobra.Command{
+	Use:   "tag SOURCE[:TAG|@DIGEST] TARGET:TAG",
+	Short: "Tag a remote encrypted image with another tag of its repository.",
+	Long: `tag tags an image in a remote repository with another tag of the same
+repository, such as to promote a release candidate. Only the manifest is fetched
+and put under the new tag, as it is, so none of the encrypted layers are
+transferred, nothing is decrypted, and the image keeps its digest. To tag an image
+in another repository or registry, use copy.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runTag(args[0], args[1])
+	},
+	Args: cobra.ExactArgs(2),
+}
+
+func runTag(source, target string) error {
+	src, err := names.ParseNormalizedNamed(source)
+	if err != nil {
+		return errors.Wrapf(err, "source = %s", source)
+	}
+
+	dst, err := names.ParseNormalizedNamed(target)
+	if err != nil {
+		return errors.Wrapf(err, "target = %s", target)
+	}
+
+	_, err = images.TagImage(src, dst)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(tagCmd)
+}
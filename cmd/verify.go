@@ -0,0 +1,52 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/images"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [OPTIONS] NAME[:TAG|@DIGEST]",
+	Short: "Check that an image in a remote repository may be pulled and decrypted.",
+	Long: `verify fetches the manifest of an image in a remote repository and its keys,
+decrypts the keys with the passphrase, and checks that the registry has each of
+its blobs, without downloading them, so that a pull may be checked before a
+deployment is scheduled. It fails if the pull would.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.Flags().VisitAll(checkFlagsPull)
+		return printResults(runVerify(args[0], &opts))
+	},
+	Args: cobra.ExactArgs(1),
+}
+
+func runVerify(remote string, opts *crypto.Opts) error {
+	ref, err := names.ParseNormalizedNamed(remote)
+	if err != nil {
+		return errors.Wrapf(err, "remote = %s", remote)
+	}
+
+	return images.VerifyImage(ref, opts, tempDir)
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+}
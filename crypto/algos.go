@@ -15,6 +15,8 @@
 package crypto
 
 import (
+	"strconv"
+
 	"github.com/pkg/errors"
 )
 
@@ -49,3 +51,54 @@ func ValidateAlgos(ctstr string) (Algos, error) {
 	}
 	return Algos(""), errors.New("invalid encryption type")
 }
+
+const (
+	// AnnotationAlgos is the annotation that records the Algos used to encrypt an image
+	AnnotationAlgos = "com.senetas.crypto.algos"
+
+	// AnnotationVersion is the annotation that records the version of the key format
+	AnnotationVersion = "com.senetas.crypto.version"
+
+	// AnnotationCipher is the annotation that records the cipher that encrypts the data
+	AnnotationCipher = "com.senetas.crypto.cipher"
+
+	// AnnotationKDF is the annotation that records the function used to derive the
+	// key encryption key from the passphrase
+	AnnotationKDF = "com.senetas.crypto.kdf"
+
+	// AnnotationKDFIterations is the annotation that records the iterations of the KDF
+	AnnotationKDFIterations = "com.senetas.crypto.kdf.iterations"
+
+	// AnnotationKeyWrap is the annotation that records how the data keys are wrapped
+	AnnotationKeyWrap = "com.senetas.crypto.keywrap"
+)
+
+// Annotations describes the algorithms and parameters that are used to encrypt with
+// opts, in a form that is suitable for manifest annotations. It returns nil if opts
+// does not encrypt.
+func Annotations(opts *Opts) map[string]string {
+	cipher, kdf, keyWrap := Describe(opts.Algos)
+	if cipher == "" {
+		return nil
+	}
+	return map[string]string{
+		AnnotationAlgos:         string(opts.Algos),
+		AnnotationVersion:       strconv.Itoa(opts.Version),
+		AnnotationCipher:        cipher,
+		AnnotationKDF:           kdf,
+		AnnotationKDFIterations: strconv.Itoa(Pbkdf2Iter),
+		AnnotationKeyWrap:       keyWrap,
+	}
+}
+
+// Describe names the cipher that encrypts the data, the function that derives the
+// key encryption key from the passphrase and the cipher that wraps the data keys of
+// algos, which are empty if algos does not encrypt
+func Describe(algos Algos) (cipher, kdf, keyWrap string) {
+	switch algos {
+	case Pbkdf2Aes256Gcm:
+		return "AES-256-GCM (DARE " + sio20 + ")", "PBKDF2-HMAC-SHA256", "AES-256-GCM"
+	default:
+		return "", "", ""
+	}
+}
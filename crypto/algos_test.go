@@ -44,3 +44,17 @@ func TestValidateAlgos(t *testing.T) {
 		assert.Equal(test.algo, algo)
 	}
 }
+
+func TestAnnotations(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(crypto.Annotations(&crypto.Opts{Algos: crypto.None}))
+
+	a := crypto.Annotations(&crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm})
+	assert.Equal("PBKDF2-AES256-GCM", a[crypto.AnnotationAlgos])
+	assert.Equal("0", a[crypto.AnnotationVersion])
+	assert.Equal("AES-256-GCM (DARE 2.0)", a[crypto.AnnotationCipher])
+	assert.Equal("PBKDF2-HMAC-SHA256", a[crypto.AnnotationKDF])
+	assert.Equal("40000", a[crypto.AnnotationKDFIterations])
+	assert.Equal("AES-256-GCM", a[crypto.AnnotationKeyWrap])
+}
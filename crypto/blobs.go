@@ -21,6 +21,9 @@ import (
 	"github.com/pkg/errors"
 )
 
+// sio20 is the name of the version of DARE that is used to encrypt blobs
+const sio20 = "2.0"
+
 var defaultConfig = sio.Config{
 	MinVersion:   sio.Version20,
 	MaxVersion:   sio.Version20,
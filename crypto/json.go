@@ -30,7 +30,11 @@ func EncryptJSON(val interface{}, key, nonce, salt []byte) (ciphertext string, e
 		err = errors.WithStack(err)
 		return
 	}
+	return EncryptBytes(plaintext, key, nonce, salt)
+}
 
+// EncryptBytes encrypts plaintext and base64 (URL) encodes the ciphertext
+func EncryptBytes(plaintext, key, nonce, salt []byte) (ciphertext string, err error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		err = errors.WithStack(err)
@@ -51,31 +55,41 @@ func EncryptJSON(val interface{}, key, nonce, salt []byte) (ciphertext string, e
 // DecryptJSON decrypts a string that is the base64 (URL) encoded ciphertext of
 // a json object and assigns that object to val
 func DecryptJSON(ciphertext string, key, nonce, salt []byte, val interface{}) (err error) {
-	decoded, err := base64.URLEncoding.DecodeString(ciphertext)
+	plaintext, err := DecryptBytes(ciphertext, key, nonce, salt)
 	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(plaintext, val); err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 
-	block, err := aes.NewCipher(key)
+	return
+}
+
+// DecryptBytes decrypts a string that is the base64 (URL) encoded ciphertext
+// produced by EncryptBytes
+func DecryptBytes(ciphertext string, key, nonce, salt []byte) (plaintext []byte, err error) {
+	decoded, err := base64.URLEncoding.DecodeString(ciphertext)
 	if err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 
-	aesgcm, err := cipher.NewGCM(block)
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 
-	plaintext, err := aesgcm.Open(nil, nonce, decoded, salt)
+	aesgcm, err := cipher.NewGCM(block)
 	if err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 
-	if err = json.Unmarshal(plaintext, val); err != nil {
+	if plaintext, err = aesgcm.Open(nil, nonce, decoded, salt); err != nil {
 		err = errors.WithStack(err)
 		return
 	}
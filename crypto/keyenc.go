@@ -20,6 +20,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"net/url"
 	"strconv"
 
@@ -69,6 +70,19 @@ type EnCrypto struct {
 
 // NewEncryptoCompat create a new Encrypto struct from some URLs
 func NewEncryptoCompat(urls []string, opts *Opts) (e EnCrypto, err error) {
+	if e, err = ParseEncryptoCompat(urls); err != nil {
+		return
+	}
+
+	if e.Algos != opts.Algos {
+		err = utils.NewError("encryption type does not match decryption type", false)
+	}
+	return
+}
+
+// ParseEncryptoCompat reads the Encrypto struct from the URLs of a blob of a compat
+// manifest, whatever the algorithms it was encrypted with
+func ParseEncryptoCompat(urls []string) (e EnCrypto, err error) {
 	if len(urls) == 0 {
 		err = errors.New("missing encryption key")
 		return
@@ -85,11 +99,6 @@ func NewEncryptoCompat(urls []string, opts *Opts) (e EnCrypto, err error) {
 		return
 	}
 
-	if e.Algos != opts.Algos {
-		err = utils.NewError("encryption type does not match decryption type", false)
-		return
-	}
-
 	e.EncKey, err = base64.URLEncoding.DecodeString(u.Query().Get(KeyKey))
 	if err != nil {
 		err = errors.WithStack(err)
@@ -123,6 +132,14 @@ func NewEncryptoCompat(urls []string, opts *Opts) (e EnCrypto, err error) {
 	return
 }
 
+// KeyID identifies the wrapped key of e by the first 12 hex digits of its SHA-256,
+// so that the blobs that share a key may be told apart from those that do not
+// without the passphrase
+func (e *EnCrypto) KeyID() string {
+	sum := sha256.Sum256(e.EncKey)
+	return hex.EncodeToString(sum[:6])
+}
+
 // NewURLCompat creates a url from an EnCrypto struct
 func NewURLCompat(e *EnCrypto, opts *Opts) (u *url.URL, err error) {
 	u, err = url.Parse(BaseCryptoURL)
@@ -169,8 +186,10 @@ func DecryptKey(e EnCrypto, opts *Opts) (d DeCrypto, err error) {
 			return
 		}
 
-		d.DecKey, err = deckey(e.EncKey, e.Nonce, e.Salt, e.Iters, passphrase)
-		err = errors.WithStack(err)
+		if d.DecKey, err = deckey(e.EncKey, e.Nonce, e.Salt, e.Iters, passphrase); err != nil {
+			// the key is authenticated, so a wrong passphrase fails to decrypt it
+			err = utils.WithClass(errors.Wrap(err, "could not decrypt the key, the passphrase may be wrong"), utils.ClassDecrypt)
+		}
 	}
 
 	return
@@ -22,20 +22,84 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 )
 
+// ErrNoTerminal is the error of StdinPassReader if stdin is not a terminal, so that
+// a run without a passphrase fails rather than waiting for one that cannot be typed
+var ErrNoTerminal = errors.New("no passphrase was given with --pass, --pass-file, --pass-env or --pass-stdin, and one cannot be prompted for without a terminal")
+
 // StdinPassReader reads a password from stdin
 var StdinPassReader = func() ([]byte, error) {
+	if !terminal.IsTerminal(syscall.Stdin) {
+		return nil, ErrNoTerminal
+	}
 	return terminal.ReadPassword(syscall.Stdin) // notest
 }
 
 // Opts stores data necessary for encryption
 type Opts struct {
 	// whether the encryption data should be stored in a v2.2 compatible manifest or not
-	Compat        bool
-	passphraseSet bool
-	passphrase    string
-	Version       int
-	Algos         Algos
-	Iter          int
+	Compat bool
+	// whether the wrapped keys should be stored in a separate artifact that refers
+	// to the image manifest, rather than in the manifest itself
+	DetachKeys bool
+	// the largest size of a blob of an encrypted layer, larger layers are split into
+	// chunks of at most this size, 0 means that layers are not split
+	ChunkSize int64
+	// the suffix appended to the mediaType of encrypted blobs, the default is
+	// DefaultMediaTypeSuffix
+	EncryptedSuffix string
+	// the names of the labels that mark the layers that follow them for encryption
+	// when true, and for no encryption when false, the default is DefaultLabel
+	Labels []string
+	// whether every layer is encrypted regardless of labels, other than the
+	// BaseLayers lowest layers, or the layers of the image with the diffIDs
+	// BaseDiffIDs if they are given, which are left unencrypted
+	EncryptAll  bool
+	BaseLayers  int
+	BaseDiffIDs []string
+	// the positions of the layers to encrypt, counting the lowest as 0, which are
+	// used in place of the labels if any are given
+	EncryptLayers []int
+	// globs of the paths of the files to encrypt, each layer is split into a plain
+	// layer and an encrypted layer of the files that match if any are given
+	EncryptPaths []string
+	// whether each run of consecutive layers to encrypt is squashed into one layer
+	Squash bool
+	// whether the attestations of an image, such as its provenance and SBOM, are
+	// encrypted when they are attached to the encrypted image
+	EncryptAttestations bool
+	passphraseSet       bool
+	passphrase          string
+	Version             int
+	Algos               Algos
+	Iter                int
+
+	// whether each layer is encrypted in the background as soon as it has been
+	// read from the source, rather than once the whole image has been, which does
+	// not change the encrypted image and so is not recorded with it
+	Stream bool `json:"-"`
+}
+
+// DefaultMediaTypeSuffix is the suffix that marks the mediaType of an encrypted
+// blob, as used by ocicrypt
+const DefaultMediaTypeSuffix = "+encrypted"
+
+// MediaTypeSuffix returns the suffix to append to the mediaType of encrypted blobs
+func (o *Opts) MediaTypeSuffix() string {
+	if o.EncryptedSuffix == "" {
+		return DefaultMediaTypeSuffix
+	}
+	return o.EncryptedSuffix
+}
+
+// DefaultLabel is the label that marks the layers of an image for encryption
+const DefaultLabel = "com.senetas.crypto.enabled"
+
+// LabelNames returns the names of the labels that mark layers for encryption
+func (o *Opts) LabelNames() []string {
+	if len(o.Labels) == 0 {
+		return []string{DefaultLabel}
+	}
+	return o.Labels
 }
 
 // SetPassphrase sets the passphrase
@@ -14,6 +14,20 @@
 
 package distribution
 
+import (
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
 // ArchiveManifest represents the json manifest in an image archive
 // such as that produced by docker save
 type ArchiveManifest struct {
@@ -21,3 +35,110 @@ type ArchiveManifest struct {
 	RepoTags []string
 	Layers   []string
 }
+
+// NewManifestFromArchive creates an unencrypted manifest (with the data necessary
+// for encryption) from an image archive such as that produced by docker save,
+// without a container runtime. The layers to encrypt are found from the history
+// in the config of the image.
+func NewManifestFromArchive(
+	r io.Reader,
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+	tempDir string,
+) (
+	manifest *ImageManifest,
+	err error,
+) {
+	// output manifest
+	manifest = &ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		DirName:       filepath.Join(tempDir, uuid.New().String()),
+	}
+
+	// extract image archive
+	if err = extractTarBall(r, 0, manifest, nil); err != nil {
+		return
+	}
+
+	image, err := selectArchiveImage(manifest.DirName, ref)
+	if err != nil {
+		return
+	}
+
+	config := &ociConfig{}
+	if err = readOCIFile(filepath.Join(manifest.DirName, image.Config), config); err != nil {
+		return
+	}
+
+	layers, err := ociLayersToEncrypt(config, opts)
+	if err != nil {
+		return
+	}
+
+	log.Debug().Msgf("The following layers are to be encrypted: %v", layers)
+
+	// make the Blob structs for the manifest
+	manifest.Config, manifest.Layers, err = mkBlobs(manifest, layers, image, opts)
+
+	return
+}
+
+// selectArchiveImage chooses the image in the extracted archive at path that is
+// tagged as ref, or the only image if there is just one
+func selectArchiveImage(path string, ref names.NamedTaggedRepository) (_ *ImageArchiveManifest, err error) {
+	var images []*ArchiveManifest
+	if err = readOCIFile(filepath.Join(path, "manifest.json"), &images); err != nil {
+		return
+	}
+
+	var image *ArchiveManifest
+	switch {
+	case len(images) == 0:
+		return nil, errors.New("no image data was found")
+	case len(images) == 1:
+		image = images[0]
+	default:
+		for _, im := range images {
+			if hasRepoTag(im, ref) {
+				image = im
+				break
+			}
+		}
+		if image == nil {
+			return nil, errors.Errorf("the archive contains several images, none of which is %s", ref)
+		}
+	}
+
+	// the names in the archive must not escape it
+	for _, name := range append([]string{image.Config}, image.Layers...) {
+		if !isLocalPath(name) {
+			return nil, errors.Errorf("invalid filename in archive: %s", name)
+		}
+	}
+
+	return &ImageArchiveManifest{Config: image.Config, Layers: image.Layers}, nil
+}
+
+func hasRepoTag(image *ArchiveManifest, ref names.NamedTaggedRepository) bool {
+	for _, t := range image.RepoTags {
+		named, err := reference.ParseNormalizedNamed(t)
+		if err != nil {
+			continue
+		}
+		tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+		if ok && reference.Domain(tagged) == ref.Domain() && reference.Path(tagged) == ref.Path() &&
+			tagged.Tag() == ref.Tag() {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalPath reports whether name is a relative path that stays within the
+// directory it is relative to
+func isLocalPath(name string) bool {
+	clean := filepath.Clean(name)
+	return name != "" && !filepath.IsAbs(clean) && clean != ".." &&
+		!strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,400 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestNewManifestFromArchive(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	plain, secret := mkLayerTar(t, "plain"), mkLayerTar(t, "secret")
+	diffIDs := []digest.Digest{digest.Canonical.FromBytes(plain), digest.Canonical.FromBytes(secret)}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop) ADD file:plain in /"},
+			{"created_by": "/bin/sh -c #(nop)  LABEL com.senetas.crypto.enabled=true", "empty_layer": true},
+			{"created_by": "/bin/sh -c #(nop) ADD file:secret in /"},
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(err)
+
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	require.NoError(err)
+	nTRep, err := names.CastToTagged(ref)
+	require.NoError(err)
+
+	// an archive of two images made by docker save
+	archive := func(layer string) *ociArchive {
+		a := &ociArchive{t: t, files: map[string][]byte{
+			"config.json":      config,
+			"plain/layer.tar":  plain,
+			"secret/layer.tar": secret,
+		}}
+		a.files["manifest.json"], err = json.Marshal([]distribution.ArchiveManifest{
+			{Config: "config.json", RepoTags: []string{"other:latest"}, Layers: []string{"plain/layer.tar"}},
+			{Config: "config.json", RepoTags: []string{"cryptocli/alpine:latest"}, Layers: []string{"plain/layer.tar", layer}},
+		})
+		require.NoError(err)
+		return a
+	}
+
+	m, err := distribution.NewManifestFromArchive(archive("secret/layer.tar").tar(), nTRep, opts, dir)
+	require.NoError(err)
+	require.Len(m.Layers, 2)
+
+	assert.IsType((*distribution.NoncryptedBlob)(nil), m.Layers[0])
+	assert.Equal(diffIDs[0], m.Layers[0].GetDigest())
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[1])
+	assert.Equal(diffIDs[1], m.Layers[1].GetDigest())
+	assert.NoError(m.VerifyDiffIDs())
+
+	// names that escape the archive are rejected
+	_, err = distribution.NewManifestFromArchive(archive("../secret/layer.tar").tar(), nTRep, opts, dir)
+	assert.Error(err)
+
+	a := archive("secret/layer.tar")
+	a.files["../escape"] = []byte("data")
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+	assert.Error(err)
+	_, err = os.Stat(filepath.Join(dir, "escape"))
+	assert.True(os.IsNotExist(err))
+
+	// an image that is not in the archive is rejected
+	missing, err := names.CastToTagged(reference.TagNameOnly(mustParse(t, "cryptocli/missing")))
+	require.NoError(err)
+	_, err = distribution.NewManifestFromArchive(archive("secret/layer.tar").tar(), missing, opts, dir)
+	assert.Error(err)
+}
+
+func mustParse(t *testing.T, s string) reference.Named {
+	ref, err := reference.ParseNormalizedNamed(s)
+	require.NoError(t, err)
+	return ref
+}
+
+func TestNewManifestFromArchiveLabels(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	layers := [][]byte{mkLayerTar(t, "base"), mkLayerTar(t, "keys"), mkLayerTar(t, "app"), mkLayerTar(t, "model")}
+	diffIDs := make([]digest.Digest, len(layers))
+	a := &ociArchive{t: t, files: map[string][]byte{}}
+	files := make([]string, len(layers))
+	for i, l := range layers {
+		diffIDs[i] = digest.Canonical.FromBytes(l)
+		files[i] = diffIDs[i].Encoded() + "/layer.tar"
+		a.files[files[i]] = l
+	}
+
+	// two regions marked by different labels
+	config, err := json.Marshal(map[string]interface{}{
+		"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop) ADD file:base in /"},
+			{"created_by": "/bin/sh -c #(nop)  LABEL com.example.secret=true", "empty_layer": true},
+			{"created_by": "/bin/sh -c #(nop) COPY file:keys in /"},
+			{"created_by": "/bin/sh -c #(nop)  LABEL com.example.secret=false", "empty_layer": true},
+			{"created_by": "/bin/sh -c #(nop) COPY file:app in /"},
+			{"created_by": "/bin/sh -c #(nop)  LABEL com.example.model=true", "empty_layer": true},
+			{"created_by": "/bin/sh -c #(nop) COPY file:model in /"},
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(err)
+	a.files["config.json"] = config
+	a.files["manifest.json"], err = json.Marshal([]distribution.ArchiveManifest{
+		{Config: "config.json", RepoTags: []string{"cryptocli/alpine:latest"}, Layers: files},
+	})
+	require.NoError(err)
+
+	nTRep, err := names.CastToTagged(mustParse(t, imageName))
+	require.NoError(err)
+
+	// the default label marks nothing
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+	assert.Error(err)
+
+	labelled := *opts
+	labelled.Labels = []string{"com.example.secret", "com.example.model"}
+	m, err := distribution.NewManifestFromArchive(a.tar(), nTRep, &labelled, dir)
+	require.NoError(err)
+	require.Len(m.Layers, 4)
+
+	for i, encrypted := range []bool{false, true, false, true} {
+		assert.Equal(diffIDs[i], m.Layers[i].GetDigest())
+		_, ok := m.Layers[i].(distribution.DecryptedBlob)
+		assert.Equal(encrypted, ok, "layer %d", i)
+	}
+
+	// only the first label
+	labelled.Labels = []string{"com.example.secret"}
+	m, err = distribution.NewManifestFromArchive(a.tar(), nTRep, &labelled, dir)
+	require.NoError(err)
+	_, ok := m.Layers[3].(distribution.DecryptedBlob)
+	assert.False(ok)
+}
+
+func TestNewManifestFromArchiveEncryptAll(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	base, app := mkLayerTar(t, "base"), mkLayerTar(t, "app")
+	diffIDs := []digest.Digest{digest.Canonical.FromBytes(base), digest.Canonical.FromBytes(app)}
+
+	// an image built without the label
+	config, err := json.Marshal(map[string]interface{}{
+		"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop) ADD file:base in /"},
+			{"created_by": "/bin/sh -c #(nop) COPY file:app in /"},
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(err)
+	a := &ociArchive{t: t, files: map[string][]byte{
+		"config.json":    config,
+		"base/layer.tar": base,
+		"app/layer.tar":  app,
+	}}
+	a.files["manifest.json"], err = json.Marshal([]distribution.ArchiveManifest{
+		{Config: "config.json", RepoTags: []string{"cryptocli/alpine:latest"}, Layers: []string{"base/layer.tar", "app/layer.tar"}},
+	})
+	require.NoError(err)
+
+	nTRep, err := names.CastToTagged(mustParse(t, imageName))
+	require.NoError(err)
+
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+	assert.Error(err)
+
+	all := *opts
+	all.EncryptAll = true
+	m, err := distribution.NewManifestFromArchive(a.tar(), nTRep, &all, dir)
+	require.NoError(err)
+	require.Len(m.Layers, 2)
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[0])
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[1])
+
+	all.BaseLayers = 1
+	m, err = distribution.NewManifestFromArchive(a.tar(), nTRep, &all, dir)
+	require.NoError(err)
+	require.Len(m.Layers, 2)
+	assert.IsType((*distribution.NoncryptedBlob)(nil), m.Layers[0])
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[1])
+
+	all.BaseLayers = 2
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, &all, dir)
+	assert.Error(err)
+
+	// the layers of a base image
+	all.BaseLayers = 0
+	all.BaseDiffIDs = []string{diffIDs[0].String()}
+	m, err = distribution.NewManifestFromArchive(a.tar(), nTRep, &all, dir)
+	require.NoError(err)
+	require.Len(m.Layers, 2)
+	assert.IsType((*distribution.NoncryptedBlob)(nil), m.Layers[0])
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[1])
+
+	// an image that is not built on the base image
+	all.BaseDiffIDs = []string{diffIDs[1].String()}
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, &all, dir)
+	assert.Error(err)
+}
+
+func TestNewManifestFromArchiveHistory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	plain, secret := mkLayerTar(t, "plain"), mkLayerTar(t, "secret")
+	diffIDs := []digest.Digest{digest.Canonical.FromBytes(plain), digest.Canonical.FromBytes(secret)}
+
+	archive := func(history ...map[string]interface{}) *ociArchive {
+		config, err := json.Marshal(map[string]interface{}{
+			"history": history,
+			"rootfs":  map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		})
+		require.NoError(err)
+		a := &ociArchive{t: t, files: map[string][]byte{
+			"config.json":      config,
+			"plain/layer.tar":  plain,
+			"secret/layer.tar": secret,
+		}}
+		a.files["manifest.json"], err = json.Marshal([]distribution.ArchiveManifest{
+			{Config: "config.json", RepoTags: []string{"cryptocli/alpine:latest"}, Layers: []string{"plain/layer.tar", "secret/layer.tar"}},
+		})
+		require.NoError(err)
+		return a
+	}
+
+	nTRep, err := names.CastToTagged(mustParse(t, imageName))
+	require.NoError(err)
+
+	// a history without empty_layer fields, as BuildKit writes it
+	a := archive(
+		map[string]interface{}{"created_by": "ADD file:plain in /"},
+		map[string]interface{}{"created_by": "LABEL com.senetas.crypto.enabled=true"},
+		map[string]interface{}{"created_by": "ENV SECRET=1"},
+		map[string]interface{}{"created_by": "COPY secret / # buildkit"},
+	)
+	m, err := distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+	require.NoError(err)
+	assert.IsType((*distribution.NoncryptedBlob)(nil), m.Layers[0])
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[1])
+
+	// the history of a squashed image does not match its layers
+	a = archive(map[string]interface{}{"created_by": "squashed"})
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+	assert.Error(err)
+
+	selected := *opts
+	selected.EncryptLayers = []int{1}
+	m, err = distribution.NewManifestFromArchive(a.tar(), nTRep, &selected, dir)
+	require.NoError(err)
+	assert.IsType((*distribution.NoncryptedBlob)(nil), m.Layers[0])
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[1])
+
+	selected.EncryptLayers = []int{2}
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, &selected, dir)
+	assert.Error(err)
+}
+
+func TestNewManifestFromArchiveLinks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts.SetPassphrase(passphrase)
+
+	plain, secret := mkLayerTar(t, "plain"), mkLayerTar(t, "secret")
+	diffIDs := []digest.Digest{digest.Canonical.FromBytes(plain), digest.Canonical.FromBytes(secret)}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop) ADD file:plain in /"},
+			{"created_by": "/bin/sh -c #(nop)  LABEL com.senetas.crypto.enabled=true", "empty_layer": true},
+			{"created_by": "/bin/sh -c #(nop) ADD file:secret in /"},
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(err)
+
+	// an archive made by docker save since 25.0, in which the layers of the image
+	// are symbolic links to the blobs of an OCI layout
+	a := &ociArchive{t: t, files: map[string][]byte{}, links: map[string]string{}}
+	configDesc := a.blob(distribution.MediaTypeImageConfig, config)
+	a.links["config.json"] = "blobs/sha256/" + configDesc.Digest.Hex()
+	a.blob(distribution.MediaTypeLayer, plain)
+	a.blob(distribution.MediaTypeLayer, secret)
+	a.links["plain/layer.tar"] = "../blobs/sha256/" + diffIDs[0].Hex()
+	a.links["secret/layer.tar"] = "../link.tar"
+	a.links["link.tar"] = "blobs/sha256/" + diffIDs[1].Hex()
+	a.files["manifest.json"], err = json.Marshal([]distribution.ArchiveManifest{
+		{Config: "config.json", RepoTags: []string{imageName}, Layers: []string{"plain/layer.tar", "secret/layer.tar"}},
+	})
+	require.NoError(err)
+
+	nTRep, err := names.CastToTagged(mustParse(t, imageName))
+	require.NoError(err)
+
+	m, err := distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+	require.NoError(err)
+	require.Len(m.Layers, 2)
+	assert.Equal(diffIDs[0], m.Layers[0].GetDigest())
+	assert.Equal(diffIDs[1], m.Layers[1].GetDigest())
+	assert.NoError(m.VerifyDiffIDs())
+
+	// links may not point out of the archive
+	a.links["secret/layer.tar"] = "../../secret.tar"
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+	assert.Error(err)
+}
+
+func TestNewManifestFromArchiveLimits(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	nTRep, err := names.CastToTagged(mustParse(t, imageName))
+	require.NoError(err)
+
+	layer := mkLayerTar(t, "secret")
+	config, err := json.Marshal(map[string]interface{}{
+		"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop)  LABEL com.senetas.crypto.enabled=true", "empty_layer": true},
+			{"created_by": "/bin/sh -c #(nop) ADD file:secret in /"},
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": []digest.Digest{digest.Canonical.FromBytes(layer)}},
+	})
+	require.NoError(err)
+	a := &ociArchive{t: t, files: map[string][]byte{"config.json": config, "layer.tar": layer}}
+	a.files["manifest.json"], err = json.Marshal([]distribution.ArchiveManifest{
+		{Config: "config.json", RepoTags: []string{imageName}, Layers: []string{"layer.tar"}},
+	})
+	require.NoError(err)
+
+	defer func(max int64) { distribution.MaxArchiveSize = max }(distribution.MaxArchiveSize)
+	distribution.MaxArchiveSize = int64(len(config) + len(layer) + len(a.files["manifest.json"]))
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+	require.NoError(err)
+
+	// archives larger than the limit are rejected
+	distribution.MaxArchiveSize--
+	_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+	assert.Error(err)
+
+	// as are absolute paths and links that escape
+	distribution.MaxArchiveSize = 1 << 20
+	for _, links := range []map[string]string{
+		{"/etc/layer.tar": "layer.tar"},
+		{"link.tar": "/etc/passwd"},
+		{"sub/link.tar": "../../layer.tar"},
+	} {
+		a.links = links
+		_, err = distribution.NewManifestFromArchive(a.tar(), nTRep, opts, dir)
+		assert.Error(err)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Descriptor describes a blob or manifest as in the OCI image spec
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       digest.Digest     `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *Platform         `json:"platform,omitempty"`
+}
+
+// Platform describes the platform an image in an index runs on
+type Platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+}
+
+// ParsePlatform parses a platform of the form os/arch or os/arch/variant, such
+// as linux/arm64 or linux/arm/v7
+func ParsePlatform(s string) (*Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, errors.Errorf("invalid platform, it must be os/arch or os/arch/variant: %s", s)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return nil, errors.Errorf("invalid platform, it must be os/arch or os/arch/variant: %s", s)
+		}
+	}
+
+	p := &Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// String is the platform in the form that ParsePlatform parses
+func (p *Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// Matches determines whether p is the platform want, which matches any variant
+// if it has none
+func (p *Platform) Matches(want *Platform) bool {
+	return p.OS == want.OS &&
+		p.Architecture == want.Architecture &&
+		(want.Variant == "" || p.Variant == want.Variant)
+}
+
+// ArtifactManifest is an OCI image manifest that describes an artifact, which may be
+// attached to another manifest through its subject
+type ArtifactManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Index is an OCI image index. It is also the format in which the referrers of
+// a manifest are listed.
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// NewIndex creates an empty OCI image index
+func NewIndex() *Index {
+	return &Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests:     []Descriptor{},
+	}
+}
+
+// Add adds a descriptor to the index, unless a descriptor with the same digest is already present
+func (i *Index) Add(d Descriptor) {
+	for _, m := range i.Manifests {
+		if m.Digest == d.Digest {
+			return
+		}
+	}
+	i.Manifests = append(i.Manifests, d)
+}
+
+// Filter returns the descriptors in the index with the given artifactType, or all of
+// them if artifactType is empty
+func (i *Index) Filter(artifactType string) (out []Descriptor) {
+	for _, m := range i.Manifests {
+		if artifactType == "" || m.ArtifactType == artifactType {
+			out = append(out, m)
+		}
+	}
+	return
+}
+
+// NewArtifactManifest creates an artifact manifest with an empty config that
+// contains the given blobs and is attached to subject
+func NewArtifactManifest(
+	artifactType string,
+	config Blob,
+	blobs []Blob,
+	subject *Descriptor,
+) *ArtifactManifest {
+	a := &ArtifactManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		ArtifactType:  artifactType,
+		Config:        NewDescriptor(config),
+		Layers:        make([]Descriptor, len(blobs)),
+		Subject:       subject,
+	}
+	for i, b := range blobs {
+		a.Layers[i] = NewDescriptor(b)
+	}
+	return a
+}
+
+// NewDescriptor creates the descriptor of a blob
+func NewDescriptor(b Blob) Descriptor {
+	return Descriptor{
+		MediaType: b.GetMediaType(),
+		Digest:    b.GetDigest(),
+		Size:      b.GetSize(),
+	}
+}
+
+// NewEmptyConfig writes the empty JSON object to a file in dir and returns
+// a blob for it that may be used as the config of an artifact
+func NewEmptyConfig(dir string) (*NoncryptedBlob, error) {
+	return writeBlobFile(filepath.Join(dir, "empty.json"), MediaTypeEmptyJSON, []byte("{}"))
+}
+
+// NewFileBlob creates a blob that describes an existing file
+func NewFileBlob(filename, mediaType string) (_ *NoncryptedBlob, err error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	d, err := fileDigest(filename)
+	if err != nil {
+		err = errors.Wrapf(err, "filename = %s", filename)
+		return
+	}
+
+	return newPlainBlob(filename, d, info.Size(), mediaType), nil
+}
+
+// writeBlobFile writes data to filename and returns a blob that describes it
+func writeBlobFile(filename, mediaType string, data []byte) (_ *NoncryptedBlob, err error) {
+	if err = os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if err = ioutil.WriteFile(filename, data, 0600); err != nil {
+		err = errors.Wrapf(err, "filename = %s", filename)
+		return
+	}
+
+	return newPlainBlob(filename, digest.Canonical.FromBytes(data), int64(len(data)), mediaType), nil
+}
@@ -0,0 +1,75 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Senetas/crypto-cli/distribution"
+)
+
+func TestIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	sig := distribution.Descriptor{
+		MediaType:    distribution.MediaTypeOCIManifest,
+		ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+		Digest:       digest.Canonical.FromString("signature"),
+	}
+	keys := distribution.Descriptor{
+		MediaType:    distribution.MediaTypeOCIManifest,
+		ArtifactType: distribution.MediaTypeKeyEnvelope,
+		Digest:       digest.Canonical.FromString("keys"),
+	}
+
+	index := distribution.NewIndex()
+	index.Add(sig)
+	index.Add(keys)
+	index.Add(keys)
+
+	assert.Len(index.Manifests, 2)
+	assert.Equal([]distribution.Descriptor{keys}, index.Filter(distribution.MediaTypeKeyEnvelope))
+	assert.Equal([]distribution.Descriptor{sig, keys}, index.Filter(""))
+	assert.Empty(index.Filter("application/spdx+json"))
+}
+
+func TestPlatform(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := distribution.ParsePlatform("linux/arm/v7")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(&distribution.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, p)
+	assert.Equal("linux/arm/v7", p.String())
+
+	arm, err := distribution.ParsePlatform("linux/arm")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("linux/arm", arm.String())
+	assert.True(p.Matches(arm))
+	assert.False(arm.Matches(p))
+	assert.True(p.Matches(p))
+	assert.False(p.Matches(&distribution.Platform{OS: "linux", Architecture: "arm64"}))
+
+	for _, s := range []string{"", "linux", "linux/", "/arm64", "linux/arm/v7/x"} {
+		_, err = distribution.ParsePlatform(s)
+		assert.Error(err, s)
+	}
+}
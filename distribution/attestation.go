@@ -0,0 +1,120 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+
+	"github.com/Senetas/crypto-cli/crypto"
+)
+
+const (
+	// AnnotationReferenceType marks the manifests in an index made by BuildKit
+	// that are not images, such as attestations
+	AnnotationReferenceType = "vnd.docker.reference.type"
+
+	// AnnotationReferenceDigest is the digest of the image manifest that an
+	// attestation manifest made by BuildKit is about
+	AnnotationReferenceDigest = "vnd.docker.reference.digest"
+
+	// ReferenceTypeAttestation is the reference type of attestation manifests
+	ReferenceTypeAttestation = "attestation-manifest"
+
+	// ArtifactTypeAttestation is the type of the artifacts that attestations are
+	// attached to encrypted images as
+	ArtifactTypeAttestation = "application/vnd.in-toto+json"
+)
+
+// Attestation is an attestation manifest made by BuildKit, such as the provenance
+// or SBOM of an image, whose in-toto statements have been read to files
+type Attestation struct {
+	// Layers describe the statements, with annotations such as their predicate types
+	Layers []Descriptor
+	Blobs  []*NoncryptedBlob
+}
+
+// isAttestation reports whether a descriptor in an index is of an attestation
+func isAttestation(d Descriptor) bool {
+	return d.Annotations[AnnotationReferenceType] == ReferenceTypeAttestation
+}
+
+// readOCIAttestations reads the attestations in index about the image manifest
+// with digest d from the OCI image layout at path
+func readOCIAttestations(path string, index *ociIndex, d digest.Digest) (as []*Attestation, err error) {
+	for _, m := range index.Manifests {
+		if !isAttestation(m) || m.Annotations[AnnotationReferenceDigest] != d.String() {
+			continue
+		}
+
+		manifest := &ociIndex{}
+		if err = readOCIBlob(path, m.Digest, manifest); err != nil {
+			return
+		}
+
+		a := &Attestation{Layers: manifest.Layers, Blobs: make([]*NoncryptedBlob, len(manifest.Layers))}
+		for i, l := range manifest.Layers {
+			var name string
+			if name, err = ociBlobName(l.Digest); err != nil {
+				return
+			}
+			if a.Blobs[i], err = NewFileBlob(filepath.Join(path, name), l.MediaType); err != nil {
+				return
+			}
+		}
+		as = append(as, a)
+	}
+	return
+}
+
+// Artifact makes an artifact of the attestation that is attached to subject, in
+// which the statements are encrypted if opts.EncryptAttestations is set. The files
+// of the artifact are written to dir.
+func (a *Attestation) Artifact(
+	subject *Descriptor,
+	dir string,
+	opts *crypto.Opts,
+) (artifact *ArtifactManifest, blobs []Blob, err error) {
+	if opts.EncryptAttestations {
+		if artifact, blobs, err = NewEncryptedArtifact(ArtifactTypeAttestation, a.Blobs, dir, opts); err != nil {
+			return
+		}
+	} else {
+		var config *NoncryptedBlob
+		if config, err = NewEmptyConfig(dir); err != nil {
+			return
+		}
+		blobs = []Blob{config}
+		for _, b := range a.Blobs {
+			blobs = append(blobs, b)
+		}
+		artifact = NewArtifactManifest(ArtifactTypeAttestation, config, blobs[1:], nil)
+	}
+
+	// keep the predicate types, so that the statements may be found without
+	// downloading them
+	for i, l := range a.Layers {
+		if artifact.Layers[i].Annotations == nil {
+			artifact.Layers[i].Annotations = make(map[string]string)
+		}
+		for k, v := range l.Annotations {
+			artifact.Layers[i].Annotations[k] = v
+		}
+	}
+	artifact.Subject = subject
+
+	return artifact, blobs, nil
+}
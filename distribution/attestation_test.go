@@ -0,0 +1,96 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestNewManifestFromOCIArchiveAttestations(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	secret := mkLayerTar(t, "secret")
+	diffIDs := []digest.Digest{digest.Canonical.FromBytes(secret)}
+
+	a := &ociArchive{t: t, files: map[string][]byte{"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`)}}
+	image := a.json(distribution.MediaTypeOCIManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"config": a.json(distribution.MediaTypeOCIConfig, map[string]interface{}{
+			"history": []map[string]interface{}{
+				{"created_by": "LABEL com.senetas.crypto.enabled=true", "empty_layer": true},
+				{"created_by": "/bin/sh -c #(nop) ADD file:secret in /"},
+			},
+			"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+		}),
+		"layers": []distribution.Descriptor{a.blob(distribution.MediaTypeOCIUncompressedLayer, secret)},
+	})
+
+	statement := a.blob(distribution.ArtifactTypeAttestation, []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`))
+	statement.Annotations = map[string]string{"in-toto.io/predicate-type": "https://slsa.dev/provenance/v0.2"}
+	attestation := a.json(distribution.MediaTypeOCIManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        a.json(distribution.MediaTypeOCIConfig, map[string]interface{}{}),
+		"layers":        []distribution.Descriptor{statement},
+	})
+	attestation.Annotations = map[string]string{
+		distribution.AnnotationReferenceType:   distribution.ReferenceTypeAttestation,
+		distribution.AnnotationReferenceDigest: image.Digest.String(),
+	}
+
+	// the attestation is listed first, so that it would be selected were it not
+	// recognised
+	a.files["index.json"], _ = json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []distribution.Descriptor{attestation, image},
+	})
+
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	require.NoError(err)
+	nTRep, err := names.CastToTagged(ref)
+	require.NoError(err)
+
+	m, err := distribution.NewManifestFromOCIArchive(a.tar(), nTRep, opts, dir)
+	require.NoError(err)
+	require.Len(m.Layers, 1)
+	assert.Equal(diffIDs[0], m.Layers[0].GetDigest())
+	require.Len(m.Attestations, 1)
+
+	subject := &distribution.Descriptor{MediaType: distribution.MediaTypeManifest, Digest: digest.Canonical.FromString("subject")}
+	artifact, blobs, err := m.Attestations[0].Artifact(subject, dir, opts)
+	require.NoError(err)
+	require.Len(artifact.Layers, 1)
+	assert.Len(blobs, 2)
+	assert.Equal(distribution.ArtifactTypeAttestation, artifact.ArtifactType)
+	assert.Equal(subject, artifact.Subject)
+	assert.Equal(statement.Digest, artifact.Layers[0].Digest)
+	assert.Equal(statement.Annotations["in-toto.io/predicate-type"], artifact.Layers[0].Annotations["in-toto.io/predicate-type"])
+}
@@ -17,10 +17,13 @@ package distribution
 import (
 	"io"
 	"os"
+	"path/filepath"
 
 	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
 
 	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
 )
 
 // Blob represents an entry for a blob in the image manifest
@@ -31,6 +34,7 @@ type Blob interface {
 	GetFilename() string
 	SetFilename(filename string)
 	ReadCloser() (io.ReadCloser, error)
+	Verify() error
 }
 
 // NoncryptedBlob is a vanilla blob with no encryption data
@@ -41,6 +45,10 @@ type NoncryptedBlob struct {
 	Size      int64         `json:"size"`
 	Digest    digest.Digest `json:"digest"`
 	Filename  string        `json:"-"`
+
+	// Chunks are the blobs that a layer has been split into, in order, which are
+	// read in place of Filename if there are any
+	Chunks []*NoncryptedBlob `json:"-"`
 }
 
 // GetDigest returnts the digest
@@ -55,12 +63,74 @@ func (b *NoncryptedBlob) GetSize() int64 { return b.Size }
 // SetFilename set the filename of the file that the blob is stored in
 func (b *NoncryptedBlob) SetFilename(filename string) { b.Filename = filename }
 
-// GetFilename retun the filename of the file that the blob is stored in
-func (b *NoncryptedBlob) GetFilename() string { return b.Filename }
+// GetFilename retun the filename of the file that the blob is stored in. A layer
+// that was split into chunks and has no file of its own is named by its digest
+// next to the file of its first chunk, so that the files made from it are too.
+func (b *NoncryptedBlob) GetFilename() string {
+	if b.Filename == "" && len(b.Chunks) > 0 && b.Chunks[0].Filename != "" {
+		return filepath.Join(filepath.Dir(b.Chunks[0].Filename), b.Digest.Encoded())
+	}
+	return b.Filename
+}
 
 // ReadCloser opens the file that backs the blob and returns a handle to it
 // It is the user's responsibility to close the file handle
-func (b *NoncryptedBlob) ReadCloser() (io.ReadCloser, error) { return os.Open(b.Filename) }
+func (b *NoncryptedBlob) ReadCloser() (io.ReadCloser, error) {
+	if len(b.Chunks) > 0 {
+		return newChunkReader(b.Chunks), nil
+	}
+	return os.Open(b.Filename)
+}
+
+// Verify re-hashes the file that backs the blob and checks that its size and digest
+// are those recorded for the blob, so that a file that has been corrupted or tampered
+// with since it was written is not uploaded
+func (b *NoncryptedBlob) Verify() (err error) {
+	if err = b.Digest.Validate(); err != nil {
+		return errors.Wrapf(err, "digest = %s", b.Digest)
+	}
+
+	fh, err := b.ReadCloser()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	verifier := b.Digest.Verifier()
+	n, err := io.Copy(verifier, fh)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	switch {
+	case n != b.Size:
+		err = errors.Errorf("%s has size %d but %d was expected", b.Filename, n, b.Size)
+	case !verifier.Verified():
+		err = errors.Errorf("%s does not match digest %s", b.Filename, b.Digest)
+	}
+	return
+}
+
+// readProgress opens the file that backs b like ReadCloser, reporting the bytes
+// read from it as the progress of op, which is done when it is closed
+func readProgress(b Blob, op string) (io.ReadCloser, error) {
+	r, err := b.ReadCloser()
+	if err != nil {
+		return nil, err
+	}
+	p := utils.StartProgress(op, b.GetDigest().String(), b.GetSize())
+	return &progressReadCloser{ProgressReader: &utils.ProgressReader{Reader: r, Progress: p}, Closer: r}, nil
+}
+
+type progressReadCloser struct {
+	*utils.ProgressReader
+	io.Closer
+}
+
+func (pr *progressReadCloser) Close() error {
+	pr.Progress.Done()
+	return pr.Closer.Close()
+}
 
 func newPlainBlob(
 	filename string,
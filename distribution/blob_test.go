@@ -15,12 +15,18 @@
 package distribution_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/google/uuid"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
 )
 
 func TestNonCryptedBlob(t *testing.T) {
@@ -53,3 +59,27 @@ func TestNonCryptedBlob(t *testing.T) {
 		assert.Equal("\\", test.blob.GetFilename())
 	}
 }
+
+func TestBlobVerify(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	size, d, fn, err := mkRandFile(t, dir)
+	require.NoError(err)
+
+	assert.NoError(distribution.NewPlainLayer(fn, d, size).Verify())
+	assert.Error(distribution.NewPlainLayer(fn, d, size+1).Verify())
+	assert.Error(distribution.NewPlainLayer(fn, digest.FromString("Hello"), size).Verify())
+	assert.Error(distribution.NewPlainLayer(fn, "sha256:..", size).Verify())
+	assert.Error(distribution.NewPlainLayer(filepath.Join(dir, "missing"), d, size).Verify())
+
+	// tampered with after it was written
+	data, err := ioutil.ReadFile(fn)
+	require.NoError(err)
+	data[0] ^= 0xff
+	require.NoError(ioutil.WriteFile(fn, data, 0600))
+	assert.Error(distribution.NewPlainLayer(fn, d, size).Verify())
+}
@@ -0,0 +1,154 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+const (
+	// ArtifactTypeBundle is the artifactType of an image that has been packed
+	// into a single encrypted blob
+	ArtifactTypeBundle = "application/vnd.senetas.crypto.bundle.v1"
+
+	// MediaTypeBundle is the mediaType of the blob of a bundle before it is
+	// encrypted, it is an uncompressed image archive that may be loaded with docker load
+	MediaTypeBundle = "application/vnd.senetas.crypto.bundle.v1.tar"
+)
+
+// Bundle packs the whole of an unencrypted image into a single encrypted blob,
+// returning an artifact that describes it and the blobs to upload with it. It
+// is for registries and proxies that mangle encrypted image manifests.
+func (m *ImageManifest) Bundle(
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+) (a *ArtifactManifest, blobs []Blob, err error) {
+	filename := filepath.Join(m.DirName, "bundle.tar")
+	d, size, err := m.writeArchive(filename, ref.String())
+	if err != nil {
+		return
+	}
+
+	plain := newPlainBlob(filename, d, size, MediaTypeBundle)
+	return NewEncryptedArtifact(ArtifactTypeBundle, []*NoncryptedBlob{plain}, m.DirName, opts)
+}
+
+// OpenBundle decrypts the blob of a bundle, which has been downloaded to filename,
+// returning a blob whose file is the image archive that was bundled
+func OpenBundle(a *ArtifactManifest, filename string, opts *crypto.Opts) (_ Blob, err error) {
+	if a.ArtifactType != ArtifactTypeBundle || len(a.Layers) != 1 {
+		err = errors.Errorf("not an encrypted bundle: %s", a.ArtifactType)
+		return
+	}
+
+	if _, ok := a.Layers[0].Annotations[AnnotationWrappedKey]; !ok {
+		err = errors.New("the bundle does not have a key")
+		return
+	}
+
+	return DecryptArtifactBlob(a.Layers[0], filename, filename+".tar", opts)
+}
+
+// writeArchive writes the image to filename as an archive that may be loaded
+// with docker load, returning its digest and size
+func (m *ImageManifest) writeArchive(filename, repoTag string) (d digest.Digest, size int64, err error) {
+	archive := &ArchiveManifest{
+		Config:   "config.json",
+		RepoTags: []string{repoTag},
+		Layers:   make([]string, len(m.Layers)),
+	}
+	for i := range m.Layers {
+		archive.Layers[i] = strconv.Itoa(i) + "/layer.tar"
+	}
+
+	manifestJSON, err := json.Marshal([]*ArchiveManifest{archive})
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	fh, err := os.Create(filename)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	digester := digest.Canonical.Digester()
+	cw := &utils.CounterWriter{Writer: io.MultiWriter(fh, digester.Hash())}
+	tw := tar.NewWriter(cw)
+
+	if err = tw.WriteHeader(&tar.Header{
+		Name: "manifest.json",
+		Mode: 0644,
+		Size: int64(len(manifestJSON)),
+	}); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	if _, err = tw.Write(manifestJSON); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if err = addFileToTar(tw, archive.Config, m.Config); err != nil {
+		return
+	}
+	for i, l := range m.Layers {
+		if err = addFileToTar(tw, archive.Layers[i], l); err != nil {
+			return
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	return digester.Digest(), int64(cw.Count), nil
+}
+
+// addFileToTar adds the file of a blob to a tarball under name
+func addFileToTar(tw *tar.Writer, name string, b Blob) (err error) {
+	r, err := b.ReadCloser()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(r, err) }()
+
+	info, err := os.Stat(b.GetFilename())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size()}); err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = io.Copy(tw, r)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,129 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestBundle(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	require.NoError(err)
+	nTRep, err := names.CastToTagged(ref)
+	require.NoError(err)
+
+	opts.SetPassphrase(passphrase)
+
+	size, d, fn, err := mkConfigFile(t, dir)
+	require.NoError(err)
+	dec, err := crypto.NewDecrypto(opts)
+	require.NoError(err)
+	manifest := &distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Config:        distribution.NewConfig(fn, d, size, dec),
+		DirName:       dir,
+	}
+
+	files := map[string]string{"manifest.json": "", "config.json": fn}
+	for i := 0; i < 2; i++ {
+		size, d, fn, err = mkRandFile(t, filepath.Join(dir, uuid.New().String()))
+		require.NoError(err)
+		manifest.Layers = append(manifest.Layers, distribution.NewPlainLayer(fn, d, size))
+		files[strconv.Itoa(i)+"/layer.tar"] = fn
+	}
+
+	artifact, blobs, err := manifest.Bundle(nTRep, opts)
+	require.NoError(err)
+	require.Len(blobs, 2)
+	require.Len(artifact.Layers, 1)
+	assert.Equal(distribution.ArtifactTypeBundle, artifact.ArtifactType)
+	assert.Equal(distribution.MediaTypeBundle+crypto.DefaultMediaTypeSuffix, artifact.Layers[0].MediaType)
+	assert.Equal(string(crypto.Pbkdf2Aes256Gcm), artifact.Annotations[crypto.AnnotationAlgos])
+
+	// the artifact as it is downloaded
+	data, err := json.Marshal(artifact)
+	require.NoError(err)
+	pulled := &distribution.ArtifactManifest{}
+	require.NoError(json.Unmarshal(data, pulled))
+
+	bundle, err := distribution.OpenBundle(pulled, blobs[1].GetFilename(), opts)
+	require.NoError(err)
+
+	r, err := bundle.ReadCloser()
+	require.NoError(err)
+	defer func() { assert.NoError(r.Close()) }()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(err)
+
+		expected, ok := files[header.Name]
+		require.True(ok, header.Name)
+		delete(files, header.Name)
+
+		actual, err := ioutil.ReadAll(tr)
+		require.NoError(err)
+
+		if header.Name == "manifest.json" {
+			var archive []distribution.ArchiveManifest
+			require.NoError(json.Unmarshal(actual, &archive))
+			assert.Equal([]string{nTRep.String()}, archive[0].RepoTags)
+			assert.Equal([]string{"0/layer.tar", "1/layer.tar"}, archive[0].Layers)
+			continue
+		}
+
+		original, err := ioutil.ReadFile(expected)
+		require.NoError(err)
+		assert.Equal(original, actual, header.Name)
+	}
+	assert.Empty(files)
+
+	// the wrong passphrase
+	wrong := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+	wrong.SetPassphrase("hunter3")
+	_, err = distribution.OpenBundle(pulled, blobs[1].GetFilename(), wrong)
+	assert.Error(err)
+
+	_, _, err = manifest.Bundle(nTRep, optsCompat)
+	assert.Error(err)
+}
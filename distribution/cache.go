@@ -0,0 +1,53 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import "sync"
+
+// BlobCache remembers the result of encrypting or compressing a blob, so that
+// identical blobs are only processed (and so uploaded) once, even when they
+// appear several times in an image or in several images
+type BlobCache struct {
+	mu    sync.Mutex
+	blobs map[string]Blob
+}
+
+// NewBlobCache creates an empty BlobCache
+func NewBlobCache() *BlobCache {
+	return &BlobCache{blobs: make(map[string]Blob)}
+}
+
+// Get returns the processed version of a blob that is identical to in, or nil
+// if there has been none
+func (c *BlobCache) Get(in Blob) Blob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blobs[cacheKey(in)]
+}
+
+// Put records that out is the processed version of in
+func (c *BlobCache) Put(in, out Blob) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blobs[cacheKey(in)] = out
+}
+
+// cacheKey identifies a blob by its digest, or by its file if it has no digest yet
+func cacheKey(b Blob) string {
+	if d := b.GetDigest(); d != "" {
+		return d.String()
+	}
+	return "file:" + b.GetFilename()
+}
@@ -0,0 +1,83 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestEncryptDuplicateLayers(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts.SetPassphrase(passphrase)
+
+	size, d, fn, err := mkConfigFile(t, dir)
+	require.NoError(err)
+	dec, err := crypto.NewDecrypto(opts)
+	require.NoError(err)
+	config := distribution.NewConfig(fn, d, size, dec)
+
+	size, d, fn, err = mkRandFile(t, dir)
+	require.NoError(err)
+	layers := make([]distribution.Blob, 3)
+	for i := range layers {
+		dec, err = crypto.NewDecrypto(opts)
+		require.NoError(err)
+		layers[i] = distribution.NewLayer(fn, d, size, dec)
+	}
+
+	manifest := &distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Config:        config,
+		Layers:        layers,
+		DirName:       dir,
+	}
+
+	cache := distribution.NewBlobCache()
+	emanifest, err := manifest.EncryptCached(nil, opts, cache)
+	require.NoError(err)
+
+	require.Len(emanifest.Layers, 3)
+	assert.True(emanifest.Layers[0] == emanifest.Layers[1])
+	assert.True(emanifest.Layers[0] == emanifest.Layers[2])
+	assert.Equal(strconv.Itoa(3), emanifest.Annotations[distribution.AnnotationEncryptedLayers])
+
+	// the cache is shared between images
+	emanifest2, err := manifest.EncryptCached(nil, opts, cache)
+	require.NoError(err)
+	assert.True(emanifest.Layers[0] == emanifest2.Layers[0])
+
+	dmanifest, err := emanifest.Decrypt(nil, opts)
+	require.NoError(err)
+	for _, l := range dmanifest.Layers {
+		assert.Equal(d, l.GetDigest())
+	}
+}
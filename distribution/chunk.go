@@ -0,0 +1,267 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+const (
+	// AnnotationChunk is the annotation on a chunk of a split layer that gives its
+	// position, as i/n for the ith of n chunks
+	AnnotationChunk = "com.senetas.crypto.chunk"
+
+	// AnnotationChunkOf is the annotation on a chunk of a split layer that gives
+	// the digest of the whole layer
+	AnnotationChunkOf = "com.senetas.crypto.chunk.of"
+)
+
+// SplitLayers splits each encrypted layer that is larger than size into chunks of
+// at most size bytes, which are stored as separate blobs for registries that
+// limit the size of a blob. The file of each chunk is written next to the file of
+// the layer.
+func (m *ImageManifest) SplitLayers(size int64) (err error) {
+	if size <= 0 {
+		return errors.Errorf("invalid chunk size: %d", size)
+	}
+
+	for _, l := range m.Layers {
+		blob, ok := l.(*encryptedBlobNew)
+		if !ok || blob.Size <= size || len(blob.Chunks) > 0 {
+			continue
+		}
+		if err = splitBlob(blob.NoncryptedBlob, size); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// LayerBlobs returns the blobs that hold the layers of the manifest as they are
+// stored, in which a layer that has been split is stored as its chunks
+func (m *ImageManifest) LayerBlobs() (blobs []Blob) {
+	for _, l := range m.Layers {
+		if chunks := chunksOf(l); len(chunks) > 0 {
+			for _, c := range chunks {
+				blobs = append(blobs, c)
+			}
+			continue
+		}
+		blobs = append(blobs, l)
+	}
+	return
+}
+
+func chunksOf(b Blob) []*NoncryptedBlob {
+	if eb, ok := b.(*encryptedBlobNew); ok {
+		return eb.Chunks
+	}
+	return nil
+}
+
+func splitBlob(b *NoncryptedBlob, size int64) (err error) {
+	fh, err := os.Open(b.Filename)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	var chunks []*NoncryptedBlob
+	for remaining := b.Size; remaining > 0; remaining -= size {
+		var chunk *NoncryptedBlob
+		filename := b.Filename + "." + strconv.Itoa(len(chunks))
+		if chunk, err = writeChunk(io.LimitReader(fh, size), filename, b.MediaType); err != nil {
+			return
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	b.Chunks = chunks
+	return nil
+}
+
+func writeChunk(r io.Reader, filename, mediaType string) (_ *NoncryptedBlob, err error) {
+	out, err := os.Create(filename)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	defer func() { err = utils.CheckedClose(out, err) }()
+
+	digester := digest.Canonical.Digester()
+	n, err := io.Copy(io.MultiWriter(digester.Hash(), out), r)
+	if err != nil {
+		err = errors.Wrapf(err, "filename = %s", filename)
+		return
+	}
+
+	return newPlainBlob(filename, digester.Digest(), n, mediaType), nil
+}
+
+// chunkReader reads the files of the chunks of a layer one after another
+type chunkReader struct {
+	chunks []*NoncryptedBlob
+	fh     *os.File
+}
+
+func newChunkReader(chunks []*NoncryptedBlob) *chunkReader {
+	return &chunkReader{chunks: chunks}
+}
+
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	for {
+		if r.fh == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+			if r.fh, err = os.Open(r.chunks[0].Filename); err != nil {
+				return 0, errors.WithStack(err)
+			}
+			r.chunks = r.chunks[1:]
+		}
+
+		if n, err = r.fh.Read(p); err != io.EOF {
+			return
+		}
+
+		if err = r.Close(); err != nil || n > 0 {
+			return
+		}
+	}
+}
+
+func (r *chunkReader) Close() (err error) {
+	if r.fh != nil {
+		err = errors.WithStack(r.fh.Close())
+		r.fh = nil
+	}
+	return
+}
+
+// chunkJSON is an entry in the layers of a manifest for a chunk of a split layer,
+// the first of which holds the key of the layer
+type chunkJSON struct {
+	MediaType   string            `json:"mediaType"`
+	Size        int64             `json:"size"`
+	Digest      digest.Digest     `json:"digest"`
+	Crypto      *crypto.EnCrypto  `json:"crypto,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func marshalChunks(b *encryptedBlobNew) (out []json.RawMessage, err error) {
+	out = make([]json.RawMessage, len(b.Chunks))
+	for i, c := range b.Chunks {
+		chunk := &chunkJSON{
+			MediaType: c.MediaType,
+			Size:      c.Size,
+			Digest:    c.Digest,
+			Annotations: map[string]string{
+				AnnotationChunk:   fmt.Sprintf("%d/%d", i, len(b.Chunks)),
+				AnnotationChunkOf: b.Digest.String(),
+			},
+		}
+		if i == 0 {
+			chunk.Crypto = b.EnCrypto
+		}
+		if out[i], err = json.Marshal(chunk); err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+	}
+	return
+}
+
+// unmarshalChunks reads the layer whose chunks begin the entries of ms, returning
+// the number of entries that were read, which is 0 if the first is not a chunk.
+// The layer is named after its digest in dir, so that the files made from it,
+// such as its decryption, are written there rather than next to no file at all.
+func unmarshalChunks(ms []json.RawMessage) (blob Blob, n int, err error) {
+	first := &chunkJSON{}
+	if err = json.Unmarshal(ms[0], first); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if _, ok := first.Annotations[AnnotationChunk]; !ok {
+		return
+	}
+
+	i, n, err := chunkPosition(first)
+	switch {
+	case err != nil:
+		return
+	case i != 0:
+		err = errors.Errorf("chunk %d of layer %s is out of place", i, first.Annotations[AnnotationChunkOf])
+		return
+	case n > len(ms):
+		err = errors.Errorf("layer %s has %d chunks but only %d follow", first.Annotations[AnnotationChunkOf], n, len(ms))
+		return
+	case first.Crypto == nil:
+		err = errors.Errorf("layer %s has no key", first.Annotations[AnnotationChunkOf])
+		return
+	}
+
+	whole := &NoncryptedBlob{
+		MediaType: first.MediaType,
+		Digest:    digest.Digest(first.Annotations[AnnotationChunkOf]),
+		Chunks:    make([]*NoncryptedBlob, n),
+	}
+	if err = whole.Digest.Validate(); err != nil {
+		err = errors.Wrapf(err, "digest = %s", whole.Digest)
+		return
+	}
+
+	for i = 0; i < n; i++ {
+		chunk := &chunkJSON{}
+		if err = json.Unmarshal(ms[i], chunk); err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+
+		var j, m int
+		if j, m, err = chunkPosition(chunk); err != nil {
+			return
+		} else if j != i || m != n || chunk.Annotations[AnnotationChunkOf] != whole.Digest.String() ||
+			chunk.MediaType != whole.MediaType {
+			err = errors.Errorf("chunk %d of layer %s is out of place", i, whole.Digest)
+			return
+		}
+
+		whole.Chunks[i] = newPlainBlob("", chunk.Digest, chunk.Size, chunk.MediaType)
+		whole.Size += chunk.Size
+	}
+
+	blob = &encryptedBlobNew{NoncryptedBlob: whole, EnCrypto: first.Crypto}
+	return blob, n, checkBlobMediaType(blob, false)
+}
+
+func chunkPosition(c *chunkJSON) (i, n int, err error) {
+	pos := c.Annotations[AnnotationChunk]
+	if _, err = fmt.Sscanf(pos, "%d/%d", &i, &n); err != nil || i < 0 || i >= n {
+		err = errors.Errorf("invalid chunk position of %s: %q", c.Digest, pos)
+	}
+	return
+}
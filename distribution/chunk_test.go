@@ -0,0 +1,113 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestSplitLayers(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "com.senetas.crypto")
+	require.NoError(err)
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts.SetPassphrase(passphrase)
+	manifest := mkEncryptedManifest(t, dir, opts)
+	layer := manifest.Layers[0]
+
+	original, err := ioutil.ReadFile(layer.GetFilename())
+	require.NoError(err)
+
+	const size = 256
+	require.NoError(manifest.SplitLayers(size))
+
+	chunks := manifest.LayerBlobs()
+	require.Len(chunks, (len(original)+size-1)/size)
+	for _, c := range chunks {
+		assert.True(c.GetSize() <= size)
+		assert.NoError(c.Verify())
+	}
+	assert.NoError(layer.Verify())
+
+	// the chunks are listed in the manifest in place of the layer
+	data, err := json.Marshal(manifest)
+	require.NoError(err)
+	aux := struct {
+		Layers []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}{}
+	require.NoError(json.Unmarshal(data, &aux))
+	require.Len(aux.Layers, len(chunks))
+	for i, l := range aux.Layers {
+		assert.Equal(chunks[i].GetDigest().String(), l.Digest)
+		assert.Equal(layer.GetDigest().String(), l.Annotations[distribution.AnnotationChunkOf])
+	}
+
+	// the layer is read from its chunks after it is pulled
+	pulled := &distribution.ImageManifest{}
+	require.NoError(json.Unmarshal(data, pulled))
+	require.Len(pulled.Layers, 1)
+	assert.Equal(layer.GetDigest(), pulled.Layers[0].GetDigest())
+	assert.Equal(layer.GetSize(), pulled.Layers[0].GetSize())
+
+	pulled.Config.SetFilename(manifest.Config.GetFilename())
+	for i, c := range pulled.LayerBlobs() {
+		c.SetFilename(chunks[i].GetFilename())
+	}
+	assert.NoError(pulled.Layers[0].Verify())
+
+	decrypted, err := pulled.Decrypt(nil, opts)
+	require.NoError(err)
+	// next to its chunks, as it has no file of its own
+	assert.Equal(filepath.Dir(chunks[0].GetFilename()), filepath.Dir(decrypted.Layers[0].GetFilename()))
+	plain, err := manifest.Decrypt(nil, opts)
+	require.NoError(err)
+	assert.Equal(plain.Layers[0].GetDigest(), decrypted.Layers[0].GetDigest())
+
+	// chunks that are out of order are rejected
+	reordered := append([]json.RawMessage{}, mustLayers(t, data)...)
+	reordered[0], reordered[1] = reordered[1], reordered[0]
+	bad, err := json.Marshal(map[string]interface{}{"config": manifest.Config, "layers": reordered})
+	require.NoError(err)
+	err = json.Unmarshal(bad, &distribution.ImageManifest{})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "chunk")
+	}
+
+	_, _, err = manifest.DetachKeys()
+	assert.Error(err)
+}
+
+func mustLayers(t *testing.T, data []byte) []json.RawMessage {
+	aux := struct {
+		Layers []json.RawMessage `json:"layers"`
+	}{}
+	require.NoError(t, json.Unmarshal(data, &aux))
+	return aux.Layers
+}
@@ -18,6 +18,9 @@ const (
 	// MediaTypeManifest specifies the mediaType for the current version.
 	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
 
+	// MediaTypeManifestList specifies the mediaType for manifest lists.
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
 	// MediaTypeImageConfig specifies the mediaType for the image configuration.
 	MediaTypeImageConfig = "application/vnd.docker.container.image.v1+json"
 
@@ -36,3 +39,47 @@ const (
 	// are not compressed.
 	MediaTypeUncompressedLayer = "application/vnd.docker.image.rootfs.diff.tar"
 )
+
+const (
+	// MediaTypeOCIManifest specifies the mediaType for an OCI image manifest.
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+
+	// MediaTypeOCIIndex specifies the mediaType for an OCI image index.
+	MediaTypeOCIIndex = "application/vnd.oci.image.index.v1+json"
+
+	// MediaTypeOCIConfig specifies the mediaType for the configuration of an OCI image.
+	MediaTypeOCIConfig = "application/vnd.oci.image.config.v1+json"
+
+	// MediaTypeOCILayer is the mediaType used for gzip compressed OCI layers.
+	MediaTypeOCILayer = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// MediaTypeOCIUncompressedLayer is the mediaType used for OCI layers which
+	// are not compressed.
+	MediaTypeOCIUncompressedLayer = "application/vnd.oci.image.layer.v1.tar"
+
+	// MediaTypeOCIZstdLayer is the mediaType used for zstd compressed OCI layers.
+	MediaTypeOCIZstdLayer = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	// MediaTypeEmptyJSON is the mediaType of the empty JSON object "{}" that is
+	// used as the config of artifacts that have no config of their own.
+	MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+	// MediaTypeKeyEnvelope is the mediaType (and artifactType) of the blob that
+	// holds the wrapped keys of an image when they are stored in a referrer.
+	MediaTypeKeyEnvelope = "application/vnd.senetas.crypto.keys.v1+json"
+)
+
+// ManifestMediaTypes are the media types of the manifests that are accepted from
+// registries: those of images and of the indexes of multi-platform images
+var ManifestMediaTypes = []string{
+	MediaTypeManifest,
+	MediaTypeOCIManifest,
+	MediaTypeManifestList,
+	MediaTypeOCIIndex,
+}
+
+// IsIndex is whether mediaType is that of an index of the manifests of the images
+// of several platforms
+func IsIndex(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeManifestList
+}
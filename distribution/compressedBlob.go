@@ -15,10 +15,14 @@
 package distribution
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"io"
 	"os"
+	"os/exec"
 
+	"github.com/docker/docker/pkg/archive"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 
@@ -37,15 +41,15 @@ type DecompressedBlob interface {
 	Compress(outfile string) (CompressedBlob, error)
 }
 
-// Decompress decompresses a blob
+// Decompress decompresses a blob, which may be gzip, bzip2, xz or zstd compressed
 func (b *NoncryptedBlob) Decompress(outfile string) (_ DecompressedBlob, err error) {
-	r, err := b.ReadCloser()
+	r, err := readProgress(b, utils.ProgressDecompress)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 	defer func() { err = utils.CheckedClose(r, err) }()
 
-	zr, err := gzip.NewReader(r)
+	zr, err := decompressStream(r)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -77,7 +81,7 @@ func (b *NoncryptedBlob) Decompress(outfile string) (_ DecompressedBlob, err err
 
 // Compress compresses a blob
 func (b *NoncryptedBlob) Compress(outfile string) (_ CompressedBlob, err error) {
-	r, err := b.ReadCloser()
+	r, err := readProgress(b, utils.ProgressCompress)
 	if err != nil {
 		err = errors.WithStack(err)
 		return
@@ -115,3 +119,87 @@ func (b *NoncryptedBlob) Compress(outfile string) (_ CompressedBlob, err error)
 		Filename:  outfile,
 	}, nil
 }
+
+// zstdMagic and xzMagic are the first bytes of zstd frames and xz streams
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// decompressStream sniffs the compression of r and returns a reader of its
+// decompressed contents. Those that are not supported by the standard library
+// are decompressed by the xz and zstd commands, which must be installed for them.
+func decompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return cmdStream("zstd", br, "-d", "-c", "-q")
+	case bytes.HasPrefix(magic, xzMagic):
+		return cmdStream("xz", br, "-d", "-c", "-q")
+	default:
+		return archive.DecompressStream(br)
+	}
+}
+
+// cmdStream runs the command name with in as its input and returns a reader of
+// its output, which fails with the contents of stderr if the command does. The
+// command is killed and waited for when the reader is closed, if the output has
+// not been read to its end.
+func cmdStream(name string, in io.Reader, args ...string) (io.ReadCloser, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, errors.Errorf("the layer is %s compressed, which needs the %s command, but it is not installed", name, name)
+	}
+
+	stderr := &bytes.Buffer{}
+	pr, pw := io.Pipe()
+
+	cmd := exec.Command(path, args...) // #nosec
+	cmd.Stdin = in
+	cmd.Stdout = pw
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "could not run %s", name)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := cmd.Wait(); err != nil {
+			pw.CloseWithError(errors.Errorf("%s: %v: %s", name, err, bytes.TrimSpace(stderr.Bytes())))
+			return
+		}
+		pw.Close()
+	}()
+
+	return &cmdReader{PipeReader: pr, cmd: cmd, done: done}, nil
+}
+
+// cmdReader is the output of a command run by cmdStream
+type cmdReader struct {
+	*io.PipeReader
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// Close stops the command if it is still running, and waits for it to exit. The
+// pipe is closed first, so that the copying of the output that Wait waits for is
+// not left blocked on a reader that has gone.
+func (r *cmdReader) Close() error {
+	err := r.PipeReader.Close()
+	select {
+	case <-r.done:
+	default:
+		// the command may exit on its own before it is killed
+		_ = r.cmd.Process.Kill()
+		<-r.done
+	}
+	return errors.WithStack(err)
+}
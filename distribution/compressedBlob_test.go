@@ -0,0 +1,191 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestDecompress(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	layer := mkLayerTar(t, "some layer contents")
+	diffID := digest.Canonical.FromBytes(layer)
+
+	compressors := map[string]func() ([]byte, error){
+		"none": func() ([]byte, error) { return layer, nil },
+		"gzip": func() ([]byte, error) { return gzipBytes(t, layer), nil },
+		"xz":   compressCmd(layer, "xz", "-c"),
+		"zstd": compressCmd(layer, "zstd", "-c", "-q"),
+	}
+
+	for name, compress := range compressors {
+		if name == "xz" || name == "zstd" {
+			if _, err := exec.LookPath(name); err != nil {
+				t.Logf("%s is not installed", name)
+				continue
+			}
+		}
+
+		data, err := compress()
+		require.NoError(err, name)
+
+		fn := filepath.Join(dir, name)
+		require.NoError(ioutil.WriteFile(fn, data, 0600), name)
+
+		blob := distribution.NewPlainLayer(fn, digest.Canonical.FromBytes(data), int64(len(data)))
+		dec, err := blob.(*distribution.NoncryptedBlob).Decompress(fn + ".tar")
+		if !assert.NoError(err, name) {
+			continue
+		}
+		assert.Equal(diffID, dec.GetDigest(), name)
+		assert.Equal(int64(len(layer)), dec.GetSize(), name)
+	}
+
+	// corrupt zstd data is reported
+	if _, err := exec.LookPath("zstd"); err == nil {
+		fn := filepath.Join(dir, "corrupt")
+		require.NoError(ioutil.WriteFile(fn, []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0}, 0600))
+		blob := distribution.NewPlainLayer(fn, "", 0).(*distribution.NoncryptedBlob)
+		_, err = blob.Decompress(fn + ".tar")
+		assert.Error(err)
+	}
+}
+
+func TestDecompressCommand(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	data, err := compressCmd(bytes.Repeat([]byte("layer"), 1<<20), "zstd", "-c", "-q")()
+	require.NoError(err)
+	fn := filepath.Join(dir, "layer.zst")
+	require.NoError(ioutil.WriteFile(fn, data, 0600))
+
+	// a decompression that fails before the output is read stops the command
+	// rather than leaving it blocked on its output
+	blob := distribution.NewPlainLayer(fn, "", 0).(*distribution.NoncryptedBlob)
+	_, err = blob.Decompress(filepath.Join(dir, "missing", "layer.tar"))
+	assert.Error(err)
+	if runtime.GOOS == "linux" {
+		assert.Empty(childProcesses(t, "zstd"))
+	}
+
+	// a missing command is named in the error
+	path := os.Getenv("PATH")
+	require.NoError(os.Setenv("PATH", dir))
+	defer func() { assert.NoError(os.Setenv("PATH", path)) }()
+
+	_, err = blob.Decompress(fn + ".tar")
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "zstd command")
+	}
+}
+
+// childProcesses lists the pids of the child processes of the test named name,
+// from /proc
+func childProcesses(t *testing.T, name string) (pids []string) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	require.NoError(t, err)
+	for _, fn := range stats {
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			continue
+		}
+		// the fields are pid (comm) state ppid ...
+		stat := string(data)
+		i := strings.LastIndex(stat, ")")
+		if i < 0 || !strings.HasSuffix(stat[:i], "("+name) {
+			continue
+		}
+		if fields := strings.Fields(stat[i+1:]); len(fields) > 1 && fields[1] == strconv.Itoa(os.Getpid()) {
+			pids = append(pids, filepath.Base(filepath.Dir(fn)))
+		}
+	}
+	return pids
+}
+
+func compressCmd(data []byte, name string, args ...string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Stdin = bytes.NewReader(data)
+		return cmd.Output()
+	}
+}
+
+type progressRecorder map[string]int64
+
+func (r progressRecorder) Start(op, name string, total int64) utils.Progress {
+	return &opProgress{r, op}
+}
+
+type opProgress struct {
+	r  progressRecorder
+	op string
+}
+
+func (p *opProgress) Add(n int64) { p.r[p.op] += n }
+func (p *opProgress) Done()       {}
+
+func TestCompressProgress(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	size, d, fn, err := mkRandFile(t, dir)
+	require.NoError(err)
+
+	recorder := progressRecorder{}
+	utils.SetProgressReporter(recorder)
+	defer utils.SetProgressReporter(nil)
+
+	compressed, err := distribution.NewPlainLayer(fn, d, size).(*distribution.NoncryptedBlob).Compress(fn + ".gz")
+	require.NoError(err)
+	_, err = compressed.(*distribution.NoncryptedBlob).Decompress(fn + ".tar")
+	require.NoError(err)
+
+	assert.Equal(size, recorder[utils.ProgressCompress])
+	assert.Equal(compressed.GetSize(), recorder[utils.ProgressDecompress])
+}
@@ -15,11 +15,14 @@
 package distribution
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/image"
+	"github.com/pkg/errors"
 
 	"github.com/Senetas/crypto-cli/crypto"
 )
@@ -49,16 +52,44 @@ type clearFields struct {
 	Size          int64     `json:",omitempty"`
 	OSVersion     string    `json:"os.version,omitempty"`
 	OSFeatures    []string  `json:"os.features,omitempty"`
+	Variant       string    `json:"variant,omitempty"`
+}
+
+// ReadPlatform reads the platform of an image from its config, which may be
+// encrypted as the fields that describe the platform are kept in the clear
+func ReadPlatform(r io.Reader) (*Platform, error) {
+	c := &clearFields{}
+	if err := json.NewDecoder(r).Decode(c); err != nil {
+		return nil, errors.Wrap(err, "could not decode config")
+	}
+
+	if c.Architecture == "" || c.OS == "" {
+		return nil, errors.New("the config does not specify a platform")
+	}
+
+	return &Platform{
+		Architecture: c.Architecture,
+		OS:           c.OS,
+		OSVersion:    c.OSVersion,
+		OSFeatures:   c.OSFeatures,
+		Variant:      c.Variant,
+	}, nil
 }
 
 // DecConfig is config that may be encrypted
 type DecConfig interface {
 	Encrypt(key, nonce, salt []byte) (EncConfig, error)
+	// Bytes serialises the config exactly as it was before it was encrypted
+	Bytes() ([]byte, error)
 }
 
 type decConfig struct {
 	secretFields
 	clearFields
+
+	// raw is the config as it was read, so that every field of it, including
+	// those that are not known here, may be restored byte for byte
+	raw []byte
 }
 
 // NewDecConfig creates a new DecConfig
@@ -66,6 +97,10 @@ func NewDecConfig() DecConfig { return &decConfig{} }
 
 // Sort the keys when marshalling
 func (c *decConfig) MarshalJSON() (_ []byte, err error) {
+	if c.raw != nil {
+		return c.raw, nil
+	}
+
 	type MarshalImage decConfig
 	pass1, err := json.Marshal(MarshalImage(*c))
 	if err != nil {
@@ -80,9 +115,30 @@ func (c *decConfig) MarshalJSON() (_ []byte, err error) {
 	return json.Marshal(sorted)
 }
 
+// Keep the config as it was read as well as its fields
+func (c *decConfig) UnmarshalJSON(data []byte) error {
+	type UnmarshalImage decConfig
+	if err := json.Unmarshal(data, (*UnmarshalImage)(c)); err != nil {
+		return err
+	}
+	c.raw = append([]byte(nil), data...)
+	return nil
+}
+
+func (c *decConfig) Bytes() ([]byte, error) {
+	if c.raw != nil {
+		return c.raw, nil
+	}
+	return c.MarshalJSON()
+}
+
 func (c *decConfig) Encrypt(key, nonce, salt []byte) (_ EncConfig, err error) {
 	out := &encConfig{clearFields: c.clearFields}
-	out.Enc, err = crypto.EncryptJSON(c.secretFields, key, nonce, salt)
+	if c.raw != nil {
+		out.Config, err = crypto.EncryptBytes(c.raw, key, nonce, salt)
+	} else {
+		out.Enc, err = crypto.EncryptJSON(c.secretFields, key, nonce, salt)
+	}
 	return out, err
 }
 
@@ -92,12 +148,46 @@ type EncConfig interface {
 }
 
 type encConfig struct {
+	// Enc is the encrypted secretFields of configs that were encrypted before
+	// whole configs were
 	Enc string `json:"enc,omitempty"`
+	// Config is the whole config, encrypted exactly as it was read
+	Config string `json:"enc_config,omitempty"`
 	clearFields
 }
 
-func (c *encConfig) Decrypt(key, nonce, salt []byte, opts *crypto.Opts) (dc DecConfig, err error) {
-	dc = &decConfig{clearFields: c.clearFields}
-	err = crypto.DecryptJSON(c.Enc, key, nonce, salt, dc)
-	return dc, err
+func (c *encConfig) Decrypt(key, nonce, salt []byte, opts *crypto.Opts) (_ DecConfig, err error) {
+	if c.Config == "" {
+		dc := &decConfig{clearFields: c.clearFields}
+		err = crypto.DecryptJSON(c.Enc, key, nonce, salt, dc)
+		dc.raw = nil
+		return dc, err
+	}
+
+	raw, err := crypto.DecryptBytes(c.Config, key, nonce, salt)
+	if err != nil {
+		return
+	}
+
+	dc := &decConfig{}
+	if err = json.Unmarshal(raw, dc); err != nil {
+		err = errors.Wrap(err, "could not decode the decrypted config")
+		return
+	}
+
+	// the fields in the clear are not authenticated, so they must agree with
+	// those that were encrypted
+	clear1, err := json.Marshal(c.clearFields)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	clear2, err := json.Marshal(dc.clearFields)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !bytes.Equal(clear1, clear2) {
+		return nil, errors.New("the unencrypted fields of the config do not match the encrypted config")
+	}
+
+	return dc, nil
 }
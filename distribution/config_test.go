@@ -15,8 +15,11 @@
 package distribution_test
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
@@ -68,3 +71,73 @@ func TestUnMarshalling(t *testing.T) {
 
 	require.Equal(val, dc)
 }
+
+func TestConfigRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	// an indented config with fields that are not known to docker 18.05
+	original := []byte(`{
+  "created": "2018-07-11T01:56:47.38138392+10:00",
+  "architecture": "arm64",
+  "variant": "v8",
+  "os": "linux",
+  "config": {"Entrypoint": ["/bin/sh"], "Labels": {"com.senetas.crypto.enabled": "true"}},
+  "history": [{"created": "2018-07-11T01:56:43Z", "created_by": "LABEL com.senetas.crypto.enabled=true", "empty_layer": true}],
+  "rootfs": {"type": "layers", "diff_ids": []},
+  "moby.buildkit.buildinfo.v1": "e30="
+}`)
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key[:])
+	require.NoError(err)
+	nonce := []byte("012345678901")
+	salt := []byte("0123456789012345")
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+
+	val := distribution.NewDecConfig()
+	require.NoError(json.Unmarshal(original, val))
+
+	ec, err := val.Encrypt(key, nonce, salt)
+	require.NoError(err)
+
+	encrypted, err := json.Marshal(ec)
+	require.NoError(err)
+	require.NotContains(string(encrypted), "buildinfo")
+	require.Contains(string(encrypted), "arm64")
+
+	dc, err := ec.Decrypt(key, nonce, salt, opts)
+	require.NoError(err)
+	data, err := dc.Bytes()
+	require.NoError(err)
+	require.Equal(string(original), string(data))
+
+	// the fields in the clear may not be altered
+	tampered := []byte(strings.Replace(string(encrypted), "arm64", "amd64", 1))
+	ec2 := reflect.New(reflect.TypeOf(ec).Elem()).Interface().(distribution.EncConfig)
+	require.NoError(json.Unmarshal(tampered, ec2))
+	_, err = ec2.Decrypt(key, nonce, salt, opts)
+	require.Error(err)
+}
+
+func TestReadPlatform(t *testing.T) {
+	require := require.New(t)
+
+	p, err := distribution.ReadPlatform(bytes.NewReader(config))
+	require.NoError(err)
+	require.Equal(&distribution.Platform{Architecture: "amd64", OS: "linux"}, p)
+
+	// the platform may be read from an encrypted config
+	val := distribution.NewDecConfig()
+	require.NoError(json.Unmarshal([]byte(`{"architecture":"arm","variant":"v7","os":"linux","config":{}}`), val))
+	ec, err := val.Encrypt(make([]byte, 32), []byte("012345678901"), []byte("0123456789012345"))
+	require.NoError(err)
+	encrypted, err := json.Marshal(ec)
+	require.NoError(err)
+
+	p, err = distribution.ReadPlatform(bytes.NewReader(encrypted))
+	require.NoError(err)
+	require.Equal(&distribution.Platform{Architecture: "arm", OS: "linux", Variant: "v7"}, p)
+
+	_, err = distribution.ReadPlatform(bytes.NewReader([]byte(`{}`)))
+	require.Error(err)
+}
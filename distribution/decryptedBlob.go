@@ -44,7 +44,7 @@ type decryptedBlob struct {
 }
 
 func (db *decryptedBlob) EncryptBlob(opts *crypto.Opts, outname string) (eb EncryptedBlob, err error) {
-	r, err := db.ReadCloser()
+	r, err := readProgress(db, utils.ProgressEncrypt)
 	if err != nil {
 		err = errors.WithStack(err)
 		return
@@ -95,7 +95,7 @@ func (db *decryptedBlob) EncryptBlob(opts *crypto.Opts, outname string) (eb Encr
 
 	nb := &NoncryptedBlob{
 		Size:      int64(cw.Count),
-		MediaType: db.MediaType,
+		MediaType: encryptedMediaType(db.MediaType, opts),
 		Digest:    dgst,
 		Filename:  outname,
 	}
@@ -122,7 +122,7 @@ type decryptedConfig struct {
 }
 
 func (db *decryptedConfig) EncryptBlob(opts *crypto.Opts, outname string) (eb EncryptedBlob, err error) {
-	r, err := db.ReadCloser()
+	r, err := readProgress(db, utils.ProgressEncrypt)
 	if err != nil {
 		err = errors.WithStack(err)
 		return
@@ -161,7 +161,7 @@ func (db *decryptedConfig) EncryptBlob(opts *crypto.Opts, outname string) (eb En
 
 	nb := &NoncryptedBlob{
 		Size:      int64(cw.Count),
-		MediaType: db.MediaType,
+		MediaType: encryptedMediaType(db.MediaType, opts),
 		Digest:    dgst,
 		Filename:  outname,
 	}
@@ -0,0 +1,46 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package distribution implements the encryption pipeline of crypto-cli so that it
+// may be embedded in other Go programs.
+//
+// An image is read into an ImageManifest with NewManifestContext, from the docker
+// daemon, or NewManifestFromOCIArchive, from an OCI archive. Both extract the image
+// into a new directory under the given temporary directory, which is recorded in
+// the DirName of the manifest and is left for the caller to remove. The manifest is
+// then encrypted with EncryptContext and may be pushed with the registry package or
+// written to an OCI image layout with WriteOCILayout.
+//
+// Each blob of a manifest is a Blob, backed by a file, that moves through the
+// following states:
+//
+//	DecryptedBlob    --EncryptBlob-->  EncryptedBlob
+//	EncryptedBlob    --DecryptKey-->   KeyDecryptedBlob
+//	KeyDecryptedBlob --DecryptFile-->  DecryptedBlob
+//	KeyDecryptedBlob --EncryptKey-->   EncryptedBlob
+//
+// Unencrypted layers are a *NoncryptedBlob, which is only compressed or
+// decompressed. Every method that makes a new blob takes the name of the file it
+// writes, and the methods of ImageManifest write the file of each blob next to the
+// file of the blob it was made from, so no files are written outside the
+// directories of the files the caller gives the blobs. A layer that was split
+// into chunks has no file of its own, so one unmarshalled from a manifest is
+// named after the file of its first chunk. Blob.Verify checks that the file of a
+// blob still has the digest and size it was made with. The progress of
+// encrypting, decrypting, compressing and decompressing blobs is reported to the
+// reporter set with utils.SetProgressReporter.
+//
+// Artifacts other than images are encrypted with NewEncryptedArtifact and
+// decrypted with DecryptArtifactBlob.
+package distribution
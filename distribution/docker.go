@@ -0,0 +1,169 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/docker/client"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// DockerAPIVersion is the version of the docker API used to talk to daemons.
+// If it is empty, the highest version supported by both the client and the
+// daemon is negotiated, unless DOCKER_API_VERSION is set in the environment.
+var DockerAPIVersion string
+
+// DockerHost is the address of the docker daemon, such as tcp://host:2376,
+// unix:///run/user/1000/docker.sock or ssh://user@host. If it is empty, the
+// daemon is found by DefaultDockerHost.
+var DockerHost string
+
+const (
+	// dockerSocket is the socket of the docker daemon of the system
+	dockerSocket = "/var/run/docker.sock"
+
+	// defaultDockerContext is the docker context of the daemon in DOCKER_HOST or
+	// at the default socket
+	defaultDockerContext = "default"
+)
+
+// DefaultDockerHost finds the address of the docker daemon when none is given. It
+// is the one in DOCKER_HOST, then that of the docker context in use, as selected
+// by docker context use or DOCKER_CONTEXT, then the socket of rootless docker in
+// XDG_RUNTIME_DIR if the socket of the system does not exist. It is the empty
+// string if none is found, in which case the socket of the system is used.
+func DefaultDockerHost() string {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host
+	}
+
+	host, err := dockerContextHost(config.Dir())
+	if err != nil {
+		log.Debug().Err(err).Msg("could not read the docker context")
+	} else if host != "" {
+		return host
+	}
+
+	if _, err := os.Stat(dockerSocket); err == nil {
+		return ""
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		socket := filepath.Join(dir, "docker.sock")
+		if _, err := os.Stat(socket); err == nil {
+			return "unix://" + socket
+		}
+	}
+	return ""
+}
+
+// dockerContextHost returns the address of the docker daemon of the docker context
+// in use, from the docker config in configDir, or the empty string if it is the
+// default context
+func dockerContextHost(configDir string) (string, error) {
+	name := os.Getenv("DOCKER_CONTEXT")
+	if name == "" {
+		var conf struct {
+			CurrentContext string `json:"currentContext"`
+		}
+		if err := readDockerConfigFile(filepath.Join(configDir, config.ConfigFileName), &conf); err != nil {
+			return "", err
+		}
+		name = conf.CurrentContext
+	}
+	if name == "" || name == defaultDockerContext {
+		return "", nil
+	}
+
+	// the metadata of a context is stored under the digest of its name
+	var meta struct {
+		Endpoints map[string]struct {
+			Host string
+		}
+	}
+	fn := filepath.Join(configDir, "contexts", "meta", digest.FromString(name).Encoded(), "meta.json")
+	if err := readDockerConfigFile(fn, &meta); err != nil {
+		return "", err
+	}
+	if meta.Endpoints["docker"].Host == "" {
+		return "", errors.Errorf("docker context %s does not exist", name)
+	}
+	return meta.Endpoints["docker"].Host, nil
+}
+
+// readDockerConfigFile decodes the JSON file fn of the docker config into v, leaving
+// v as it is if fn does not exist
+func readDockerConfigFile(fn string, v interface{}) error {
+	// the docker config belongs to the user
+	data, err := ioutil.ReadFile(fn) // #nosec
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(json.Unmarshal(data, v), "file = %s", fn)
+}
+
+// NewDockerClient creates a client of the docker daemon at host, or of the
+// daemon given by DockerHost or found by DefaultDockerHost if host is empty
+func NewDockerClient(ctx context.Context, host string) (*client.Client, error) {
+	daemon := host
+	if daemon == "" {
+		daemon = DockerHost
+	}
+	if daemon == "" {
+		daemon = DefaultDockerHost()
+	}
+
+	opts := []func(*client.Client) error{client.FromEnv}
+	switch {
+	case strings.HasPrefix(daemon, "ssh://"):
+		dial, err := sshDialer(daemon)
+		if err != nil {
+			return nil, err
+		}
+		// the host is only a name for the daemon, which is reached over ssh
+		opts = append(opts, client.WithHost("http://docker.example.com"), client.WithDialContext(dial))
+	case daemon != "":
+		opts = append(opts, client.WithHost(daemon))
+	}
+	if DockerAPIVersion != "" {
+		opts = append(opts, client.WithVersion(DockerAPIVersion))
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		if daemon == "" {
+			return nil, utils.WithClass(errors.Wrap(err, "could not create client for docker daemon"), utils.ClassDaemon)
+		}
+		return nil, utils.WithClass(errors.Wrapf(err, "could not create client for %s", daemon), utils.ClassDaemon)
+	}
+
+	if DockerAPIVersion == "" {
+		cli.NegotiateAPIVersion(ctx)
+	}
+
+	return cli, nil
+}
@@ -0,0 +1,112 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dconfig "github.com/docker/cli/cli/config"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+)
+
+func TestNewDockerClient(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("API-Version", "1.30")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer daemon.Close()
+	host := "tcp://" + daemon.Listener.Addr().String()
+
+	if v, ok := os.LookupEnv("DOCKER_API_VERSION"); ok {
+		require.NoError(os.Unsetenv("DOCKER_API_VERSION"))
+		defer func() { assert.NoError(os.Setenv("DOCKER_API_VERSION", v)) }()
+	}
+
+	cli, err := distribution.NewDockerClient(context.Background(), host)
+	require.NoError(err)
+	assert.Equal("1.30", cli.ClientVersion())
+
+	distribution.DockerAPIVersion = "1.37"
+	defer func() { distribution.DockerAPIVersion = "" }()
+
+	cli, err = distribution.NewDockerClient(context.Background(), host)
+	require.NoError(err)
+	assert.Equal("1.37", cli.ClientVersion())
+
+	_, err = distribution.NewDockerClient(context.Background(), "not a host")
+	assert.Error(err)
+}
+
+func TestNewDockerClientSSH(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, host := range []string{"ssh://", "ssh://host/path", "ssh://host?x=1"} {
+		_, err := distribution.NewDockerClient(context.Background(), host)
+		assert.Error(err, host)
+	}
+}
+
+func TestDefaultDockerHost(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	for _, env := range []string{"DOCKER_HOST", "DOCKER_CONTEXT"} {
+		if v, ok := os.LookupEnv(env); ok {
+			require.NoError(os.Unsetenv(env))
+			defer func(env, v string) { assert.NoError(os.Setenv(env, v)) }(env, v)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "docker-config")
+	require.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	old := dconfig.Dir()
+	dconfig.SetDir(dir)
+	defer dconfig.SetDir(old)
+
+	// the context in use is read from the config
+	meta := filepath.Join(dir, "contexts", "meta", digest.FromString("remote").Encoded())
+	require.NoError(os.MkdirAll(meta, 0700))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(meta, "meta.json"),
+		[]byte(`{"Name":"remote","Endpoints":{"docker":{"Host":"ssh://user@remote","SkipTLSVerify":false}}}`),
+		0600,
+	))
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(`{"currentContext":"remote"}`), 0600))
+	assert.Equal("ssh://user@remote", distribution.DefaultDockerHost())
+
+	// DOCKER_CONTEXT selects another context, and DOCKER_HOST takes precedence
+	require.NoError(os.Setenv("DOCKER_CONTEXT", "default"))
+	defer func() { assert.NoError(os.Unsetenv("DOCKER_CONTEXT")) }()
+	assert.NotEqual("ssh://user@remote", distribution.DefaultDockerHost())
+
+	require.NoError(os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2375"))
+	defer func() { assert.NoError(os.Unsetenv("DOCKER_HOST")) }()
+	assert.Equal("tcp://127.0.0.1:2375", distribution.DefaultDockerHost())
+}
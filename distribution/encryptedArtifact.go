@@ -0,0 +1,146 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+)
+
+const (
+	// AnnotationTitle is the annotation that gives the filename of a blob of an
+	// artifact, as used by oras
+	AnnotationTitle = "org.opencontainers.image.title"
+
+	// AnnotationWrappedKey is the annotation on an encrypted blob of an artifact
+	// that holds its wrapped key
+	AnnotationWrappedKey = "com.senetas.crypto.key"
+)
+
+// NewEncryptedArtifact encrypts the files of an artifact of any type, such as a
+// helm chart or a WASM module, into dir. It returns the manifest of the artifact,
+// in which the wrapped key of each blob is recorded in an annotation on its
+// descriptor, and the blobs to upload with it.
+func NewEncryptedArtifact(
+	artifactType string,
+	files []*NoncryptedBlob,
+	dir string,
+	opts *crypto.Opts,
+) (a *ArtifactManifest, blobs []Blob, err error) {
+	switch {
+	case opts.Compat:
+		err = errors.New("an artifact may not be encrypted with a compat manifest")
+	case opts.Algos == crypto.None:
+		err = errors.Errorf("an artifact may not be encrypted with %s", opts.Algos)
+	}
+	if err != nil {
+		return
+	}
+
+	config, err := NewEmptyConfig(dir)
+	if err != nil {
+		return
+	}
+
+	encrypted := make([]Blob, len(files))
+	keys := make([]string, len(files))
+	for i, f := range files {
+		var dec *crypto.DeCrypto
+		if dec, err = crypto.NewDecrypto(opts); err != nil {
+			return
+		}
+
+		plain := &decryptedBlob{NoncryptedBlob: f, DeCrypto: dec}
+		var enc EncryptedBlob
+		if enc, err = plain.EncryptBlob(opts, filepath.Join(dir, strconv.Itoa(i)+".aes")); err != nil {
+			return
+		}
+
+		var key []byte
+		if key, err = json.Marshal(enc.(*encryptedBlobNew).EnCrypto); err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+
+		encrypted[i], keys[i] = enc, string(key)
+	}
+
+	a = NewArtifactManifest(artifactType, config, encrypted, nil)
+	for i := range a.Layers {
+		a.Layers[i].Annotations = map[string]string{
+			AnnotationWrappedKey: keys[i],
+			AnnotationTitle:      filepath.Base(files[i].Filename),
+		}
+	}
+	a.Annotations = crypto.Annotations(opts)
+
+	return a, append([]Blob{config}, encrypted...), nil
+}
+
+// DecryptArtifactBlob decrypts the blob of an artifact with descriptor desc, which
+// has been downloaded to filename, to outfile. A blob without a wrapped key is
+// returned as it is, unless its media type is that of an encrypted blob, so that
+// a blob whose key has been stripped from the manifest is not taken for a
+// decrypted one.
+func DecryptArtifactBlob(desc Descriptor, filename, outfile string, opts *crypto.Opts) (_ Blob, err error) {
+	blob := newPlainBlob(filename, desc.Digest, desc.Size, desc.MediaType)
+
+	key, ok := desc.Annotations[AnnotationWrappedKey]
+	if !ok {
+		if encryptedArtifactType(desc.MediaType, opts) {
+			return nil, errors.Errorf("%s is encrypted but has no key", desc.Digest)
+		}
+		return blob, nil
+	}
+
+	ek := &crypto.EnCrypto{}
+	if err = json.Unmarshal([]byte(key), ek); err != nil {
+		err = errors.Wrapf(err, "%s does not have a valid key", desc.Digest)
+		return
+	}
+
+	eb := &encryptedBlobNew{NoncryptedBlob: blob, EnCrypto: ek}
+	return eb.DecryptBlob(opts, outfile)
+}
+
+// ArtifactFilename is the name to give the file of a blob of an artifact, which is
+// its title if that is a plain filename and its digest otherwise
+func ArtifactFilename(desc Descriptor) string {
+	title := desc.Annotations[AnnotationTitle]
+	if title == "" || title == "." || title == ".." || filepath.Base(title) != title ||
+		strings.ContainsAny(title, `/\`) {
+		return desc.Digest.Encoded()
+	}
+	return title
+}
+
+// encryptedArtifactType is whether the blobs of mediaType are encrypted, which
+// they are if it has the suffix of encrypted media types, or is an encrypted
+// layer type. Other media types, including those that are not registered such as
+// application/octet-stream, are those of plain blobs.
+func encryptedArtifactType(mediaType string, opts *crypto.Opts) bool {
+	if strings.HasSuffix(mediaType, crypto.DefaultMediaTypeSuffix) ||
+		strings.HasSuffix(mediaType, opts.MediaTypeSuffix()) {
+		return true
+	}
+	info, err := LookupMediaType(mediaType)
+	return err == nil && info.Encrypted
+}
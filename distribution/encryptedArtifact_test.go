@@ -0,0 +1,123 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestEncryptedArtifact(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts.SetPassphrase(passphrase)
+
+	chart := filepath.Join(dir, "mychart-0.1.0.tgz")
+	require.NoError(ioutil.WriteFile(chart, []byte("not really a chart"), 0600))
+	plain, err := distribution.NewFileBlob(chart, "application/vnd.cncf.helm.chart.content.v1.tar+gzip")
+	require.NoError(err)
+
+	artifact, blobs, err := distribution.NewEncryptedArtifact(
+		"application/vnd.cncf.helm.config.v1+json",
+		[]*distribution.NoncryptedBlob{plain},
+		dir,
+		opts,
+	)
+	require.NoError(err)
+	require.Len(blobs, 2)
+	require.Len(artifact.Layers, 1)
+	assert.Equal(plain.MediaType+crypto.DefaultMediaTypeSuffix, artifact.Layers[0].MediaType)
+	assert.Equal("mychart-0.1.0.tgz", distribution.ArtifactFilename(artifact.Layers[0]))
+	assert.NotEqual(plain.Digest, artifact.Layers[0].Digest)
+
+	// the artifact as it is downloaded
+	data, err := json.Marshal(artifact)
+	require.NoError(err)
+	pulled := &distribution.ArtifactManifest{}
+	require.NoError(json.Unmarshal(data, pulled))
+
+	outfile := filepath.Join(dir, "out", distribution.ArtifactFilename(pulled.Layers[0]))
+	dec, err := distribution.DecryptArtifactBlob(pulled.Layers[0], blobs[1].GetFilename(), outfile, opts)
+	require.NoError(err)
+	assert.Equal(plain.Digest, dec.GetDigest())
+
+	actual, err := ioutil.ReadFile(outfile)
+	require.NoError(err)
+	assert.Equal("not really a chart", string(actual))
+
+	// blobs without a key are returned as they are if they are of a plain media
+	// type, whether or not it is registered
+	unencrypted := distribution.Descriptor{Digest: plain.Digest, Size: plain.Size}
+	for _, mediaType := range []string{
+		distribution.MediaTypeOCILayer,
+		plain.MediaType,
+		"application/octet-stream",
+	} {
+		unencrypted.MediaType = mediaType
+		blob, err := distribution.DecryptArtifactBlob(unencrypted, chart, outfile, opts)
+		require.NoError(err, mediaType)
+		assert.Equal(chart, blob.GetFilename(), mediaType)
+	}
+
+	// but not if they are of an encrypted one, as their keys may have been stripped
+	for _, mediaType := range []string{
+		distribution.MediaTypeOCILayer + crypto.DefaultMediaTypeSuffix,
+		distribution.MediaTypeOCILayer + "+enc",
+		"application/octet-stream" + crypto.DefaultMediaTypeSuffix,
+		pulled.Layers[0].MediaType,
+	} {
+		unencrypted.MediaType = mediaType
+		_, err = distribution.DecryptArtifactBlob(unencrypted, chart, outfile, opts)
+		assert.Error(err, mediaType)
+	}
+
+	_, _, err = distribution.NewEncryptedArtifact("", []*distribution.NoncryptedBlob{plain}, dir, optsCompat)
+	assert.Error(err)
+}
+
+func TestArtifactFilename(t *testing.T) {
+	d := digest.FromString("blob")
+	for title, expected := range map[string]string{
+		"chart.tgz":     "chart.tgz",
+		"":              d.Encoded(),
+		"..":            d.Encoded(),
+		"../etc/passwd": d.Encoded(),
+		"/etc/passwd":   d.Encoded(),
+		`..\evil`:       d.Encoded(),
+	} {
+		desc := distribution.Descriptor{
+			Digest:      d,
+			Annotations: map[string]string{distribution.AnnotationTitle: title},
+		}
+		assert.Equal(t, expected, distribution.ArtifactFilename(desc), title)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+)
+
+// AnnotationCreated is the annotation of a key envelope artifact that gives when it
+// was made, by which the newest of the envelopes that refer to an image is found
+const AnnotationCreated = "org.opencontainers.image.created"
+
+// KeyEnvelope holds the wrapped data keys of an encrypted image, indexed by the
+// digest of the blob that each key encrypts. It allows the keys to be stored in
+// an artifact that refers to the image, rather than in the image manifest itself.
+type KeyEnvelope struct {
+	Keys map[digest.Digest]*crypto.EnCrypto `json:"keys"`
+}
+
+// NewKeyEnvelope reads a key envelope
+func NewKeyEnvelope(r io.Reader) (e *KeyEnvelope, err error) {
+	e = &KeyEnvelope{}
+	if err = json.NewDecoder(r).Decode(e); err != nil {
+		err = errors.Wrap(err, "error unmarshalling key envelope")
+		return
+	}
+	return
+}
+
+// Artifact writes the envelope and an empty config to files in dir and returns
+// the artifact manifest that attaches them to subject, along with the blobs that
+// must be uploaded before the manifest
+func (e *KeyEnvelope) Artifact(
+	dir string,
+	subject *Descriptor,
+) (
+	a *ArtifactManifest,
+	blobs []Blob,
+	err error,
+) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	keys, err := writeBlobFile(filepath.Join(dir, "keys.json"), MediaTypeKeyEnvelope, data)
+	if err != nil {
+		return
+	}
+
+	config, err := NewEmptyConfig(dir)
+	if err != nil {
+		return
+	}
+
+	a = NewArtifactManifest(MediaTypeKeyEnvelope, config, []Blob{keys}, subject)
+	a.Annotations = map[string]string{AnnotationCreated: time.Now().UTC().Format(time.RFC3339Nano)}
+	return a, []Blob{config, keys}, nil
+}
+
+// Encrypted returns true if any of the blobs in the manifest carry key data
+func (m *ImageManifest) Encrypted() bool {
+	if _, ok := m.Config.(EncryptedBlob); ok {
+		return true
+	}
+	for _, l := range m.Layers {
+		if _, ok := l.(EncryptedBlob); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DetachKeys moves the wrapped keys of an encrypted manifest into a key envelope,
+// returning a manifest whose blobs are plain descriptors
+func (m *ImageManifest) DetachKeys() (out *ImageManifest, e *KeyEnvelope, err error) {
+	out = &ImageManifest{
+		SchemaVersion: m.SchemaVersion,
+		MediaType:     m.MediaType,
+		Layers:        make([]Blob, len(m.Layers)),
+		Annotations:   m.Annotations,
+		DirName:       m.DirName,
+	}
+	e = &KeyEnvelope{Keys: make(map[digest.Digest]*crypto.EnCrypto)}
+
+	if out.Config, err = e.detach(m.Config); err != nil {
+		return
+	}
+
+	for i := 0; i < len(m.Layers) && err == nil; i++ {
+		out.Layers[i], err = e.detach(m.Layers[i])
+	}
+
+	return
+}
+
+func (e *KeyEnvelope) detach(b Blob) (Blob, error) {
+	switch blob := b.(type) {
+	case *encryptedConfigNew:
+		e.Keys[blob.Digest] = blob.EnCrypto
+		return blob.NoncryptedBlob, nil
+	case *encryptedBlobNew:
+		if len(blob.Chunks) > 0 {
+			return nil, errors.New("keys may not be detached from a manifest with split layers")
+		}
+		e.Keys[blob.Digest] = blob.EnCrypto
+		return blob.NoncryptedBlob, nil
+	case *encryptedConfigCompat, *encryptedBlobCompat:
+		return nil, errors.New("keys may not be detached from a compat manifest")
+	case *NoncryptedBlob:
+		return blob, nil
+	default:
+		return nil, errors.Errorf("blob is of wrong type: %T", blob)
+	}
+}
+
+// AttachKeys restores the keys in a key envelope to the blobs of the manifest
+// that they encrypt. It is an error for the envelope to hold a key for a blob
+// that is not in the manifest.
+func (m *ImageManifest) AttachKeys(e *KeyEnvelope) error {
+	used := make(map[digest.Digest]bool)
+
+	if blob, ok := m.Config.(*NoncryptedBlob); ok {
+		if ek, ok := e.Keys[blob.Digest]; ok {
+			m.Config = &encryptedConfigNew{NoncryptedBlob: blob, EnCrypto: ek}
+			used[blob.Digest] = true
+		}
+	}
+
+	for i, l := range m.Layers {
+		if blob, ok := l.(*NoncryptedBlob); ok {
+			if ek, ok := e.Keys[blob.Digest]; ok {
+				m.Layers[i] = &encryptedBlobNew{NoncryptedBlob: blob, EnCrypto: ek}
+				used[blob.Digest] = true
+			}
+		}
+	}
+
+	if len(used) != len(e.Keys) {
+		return errors.New("key envelope does not match the manifest")
+	}
+
+	return nil
+}
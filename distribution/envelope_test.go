@@ -0,0 +1,142 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func mkEncryptedManifest(t *testing.T, dir string, opts *crypto.Opts) *distribution.ImageManifest {
+	require := require.New(t)
+
+	size, d, fn, err := mkConfigFile(t, dir)
+	require.NoError(err)
+	dec, err := crypto.NewDecrypto(opts)
+	require.NoError(err)
+	config, err := distribution.NewConfig(fn, d, size, dec).EncryptBlob(opts, fn+".aes")
+	require.NoError(err)
+
+	size, d, fn, err = mkRandFile(t, dir)
+	require.NoError(err)
+	dec, err = crypto.NewDecrypto(opts)
+	require.NoError(err)
+	layer, err := distribution.NewLayer(fn, d, size, dec).EncryptBlob(opts, fn+".aes")
+	require.NoError(err)
+
+	return &distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Config:        config,
+		Layers:        []distribution.Blob{layer},
+		DirName:       dir,
+	}
+}
+
+func TestDetachAttachKeys(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts.SetPassphrase(passphrase)
+	manifest := mkEncryptedManifest(t, dir, opts)
+	require.True(manifest.Encrypted())
+
+	detached, envelope, err := manifest.DetachKeys()
+	require.NoError(err)
+	assert.False(detached.Encrypted())
+	assert.Len(envelope.Keys, 2)
+
+	data, err := json.Marshal(detached)
+	require.NoError(err)
+	assert.False(strings.Contains(string(data), "crypto"))
+
+	pulled := &distribution.ImageManifest{}
+	require.NoError(json.Unmarshal(data, pulled))
+	assert.False(pulled.Encrypted())
+
+	envData, err := json.Marshal(envelope)
+	require.NoError(err)
+	envelope2, err := distribution.NewKeyEnvelope(bytes.NewReader(envData))
+	require.NoError(err)
+
+	require.NoError(pulled.AttachKeys(envelope2))
+	assert.True(pulled.Encrypted())
+	assert.NoError(pulled.DecryptKeys(nil, opts))
+
+	// an envelope for a different image must be rejected
+	other := mkEncryptedManifest(t, filepath.Join(dir, "other"), opts)
+	_, otherEnvelope, err := other.DetachKeys()
+	require.NoError(err)
+	pulled = &distribution.ImageManifest{}
+	require.NoError(json.Unmarshal(data, pulled))
+	assert.EqualError(pulled.AttachKeys(otherEnvelope), "key envelope does not match the manifest")
+}
+
+func TestDetachKeysCompat(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	optsCompat.SetPassphrase(passphrase)
+	manifest := mkEncryptedManifest(t, dir, optsCompat)
+
+	_, _, err := manifest.DetachKeys()
+	assert.EqualError(err, "keys may not be detached from a compat manifest")
+}
+
+func TestKeyEnvelopeArtifact(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	opts.SetPassphrase(passphrase)
+	_, envelope, err := mkEncryptedManifest(t, dir, opts).DetachKeys()
+	require.NoError(err)
+
+	subject := &distribution.Descriptor{MediaType: distribution.MediaTypeManifest}
+	artifact, blobs, err := envelope.Artifact(dir, subject)
+	require.NoError(err)
+
+	assert.Equal(distribution.MediaTypeKeyEnvelope, artifact.ArtifactType)
+	assert.Equal(distribution.MediaTypeEmptyJSON, artifact.Config.MediaType)
+	assert.Equal("sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a", artifact.Config.Digest.String())
+	assert.Equal(subject, artifact.Subject)
+	require.Len(artifact.Layers, 1)
+	assert.Equal(distribution.MediaTypeKeyEnvelope, artifact.Layers[0].MediaType)
+	assert.Len(blobs, 2)
+
+	created, err := time.Parse(time.RFC3339Nano, artifact.Annotations[distribution.AnnotationCreated])
+	require.NoError(err)
+	assert.WithinDuration(time.Now(), created, time.Minute)
+}
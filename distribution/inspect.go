@@ -0,0 +1,122 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+)
+
+// ManifestInfo describes an image manifest and how its blobs are encrypted, as far
+// as the manifest tells without the passphrase
+type ManifestInfo struct {
+	Digest      digest.Digest     `json:"digest"`
+	MediaType   string            `json:"mediaType"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Config      BlobInfo          `json:"config"`
+	Layers      []BlobInfo        `json:"layers"`
+	// KeyEnvelopes are the artifacts that hold the detached keys of the image
+	KeyEnvelopes []Descriptor `json:"keyEnvelopes,omitempty"`
+}
+
+// BlobInfo describes a blob of a manifest and how it is encrypted
+type BlobInfo struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	Encrypted bool          `json:"encrypted"`
+	// Detached is set for an encrypted blob whose key is in a key envelope rather
+	// than in the manifest, so that its parameters are not known
+	Detached bool `json:"detached,omitempty"`
+	// Compat is set for a blob whose key is in its URLs, as in a compat manifest
+	Compat bool `json:"compat,omitempty"`
+	// Chunks is the number of blobs that the layer is split into, if it is split
+	Chunks        int          `json:"chunks,omitempty"`
+	Algos         crypto.Algos `json:"algos,omitempty"`
+	Cipher        string       `json:"cipher,omitempty"`
+	KDF           string       `json:"kdf,omitempty"`
+	KDFIterations int          `json:"kdfIterations,omitempty"`
+	KeyWrap       string       `json:"keyWrap,omitempty"`
+	Version       int          `json:"version,omitempty"`
+	KeyID         string       `json:"keyId,omitempty"`
+}
+
+// Inspect describes the manifest and the encryption of each of its blobs from the
+// manifest alone, so that no blob need be downloaded
+func (m *ImageManifest) Inspect() (info *ManifestInfo, err error) {
+	info = &ManifestInfo{
+		Digest:      m.Digest,
+		MediaType:   m.MediaType,
+		Annotations: m.Annotations,
+		Layers:      make([]BlobInfo, len(m.Layers)),
+	}
+
+	if info.Config, err = inspectBlob(m.Config); err != nil {
+		return nil, err
+	}
+	for i, l := range m.Layers {
+		if info.Layers[i], err = inspectBlob(l); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+func inspectBlob(b Blob) (info BlobInfo, err error) {
+	info = BlobInfo{
+		Digest:    b.GetDigest(),
+		MediaType: b.GetMediaType(),
+		Size:      b.GetSize(),
+	}
+
+	var ek crypto.EnCrypto
+	switch blob := b.(type) {
+	case *encryptedConfigNew:
+		ek = *blob.EnCrypto
+	case *encryptedBlobNew:
+		ek = *blob.EnCrypto
+		info.Chunks = len(blob.Chunks)
+	case *encryptedConfigCompat:
+		ek, err = crypto.ParseEncryptoCompat(blob.URLs)
+		info.Compat = true
+	case *encryptedBlobCompat:
+		ek, err = crypto.ParseEncryptoCompat(blob.URLs)
+		info.Compat = true
+	case *NoncryptedBlob:
+		// the key of an encrypted blob without one has been detached
+		var mt MediaTypeInfo
+		if mt, err = LookupMediaType(blob.MediaType); err != nil {
+			return
+		}
+		info.Encrypted = mt.Encrypted
+		info.Detached = mt.Encrypted
+		return
+	default:
+		err = errors.Errorf("blob is of wrong type: %T", blob)
+	}
+	if err != nil {
+		return
+	}
+
+	info.Encrypted = true
+	info.Algos = ek.Algos
+	info.Cipher, info.KDF, info.KeyWrap = crypto.Describe(ek.Algos)
+	info.KDFIterations = ek.Iters
+	info.Version = ek.Version
+	info.KeyID = ek.KeyID()
+	return
+}
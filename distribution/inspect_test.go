@@ -0,0 +1,87 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestInspect(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	// the manifest is inspected as it is pulled, without the passphrase
+	pulled := func(m *distribution.ImageManifest) *distribution.ImageManifest {
+		data, err := json.Marshal(m)
+		require.NoError(err)
+		out := &distribution.ImageManifest{}
+		require.NoError(json.Unmarshal(data, out))
+		return out
+	}
+
+	opts.SetPassphrase(passphrase)
+	manifest := mkEncryptedManifest(t, dir, opts)
+	info, err := pulled(manifest).Inspect()
+	require.NoError(err)
+	require.Len(info.Layers, 1)
+
+	for _, b := range []distribution.BlobInfo{info.Config, info.Layers[0]} {
+		assert.True(b.Encrypted)
+		assert.False(b.Detached)
+		assert.False(b.Compat)
+		assert.Equal(crypto.Pbkdf2Aes256Gcm, b.Algos)
+		assert.Equal("PBKDF2-HMAC-SHA256", b.KDF)
+		assert.Equal(int(crypto.Pbkdf2Iter), b.KDFIterations)
+		assert.Len(b.KeyID, 12)
+	}
+	assert.Equal(manifest.Layers[0].GetDigest(), info.Layers[0].Digest)
+	assert.Equal(manifest.Layers[0].GetSize(), info.Layers[0].Size)
+	assert.NotEqual(info.Config.KeyID, info.Layers[0].KeyID)
+
+	// the encryption is still described once the keys are decrypted
+	decrypted := pulled(manifest)
+	require.NoError(decrypted.DecryptKeys(nil, opts))
+	assert.Equal(info, decrypted.Encryption)
+
+	detached, _, err := manifest.DetachKeys()
+	require.NoError(err)
+	info, err = pulled(detached).Inspect()
+	require.NoError(err)
+	assert.True(info.Layers[0].Encrypted)
+	assert.True(info.Layers[0].Detached)
+	assert.Empty(info.Layers[0].KeyID)
+
+	optsCompat.SetPassphrase(passphrase)
+	info, err = pulled(mkEncryptedManifest(t, filepath.Join(dir, "compat"), optsCompat)).Inspect()
+	require.NoError(err)
+	assert.True(info.Layers[0].Encrypted)
+	assert.True(info.Layers[0].Compat)
+	assert.Equal(crypto.Pbkdf2Aes256Gcm, info.Layers[0].Algos)
+	assert.Len(info.Layers[0].KeyID, 12)
+}
@@ -42,7 +42,7 @@ type keyDecryptedBlob struct {
 }
 
 func (kb *keyDecryptedBlob) DecryptFile(opts *crypto.Opts, outfile string) (DecryptedBlob, error) {
-	r, err := kb.ReadCloser()
+	r, err := readProgress(kb, utils.ProgressDecrypt)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -82,7 +82,7 @@ func (kb *keyDecryptedBlob) DecryptFile(opts *crypto.Opts, outfile string) (Decr
 	return &decryptedBlob{
 		NoncryptedBlob: &NoncryptedBlob{
 			Size:      n,
-			MediaType: kb.MediaType,
+			MediaType: plainMediaType(kb.MediaType),
 			Digest:    dgst,
 			Filename:  outfile,
 		},
@@ -107,7 +107,7 @@ type keyDecryptedConfig struct {
 }
 
 func (kc *keyDecryptedConfig) DecryptFile(opts *crypto.Opts, outname string) (DecryptedBlob, error) {
-	r, err := kc.ReadCloser()
+	r, err := readProgress(kc, utils.ProgressDecrypt)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -132,11 +132,14 @@ func (kc *keyDecryptedConfig) DecryptFile(opts *crypto.Opts, outname string) (De
 		return nil, err
 	}
 
-	cw := &utils.CounterWriter{Writer: mw}
-	nnw := utils.NewNoNewlineWriter(cw)
+	data, err := dc.Bytes()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 
-	if err = json.NewEncoder(nnw).Encode(dc); err != nil {
-		return nil, err
+	cw := &utils.CounterWriter{Writer: mw}
+	if _, err = cw.Write(data); err != nil {
+		return nil, errors.WithStack(err)
 	}
 
 	dgst := digester.Digest()
@@ -144,7 +147,7 @@ func (kc *keyDecryptedConfig) DecryptFile(opts *crypto.Opts, outname string) (De
 	return &decryptedConfig{
 		NoncryptedBlob: &NoncryptedBlob{
 			Size:      int64(cw.Count),
-			MediaType: kc.MediaType,
+			MediaType: plainMediaType(kc.MediaType),
 			Digest:    dgst,
 			Filename:  outname,
 		},
@@ -0,0 +1,214 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// ociLayoutVersion is the version of the OCI image layout that is written
+const ociLayoutVersion = `{"imageLayoutVersion":"1.0.0"}`
+
+// WriteOCILayout writes a manifest and its blobs to the OCI image layout at dir,
+// which is created if it does not exist. The manifest is recorded in the index of
+// the layout under the name tag, replacing any manifest already recorded under it.
+func WriteOCILayout(dir, tag string, manifest *ImageManifest) (_ *Descriptor, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		err = errors.Wrapf(err, "could not create: %s", dir)
+		return
+	}
+
+	layoutfile := filepath.Join(dir, "oci-layout")
+	if _, err = os.Stat(layoutfile); os.IsNotExist(err) {
+		err = ioutil.WriteFile(layoutfile, []byte(ociLayoutVersion), 0644)
+	}
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	for _, b := range append([]Blob{manifest.Config}, manifest.LayerBlobs()...) {
+		if err = copyBlobToLayout(dir, b); err != nil {
+			return
+		}
+	}
+	log.Info().Msg("Layers and config written successfully.")
+
+	body, err := utils.CanonicalJSON(manifest)
+	if err != nil {
+		return
+	}
+
+	desc := Descriptor{
+		MediaType:   MediaTypeManifest,
+		Digest:      digest.Canonical.FromBytes(body),
+		Size:        int64(len(body)),
+		Annotations: map[string]string{AnnotationRefName: tag},
+	}
+
+	name, err := ociBlobName(desc.Digest)
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, name), body, 0644); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if err = addToLayoutIndex(dir, desc); err != nil {
+		return
+	}
+	log.Info().Msgf("Successfully wrote manifest: %s.", desc.Digest)
+
+	return &desc, nil
+}
+
+// ReadOCILayout reads the manifest of the image that ref refers to from the OCI
+// image layout at dir, such as one written by WriteOCILayout. The filenames of its
+// blobs are set to their location in the layout.
+func ReadOCILayout(dir string, ref names.NamedTaggedRepository) (manifest *ImageManifest, err error) {
+	index := &ociIndex{}
+	if err = readOCIFile(filepath.Join(dir, "index.json"), index); err != nil {
+		return
+	}
+
+	desc, err := selectOCIManifest(index, ref)
+	if err != nil {
+		return
+	}
+
+	if desc.MediaType != MediaTypeManifest {
+		err = errors.Errorf("unsupported manifest mediaType: %s", desc.MediaType)
+		return
+	}
+
+	name, err := ociBlobName(desc.Digest)
+	if err != nil {
+		return
+	}
+
+	// name is derived from a validated digest, so it is a file in the layout
+	body, err := ioutil.ReadFile(filepath.Join(dir, name)) // #nosec
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if d := desc.Digest.Algorithm().FromBytes(body); d != desc.Digest {
+		err = errors.Errorf("manifest %s does not match its digest", desc.Digest)
+		return
+	}
+
+	manifest = &ImageManifest{DirName: dir, Digest: desc.Digest}
+	if err = json.Unmarshal(body, manifest); err != nil {
+		err = errors.Wrapf(err, "could not decode manifest %s", desc.Digest)
+		return
+	} else if manifest.Config == nil {
+		err = errors.Errorf("manifest %s has no config", desc.Digest)
+		return
+	}
+
+	for _, b := range append([]Blob{manifest.Config}, manifest.LayerBlobs()...) {
+		if name, err = ociBlobName(b.GetDigest()); err != nil {
+			return
+		}
+		b.SetFilename(filepath.Join(dir, name))
+	}
+
+	return
+}
+
+// addToLayoutIndex records desc in the index of the OCI image layout at dir
+func addToLayoutIndex(dir string, desc Descriptor) (err error) {
+	indexfile := filepath.Join(dir, "index.json")
+
+	index := NewIndex()
+	if err = readOCIFile(indexfile, index); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return
+	}
+
+	// a name may only refer to one manifest
+	manifests := []Descriptor{}
+	for _, m := range index.Manifests {
+		if m.Annotations[AnnotationRefName] != desc.Annotations[AnnotationRefName] {
+			manifests = append(manifests, m)
+		}
+	}
+	index.Manifests = append(manifests, desc)
+
+	body, err := utils.CanonicalJSON(index)
+	if err != nil {
+		return err
+	}
+
+	return errors.WithStack(ioutil.WriteFile(indexfile, body, 0644))
+}
+
+// copyBlobToLayout copies the file of a blob into the OCI image layout at dir,
+// unless the layout already contains it
+func copyBlobToLayout(dir string, b Blob) (err error) {
+	name, err := ociBlobName(b.GetDigest())
+	if err != nil {
+		return
+	}
+
+	filename := filepath.Join(dir, name)
+	if _, err = os.Stat(filename); err == nil {
+		log.Info().Msgf("Blob %s exists.", b.GetDigest())
+		return
+	} else if !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	r, err := b.ReadCloser()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(r, err) }()
+
+	// write to a temporary file first so that the layout never holds a
+	// partially written blob under its digest
+	fh, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	digester := digest.Canonical.Digester()
+	_, err = io.Copy(io.MultiWriter(fh, digester.Hash()), r)
+	if err = utils.CheckedClose(fh, err); err != nil {
+		return utils.CleanUp(fh.Name(), errors.WithStack(err))
+	}
+
+	if digester.Digest() != b.GetDigest() {
+		return utils.CleanUp(fh.Name(), errors.Errorf("blob %s does not match its digest", b.GetDigest()))
+	}
+
+	return errors.WithStack(os.Rename(fh.Name(), filename))
+}
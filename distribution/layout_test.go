@@ -0,0 +1,117 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestWriteOCILayout(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	layout := filepath.Join(dir, "layout")
+
+	opts.SetPassphrase(passphrase)
+	manifest := mkEncryptedManifest(t, dir, opts)
+
+	desc, err := distribution.WriteOCILayout(layout, "latest", manifest)
+	require.NoError(err)
+
+	for _, b := range append([]distribution.Blob{manifest.Config}, manifest.Layers...) {
+		assert.FileExists(filepath.Join(layout, "blobs", "sha256", b.GetDigest().Hex()))
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(layout, "blobs", "sha256", desc.Digest.Hex()))
+	require.NoError(err)
+	assert.Equal(desc.Digest, desc.Digest.Algorithm().FromBytes(body))
+
+	// writing the same image under a new name adds to the index, and under an
+	// existing name replaces its entry
+	_, err = distribution.WriteOCILayout(layout, "v1", manifest)
+	require.NoError(err)
+	_, err = distribution.WriteOCILayout(layout, "latest", manifest)
+	require.NoError(err)
+
+	body, err = ioutil.ReadFile(filepath.Join(layout, "index.json"))
+	require.NoError(err)
+	index := &distribution.Index{}
+	require.NoError(json.Unmarshal(body, index))
+	require.Len(index.Manifests, 2)
+	assert.Equal("v1", index.Manifests[0].Annotations[distribution.AnnotationRefName])
+	assert.Equal("latest", index.Manifests[1].Annotations[distribution.AnnotationRefName])
+	assert.Equal(desc.Digest, index.Manifests[1].Digest)
+
+	assert.FileExists(filepath.Join(layout, "oci-layout"))
+}
+
+func TestReadOCILayout(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	layout := filepath.Join(dir, "layout")
+
+	opts.SetPassphrase(passphrase)
+	manifest := mkEncryptedManifest(t, dir, opts)
+
+	desc, err := distribution.WriteOCILayout(layout, "latest", manifest)
+	require.NoError(err)
+
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	require.NoError(err)
+	nTRep, err := names.CastToTagged(ref)
+	require.NoError(err)
+
+	read, err := distribution.ReadOCILayout(layout, nTRep)
+	require.NoError(err)
+	assert.Equal(desc.Digest, read.Digest)
+	assert.True(read.Encrypted())
+
+	for _, b := range append([]distribution.Blob{read.Config}, read.Layers...) {
+		assert.Equal(filepath.Join(layout, "blobs", "sha256", b.GetDigest().Hex()), b.GetFilename())
+	}
+
+	// the manifest is pushed as it was written
+	body, err := utils.CanonicalJSON(read)
+	require.NoError(err)
+	assert.Equal(desc.Digest, desc.Digest.Algorithm().FromBytes(body))
+
+	// an image that is not in the layout
+	other, err := reference.ParseNormalizedNamed("cryptocli/alpine:other")
+	require.NoError(err)
+	otherRep, err := names.CastToTagged(other)
+	require.NoError(err)
+	_, err = distribution.WriteOCILayout(layout, "v1", manifest)
+	require.NoError(err)
+	_, err = distribution.ReadOCILayout(layout, otherRep)
+	assert.Error(err)
+}
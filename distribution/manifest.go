@@ -22,32 +22,53 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
 	"github.com/google/uuid"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
-	pb "gopkg.in/cheggaaa/pb.v1"
 
 	"github.com/Senetas/crypto-cli/crypto"
 	"github.com/Senetas/crypto-cli/registry/names"
 	"github.com/Senetas/crypto-cli/utils"
 )
 
-const labelString = "LABEL com.senetas.crypto.enabled"
-
-var createdRE = `#\(nop\)\s+` + labelString + `=(true|false)|(#\(nop\))`
+// AnnotationEncryptedLayers is the annotation that records how many layers of
+// an image are encrypted
+const AnnotationEncryptedLayers = "com.senetas.crypto.layers.encrypted"
 
 // ImageManifest represents a docker image manifest schema v2.2
 type ImageManifest struct {
-	SchemaVersion int    `json:"schemaVersion"`
-	MediaType     string `json:"mediaType"`
-	Config        Blob   `json:"config"`
-	Layers        []Blob `json:"layers"`
-	DirName       string `json:"-"`
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        Blob              `json:"config"`
+	Layers        []Blob            `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+
+	// DirName is the directory that holds the files of the blobs of the manifest,
+	// which are not removed until the caller removes it
+	DirName string `json:"-"`
+
+	// Digest is the digest of the manifest as it was downloaded, if it was
+	Digest digest.Digest `json:"-"`
+
+	// Encryption describes the encryption of the blobs of the manifest as it was
+	// before their keys were decrypted, once they are
+	Encryption *ManifestInfo `json:"-"`
+
+	// Attestations are those about an unencrypted image that was read from an
+	// index, which are attached to the image once it is encrypted
+	Attestations []*Attestation `json:"-"`
+
+	// digests are the digests of the files in DirName that were found as they
+	// were extracted
+	digests map[string]digest.Digest
+
+	// stream processes the layers as they were read, if they were
+	stream *layerStream
 }
 
 // NewManifest creates an unencrypted manifest (with the data necessary for encryption)
@@ -59,39 +80,83 @@ func NewManifest(
 	manifest *ImageManifest,
 	err error,
 ) {
-	ctx := context.Background()
+	return NewManifestContext(context.Background(), ref, opts, tempDir)
+}
 
+// NewManifestContext creates an unencrypted manifest like NewManifest, by saving the
+// image from the docker daemon into a new directory in tempDir, using ctx for the
+// requests to the daemon
+func NewManifestContext(
+	ctx context.Context,
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+	tempDir string,
+) (
+	manifest *ImageManifest,
+	err error,
+) {
 	// create client to docker API
-	// TODO: fix hardcoded version if necessary
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion("1.37"))
+	cli, err := NewDockerClient(ctx, "")
 	if err != nil {
-		err = errors.Wrap(err, "could not create client for docker daemon")
 		return
 	}
 
+	return NewManifestFromDaemon(ctx, cli, ref, opts, tempDir)
+}
+
+// NewManifestFromDaemon creates an unencrypted manifest like NewManifestContext,
+// from the daemon that cli is a client of, which may be any daemon with a docker
+// compatible API such as podman
+func NewManifestFromDaemon(
+	ctx context.Context,
+	cli *client.Client,
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+	tempDir string,
+) (
+	manifest *ImageManifest,
+	err error,
+) {
 	// run docker inspect to optain the image ID
 	inspt, _, err := cli.ImageInspectWithRaw(ctx, ref.String())
 	if err != nil {
-		err = errors.WithStack(err)
+		err = utils.WithClass(errors.WithStack(err), utils.ClassDaemon)
 		return
 	}
 
 	// docker save the image to an archive (as a ReadCloser)
 	imageTar, err := cli.ImageSave(ctx, []string{inspt.ID})
 	if err != nil {
-		err = errors.WithStack(err)
+		err = utils.WithClass(errors.WithStack(err), utils.ClassDaemon)
 		return
 	}
 	defer func() { err = utils.CheckedClose(imageTar, err) }()
 
-	// determine which layers need to be encrypted
-	layers, err := layersToEncrypt(ctx, cli, inspt)
-	if err != nil {
-		return
+	diffIDs := make([]digest.Digest, len(inspt.RootFS.Layers))
+	for i, l := range inspt.RootFS.Layers {
+		diffIDs[i] = digest.Digest(l)
 	}
 
-	log.Debug().Msgf("The following layers are to be encrypted: %v", layers)
+	return newManifestFromSave(ctx, imageTar, inspt.Size, digest.Digest(inspt.ID), diffIDs, opts, tempDir)
+}
 
+// newManifestFromSave creates an unencrypted manifest from r, the archive that
+// docker save made of the image with the config digest id and the layer diffIDs,
+// of which size is the size. The config and layers are known by their digests as
+// they are extracted, so if opts.Stream is set each layer is encrypted while the
+// rest of the archive is extracted, once the config has been.
+func newManifestFromSave(
+	ctx context.Context,
+	r io.Reader,
+	size int64,
+	id digest.Digest,
+	diffIDs []digest.Digest,
+	opts *crypto.Opts,
+	tempDir string,
+) (
+	manifest *ImageManifest,
+	err error,
+) {
 	// output manifest
 	manifest = &ImageManifest{
 		SchemaVersion: 2,
@@ -99,19 +164,79 @@ func NewManifest(
 		DirName:       filepath.Join(tempDir, uuid.New().String()),
 	}
 
+	stream := newLayerStream(ctx, opts, diffIDs)
+	defer func() {
+		if err != nil {
+			stream.stop()
+			return
+		}
+		stream.finish()
+	}()
+
+	// the layers to encrypt are chosen as soon as the config is extracted, and the
+	// layers are encrypted as they are, if they are streamed
+	onFile := func(path string, d digest.Digest) error {
+		if stream == nil {
+			return nil
+		}
+		if d != id {
+			stream.add(path, d)
+			return nil
+		}
+		config := &ociConfig{}
+		if err := readOCIFile(path, config); err != nil {
+			return err
+		}
+		layers, err := ociLayersToEncrypt(config, opts)
+		if err != nil {
+			return err
+		}
+		stream.choose(layers)
+		return nil
+	}
+
 	// extract image archive and fill out manifest
-	if err = extractTarBall(imageTar, inspt.Size, manifest); err != nil {
+	if err = extractTarBall(r, size, manifest, onFile); err != nil {
 		return
 	}
 
+	// read the archive manifest
+	// manifestfile consists of information that is local to the os, or supplied by the user or the
+	// docker daemon. Thus, assuming they are not compromised, it is safe to open
+	manifestfile := filepath.Join(manifest.DirName, "manifest.json")
+	manifestFH, err := os.Open(manifestfile) // #nosec
+	defer func() { err = utils.CheckedClose(manifestFH, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "could not open file: %s", manifestfile)
+		return
+	}
+
+	image, err := NewImageArchiveManifest(manifestFH)
+	if err != nil {
+		return
+	}
+
+	// determine which layers need to be encrypted, from the history in the config,
+	// which unlike the history given by the daemon records which entries are empty
+	// layers, as is needed for images built by BuildKit
+	config := &ociConfig{}
+	if err = readOCIFile(filepath.Join(manifest.DirName, image.Config), config); err != nil {
+		return
+	}
+
+	layers, err := ociLayersToEncrypt(config, opts)
+	if err != nil {
+		return
+	}
+
+	log.Debug().Msgf("The following layers are to be encrypted: %v", layers)
+
+	// the layers are chosen here if the config was not known as it was extracted
+	stream.choose(layers)
+	manifest.stream = stream
+
 	// make the Blob structs for the manifest
-	manifest.Config, manifest.Layers, err = mkBlobs(
-		ref.Path(),
-		ref.Tag(),
-		manifest.DirName,
-		layers,
-		opts,
-	)
+	manifest.Config, manifest.Layers, err = mkBlobs(manifest, layers, image, opts)
 
 	return
 }
@@ -124,6 +249,60 @@ func (m *ImageManifest) Encrypt(
 	out *ImageManifest,
 	err error,
 ) {
+	return m.EncryptCachedContext(context.Background(), ref, opts, NewBlobCache())
+}
+
+// EncryptContext encrypts an image like Encrypt, stopping before the next blob if
+// ctx is done
+func (m *ImageManifest) EncryptContext(
+	ctx context.Context,
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+) (
+	out *ImageManifest,
+	err error,
+) {
+	return m.EncryptCachedContext(ctx, ref, opts, NewBlobCache())
+}
+
+// EncryptCached encrypts an image like Encrypt, but layers that are identical to
+// one that has already been processed with the same cache are not processed again
+func (m *ImageManifest) EncryptCached(
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+	cache *BlobCache,
+) (
+	out *ImageManifest,
+	err error,
+) {
+	return m.EncryptCachedContext(context.Background(), ref, opts, cache)
+}
+
+// EncryptCachedContext encrypts an image like EncryptCached, stopping before the
+// next blob if ctx is done. The file of each encrypted blob is written next to the
+// file of the blob it was made from, with the suffix .aes, or .gz for layers that
+// are only compressed. If opts.EncryptPaths or opts.Squash are set, the layers of
+// m are split or squashed first.
+func (m *ImageManifest) EncryptCachedContext(
+	ctx context.Context,
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+	cache *BlobCache,
+) (
+	out *ImageManifest,
+	err error,
+) {
+	if len(opts.EncryptPaths) > 0 {
+		if err = m.SplitPaths(opts.EncryptPaths); err != nil {
+			return
+		}
+	}
+	if opts.Squash {
+		if err = m.SquashLayers(); err != nil {
+			return
+		}
+	}
+
 	out = &ImageManifest{
 		SchemaVersion: m.SchemaVersion,
 		MediaType:     m.MediaType,
@@ -146,18 +325,59 @@ func (m *ImageManifest) Encrypt(
 		return
 	}
 
+	encrypted := 0
 	for i := 0; i < len(m.Layers) && err == nil; i++ {
-		switch blob := m.Layers[i].(type) {
-		case DecryptedBlob:
-			log.Debug().Msgf("encrypting layer %d: %s", i, blob.GetFilename())
-			out.Layers[i], err = blob.EncryptBlob(opts, blob.GetFilename()+".aes")
-		case *NoncryptedBlob:
-			log.Debug().Msgf("compressing layer %d: %s", i, blob.GetFilename())
-			out.Layers[i], err = blob.Compress(blob.GetFilename() + ".gz")
-		default:
-			err = errors.Errorf("layer is of wrong type: %T", blob)
+		if err = errors.WithStack(ctx.Err()); err != nil {
+			break
 		}
+
+		if out.Layers[i] = cache.Get(m.Layers[i]); out.Layers[i] != nil {
+			log.Debug().Msgf("layer %d is identical to a previous layer", i)
+			if _, ok := out.Layers[i].(EncryptedBlob); ok {
+				encrypted++
+			}
+			continue
+		}
+
+		// the layer may have been processed already as it was read
+		if out.Layers[i], err = m.stream.result(m.Layers[i], opts); out.Layers[i] != nil || err != nil {
+			log.Debug().Msgf("layer %d was processed as it was read", i)
+			if _, ok := out.Layers[i].(EncryptedBlob); ok {
+				encrypted++
+			}
+		} else {
+			switch blob := m.Layers[i].(type) {
+			case DecryptedBlob:
+				log.Debug().Msgf("encrypting layer %d: %s", i, blob.GetFilename())
+				out.Layers[i], err = blob.EncryptBlob(opts, blob.GetFilename()+".aes")
+				encrypted++
+			case *NoncryptedBlob:
+				log.Debug().Msgf("compressing layer %d: %s", i, blob.GetFilename())
+				out.Layers[i], err = blob.Compress(blob.GetFilename() + ".gz")
+			default:
+				err = errors.Errorf("layer is of wrong type: %T", blob)
+			}
+		}
+
+		if err == nil {
+			cache.Put(m.Layers[i], out.Layers[i])
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	if opts.ChunkSize > 0 {
+		if err = out.SplitLayers(opts.ChunkSize); err != nil {
+			return
+		}
+	}
+
+	// record the parameters so that the image may be audited without decrypting it
+	if out.Annotations = crypto.Annotations(opts); out.Annotations != nil {
+		out.Annotations[AnnotationEncryptedLayers] = strconv.Itoa(encrypted)
 	}
+
 	return
 }
 
@@ -166,6 +386,12 @@ func (m *ImageManifest) DecryptKeys(
 	ref names.NamedTaggedRepository,
 	opts *crypto.Opts,
 ) (err error) {
+	// the wrapped keys are gone once they are decrypted, so the encryption is
+	// described first, if the manifest may be
+	if info, ierr := m.Inspect(); ierr == nil {
+		m.Encryption = info
+	}
+
 	switch blob := m.Config.(type) {
 	case EncryptedBlob:
 		m.Config, err = blob.DecryptKey(opts)
@@ -194,11 +420,23 @@ func (m *ImageManifest) DecryptKeys(
 func (m *ImageManifest) Decrypt(
 	ref names.NamedTaggedRepository,
 	opts *crypto.Opts,
+) (out *ImageManifest, err error) {
+	return m.DecryptContext(context.Background(), ref, opts)
+}
+
+// DecryptContext decrypts a manifest like Decrypt, stopping before the next blob if
+// ctx is done. The file of each decrypted blob is written next to the file of the
+// blob it was made from, with the suffix .dec.
+func (m *ImageManifest) DecryptContext(
+	ctx context.Context,
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
 ) (out *ImageManifest, err error) {
 	out = &ImageManifest{
 		SchemaVersion: m.SchemaVersion,
 		MediaType:     m.MediaType,
 		Layers:        make([]Blob, len(m.Layers)),
+		Annotations:   m.Annotations,
 		DirName:       m.DirName,
 	}
 
@@ -208,7 +446,9 @@ func (m *ImageManifest) Decrypt(
 	case KeyDecryptedBlob:
 		out.Config, err = blob.DecryptFile(opts, blob.GetFilename()+".dec")
 	case *NoncryptedBlob:
-		out.Config = blob
+		if _, err = checkPlain(blob); err == nil {
+			out.Config = blob
+		}
 	default:
 		err = errors.Errorf("config is of wrong type: %T", blob)
 	}
@@ -219,43 +459,120 @@ func (m *ImageManifest) Decrypt(
 	// decrypt keys and files for layers
 	out.Layers = make([]Blob, len(m.Layers))
 	for i := 0; i < len(m.Layers) && err == nil; i++ {
-		out.Layers[i], err = decryptLayer(ref, opts, m.Layers[i])
+		if err = errors.WithStack(ctx.Err()); err == nil {
+			out.Layers[i], err = decryptLayer(ref, opts, m.Layers[i])
+		}
 	}
 
 	return
 }
 
+// VerifyDiffIDs checks that the digests of the layers of a decrypted manifest
+// match the diffIDs that are recorded in the rootfs of its config
+func (m *ImageManifest) VerifyDiffIDs() (err error) {
+	// the config file has either been created locally or downloaded to a file
+	// named by its validated digest
+	fh, err := os.Open(m.Config.GetFilename()) // #nosec
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	config := &struct {
+		RootFS struct {
+			DiffIDs []digest.Digest `json:"diff_ids"`
+		} `json:"rootfs"`
+	}{}
+	if err = json.NewDecoder(fh).Decode(config); err != nil {
+		err = errors.Wrap(err, "could not read the rootfs of the config")
+		return
+	}
+
+	diffIDs := config.RootFS.DiffIDs
+	if len(diffIDs) != len(m.Layers) {
+		return errors.Errorf(
+			"the image has %d layers but its config lists %d diffIDs",
+			len(m.Layers),
+			len(diffIDs),
+		)
+	}
+
+	for i, l := range m.Layers {
+		if l.GetDigest() != diffIDs[i] {
+			return errors.Errorf(
+				"layer %d does not match the config: diffID is %s, expected %s",
+				i,
+				l.GetDigest(),
+				diffIDs[i],
+			)
+		}
+	}
+
+	return nil
+}
+
+// MaxArchiveSize is the largest total size of the files that may be extracted from
+// an image archive, so that an archive cannot fill the disk
+var MaxArchiveSize int64 = 64 << 30
+
+// maxArchiveEntries is the largest number of entries an image archive may have,
+// which is far more than an image with the greatest number of layers needs
+const maxArchiveEntries = 1 << 16
+
 // extractTarBall extracts the tarball from a docker save and fills out the
-// provided image manifest that with details about the layers
-func extractTarBall(r io.Reader, size int64, manifest *ImageManifest) (err error) {
+// provided image manifest that with details about the layers. If onFile is not nil
+// it is called with each file and its digest as soon as the file is extracted, so
+// that it may be processed while the rest of the archive is.
+func extractTarBall(
+	r io.Reader,
+	size int64,
+	manifest *ImageManifest,
+	onFile func(path string, d digest.Digest) error,
+) (err error) {
 	if err = os.MkdirAll(manifest.DirName, 0700); err != nil {
 		err = errors.Wrapf(err, "could not create: %s", manifest.DirName)
 		return
 	}
 
+	// the files are digested as they are extracted, so that layers need not be
+	// read again to find their diffIDs
+	manifest.digests = make(map[string]digest.Digest)
+
 	log.Info().Msg("Extracting image.")
-	bar := pb.New64(0).SetUnits(pb.U_BYTES)
+	p := utils.StartProgress(utils.ProgressExtract, manifest.DirName, size)
 	tr := tar.NewReader(r)
-	br := bar.NewProxyReader(tr)
+	br := &utils.ProgressReader{Reader: tr, Progress: p}
+	defer p.Done()
 
-	bar.Start()
-	defer bar.Finish()
+	// links are made once every file has been extracted, as archives such as those
+	// made by docker save since 25.0 may link to files that come after the link
+	links := make(map[string]string)
 
-	for {
+	var total int64
+	for entries := 0; ; entries++ {
 		var header *tar.Header
 		header, err = tr.Next()
 		if err == io.EOF {
-			return nil
+			return manifest.mkLinks(links)
 		} else if err != nil {
 			return errors.WithStack(err)
 		}
 
+		if entries == maxArchiveEntries {
+			return errors.Errorf("archive has more than %d entries", maxArchiveEntries)
+		}
+
+		// archives may be supplied by the user, so their entries must not escape
+		if !isLocalPath(header.Name) {
+			return errors.Errorf("invalid filename in archive: %s", header.Name)
+		}
 		path := filepath.Join(manifest.DirName, header.Name)
 		info := header.FileInfo()
 
 		switch {
 		case info.IsDir():
-			if err = os.MkdirAll(path, info.Mode()); err != nil {
+			if err = os.MkdirAll(path, 0700); err != nil {
 				return errors.WithStack(err)
 			}
 			fallthrough
@@ -263,12 +580,63 @@ func extractTarBall(r io.Reader, size int64, manifest *ImageManifest) (err error
 			continue
 		}
 
-		bar.SetTotal64(bar.Total + header.Size)
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if total += header.Size; header.Size < 0 || total > MaxArchiveSize {
+				return errors.Errorf("archive is larger than the limit of %d bytes", MaxArchiveSize)
+			}
+			var d digest.Digest
+			if d, err = mkFile(path, br); err != nil {
+				return err
+			}
+			manifest.digests[path] = d
+			if onFile != nil {
+				if err = onFile(path, d); err != nil {
+					return err
+				}
+			}
+		case tar.TypeLink, tar.TypeSymlink:
+			// the target of a hard link is relative to the root of the archive, and
+			// that of a symbolic link to the directory of the link
+			target := header.Linkname
+			if header.Typeflag == tar.TypeSymlink {
+				target = filepath.Join(filepath.Dir(header.Name), target)
+			}
+			if filepath.IsAbs(header.Linkname) || !isLocalPath(target) {
+				return errors.Errorf("invalid link in archive: %s -> %s", header.Name, header.Linkname)
+			}
+			links[path] = filepath.Join(manifest.DirName, target)
+		default:
+			// the files of an image archive are never devices or pipes, those of the
+			// filesystem of the image are inside the tarballs of its layers
+			log.Debug().Msgf("skipping %s of type %q", header.Name, header.Typeflag)
+		}
+	}
+}
 
-		if err = mkFile(path, info, br); err != nil {
-			return err
+// mkLinks makes each file in links a hard link to the file it links to, following
+// links to links, so that it has the same contents and digest
+func (m *ImageManifest) mkLinks(links map[string]string) error {
+	for path, target := range links {
+		// a chain of links longer than the number of links must be a cycle
+		for i := 0; links[target] != ""; i++ {
+			if i == len(links) {
+				return errors.Errorf("cycle of links in archive: %s", path)
+			}
+			target = links[target]
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := os.Link(target, path); err != nil {
+			return errors.Wrapf(err, "could not link %s to %s", path, target)
+		}
+		if d, ok := m.digests[target]; ok {
+			m.digests[path] = d
 		}
 	}
+	return nil
 }
 
 // dontExtract holds the names of the file int the image archive to not extract
@@ -276,27 +644,36 @@ func dontExtract(name string) bool {
 	return name == "json" || name == "VERSION" || name == "repositories"
 }
 
-// mkFile makes the file in extractTarBall
-func mkFile(path string, info os.FileInfo, r io.Reader) (err error) {
-	fh, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+// mkFile makes the file in extractTarBall, returning the digest of its contents
+func mkFile(path string, r io.Reader) (_ digest.Digest, err error) {
+	// not every archive has entries for the directories that contain its files
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// the modes in the archive are ignored, so that no file is made executable or
+	// readable by others
+	fh, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	defer func() { err = utils.CheckedClose(fh, err) }()
 	if err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 
-	if _, err = io.Copy(fh, r); err != nil {
+	digester := digest.Canonical.Digester()
+	if _, err = io.Copy(io.MultiWriter(fh, digester.Hash()), r); err != nil {
 		err = errors.WithStack(err)
 		return
 	}
-	return
+	return digester.Digest(), nil
 }
 
 // mkBlobs assembles the list of filenames that contains the layers of the image
 // into a struct that contain additional information such as their digest
 func mkBlobs(
-	repo, tag, path string,
+	manifest *ImageManifest,
 	layers []string,
+	image *ImageArchiveManifest,
 	opts *crypto.Opts,
 ) (
 	configBlob Blob,
@@ -309,27 +686,11 @@ func mkBlobs(
 		layerSet[x] = true
 	}
 
-	// read the archive manifest
-	// manifestfile consists of information that is local to the os, or supplied by the user or the
-	// docker daemon. Thus, assuming they are not compromised, it is safe to open
-	manifestfile := filepath.Join(path, "manifest.json")
-	manifestFH, err := os.Open(manifestfile) // #nosec
-	defer func() { err = utils.CheckedClose(manifestFH, err) }()
-	if err != nil {
-		err = errors.Wrapf(err, "could not open file: %s", manifestfile)
-		return
-	}
-
-	image, err := NewImageArchiveManifest(manifestFH)
-	if err != nil {
-		return
-	}
-
 	switch opts.Algos {
 	case crypto.Pbkdf2Aes256Gcm:
-		return pbkdf2Aes256GcmEncrypt(path, layerSet, image, opts)
+		return pbkdf2Aes256GcmEncrypt(manifest, layerSet, image, opts)
 	case crypto.None:
-		return noneEncrypt(path, layerSet, image, opts)
+		return noneEncrypt(manifest.DirName, layerSet, image, opts)
 	default:
 	}
 	return nil, nil, errors.Errorf("%v is not a valid encryption type", opts.Algos)
@@ -358,7 +719,7 @@ func noneEncrypt(
 // pbkdf2Aes256GcmEncrypt encrypts the images's Blob structs when the enctype
 // is Pbkdf2Aes256Gcm
 func pbkdf2Aes256GcmEncrypt(
-	path string,
+	manifest *ImageManifest,
 	layerSet map[string]bool,
 	image *ImageArchiveManifest,
 	opts *crypto.Opts,
@@ -373,29 +734,32 @@ func pbkdf2Aes256GcmEncrypt(
 	if err != nil {
 		return
 	}
-	configBlob = NewConfig(filepath.Join(path, image.Config), "", 0, dec)
+	configBlob = NewConfig(filepath.Join(manifest.DirName, image.Config), "", 0, dec)
 
 	layerBlobs = make([]Blob, len(image.Layers))
 	for i, f := range image.Layers {
-		basename := filepath.Join(path, f)
+		basename := filepath.Join(manifest.DirName, f)
 
 		dec, err = crypto.NewDecrypto(opts)
 		if err != nil {
 			return
 		}
 
-		var d digest.Digest
-		d, err = fileDigest(basename)
-		if err != nil {
-			err = errors.WithStack(err)
-			return
+		d, ok := manifest.digests[basename]
+		if !ok {
+			if d, err = fileDigest(basename); err != nil {
+				err = errors.WithStack(err)
+				return
+			}
 		}
 
 		log.Debug().Msgf("preparing %s", d)
-		if layerSet[d.String()] {
-			layerBlobs[i] = NewLayer(filepath.Join(path, f), d, 0, dec)
+		if in := manifest.stream.blob(d); in != nil {
+			layerBlobs[i] = in
+		} else if layerSet[d.String()] {
+			layerBlobs[i] = NewLayer(basename, d, 0, dec)
 		} else {
-			layerBlobs[i] = NewPlainLayer(filepath.Join(path, f), d, 0)
+			layerBlobs[i] = NewPlainLayer(basename, d, 0)
 		}
 	}
 
@@ -415,72 +779,49 @@ func fileDigest(filename string) (d digest.Digest, err error) {
 	return digest.Canonical.FromReader(fh)
 }
 
-// layersToEncrypt returns the diffIDs of the layers that have been marked for encryption
-func layersToEncrypt(
-	ctx context.Context,
-	cli *client.Client,
-	inspt types.ImageInspect,
-) (_ []string, err error) {
-	// get the history
-	hist, err := cli.ImageHistory(ctx, inspt.ID)
-	if err != nil {
-		err = errors.WithStack(err)
-		return
-	}
-
-	// the positions of the layers to encrypt
-	eps, err := encryptPositions(hist)
-	if err != nil {
-		return
+// allLayers returns the diffIDs of the layers above the base layers of opts,
+// which are all encrypted when opts.EncryptAll is set
+func allLayers(diffIDs []string, opts *crypto.Opts) ([]string, error) {
+	base := opts.BaseLayers
+	if len(opts.BaseDiffIDs) > 0 {
+		if !hasPrefix(diffIDs, opts.BaseDiffIDs) {
+			return nil, errors.New("the image is not built on the base image")
+		}
+		base = len(opts.BaseDiffIDs)
 	}
 
-	log.Debug().Msgf("%v", eps)
-	log.Debug().Msgf("%v", inspt.RootFS.Layers)
-
-	// the total number of layers
-	diffIDsToEncrypt := make([]string, len(eps))
-	for i, n := range eps {
-		diffIDsToEncrypt[i] = inspt.RootFS.Layers[n]
+	if base < 0 || base >= len(diffIDs) {
+		return nil, errors.Errorf(
+			"cannot leave %d base layers unencrypted in an image of %d layers",
+			base,
+			len(diffIDs),
+		)
 	}
-
-	log.Debug().Msgf("%v", diffIDsToEncrypt)
-
-	// the last n entries in this array are the diffIDs of the layers to encrypt
-	return diffIDsToEncrypt, nil
+	return diffIDs[base:], nil
 }
 
-// encryptPositions gives the positions in the image history that correspond to encrypted layers
-// the length of the output array is the number of layers that are to be encrypted
-func encryptPositions(hist []image.HistoryResponseItem) (encryptPos []int, err error) {
-	n := 0
-	toEncrypt := false
-	re := regexp.MustCompile(createdRE)
-
-	for i := len(hist) - 1; i >= 0; i-- {
-		matches := re.FindSubmatch([]byte(hist[i].CreatedBy))
-
-		if hist[i].Size != 0 || len(matches) == 0 {
-			if toEncrypt {
-				encryptPos = append(encryptPos, n)
-			}
-			n++
-		} else {
-			switch string(matches[1]) {
-			case "true":
-				toEncrypt = true
-			case "false":
-				toEncrypt = false
-			default:
-			}
+// hasPrefix reports whether the layers of base are the lowest layers of diffIDs
+func hasPrefix(diffIDs, base []string) bool {
+	if len(base) > len(diffIDs) {
+		return false
+	}
+	for i := range base {
+		if diffIDs[i] != base[i] {
+			return false
 		}
 	}
+	return true
+}
 
-	if len(encryptPos) == 0 {
-		err = errors.New("this image was not built with the correct LABEL")
-		return
+// markerRE is a regular expression that matches the LABEL instructions that set
+// any of the labels of opts, with the value of the label as its first group
+func markerRE(opts *crypto.Opts) string {
+	labels := opts.LabelNames()
+	quoted := make([]string, len(labels))
+	for i, l := range labels {
+		quoted[i] = regexp.QuoteMeta(l)
 	}
-
-	return
+	return `LABEL (?:` + strings.Join(quoted, "|") + `)=(true|false)`
 }
 
 // ImageArchiveManifest collects the filenames of the config and layers in the image
@@ -534,9 +875,22 @@ func decryptLayer(
 	case KeyDecryptedBlob:
 		layer, err = blob.DecryptFile(opts, blob.GetFilename()+".dec")
 	case CompressedBlob:
+		var info MediaTypeInfo
+		if info, err = checkPlain(blob); err != nil || !info.Compressed {
+			return blob, err
+		}
 		layer, err = blob.Decompress(blob.GetFilename() + ".dec")
 	default:
 		err = errors.Errorf("layer is of wrong type: %T", blob)
 	}
 	return
 }
+
+// checkPlain checks that a blob without a key is not meant to be encrypted,
+// returning how it is to be handled
+func checkPlain(blob Blob) (info MediaTypeInfo, err error) {
+	if info, err = LookupMediaType(blob.GetMediaType()); err == nil && info.Encrypted {
+		err = errors.Errorf("%s is encrypted but no key was found for it", blob.GetDigest())
+	}
+	return
+}
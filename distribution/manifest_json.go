@@ -72,12 +72,23 @@ func marshalBlob(config Blob) (bs json.RawMessage, err error) {
 }
 
 func marshalLayers(layers []Blob) (out []json.RawMessage, err error) {
-	out = make([]json.RawMessage, len(layers))
-	for i, l := range layers {
-		out[i], err = marshalBlob(l)
-		if err != nil {
+	out = make([]json.RawMessage, 0, len(layers))
+	for _, l := range layers {
+		// a layer that has been split is listed as its chunks
+		if eb, ok := l.(*encryptedBlobNew); ok && len(eb.Chunks) > 0 {
+			var chunks []json.RawMessage
+			if chunks, err = marshalChunks(eb); err != nil {
+				return
+			}
+			out = append(out, chunks...)
+			continue
+		}
+
+		var bs json.RawMessage
+		if bs, err = marshalBlob(l); err != nil {
 			return
 		}
+		out = append(out, bs)
 	}
 	return
 }
@@ -101,6 +112,8 @@ func (m *ImageManifest) UnmarshalJSON(data []byte) (err error) {
 			m.Config, err = unmarshalConfig(v)
 		case "layers":
 			m.Layers, err = unmarshalLayers(v)
+		case "annotations":
+			err = json.Unmarshal(v, &m.Annotations)
 		default:
 		}
 		if err != nil {
@@ -129,7 +142,7 @@ func unmarshalConfig(m json.RawMessage) (blob Blob, err error) {
 		err = errors.WithStack(err)
 		return
 	}
-	return
+	return blob, checkBlobMediaType(blob, true)
 }
 
 func unmarshalLayers(v json.RawMessage) (layers []Blob, err error) {
@@ -140,9 +153,20 @@ func unmarshalLayers(v json.RawMessage) (layers []Blob, err error) {
 		return
 	}
 
-	layers = make([]Blob, len(layerJSONs))
-	for i := 0; i < len(layerJSONs) && err == nil; i++ {
-		layers[i], err = unmarshalLayer(layerJSONs[i])
+	layers = make([]Blob, 0, len(layerJSONs))
+	for i := 0; i < len(layerJSONs); {
+		var layer Blob
+		var n int
+		if layer, n, err = unmarshalChunks(layerJSONs[i:]); err != nil {
+			return
+		} else if n == 0 {
+			if layer, err = unmarshalLayer(layerJSONs[i]); err != nil {
+				return
+			}
+			n = 1
+		}
+		layers = append(layers, layer)
+		i += n
 	}
 
 	return
@@ -166,5 +190,24 @@ func unmarshalLayer(m json.RawMessage) (blob Blob, err error) {
 		err = errors.WithStack(err)
 		return
 	}
-	return
+	return blob, checkBlobMediaType(blob, false)
+}
+
+// checkBlobMediaType checks that the mediaType of a blob in a manifest is one that
+// may be handled and that it agrees with the position of the blob in the manifest
+func checkBlobMediaType(blob Blob, config bool) error {
+	info, err := LookupMediaType(blob.GetMediaType())
+	if err != nil {
+		return err
+	}
+
+	if info.Config != config {
+		kind := "layer"
+		if info.Config {
+			kind = "config"
+		}
+		return errors.Errorf("%s has the mediaType of a %s: %s", blob.GetDigest(), kind, blob.GetMediaType())
+	}
+
+	return nil
 }
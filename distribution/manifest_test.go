@@ -16,6 +16,7 @@ package distribution_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -46,6 +47,7 @@ func (b *mockBlob) GetSize() int64                     { return 0 }
 func (b *mockBlob) GetFilename() string                { return "" }
 func (b *mockBlob) SetFilename(f string)               {}
 func (b *mockBlob) ReadCloser() (io.ReadCloser, error) { return nil, nil }
+func (b *mockBlob) Verify() error                      { return nil }
 
 func TestImageMock(t *testing.T) {
 	assert := assert.New(t)
@@ -231,3 +233,50 @@ func checkFiles(m1, m2 *distribution.ImageManifest) (err error) {
 
 	return
 }
+
+func TestEncryptContextCancelled(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	require.NoError(err)
+	nTRep, err := names.CastToTagged(ref)
+	require.NoError(err)
+
+	opts.SetPassphrase(passphrase)
+
+	size, d, fn, err := mkConfigFile(t, dir)
+	require.NoError(err)
+	dec, err := crypto.NewDecrypto(opts)
+	require.NoError(err)
+	manifest := &distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Config:        distribution.NewConfig(fn, d, size, dec),
+		DirName:       dir,
+	}
+
+	size, d, fn, err = mkRandFile(t, filepath.Join(dir, uuid.New().String()))
+	require.NoError(err)
+	dec, err = crypto.NewDecrypto(opts)
+	require.NoError(err)
+	manifest.Layers = append(manifest.Layers, distribution.NewLayer(fn, d, size, dec))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = manifest.EncryptContext(ctx, nTRep, opts)
+	assert.Equal(context.Canceled, errors.Cause(err))
+
+	_, err = os.Stat(fn + ".aes")
+	assert.True(os.IsNotExist(err), "a cancelled layer should not be encrypted")
+
+	encrypted, err := manifest.EncryptContext(context.Background(), nTRep, opts)
+	require.NoError(err)
+
+	_, err = encrypted.DecryptContext(ctx, nTRep, opts)
+	assert.Equal(context.Canceled, errors.Cause(err))
+}
@@ -0,0 +1,110 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+)
+
+// MediaTypeInfo describes how the blobs of a mediaType are handled
+type MediaTypeInfo struct {
+	// Config is set for image configs and unset for layers
+	Config bool
+	// Compressed is set for layers that are compressed tarballs, the compression
+	// is detected when they are decompressed
+	Compressed bool
+	// Encrypted is set for blobs that are encrypted, it is implied by a suffix
+	// on the mediaType of a registered unencrypted mediaType
+	Encrypted bool
+}
+
+var (
+	mediaTypesMu sync.RWMutex
+	mediaTypes   = map[string]MediaTypeInfo{
+		MediaTypeImageConfig:          {Config: true},
+		MediaTypeOCIConfig:            {Config: true},
+		MediaTypeLayer:                {Compressed: true},
+		MediaTypeForeignLayer:         {Compressed: true},
+		MediaTypeUncompressedLayer:    {},
+		MediaTypeOCILayer:             {Compressed: true},
+		MediaTypeOCIUncompressedLayer: {},
+		MediaTypeOCIZstdLayer:         {Compressed: true},
+	}
+)
+
+// RegisterMediaType registers how the blobs of a mediaType are to be handled
+func RegisterMediaType(mediaType string, info MediaTypeInfo) {
+	mediaTypesMu.Lock()
+	defer mediaTypesMu.Unlock()
+	mediaTypes[mediaType] = info
+}
+
+// LookupMediaType returns how the blobs of mediaType are to be handled. A
+// mediaType that is not registered, but is a registered one with a suffix such
+// as "+encrypted" appended, is that of an encrypted blob.
+func LookupMediaType(mediaType string) (info MediaTypeInfo, err error) {
+	mediaTypesMu.RLock()
+	defer mediaTypesMu.RUnlock()
+
+	if info, ok := mediaTypes[mediaType]; ok {
+		return info, nil
+	}
+
+	base := plainMediaTypeLocked(mediaType)
+	if base == mediaType {
+		return info, errors.Errorf("unsupported mediaType: %s", mediaType)
+	}
+
+	info = mediaTypes[base]
+	info.Encrypted = true
+	return info, nil
+}
+
+// encryptedMediaType is the mediaType of a blob of the given mediaType once it
+// has been encrypted. Compat manifests keep the mediaType of the plain blob.
+func encryptedMediaType(mediaType string, opts *crypto.Opts) string {
+	if opts.Compat {
+		return mediaType
+	}
+	return mediaType + opts.MediaTypeSuffix()
+}
+
+// plainMediaType is the mediaType of an encrypted blob of the given mediaType
+// once it has been decrypted
+func plainMediaType(mediaType string) string {
+	mediaTypesMu.RLock()
+	defer mediaTypesMu.RUnlock()
+	return plainMediaTypeLocked(mediaType)
+}
+
+// plainMediaTypeLocked strips the suffix from mediaType that is not part of the
+// longest registered mediaType that is a prefix of it
+func plainMediaTypeLocked(mediaType string) string {
+	base := ""
+	for m := range mediaTypes {
+		if strings.HasPrefix(mediaType, m+"+") && len(m) > len(base) {
+			base = m
+		}
+	}
+	if base == "" {
+		return mediaType
+	}
+	return base
+}
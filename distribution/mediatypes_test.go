@@ -0,0 +1,110 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestLookupMediaType(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		mediaType string
+		info      distribution.MediaTypeInfo
+		err       bool
+	}{
+		{distribution.MediaTypeLayer, distribution.MediaTypeInfo{Compressed: true}, false},
+		{distribution.MediaTypeOCIUncompressedLayer, distribution.MediaTypeInfo{}, false},
+		{distribution.MediaTypeImageConfig, distribution.MediaTypeInfo{Config: true}, false},
+		{distribution.MediaTypeLayer + "+encrypted", distribution.MediaTypeInfo{Compressed: true, Encrypted: true}, false},
+		{distribution.MediaTypeOCILayer + "+encrypted", distribution.MediaTypeInfo{Compressed: true, Encrypted: true}, false},
+		{distribution.MediaTypeOCIUncompressedLayer + "+senetas", distribution.MediaTypeInfo{Encrypted: true}, false},
+		{distribution.MediaTypeImageConfig + "+encrypted", distribution.MediaTypeInfo{Config: true, Encrypted: true}, false},
+		{"application/octet-stream", distribution.MediaTypeInfo{}, true},
+		{"application/octet-stream+encrypted", distribution.MediaTypeInfo{}, true},
+	}
+
+	for _, test := range tests {
+		info, err := distribution.LookupMediaType(test.mediaType)
+		if test.err {
+			assert.Error(err, test.mediaType)
+			continue
+		}
+		if assert.NoError(err, test.mediaType) {
+			assert.Equal(test.info, info, test.mediaType)
+		}
+	}
+
+	distribution.RegisterMediaType("application/vnd.example.layer", distribution.MediaTypeInfo{})
+	info, err := distribution.LookupMediaType("application/vnd.example.layer+encrypted")
+	assert.NoError(err)
+	assert.True(info.Encrypted)
+}
+
+func TestEncryptedMediaTypes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	require.NoError(err)
+	nTRep, err := names.CastToTagged(ref)
+	require.NoError(err)
+
+	tests := []struct {
+		opts   *crypto.Opts
+		suffix string
+	}{
+		{&crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}, "+encrypted"},
+		{&crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, EncryptedSuffix: "+senetas"}, "+senetas"},
+		{&crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, Compat: true}, ""},
+	}
+
+	for _, test := range tests {
+		test.opts.SetPassphrase(passphrase)
+		manifest := mkEncryptedManifest(t, dir, test.opts)
+		assert.Equal(distribution.MediaTypeImageConfig+test.suffix, manifest.Config.GetMediaType())
+		assert.Equal(distribution.MediaTypeLayer+test.suffix, manifest.Layers[0].GetMediaType())
+
+		require.NoError(manifest.DecryptKeys(nTRep, test.opts))
+		decrypted, err := manifest.Decrypt(nTRep, test.opts)
+		require.NoError(err)
+		assert.Equal(distribution.MediaTypeImageConfig, decrypted.Config.GetMediaType())
+		assert.Equal(distribution.MediaTypeLayer, decrypted.Layers[0].GetMediaType())
+	}
+
+	// a blob that is marked as encrypted may not be used without its key
+	opts.SetPassphrase(passphrase)
+	manifest := mkEncryptedManifest(t, dir, opts)
+	detached, _, err := manifest.DetachKeys()
+	require.NoError(err)
+	_, err = detached.Decrypt(nTRep, opts)
+	assert.Error(err)
+}
@@ -0,0 +1,575 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// AnnotationRefName is the annotation of the descriptors in the index of an OCI
+// image layout that gives the name the image was saved under
+const AnnotationRefName = "org.opencontainers.image.ref.name"
+
+// AnnotationContainerdImageName is the annotation that gives the full name of an
+// image exported from containerd
+const AnnotationContainerdImageName = "io.containerd.image.name"
+
+// ociIndex is an index or an image manifest in an OCI image layout, only the
+// fields that are needed to find the config and layers of an image are read
+type ociIndex struct {
+	MediaType string       `json:"mediaType"`
+	Manifests []Descriptor `json:"manifests"`
+	Config    *Descriptor  `json:"config"`
+	Layers    []Descriptor `json:"layers"`
+}
+
+// History is an entry of the history in the config of an image
+type History struct {
+	CreatedBy  string `json:"created_by"`
+	EmptyLayer bool   `json:"empty_layer"`
+}
+
+// ociConfig holds the fields of an image config that determine which layers
+// are to be encrypted
+type ociConfig struct {
+	History []History `json:"history"`
+	RootFS  struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// NewManifestFromOCIArchive creates an unencrypted manifest (with the data
+// necessary for encryption) from a tarball of an OCI image layout, such as
+// that produced by podman save --format oci-archive
+func NewManifestFromOCIArchive(
+	r io.Reader,
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+	tempDir string,
+) (
+	manifest *ImageManifest,
+	err error,
+) {
+	// output manifest
+	manifest = &ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		DirName:       filepath.Join(tempDir, uuid.New().String()),
+	}
+
+	// extract image archive
+	if err = extractTarBall(r, 0, manifest, nil); err != nil {
+		return
+	}
+
+	image, layers, attestations, err := readOCILayout(manifest.DirName, ref, opts)
+	if err != nil {
+		return
+	}
+	manifest.Attestations = attestations
+
+	log.Debug().Msgf("The following layers are to be encrypted: %v", layers)
+
+	// make the Blob structs for the manifest
+	manifest.Config, manifest.Layers, err = mkBlobs(manifest, layers, image, opts)
+
+	return
+}
+
+// NewManifestFromPlain creates an unencrypted manifest (with the data necessary
+// for encryption) from the manifest of a plain image that has been downloaded from
+// a registry to its DirName. Compressed layers are decompressed alongside the
+// downloaded files.
+func NewManifestFromPlain(plain *ImageManifest, opts *crypto.Opts) (manifest *ImageManifest, err error) {
+	return NewManifestFromPlainPull(context.Background(), plain, opts, nil)
+}
+
+// NewManifestFromPlainPull creates an unencrypted manifest like NewManifestFromPlain,
+// from the manifest of a plain image whose blobs are downloaded by pull, which
+// calls downloaded with the digest of each blob and the file it was downloaded to
+// as soon as it has been. Each layer is decompressed as soon as it is downloaded,
+// and if opts.Stream is set encrypted while the rest are downloaded, once the
+// config has been. If pull is nil the blobs have been downloaded already.
+func NewManifestFromPlainPull(
+	ctx context.Context,
+	plain *ImageManifest,
+	opts *crypto.Opts,
+	pull func(downloaded func(d digest.Digest, filename string) error) error,
+) (manifest *ImageManifest, err error) {
+	if plain.Encrypted() {
+		return nil, errors.New("the image is already encrypted")
+	}
+
+	manifest = &ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		DirName:       plain.DirName,
+		digests:       make(map[string]digest.Digest),
+	}
+
+	stream := newLayerStream(ctx, opts, nil)
+	defer func() {
+		if err != nil {
+			stream.stop()
+			return
+		}
+		stream.finish()
+	}()
+
+	// the names of the decompressed layers, by the digests of the downloaded ones
+	var mu sync.Mutex
+	layerNames := make(map[digest.Digest]string)
+
+	downloaded := func(d digest.Digest, filename string) error {
+		if d == plain.Config.GetDigest() {
+			if stream == nil {
+				return nil
+			}
+			config := &ociConfig{}
+			if err := readOCIFile(filename, config); err != nil {
+				return err
+			}
+			layers, err := ociLayersToEncrypt(config, opts)
+			if err != nil {
+				return err
+			}
+			stream.choose(layers)
+			return nil
+		}
+
+		for _, l := range plain.Layers {
+			if l.GetDigest() != d {
+				continue
+			}
+			name, diffID, err := uncompressedOCILayer(plain.DirName, NewDescriptor(l), filename)
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(plain.DirName, name)
+
+			mu.Lock()
+			layerNames[d] = name
+			manifest.digests[path] = diffID
+			mu.Unlock()
+
+			stream.add(path, diffID)
+			return nil
+		}
+		return nil
+	}
+
+	if pull == nil {
+		for _, l := range plain.Layers {
+			if _, ok := layerNames[l.GetDigest()]; !ok {
+				if err = downloaded(l.GetDigest(), l.GetFilename()); err != nil {
+					return
+				}
+			}
+		}
+	} else if err = pull(downloaded); err != nil {
+		return
+	}
+
+	image := &ImageArchiveManifest{Layers: make([]string, len(plain.Layers))}
+	if image.Config, err = filepath.Rel(plain.DirName, plain.Config.GetFilename()); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for i, l := range plain.Layers {
+		image.Layers[i] = layerNames[l.GetDigest()]
+	}
+
+	config := &ociConfig{}
+	if err = readOCIFile(plain.Config.GetFilename(), config); err != nil {
+		return
+	}
+
+	layers, err := ociLayersToEncrypt(config, opts)
+	if err != nil {
+		return
+	}
+
+	log.Debug().Msgf("The following layers are to be encrypted: %v", layers)
+
+	stream.choose(layers)
+	manifest.stream = stream
+
+	manifest.Config, manifest.Layers, err = mkBlobs(manifest, layers, image, opts)
+
+	return
+}
+
+// NewManifestFromDecrypted creates an unencrypted manifest (with the data necessary
+// for encryption) from dec, the decryption of the encrypted manifest enc, so that
+// the image may be encrypted again with new keys. The layers that are encrypted in
+// enc are the ones to encrypt.
+func NewManifestFromDecrypted(enc, dec *ImageManifest, opts *crypto.Opts) (manifest *ImageManifest, err error) {
+	if len(enc.Layers) != len(dec.Layers) {
+		return nil, errors.Errorf("the image has %d layers but %d were decrypted", len(enc.Layers), len(dec.Layers))
+	}
+
+	image := &ImageArchiveManifest{Layers: make([]string, len(dec.Layers))}
+	if image.Config, err = filepath.Rel(dec.DirName, dec.Config.GetFilename()); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var layers []string
+	for i, l := range dec.Layers {
+		if image.Layers[i], err = filepath.Rel(dec.DirName, l.GetFilename()); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if info, err := LookupMediaType(enc.Layers[i].GetMediaType()); err == nil && info.Encrypted {
+			layers = append(layers, l.GetDigest().String())
+		}
+	}
+
+	log.Debug().Msgf("The following layers are to be encrypted again: %v", layers)
+
+	manifest = &ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		DirName:       dec.DirName,
+	}
+	manifest.Config, manifest.Layers, err = mkBlobs(manifest, layers, image, opts)
+
+	return
+}
+
+// readOCILayout finds the image in the OCI image layout at path and maps it
+// onto the layout of a docker image archive. Compressed layers are decompressed
+// alongside the originals. It also returns the diffIDs of the layers to encrypt,
+// and the attestations about the image in the index it was found in.
+func readOCILayout(
+	path string,
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+) (
+	image *ImageArchiveManifest,
+	layers []string,
+	attestations []*Attestation,
+	err error,
+) {
+	index := &ociIndex{}
+	if err = readOCIFile(filepath.Join(path, "index.json"), index); err != nil {
+		return
+	}
+
+	// descend through the indices until an image manifest is reached
+	for index.Config == nil {
+		var desc *Descriptor
+		if desc, err = selectOCIManifest(index, ref); err != nil {
+			return
+		}
+
+		if attestations, err = readOCIAttestations(path, index, desc.Digest); err != nil {
+			return
+		}
+
+		index = &ociIndex{}
+		if err = readOCIBlob(path, desc.Digest, index); err != nil {
+			return
+		}
+	}
+
+	config := &ociConfig{}
+	if err = readOCIBlob(path, index.Config.Digest, config); err != nil {
+		return
+	}
+
+	image = &ImageArchiveManifest{Layers: make([]string, len(index.Layers))}
+	if image.Config, err = ociBlobName(index.Config.Digest); err != nil {
+		return
+	}
+
+	for i, l := range index.Layers {
+		if image.Layers[i], _, err = uncompressedOCILayer(path, l, ""); err != nil {
+			return
+		}
+	}
+
+	layers, err = ociLayersToEncrypt(config, opts)
+	return
+}
+
+// selectOCIManifest chooses the manifest in an index that ref refers to. The
+// manifests in the index of the layout are matched by name, and the manifests
+// in a nested index by the platform of the host.
+func selectOCIManifest(index *ociIndex, ref names.NamedTaggedRepository) (*Descriptor, error) {
+	// attestations are not images, though they are listed with them
+	var manifests []Descriptor
+	for _, m := range index.Manifests {
+		if !isAttestation(m) {
+			manifests = append(manifests, m)
+		}
+	}
+	index = &ociIndex{Manifests: manifests}
+
+	if len(index.Manifests) == 0 {
+		return nil, errors.New("no image data was found")
+	}
+
+	for i, m := range index.Manifests {
+		name := m.Annotations[AnnotationRefName]
+		if name != "" && (name == ref.Tag() || name == ref.String()) ||
+			m.Annotations[AnnotationContainerdImageName] == ref.String() {
+			return &index.Manifests[i], nil
+		}
+	}
+
+	for i, m := range index.Manifests {
+		if m.Platform != nil &&
+			m.Platform.OS == runtime.GOOS &&
+			m.Platform.Architecture == runtime.GOARCH {
+			return &index.Manifests[i], nil
+		}
+	}
+
+	if len(index.Manifests) > 1 {
+		return nil, errors.Errorf("the archive contains several images, none of which is %s", ref)
+	}
+
+	return &index.Manifests[0], nil
+}
+
+// uncompressedOCILayer returns the name, relative to path, of the file that
+// contains the uncompressed layer described by desc, which is stored in filename
+// or in the OCI image layout at path if it is empty, and the digest of that file
+func uncompressedOCILayer(path string, desc Descriptor, filename string) (_ string, _ digest.Digest, err error) {
+	var name string
+	if filename == "" {
+		name, err = ociBlobName(desc.Digest)
+	} else {
+		name, err = filepath.Rel(path, filename)
+	}
+	if err != nil {
+		return "", "", errors.WithStack(err)
+	}
+
+	info, err := LookupMediaType(desc.MediaType)
+	switch {
+	case err != nil:
+		return
+	case info.Config || info.Encrypted:
+		return "", "", errors.Errorf("unsupported layer mediaType: %s", desc.MediaType)
+	case !info.Compressed:
+		return name, desc.Digest, nil
+	}
+
+	blob := newPlainBlob(filepath.Join(path, name), desc.Digest, desc.Size, desc.MediaType)
+	dec, err := blob.Decompress(blob.GetFilename() + ".tar")
+	if err != nil {
+		return
+	}
+
+	return name + ".tar", dec.GetDigest(), nil
+}
+
+// ociLayersToEncrypt returns the diffIDs of the layers that have been marked for
+// encryption, according to the history in the config
+func ociLayersToEncrypt(config *ociConfig, opts *crypto.Opts) (diffIDs []string, err error) {
+	layers := config.RootFS.DiffIDs
+	switch {
+	case len(opts.EncryptLayers) > 0:
+		return selectLayers(layers, opts.EncryptLayers)
+	// the files to encrypt are chosen by path from every layer
+	case opts.EncryptAll || len(opts.EncryptPaths) > 0:
+		return allLayers(layers, opts)
+	default:
+	}
+
+	empty, err := emptyLayers(config, opts)
+	if err != nil {
+		return
+	}
+
+	re := regexp.MustCompile(markerRE(opts))
+	toEncrypt := false
+	n := 0
+
+	for i, h := range config.History {
+		if !empty[i] {
+			if toEncrypt {
+				diffIDs = append(diffIDs, layers[n])
+			}
+			n++
+			continue
+		}
+
+		if matches := re.FindStringSubmatch(h.CreatedBy); matches != nil {
+			toEncrypt = matches[1] == "true"
+		}
+	}
+
+	if len(diffIDs) == 0 {
+		err = utils.WithClass(errors.New("this image was not built with the correct LABEL"), utils.ClassLabel)
+		return
+	}
+
+	return
+}
+
+// LayersToEncrypt returns the positions of the layers of an image that are
+// encrypted with opts, counting the lowest as 0, given the history and the diffIDs
+// of its layers from its config
+func LayersToEncrypt(history []History, diffIDs []string, opts *crypto.Opts) (positions []int, err error) {
+	config := &ociConfig{History: history}
+	config.RootFS.DiffIDs = diffIDs
+
+	selected, err := ociLayersToEncrypt(config, opts)
+	if err != nil {
+		return
+	}
+
+	encrypt := make(map[string]bool)
+	for _, d := range selected {
+		encrypt[d] = true
+	}
+	for i, d := range diffIDs {
+		if encrypt[d] {
+			positions = append(positions, i)
+		}
+	}
+	return
+}
+
+// metadataRE matches the history entries of instructions that only change the
+// config, in the forms of both the classic builder and BuildKit
+var metadataRE = regexp.MustCompile(
+	`^(?:/bin/sh -c )?(?:#\(nop\)\s+)?(?:LABEL|ENV|CMD|ENTRYPOINT|EXPOSE|USER|ARG|ONBUILD|` +
+		`STOPSIGNAL|HEALTHCHECK|SHELL|VOLUME|MAINTAINER|WORKDIR)\b`,
+)
+
+// emptyLayers decides which entries of the history in the config made no layer,
+// so that the other entries may be matched with the layers in order. The
+// empty_layer fields are used if they agree with the number of layers. Some
+// builders and tools do not set them, so failing that entries of instructions
+// that only change the config are taken to be empty. If neither agree, the
+// layers cannot be matched and the layers to encrypt must be selected explicitly.
+func emptyLayers(config *ociConfig, opts *crypto.Opts) ([]bool, error) {
+	layers := len(config.RootFS.DiffIDs)
+	empty := make([]bool, len(config.History))
+
+	n := 0
+	for i, h := range config.History {
+		if empty[i] = h.EmptyLayer; !empty[i] {
+			n++
+		}
+	}
+	if n == layers {
+		return empty, nil
+	}
+
+	m := 0
+	for i, h := range config.History {
+		if empty[i] = h.EmptyLayer || metadataRE.MatchString(h.CreatedBy); !empty[i] {
+			m++
+		}
+	}
+	if m == layers {
+		log.Debug().Msgf("matched %d history entries with layers by their instructions", m)
+		return empty, nil
+	}
+
+	return nil, errors.Errorf(
+		"the history of the image lists %d layers but it has %d, as happens for squashed or imported images, "+
+			"so the layers marked by the %s label cannot be found: select the layers to encrypt explicitly",
+		n,
+		layers,
+		strings.Join(opts.LabelNames(), " or "),
+	)
+}
+
+// selectLayers returns the diffIDs of the layers at positions, counting the
+// lowest layer as 0
+func selectLayers(layers []string, positions []int) (diffIDs []string, err error) {
+	selected := make(map[int]bool)
+	for _, p := range positions {
+		if p < 0 || p >= len(layers) {
+			return nil, errors.Errorf("there is no layer %d in an image of %d layers", p, len(layers))
+		}
+		selected[p] = true
+	}
+
+	for i, d := range layers {
+		if selected[i] {
+			diffIDs = append(diffIDs, d)
+		}
+	}
+	return
+}
+
+// ConfigDiffIDs reads the diffIDs of the layers of an image from the file of
+// its config
+func ConfigDiffIDs(filename string) ([]string, error) {
+	config := &ociConfig{}
+	if err := readOCIFile(filename, config); err != nil {
+		return nil, err
+	}
+	return config.RootFS.DiffIDs, nil
+}
+
+// ociBlobName is the name of the blob with digest d relative to the root of
+// an OCI image layout
+func ociBlobName(d digest.Digest) (string, error) {
+	// the digest comes from the archive so it must be validated before it is
+	// used as part of a filename
+	if err := d.Validate(); err != nil {
+		return "", errors.Wrapf(err, "invalid digest: %q", d)
+	}
+	return filepath.Join("blobs", d.Algorithm().String(), d.Hex()), nil
+}
+
+// readOCIBlob decodes the JSON blob with digest d in the OCI image layout at path
+func readOCIBlob(path string, d digest.Digest, v interface{}) error {
+	name, err := ociBlobName(d)
+	if err != nil {
+		return err
+	}
+	return readOCIFile(filepath.Join(path, name), v)
+}
+
+// readOCIFile decodes the JSON file filename, which is part of an extracted
+// OCI image layout
+func readOCIFile(filename string, v interface{}) (err error) {
+	// filename is either index.json or named by a validated digest, so it is a
+	// file in the layout
+	fh, err := os.Open(filename) // #nosec
+	if err != nil {
+		return errors.Wrapf(err, "could not open file: %s", filename)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	if err = json.NewDecoder(fh).Decode(v); err != nil {
+		err = errors.Wrapf(err, "could not decode: %s", filename)
+	}
+
+	return
+}
@@ -0,0 +1,323 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// ociArchive builds an OCI archive in memory
+type ociArchive struct {
+	t     *testing.T
+	files map[string][]byte
+	// symbolic links, which are written before any file
+	links map[string]string
+}
+
+func (a *ociArchive) blob(mediaType string, data []byte) distribution.Descriptor {
+	d := digest.Canonical.FromBytes(data)
+	a.files["blobs/sha256/"+d.Hex()] = data
+	return distribution.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(data))}
+}
+
+func (a *ociArchive) json(mediaType string, v interface{}) distribution.Descriptor {
+	data, err := json.Marshal(v)
+	require.NoError(a.t, err)
+	return a.blob(mediaType, data)
+}
+
+func (a *ociArchive) tar() *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, target := range a.links {
+		require.NoError(a.t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}))
+	}
+	for name, data := range a.files {
+		require.NoError(a.t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}))
+		_, err := tw.Write(data)
+		require.NoError(a.t, err)
+	}
+	require.NoError(a.t, tw.Close())
+	return buf
+}
+
+func mkLayerTar(t *testing.T, content string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "file", Mode: 0600, Size: int64(len(content))}))
+	_, err := tw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestNewManifestFromOCIArchive(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	plain, secret := mkLayerTar(t, "plain"), mkLayerTar(t, "secret")
+	diffIDs := []digest.Digest{digest.Canonical.FromBytes(plain), digest.Canonical.FromBytes(secret)}
+
+	a := &ociArchive{t: t, files: map[string][]byte{"oci-layout": []byte(`{"imageLayoutVersion":"1.0.0"}`)}}
+	config := a.json(distribution.MediaTypeOCIConfig, map[string]interface{}{
+		"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop) ADD file:plain in /"},
+			{"created_by": "LABEL com.senetas.crypto.enabled=true", "empty_layer": true},
+			{"created_by": "/bin/sh -c #(nop) ADD file:secret in /"},
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	manifest := a.json(distribution.MediaTypeOCIManifest, map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        config,
+		"layers": []distribution.Descriptor{
+			a.blob(distribution.MediaTypeOCIUncompressedLayer, plain),
+			a.blob(distribution.MediaTypeOCILayer, gzipBytes(t, secret)),
+		},
+	})
+	manifest.Annotations = map[string]string{distribution.AnnotationRefName: "latest"}
+	a.files["index.json"], _ = json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []distribution.Descriptor{
+			manifest,
+			{MediaType: distribution.MediaTypeOCIManifest, Digest: digest.Canonical.FromString("other")},
+		},
+	})
+
+	ref, err := reference.ParseNormalizedNamed(imageName)
+	require.NoError(err)
+	nTRep, err := names.CastToTagged(ref)
+	require.NoError(err)
+
+	m, err := distribution.NewManifestFromOCIArchive(a.tar(), nTRep, opts, dir)
+	require.NoError(err)
+	require.Len(m.Layers, 2)
+
+	assert.IsType((*distribution.NoncryptedBlob)(nil), m.Layers[0])
+	assert.Equal(diffIDs[0], m.Layers[0].GetDigest())
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[1])
+	assert.Equal(diffIDs[1], m.Layers[1].GetDigest())
+	assert.NoError(m.VerifyDiffIDs())
+
+	// an archive without a marked layer is rejected
+	a.files["index.json"], _ = json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []distribution.Descriptor{a.json(distribution.MediaTypeOCIManifest, map[string]interface{}{
+			"schemaVersion": 2,
+			"config": a.json(distribution.MediaTypeOCIConfig, map[string]interface{}{
+				"history": []map[string]interface{}{{"created_by": "ADD file:plain in /"}},
+				"rootfs":  map[string]interface{}{"type": "layers", "diff_ids": diffIDs[:1]},
+			}),
+			"layers": []distribution.Descriptor{a.blob(distribution.MediaTypeOCIUncompressedLayer, plain)},
+		})},
+	})
+	_, err = distribution.NewManifestFromOCIArchive(a.tar(), nTRep, opts, dir)
+	assert.Error(err)
+}
+
+func TestNewManifestFromPlain(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	plain, secret := mkLayerTar(t, "plain"), mkLayerTar(t, "secret")
+	diffIDs := []digest.Digest{digest.Canonical.FromBytes(plain), digest.Canonical.FromBytes(secret)}
+
+	// the blobs as they are downloaded from a registry
+	a := &ociArchive{t: t, files: map[string][]byte{}}
+	config := a.json(distribution.MediaTypeImageConfig, map[string]interface{}{
+		"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop) ADD file:plain in /"},
+			{"created_by": "/bin/sh -c #(nop)  LABEL com.senetas.crypto.enabled=true", "empty_layer": true},
+			{"created_by": "/bin/sh -c #(nop) ADD file:secret in /"},
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	body, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     distribution.MediaTypeManifest,
+		"config":        config,
+		"layers": []distribution.Descriptor{
+			a.blob(distribution.MediaTypeLayer, gzipBytes(t, plain)),
+			a.blob(distribution.MediaTypeLayer, gzipBytes(t, secret)),
+		},
+	})
+	require.NoError(err)
+
+	pulled := &distribution.ImageManifest{DirName: dir}
+	require.NoError(json.Unmarshal(body, pulled))
+	for _, b := range append([]distribution.Blob{pulled.Config}, pulled.Layers...) {
+		fn := filepath.Join(dir, b.GetDigest().Encoded())
+		require.NoError(ioutil.WriteFile(fn, a.files["blobs/sha256/"+b.GetDigest().Encoded()], 0600))
+		b.SetFilename(fn)
+	}
+
+	opts.SetPassphrase(passphrase)
+	m, err := distribution.NewManifestFromPlain(pulled, opts)
+	require.NoError(err)
+	require.Len(m.Layers, 2)
+
+	assert.IsType((*distribution.NoncryptedBlob)(nil), m.Layers[0])
+	assert.Equal(diffIDs[0], m.Layers[0].GetDigest())
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[1])
+	assert.Equal(diffIDs[1], m.Layers[1].GetDigest())
+	assert.NoError(m.VerifyDiffIDs())
+
+	encrypted, err := m.Encrypt(nil, opts)
+	require.NoError(err)
+	_, err = distribution.NewManifestFromPlain(encrypted, opts)
+	assert.Error(err)
+}
+
+func TestLayersToEncrypt(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	diffIDs := []string{
+		digest.Canonical.FromString("base").String(),
+		digest.Canonical.FromString("secret").String(),
+		digest.Canonical.FromString("app").String(),
+	}
+
+	// the history a daemon reports, without the empty_layer flags
+	history := []distribution.History{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:base in /"},
+		{CreatedBy: "LABEL com.senetas.crypto.enabled=true"},
+		{CreatedBy: "COPY secret /secret # buildkit"},
+		{CreatedBy: "LABEL com.senetas.crypto.enabled=false"},
+		{CreatedBy: "RUN /bin/sh -c make # buildkit"},
+	}
+
+	positions, err := distribution.LayersToEncrypt(history, diffIDs, opts)
+	require.NoError(err)
+	assert.Equal([]int{1}, positions)
+
+	_, err = distribution.LayersToEncrypt(history[:1], diffIDs, opts)
+	assert.Error(err)
+}
+
+func TestNewManifestFromDecrypted(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	opts.SetPassphrase(passphrase)
+	m := mkSquashManifest(t, dir, []bool{false, true},
+		[]tarEntry{tarFile("bin/app", "app")},
+		[]tarEntry{tarFile("etc/secret", "secret")},
+	)
+
+	enc, err := m.Encrypt(nil, opts)
+	require.NoError(err)
+	dec, err := enc.Decrypt(nil, opts)
+	require.NoError(err)
+	require.NoError(dec.VerifyDiffIDs())
+
+	// the layers that were encrypted are encrypted again, with new keys
+	again, err := distribution.NewManifestFromDecrypted(enc, dec, opts)
+	require.NoError(err)
+	require.Len(again.Layers, 2)
+	assert.IsType((*distribution.NoncryptedBlob)(nil), again.Layers[0])
+	assert.Implements((*distribution.DecryptedBlob)(nil), again.Layers[1])
+	assert.Equal(m.Layers[1].GetDigest(), again.Layers[1].GetDigest())
+
+	enc2, err := again.Encrypt(nil, opts)
+	require.NoError(err)
+	assert.NotEqual(enc.Layers[1].GetDigest(), enc2.Layers[1].GetDigest())
+}
+
+func TestReencryptPassphrase(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	// the image is encrypted with the passphrase a
+	a := *opts
+	a.SetPassphrase(passphrase)
+	m := mkSquashManifest(t, dir, []bool{false, true},
+		[]tarEntry{tarFile("bin/app", "app")},
+		[]tarEntry{tarFile("etc/secret", "secret")},
+	)
+	enc, err := m.Encrypt(nil, &a)
+	require.NoError(err)
+	dec, err := enc.Decrypt(nil, &a)
+	require.NoError(err)
+
+	// and encrypted again with new keys wrapped with the passphrase b
+	b := *opts
+	b.SetPassphrase("correct horse battery staple")
+	again, err := distribution.NewManifestFromDecrypted(enc, dec, &b)
+	require.NoError(err)
+	enc2, err := again.Encrypt(nil, &b)
+	require.NoError(err)
+
+	// which b decrypts to the layers that were encrypted with a
+	dec2, err := enc2.Decrypt(nil, &b)
+	require.NoError(err)
+	require.NoError(dec2.VerifyDiffIDs())
+	require.Len(dec2.Layers, 2)
+	for i, l := range dec2.Layers {
+		assert.Equal(m.Layers[i].GetDigest(), l.GetDigest())
+		want, err := ioutil.ReadFile(m.Layers[i].GetFilename())
+		require.NoError(err)
+		got, err := ioutil.ReadFile(l.GetFilename())
+		require.NoError(err)
+		assert.Equal(want, got)
+	}
+
+	// but a no longer does
+	_, err = enc2.Decrypt(nil, &a)
+	if assert.Error(err) {
+		assert.Equal(utils.ClassDecrypt, utils.ClassOf(err))
+	}
+}
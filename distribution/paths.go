@@ -0,0 +1,285 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// SplitComment is the comment on the history entries of the layers that hold
+// the files split from the layer below by SplitPaths
+const SplitComment = "com.senetas.crypto: files of the layer below that match the encrypted paths"
+
+// SplitPaths splits each layer to encrypt into a plain layer of the files whose
+// paths do not match any of patterns, followed by a layer to encrypt of those
+// that do, so that secrets may be protected without encrypting the whole of a
+// layer. A layer in which no files match is not encrypted at all. The config is
+// rewritten to match. The patterns are globs in which * and ? do not match a /,
+// and ** matches anything, and a path also matches if any of its parents does.
+func (m *ImageManifest) SplitPaths(patterns []string) (err error) {
+	globs, err := compileGlobs(patterns)
+	if err != nil {
+		return
+	}
+
+	var (
+		layers  []Blob
+		diffIDs = make(map[int][]digest.Digest)
+	)
+
+	for i, l := range m.Layers {
+		blob, ok := l.(*decryptedBlob)
+		if !ok {
+			layers = append(layers, l)
+			continue
+		}
+
+		var plain, secret Blob
+		if plain, secret, err = splitLayer(blob, globs, m.DirName); err != nil {
+			return
+		}
+
+		switch {
+		case secret == nil:
+			log.Debug().Msgf("no files of layer %d match the encrypted paths", i)
+			layers = append(layers, NewPlainLayer(blob.GetFilename(), blob.GetDigest(), blob.Size))
+		case plain == nil:
+			layers = append(layers, l)
+		default:
+			log.Debug().Msgf("splitting layer %d", i)
+			layers = append(layers, plain, secret)
+			diffIDs[i] = []digest.Digest{plain.GetDigest(), secret.GetDigest()}
+		}
+	}
+
+	if len(diffIDs) > 0 {
+		var filename string
+		filename, err = rewriteConfig(m.Config.GetFilename(), len(m.Layers), func(
+			old []digest.Digest,
+			history []map[string]interface{},
+		) (split []digest.Digest, out []map[string]interface{}) {
+			for i, d := range old {
+				if ds, ok := diffIDs[i]; ok {
+					split = append(split, ds...)
+					continue
+				}
+				split = append(split, d)
+			}
+
+			n := 0
+			for _, h := range history {
+				out = append(out, h)
+				if empty, _ := h["empty_layer"].(bool); empty {
+					continue
+				}
+				if _, ok := diffIDs[n]; ok {
+					out = append(out, map[string]interface{}{
+						"created":    h["created"],
+						"created_by": h["created_by"],
+						"comment":    SplitComment,
+					})
+				}
+				n++
+			}
+
+			return split, out
+		})
+		if err != nil {
+			return
+		}
+		m.Config.SetFilename(filename)
+	}
+
+	m.Layers = layers
+	return nil
+}
+
+// compileGlobs converts glob patterns into regular expressions of paths that
+// are relative to the root, as they appear in layers
+func compileGlobs(patterns []string) ([]*regexp.Regexp, error) {
+	globs := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		p = strings.Trim(path.Clean("/"+p), "/")
+		if p == "" {
+			return nil, errors.Errorf("the pattern %q matches every file", patterns[i])
+		}
+
+		var re strings.Builder
+		re.WriteString("^")
+		for j := 0; j < len(p); j++ {
+			switch {
+			case strings.HasPrefix(p[j:], "**"):
+				re.WriteString(".*")
+				j++
+			case p[j] == '*':
+				re.WriteString("[^/]*")
+			case p[j] == '?':
+				re.WriteString("[^/]")
+			default:
+				re.WriteString(regexp.QuoteMeta(p[j : j+1]))
+			}
+		}
+		re.WriteString("$")
+
+		var err error
+		if globs[i], err = regexp.Compile(re.String()); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern: %q", patterns[i])
+		}
+	}
+	return globs, nil
+}
+
+// matchGlobs reports whether name or any of its parents match any of globs
+func matchGlobs(globs []*regexp.Regexp, name string) bool {
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		for _, g := range globs {
+			if g.MatchString(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitLayer writes the entries of the tarball of a layer to a plain and a secret
+// tarball in the directory dir, and returns the blobs of those that are not empty
+func splitLayer(layer *decryptedBlob, globs []*regexp.Regexp, dir string) (plain, secret Blob, err error) {
+	hdrs, err := readHeaders(layer)
+	if err != nil {
+		return
+	}
+
+	// whiteouts are matched on the path they delete, so that their names do not
+	// give away the paths, and hard links follow their targets, which must precede
+	// them in a layer at or below their own
+	isSecret := make([]bool, len(hdrs))
+	secretNames := make(map[string]bool)
+	nSecret := 0
+	for i, hdr := range hdrs {
+		name := cleanName(hdr.Name)
+		if base := path.Base(name); strings.HasPrefix(base, whiteoutPrefix) && base != whiteoutOpaque {
+			name = path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix))
+		}
+		isSecret[i] = matchGlobs(globs, name) ||
+			hdr.Typeflag == tar.TypeLink && secretNames[cleanName(hdr.Linkname)]
+		if isSecret[i] {
+			secretNames[name] = true
+			nSecret++
+		}
+	}
+
+	if nSecret == 0 || nSecret == len(hdrs) {
+		if nSecret == 0 {
+			return layer, nil, nil
+		}
+		return nil, layer, nil
+	}
+
+	plainTar, err := newTarFile(filepath.Join(dir, uuid.New().String()+".tar"))
+	if err != nil {
+		return
+	}
+	defer func() { err = plainTar.close(err) }()
+
+	secretTar, err := newTarFile(filepath.Join(dir, uuid.New().String()+".tar"))
+	if err != nil {
+		return
+	}
+	defer func() { err = secretTar.close(err) }()
+
+	r, err := layer.ReadCloser()
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	defer func() { err = utils.CheckedClose(r, err) }()
+
+	tr := tar.NewReader(r)
+	for i := 0; ; i++ {
+		var hdr *tar.Header
+		if hdr, err = tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			err = errors.Wrapf(err, "could not read layer: %s", layer.GetFilename())
+			return
+		}
+
+		out := plainTar
+		if i < len(isSecret) && isSecret[i] {
+			out = secretTar
+		}
+		if err = out.tw.WriteHeader(hdr); err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+		if _, err = io.Copy(out.tw, tr); err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+	}
+
+	if err = plainTar.finish(); err != nil {
+		return
+	}
+	if err = secretTar.finish(); err != nil {
+		return
+	}
+
+	plain = NewPlainLayer(plainTar.filename, plainTar.digester.Digest(), int64(plainTar.cw.Count))
+	secret = NewLayer(secretTar.filename, secretTar.digester.Digest(), int64(secretTar.cw.Count), layer.DeCrypto)
+	return plain, secret, nil
+}
+
+// tarFile is a tarball that is being written to a file
+type tarFile struct {
+	filename string
+	fh       *os.File
+	digester digest.Digester
+	cw       *utils.CounterWriter
+	tw       *tar.Writer
+}
+
+func newTarFile(filename string) (*tarFile, error) {
+	fh, err := os.Create(filename)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	t := &tarFile{filename: filename, fh: fh, digester: digest.Canonical.Digester()}
+	t.cw = &utils.CounterWriter{Writer: io.MultiWriter(fh, t.digester.Hash())}
+	t.tw = tar.NewWriter(t.cw)
+	return t, nil
+}
+
+// finish writes the end of the tarball
+func (t *tarFile) finish() error {
+	return errors.WithStack(t.tw.Close())
+}
+
+func (t *tarFile) close(err error) error {
+	return utils.CheckedClose(t.fh, err)
+}
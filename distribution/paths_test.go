@@ -0,0 +1,85 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestSplitPaths(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(path, 0700))
+	defer func() { assert.NoError(utils.CleanUp(path, nil)) }()
+
+	m := mkSquashManifest(t, path, []bool{false, true, true, true},
+		[]tarEntry{tarFile("etc/passwd", "root")},
+		[]tarEntry{
+			tarDir("opt/"),
+			tarFile("opt/app", "app"),
+			tarDir("opt/secret/"),
+			tarFile("opt/secret/key", "key"),
+			tarLink("opt/keylink", "opt/secret/key"),
+			tarFile("etc/tls/cert.pem", "cert"),
+			tarFile("etc/tls/.wh.old.pem", ""),
+		},
+		[]tarEntry{tarFile("readme", "readme")},
+		[]tarEntry{tarFile("opt/secret/other", "other")},
+	)
+	base, whole := m.Layers[0], m.Layers[3]
+
+	require.NoError(m.SplitPaths([]string{"/opt/secret/**", "etc/**/*.pem"}))
+	require.Len(m.Layers, 5)
+
+	assert.Equal(base, m.Layers[0])
+	assert.IsType((*distribution.NoncryptedBlob)(nil), m.Layers[1])
+	assert.Equal([]string{"opt/", "opt/app", "opt/secret/"}, tarNames(t, m.Layers[1]))
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[2])
+	assert.Equal(
+		[]string{"opt/secret/key", "opt/keylink", "etc/tls/cert.pem", "etc/tls/.wh.old.pem"},
+		tarNames(t, m.Layers[2]),
+	)
+
+	// a layer without secrets is not encrypted, and one of only secrets is kept whole
+	assert.IsType((*distribution.NoncryptedBlob)(nil), m.Layers[3])
+	assert.Equal(whole, m.Layers[4])
+	assert.NoError(m.VerifyDiffIDs())
+
+	data, err := ioutil.ReadFile(m.Config.GetFilename())
+	require.NoError(err)
+	config := &struct {
+		History []struct {
+			Comment string `json:"comment"`
+		}
+	}{}
+	require.NoError(json.Unmarshal(data, config))
+	require.Len(config.History, 5)
+	assert.Equal(distribution.SplitComment, config.History[2].Comment)
+
+	assert.Error(m.SplitPaths([]string{"/"}))
+}
@@ -0,0 +1,103 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"os"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+)
+
+// ManifestPlan describes what encrypting an image would do, without encrypting it
+type ManifestPlan struct {
+	MediaType string     `json:"mediaType"`
+	Config    BlobPlan   `json:"config"`
+	Layers    []BlobPlan `json:"layers"`
+}
+
+// BlobPlan describes whether a blob of an image would be encrypted, or only
+// compressed
+type BlobPlan struct {
+	// Digest is that of the blob before it is compressed or encrypted, which for a
+	// layer is its diff ID
+	Digest digest.Digest `json:"digest,omitempty"`
+	// MediaType is that of the blob once it is encrypted or compressed
+	MediaType string `json:"mediaType"`
+	// Size is that of the blob before it is compressed or encrypted
+	Size    int64 `json:"size"`
+	Encrypt bool  `json:"encrypt"`
+}
+
+// Plan describes what encrypting m with opts would do, without encrypting it. The
+// layers are split by opts.EncryptPaths and squashed by opts.Squash first, as they
+// would be on encryption, which changes m.
+func (m *ImageManifest) Plan(opts *crypto.Opts) (plan *ManifestPlan, err error) {
+	if len(opts.EncryptPaths) > 0 {
+		if err = m.SplitPaths(opts.EncryptPaths); err != nil {
+			return
+		}
+	}
+	if opts.Squash {
+		if err = m.SquashLayers(); err != nil {
+			return
+		}
+	}
+
+	plan = &ManifestPlan{
+		MediaType: m.MediaType,
+		Layers:    make([]BlobPlan, len(m.Layers)),
+	}
+
+	if plan.Config, err = planBlob(m.Config, opts); err != nil {
+		return nil, err
+	}
+	for i, l := range m.Layers {
+		if plan.Layers[i], err = planBlob(l, opts); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+func planBlob(b Blob, opts *crypto.Opts) (plan BlobPlan, err error) {
+	plan = BlobPlan{
+		Digest:    b.GetDigest(),
+		MediaType: b.GetMediaType(),
+		Size:      b.GetSize(),
+	}
+
+	switch b.(type) {
+	case DecryptedBlob:
+		plan.Encrypt = true
+		plan.MediaType = encryptedMediaType(plan.MediaType, opts)
+	case *NoncryptedBlob:
+	default:
+		return plan, errors.Errorf("blob is of wrong type: %T", b)
+	}
+
+	// the sizes of blobs that were extracted from an archive are not known until
+	// they are encrypted or compressed
+	if plan.Size == 0 {
+		fi, err := os.Stat(b.GetFilename())
+		if err != nil {
+			return plan, errors.WithStack(err)
+		}
+		plan.Size = fi.Size()
+	}
+	return plan, nil
+}
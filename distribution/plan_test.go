@@ -0,0 +1,60 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestPlan(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	m := mkSquashManifest(t, dir, []bool{false, true},
+		[]tarEntry{tarFile("etc/hosts", "localhost")},
+		[]tarEntry{tarFile("root/secret", "swordfish")},
+	)
+
+	plan, err := m.Plan(opts)
+	require.NoError(err)
+	require.Len(plan.Layers, 2)
+
+	assert.True(plan.Config.Encrypt)
+	assert.False(plan.Layers[0].Encrypt)
+	assert.True(plan.Layers[1].Encrypt)
+	assert.Equal(m.Layers[1].GetDigest(), plan.Layers[1].Digest)
+	assert.Equal(m.Layers[0].GetMediaType(), plan.Layers[0].MediaType)
+	assert.Equal(m.Layers[1].GetMediaType()+opts.MediaTypeSuffix(), plan.Layers[1].MediaType)
+	for _, b := range plan.Layers {
+		assert.NotZero(b.Size)
+	}
+
+	// nothing was encrypted
+	files, err := filepath.Glob(filepath.Join(dir, "*.aes"))
+	require.NoError(err)
+	assert.Empty(files)
+}
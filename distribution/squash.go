@@ -0,0 +1,397 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// SquashLayers merges each run of consecutive layers that are to be encrypted into
+// a single layer, so that fewer keys are needed and the layer structure of the
+// sensitive part of the image is hidden. The config is rewritten to match. The
+// files of the squashed layers and the config are written to the directory of
+// the manifest.
+func (m *ImageManifest) SquashLayers() (err error) {
+	var (
+		layers  []Blob
+		runs    [][2]int
+		diffIDs []digest.Digest
+	)
+
+	for i := 0; i < len(m.Layers); {
+		j := i
+		for j < len(m.Layers) && isToEncrypt(m.Layers[j]) {
+			j++
+		}
+
+		switch {
+		case j-i > 1:
+			log.Debug().Msgf("squashing layers %d to %d", i, j-1)
+			var squashed Blob
+			if squashed, err = squashLayers(m.Layers[i:j], m.DirName); err != nil {
+				return
+			}
+			layers = append(layers, squashed)
+			runs = append(runs, [2]int{i, j})
+			diffIDs = append(diffIDs, squashed.GetDigest())
+		case j == i:
+			j++
+			fallthrough
+		default:
+			layers = append(layers, m.Layers[i:j]...)
+		}
+		i = j
+	}
+
+	if len(runs) == 0 {
+		return nil
+	}
+
+	filename, err := squashConfig(m.Config.GetFilename(), len(m.Layers), runs, diffIDs)
+	if err != nil {
+		return
+	}
+	m.Config.SetFilename(filename)
+	m.Layers = layers
+
+	return nil
+}
+
+func isToEncrypt(b Blob) bool {
+	_, ok := b.(*decryptedBlob)
+	return ok
+}
+
+// squashLayers merges the tarballs of layers, lowest first, into one tarball that
+// has the same effect when applied. Entries that are overwritten or deleted by a
+// higher layer are dropped, but whiteouts are kept as they may delete files from
+// the layers below.
+func squashLayers(layers []Blob, dir string) (_ Blob, err error) {
+	keep, err := squashedEntries(layers)
+	if err != nil {
+		return
+	}
+
+	filename := filepath.Join(dir, uuid.New().String()+".tar")
+	fh, err := os.Create(filename)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	digester := digest.Canonical.Digester()
+	cw := &utils.CounterWriter{Writer: io.MultiWriter(fh, digester.Hash())}
+	tw := tar.NewWriter(cw)
+
+	for i, l := range layers {
+		if err = copyEntries(tw, l, keep[i]); err != nil {
+			return
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	return NewLayer(filename, digester.Digest(), int64(cw.Count), layers[0].(*decryptedBlob).DeCrypto), nil
+}
+
+// squashedEntries decides which entries of each layer are kept, visiting the
+// layers from the highest down, so that what a layer hides is known before the
+// layers below it are visited
+func squashedEntries(layers []Blob) (keep [][]bool, err error) {
+	keep = make([][]bool, len(layers))
+
+	var (
+		// paths that a higher layer has an entry for, and whether it is a directory
+		seen = make(map[string]bool)
+		// paths whose contents are replaced, by a whiteout or a file, in a higher layer
+		hidden = make(map[string]bool)
+		// directories made opaque in a higher layer
+		opaque = make(map[string]bool)
+	)
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		entries, err := readHeaders(layers[i])
+		if err != nil {
+			return nil, err
+		}
+
+		newSeen := make(map[string]bool)
+		newHidden := make(map[string]bool)
+		newOpaque := make(map[string]bool)
+		keep[i] = make([]bool, len(entries))
+
+		for j, hdr := range entries {
+			name := cleanName(hdr.Name)
+			base := path.Base(name)
+
+			if hiddenBy(name, hidden, opaque) {
+				continue
+			}
+
+			switch {
+			case base == whiteoutOpaque:
+				newOpaque[path.Dir(name)] = true
+			case strings.HasPrefix(base, whiteoutPrefix):
+				newHidden[path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix))] = true
+			default:
+				isDir := hdr.Typeflag == tar.TypeDir
+				if dir, ok := seen[name]; hidden[name] || ok && !(dir && isDir) {
+					continue
+				}
+				newSeen[name] = isDir
+				if !isDir {
+					newHidden[name] = true
+				}
+				// the target of a hard link must precede it, which it no longer
+				// does if it is overwritten by a higher layer
+				if target := cleanName(hdr.Linkname); hdr.Typeflag == tar.TypeLink {
+					if _, ok := seen[target]; ok || hidden[target] || hiddenBy(target, hidden, opaque) {
+						return nil, errors.Errorf("cannot squash layers: the target of the hard link %s is overwritten", name)
+					}
+				}
+			}
+			keep[i][j] = true
+		}
+
+		for k, v := range newSeen {
+			seen[k] = seen[k] || v
+		}
+		for k := range newHidden {
+			hidden[k] = true
+		}
+		for k := range newOpaque {
+			opaque[k] = true
+		}
+	}
+
+	return keep, nil
+}
+
+// hiddenBy reports whether a higher layer hides the entry name, by deleting one
+// of its parents, replacing one with a file or making one opaque
+func hiddenBy(name string, hidden, opaque map[string]bool) bool {
+	for p := path.Dir(name); p != "." && p != "/"; p = path.Dir(p) {
+		if hidden[p] || opaque[p] {
+			return true
+		}
+	}
+	return false
+}
+
+func cleanName(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "./"))
+}
+
+// readHeaders reads the headers of the entries in the tarball of a layer
+func readHeaders(b Blob) (hdrs []*tar.Header, err error) {
+	r, err := b.ReadCloser()
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	defer func() { err = utils.CheckedClose(r, err) }()
+
+	tr := tar.NewReader(r)
+	for {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			return hdrs, nil
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "could not read layer: %s", b.GetFilename())
+			return
+		}
+		hdrs = append(hdrs, hdr)
+	}
+}
+
+// copyEntries copies the entries of the tarball of a layer that are to be kept
+func copyEntries(tw *tar.Writer, b Blob, keep []bool) (err error) {
+	r, err := b.ReadCloser()
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	defer func() { err = utils.CheckedClose(r, err) }()
+
+	tr := tar.NewReader(r)
+	for i := 0; ; i++ {
+		var hdr *tar.Header
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "could not read layer: %s", b.GetFilename())
+			return
+		}
+		if i >= len(keep) || !keep[i] {
+			continue
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+		if _, err = io.Copy(tw, tr); err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+	}
+}
+
+// squashConfig writes a copy of the config at filename in which the diffIDs of
+// each run of squashed layers are replaced by the diffID of the squashed layer,
+// and the history entries of all but the last layer of the run are marked empty
+func squashConfig(
+	filename string,
+	layers int,
+	runs [][2]int,
+	diffIDs []digest.Digest,
+) (string, error) {
+	return rewriteConfig(filename, layers, func(old []digest.Digest, history []map[string]interface{}) (
+		squashed []digest.Digest,
+		_ []map[string]interface{},
+	) {
+		// the position of each layer that is squashed into a higher one
+		merged := make(map[int]bool)
+		for i, n := 0, 0; i < len(old); i++ {
+			if n < len(runs) && i >= runs[n][0] {
+				if i == runs[n][0] {
+					squashed = append(squashed, diffIDs[n])
+				}
+				if i < runs[n][1]-1 {
+					merged[i] = true
+				} else {
+					n++
+				}
+				continue
+			}
+			squashed = append(squashed, old[i])
+		}
+
+		n := 0
+		for _, h := range history {
+			if empty, _ := h["empty_layer"].(bool); empty {
+				continue
+			}
+			if merged[n] {
+				h["empty_layer"] = true
+			}
+			n++
+		}
+
+		return squashed, history
+	})
+}
+
+// rewriteConfig writes a copy of the config at filename, of an image with the
+// given number of layers, with its diffIDs and history replaced by those that
+// rewrite returns, and returns the name of the copy. Other fields of the config
+// are kept as they are.
+func rewriteConfig(
+	filename string,
+	layers int,
+	rewrite func([]digest.Digest, []map[string]interface{}) ([]digest.Digest, []map[string]interface{}),
+) (_ string, err error) {
+	// the config file has either been created locally or downloaded to a file
+	// named by its validated digest
+	data, err := ioutil.ReadFile(filename) // #nosec
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	var (
+		config  map[string]json.RawMessage
+		rootfs  map[string]json.RawMessage
+		history []map[string]interface{}
+		diffIDs []digest.Digest
+	)
+	if err = json.Unmarshal(data, &config); err != nil {
+		err = errors.Wrap(err, "could not read the config")
+		return
+	}
+	if err = json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		err = errors.Wrap(err, "could not read the rootfs of the config")
+		return
+	}
+	if err = json.Unmarshal(rootfs["diff_ids"], &diffIDs); err != nil {
+		err = errors.Wrap(err, "could not read the diffIDs of the config")
+		return
+	}
+	if len(diffIDs) != layers {
+		return "", errors.Errorf("the image has %d layers but its config lists %d diffIDs", layers, len(diffIDs))
+	}
+	if config["history"] != nil {
+		if err = json.Unmarshal(config["history"], &history); err != nil {
+			err = errors.Wrap(err, "could not read the history of the config")
+			return
+		}
+	}
+
+	diffIDs, history = rewrite(diffIDs, history)
+
+	if rootfs["diff_ids"], err = json.Marshal(diffIDs); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	if config["rootfs"], err = json.Marshal(rootfs); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	if history != nil {
+		if config["history"], err = json.Marshal(history); err != nil {
+			err = errors.WithStack(err)
+			return
+		}
+	}
+
+	if data, err = json.Marshal(config); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	out := filepath.Join(filepath.Dir(filename), uuid.New().String()+".json")
+	if err = ioutil.WriteFile(out, data, 0600); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	return out, nil
+}
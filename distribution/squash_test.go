@@ -0,0 +1,192 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+type tarEntry struct {
+	hdr  tar.Header
+	data string
+}
+
+func tarFile(name, data string) tarEntry {
+	return tarEntry{tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}, data}
+}
+
+func tarDir(name string) tarEntry {
+	return tarEntry{hdr: tar.Header{Name: name, Mode: 0700, Typeflag: tar.TypeDir}}
+}
+
+func tarLink(name, target string) tarEntry {
+	return tarEntry{hdr: tar.Header{Name: name, Mode: 0600, Typeflag: tar.TypeLink, Linkname: target}}
+}
+
+// mkSquashManifest writes a layer for each of layers, which are encrypted if
+// they are marked in encrypt, and a config with a history entry for each
+func mkSquashManifest(t *testing.T, path string, encrypt []bool, layers ...[]tarEntry) *distribution.ImageManifest {
+	require := require.New(t)
+
+	dec, err := crypto.NewDecrypto(opts)
+	require.NoError(err)
+
+	m := &distribution.ImageManifest{DirName: path}
+	var diffIDs []digest.Digest
+	var history []map[string]interface{}
+
+	for i, entries := range layers {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, e := range entries {
+			hdr := e.hdr
+			require.NoError(tw.WriteHeader(&hdr))
+			_, err = tw.Write([]byte(e.data))
+			require.NoError(err)
+		}
+		require.NoError(tw.Close())
+
+		fn := filepath.Join(path, uuid.New().String()+".tar")
+		require.NoError(ioutil.WriteFile(fn, buf.Bytes(), 0600))
+
+		d := digest.Canonical.FromBytes(buf.Bytes())
+		diffIDs = append(diffIDs, d)
+		history = append(history, map[string]interface{}{"created_by": fn})
+		if encrypt[i] {
+			m.Layers = append(m.Layers, distribution.NewLayer(fn, d, 0, dec))
+		} else {
+			m.Layers = append(m.Layers, distribution.NewPlainLayer(fn, d, 0))
+		}
+	}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"history":      history,
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(err)
+	fn := filepath.Join(path, "config.json")
+	require.NoError(ioutil.WriteFile(fn, config, 0600))
+	m.Config = distribution.NewConfig(fn, "", 0, dec)
+
+	return m
+}
+
+func tarNames(t *testing.T, b distribution.Blob) (names []string) {
+	r, err := b.ReadCloser()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, r.Close()) }()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestSquashLayers(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(path, 0700))
+	defer func() { assert.NoError(utils.CleanUp(path, nil)) }()
+
+	m := mkSquashManifest(t, path, []bool{false, true, true, true, false},
+		[]tarEntry{tarFile("etc/passwd", "root")},
+		[]tarEntry{tarDir("app/"), tarFile("app/a", "1"), tarFile("app/b", "b"), tarDir("data/"), tarFile("data/old", "old")},
+		[]tarEntry{tarFile("app/a", "2"), tarFile("app/.wh.b", ""), tarFile("etc/.wh.passwd", "")},
+		[]tarEntry{tarDir("data/"), tarFile("data/.wh..wh..opq", ""), tarFile("data/new", "new")},
+		[]tarEntry{tarFile("plain", "plain")},
+	)
+	base, top := m.Layers[0], m.Layers[4]
+
+	require.NoError(m.SquashLayers())
+	require.Len(m.Layers, 3)
+	assert.Equal(base, m.Layers[0])
+	assert.Equal(top, m.Layers[2])
+	assert.Implements((*distribution.DecryptedBlob)(nil), m.Layers[1])
+
+	// overwritten and deleted files are dropped, but whiteouts are kept for the
+	// layers below
+	assert.Equal([]string{
+		"app/", "data/",
+		"app/a", "app/.wh.b", "etc/.wh.passwd",
+		"data/", "data/.wh..wh..opq", "data/new",
+	}, tarNames(t, m.Layers[1]))
+	assert.NoError(m.VerifyDiffIDs())
+
+	data, err := ioutil.ReadFile(m.Config.GetFilename())
+	require.NoError(err)
+	config := &struct {
+		Architecture string
+		History      []struct {
+			EmptyLayer bool `json:"empty_layer"`
+		}
+	}{}
+	require.NoError(json.Unmarshal(data, config))
+	assert.Equal("amd64", config.Architecture)
+	require.Len(config.History, 5)
+	for i, empty := range []bool{false, true, true, false, false} {
+		assert.Equal(empty, config.History[i].EmptyLayer, "history %d", i)
+	}
+
+	// squashing again changes nothing
+	require.NoError(m.SquashLayers())
+	assert.Len(m.Layers, 3)
+}
+
+func TestSquashLayersHardLink(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	path := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	require.NoError(os.MkdirAll(path, 0700))
+	defer func() { assert.NoError(utils.CleanUp(path, nil)) }()
+
+	m := mkSquashManifest(t, path, []bool{true, true},
+		[]tarEntry{tarFile("x", "1"), tarLink("y", "x")},
+		[]tarEntry{tarFile("x", "2")},
+	)
+	assert.Error(m.SquashLayers())
+
+	m = mkSquashManifest(t, path, []bool{true, true},
+		[]tarEntry{tarFile("x", "1"), tarLink("y", "x")},
+		[]tarEntry{tarFile("z", "2")},
+	)
+	require.NoError(m.SquashLayers())
+	require.Len(m.Layers, 1)
+	assert.Equal([]string{"x", "y", "z"}, tarNames(t, m.Layers[0]))
+}
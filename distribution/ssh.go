@@ -0,0 +1,131 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sshDialer returns a dialer of the docker daemon at an ssh:// address, such as
+// ssh://user@host:22, which runs docker system dial-stdio on the host over ssh
+// for each connection, as the docker CLI does
+func sshDialer(host string) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "host = %s", host)
+	}
+	if u.Hostname() == "" || u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+		return nil, errors.Errorf("invalid ssh host, expected ssh://[user@]host[:port]: %s", host)
+	}
+
+	args := []string{"-T"}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return newCommandConn(exec.Command("ssh", args...)) // #nosec
+	}, nil
+}
+
+// commandConn is a connection to the standard input and output of a command
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+
+	waitOnce sync.Once
+	waitErr  error
+}
+
+func newCommandConn(cmd *exec.Cmd) (_ *commandConn, err error) {
+	c := &commandConn{cmd: cmd}
+	if c.stdin, err = cmd.StdinPipe(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if c.stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cmd.Stderr = &c.stderr
+
+	if err = cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "could not run %s", cmd.Args[0])
+	}
+	return c, nil
+}
+
+// wait waits for the command to exit, returning an error with its stderr if it
+// failed
+func (c *commandConn) wait() error {
+	c.waitOnce.Do(func() {
+		if err := c.cmd.Wait(); err != nil {
+			c.waitErr = errors.Errorf("%s: %v: %s", c.cmd.Args[0], err, bytes.TrimSpace(c.stderr.Bytes()))
+		}
+	})
+	return c.waitErr
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		// the connection is closed by the command exiting, which explains why if
+		// it failed, such as when the host could not be reached
+		if werr := c.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *commandConn) Close() error {
+	_ = c.stdin.Close()
+	if c.cmd.Process != nil {
+		_ = c.cmd.Process.Kill()
+	}
+	_ = c.wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return commandAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr { return commandAddr{} }
+
+// the deadlines of the connection are those of the command, which is killed when
+// the connection is closed
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type commandAddr struct{}
+
+func (commandAddr) Network() string { return "command" }
+func (commandAddr) String() string  { return "command" }
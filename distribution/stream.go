@@ -0,0 +1,273 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"context"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+)
+
+// errStreamStopped is the error of the layers that were left when a layerStream
+// was stopped
+var errStreamStopped = errors.New("the layer was not processed as the image was not read in full")
+
+// layerStream encrypts or compresses the layers of an image in the background, as
+// each is read from the source, so that the encryption of the first layers
+// overlaps the reading of the rest. A layer is processed once it has been read and
+// the layers to encrypt have been chosen, which may not be until the config has
+// been read, since docker save may write the config after the layers.
+type layerStream struct {
+	ctx  context.Context
+	opts *crypto.Opts
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// diffIDs are those of the layers of the image, which are the only files that
+	// are streamed, or nil if every file that is added is a layer
+	diffIDs map[digest.Digest]bool
+	// chosen are the diffIDs of the layers to encrypt, nil until they are known
+	chosen map[string]bool
+	layers map[digest.Digest]*streamedLayer
+	// added are the layers in the order they were read, and queue those that are
+	// ready to be processed
+	added  []*streamedLayer
+	queue  []*streamedLayer
+	closed bool
+	done   chan struct{}
+}
+
+// streamedLayer is a layer that has been read by a layerStream, in is the blob
+// that is processed and out the result, once done is closed
+type streamedLayer struct {
+	filename string
+	d        digest.Digest
+	in       Blob
+	out      Blob
+	err      error
+	done     chan struct{}
+}
+
+// streams reports whether the layers of an image encrypted with opts may be
+// processed as they are read. Those that are split or squashed are not, as the
+// layers that are encrypted are not those that are read.
+func streams(opts *crypto.Opts) bool {
+	return opts.Stream && opts.Algos == crypto.Pbkdf2Aes256Gcm &&
+		len(opts.EncryptPaths) == 0 && !opts.Squash
+}
+
+// newLayerStream starts a layerStream for the layers with diffIDs, or for every
+// file that is added if diffIDs is nil, or returns nil if the layers of an image
+// encrypted with opts are not streamed. The passphrase is obtained first, so that
+// the background never prompts for it.
+func newLayerStream(ctx context.Context, opts *crypto.Opts, diffIDs []digest.Digest) *layerStream {
+	if !streams(opts) {
+		return nil
+	}
+	if _, err := opts.GetPassphrase(crypto.StdinPassReader); err != nil {
+		log.Debug().Err(err).Msg("not encrypting layers as they are read")
+		return nil
+	}
+
+	s := &layerStream{
+		ctx:    ctx,
+		opts:   opts,
+		layers: make(map[digest.Digest]*streamedLayer),
+		done:   make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if diffIDs != nil {
+		s.diffIDs = make(map[digest.Digest]bool)
+		for _, d := range diffIDs {
+			s.diffIDs[d] = true
+		}
+	}
+
+	go s.run()
+	return s
+}
+
+// add hands the layer in filename, with the digest d, to the stream, if it is one
+// of the layers of the image that has not been added already
+func (s *layerStream) add(filename string, d digest.Digest) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.diffIDs != nil && !s.diffIDs[d] || s.layers[d] != nil {
+		return
+	}
+	l := &streamedLayer{filename: filename, d: d, done: make(chan struct{})}
+	s.layers[d] = l
+	s.added = append(s.added, l)
+	if s.chosen != nil {
+		s.prepare(l)
+	}
+}
+
+// choose sets the diffIDs of the layers to encrypt, after which the layers are
+// processed. Only the first call has an effect.
+func (s *layerStream) choose(layers []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chosen != nil {
+		return
+	}
+	s.chosen = make(map[string]bool)
+	for _, d := range layers {
+		s.chosen[d] = true
+	}
+	for _, l := range s.added {
+		s.prepare(l)
+	}
+}
+
+// prepare makes the blob of a layer and queues it, s.mu must be held
+func (s *layerStream) prepare(l *streamedLayer) {
+	if s.chosen[l.d.String()] {
+		dec, err := crypto.NewDecrypto(s.opts)
+		if err != nil {
+			// the layer is left to be processed with the rest of the image
+			l.err = err
+			close(l.done)
+			return
+		}
+		l.in = NewLayer(l.filename, l.d, 0, dec)
+	} else {
+		l.in = NewPlainLayer(l.filename, l.d, 0)
+	}
+	s.queue = append(s.queue, l)
+	s.cond.Signal()
+}
+
+// run processes the layers in the order they are queued until the stream is
+// finished or stopped
+func (s *layerStream) run() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		for !s.closed && len(s.queue) == 0 {
+			s.cond.Wait()
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		l := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		l.out, l.err = s.process(l.in)
+		close(l.done)
+	}
+}
+
+// process encrypts or compresses in as EncryptCachedContext would
+func (s *layerStream) process(in Blob) (_ Blob, err error) {
+	if err = errors.WithStack(s.ctx.Err()); err != nil {
+		return
+	}
+
+	switch blob := in.(type) {
+	case DecryptedBlob:
+		log.Debug().Msgf("encrypting layer as it is read: %s", blob.GetFilename())
+		var eb EncryptedBlob
+		if eb, err = blob.EncryptBlob(s.opts, blob.GetFilename()+".aes"); err == nil {
+			return eb, nil
+		}
+	case *NoncryptedBlob:
+		log.Debug().Msgf("compressing layer as it is read: %s", blob.GetFilename())
+		var cb CompressedBlob
+		if cb, err = blob.Compress(blob.GetFilename() + ".gz"); err == nil {
+			return cb, nil
+		}
+	default:
+		err = errors.Errorf("layer is of wrong type: %T", blob)
+	}
+	return
+}
+
+// finish tells the stream that no more layers will be added, so that it stops
+// once those it has are processed
+func (s *layerStream) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// stop abandons the layers that have not been processed, and waits for the one
+// that is being processed, so that no more files are written
+func (s *layerStream) stop() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	for _, l := range s.queue {
+		l.err = errStreamStopped
+		close(l.done)
+	}
+	s.queue = nil
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	<-s.done
+}
+
+// blob returns the blob that the stream processes for the layer with the digest
+// d, or nil if it has none
+func (s *layerStream) blob(d digest.Digest) Blob {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l := s.layers[d]; l != nil {
+		return l.in
+	}
+	return nil
+}
+
+// result waits for the layer in to be processed and returns the result, or nil
+// if in is not processed by the stream, or not with opts
+func (s *layerStream) result(in Blob, opts *crypto.Opts) (Blob, error) {
+	if s == nil || opts != s.opts {
+		return nil, nil
+	}
+	s.mu.Lock()
+	l := s.layers[in.GetDigest()]
+	ok := l != nil && l.in != nil && l.in == in
+	s.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	<-l.done
+	return l.out, l.err
+}
@@ -0,0 +1,262 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// writeSave writes an archive like that of docker save to w, with the config
+// after the layers. The manifest.json that ends the archive is only written once
+// after is done.
+func writeSave(w *io.PipeWriter, files map[string][]byte, order []string, after func() error) {
+	tw := tar.NewWriter(w)
+	write := func(name string) error {
+		data := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	for _, name := range order {
+		if err := write(name); err != nil {
+			w.CloseWithError(err)
+			return
+		}
+	}
+	if err := after(); err != nil {
+		w.CloseWithError(err)
+		return
+	}
+	if err := write("manifest.json"); err != nil {
+		w.CloseWithError(err)
+		return
+	}
+	w.CloseWithError(tw.Close())
+}
+
+func TestNewManifestFromSaveStream(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+
+	base, app := make([]byte, 4096), make([]byte, 4096)
+	_, err := rand.Read(base)
+	require.NoError(err)
+	_, err = rand.Read(app)
+	require.NoError(err)
+	diffIDs := []digest.Digest{digest.Canonical.FromBytes(base), digest.Canonical.FromBytes(app)}
+
+	config, err := json.Marshal(map[string]interface{}{
+		"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop) ADD file:base in /"},
+			{"created_by": "/bin/sh -c #(nop) COPY file:app in /"},
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(err)
+	manifest, err := json.Marshal([]ArchiveManifest{
+		{Config: "config.json", Layers: []string{"base/layer.tar", "app/layer.tar"}},
+	})
+	require.NoError(err)
+	files := map[string][]byte{
+		"base/layer.tar": base,
+		"app/layer.tar":  app,
+		"config.json":    config,
+		"manifest.json":  manifest,
+	}
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, EncryptAll: true, BaseLayers: 1, Stream: true}
+	opts.SetPassphrase("hunter2")
+
+	// the archive only ends once the layer to encrypt is being encrypted, which it
+	// is only before the end if it is encrypted as it is read
+	r, w := io.Pipe()
+	go writeSave(w, files, []string{"base/layer.tar", "app/layer.tar", "config.json"}, func() error {
+		return waitFor(filepath.Join(dir, "*", "app", "layer.tar.aes"))
+	})
+
+	m, err := newManifestFromSave(context.Background(), r, 0, digest.Canonical.FromBytes(config), diffIDs, opts, dir)
+	require.NoError(err)
+	require.NotNil(m.stream)
+	require.Len(m.Layers, 2)
+
+	out, err := m.Encrypt(nil, opts)
+	require.NoError(err)
+	require.Len(out.Layers, 2)
+
+	// the encrypted image is made of the layers that were processed as they were read
+	for i, d := range diffIDs {
+		assert.Equal(m.stream.layers[d].out, out.Layers[i])
+	}
+	assert.IsType((*NoncryptedBlob)(nil), out.Layers[0])
+	assert.True(strings.HasSuffix(out.Layers[0].GetFilename(), ".gz"))
+	assert.Implements((*EncryptedBlob)(nil), out.Layers[1])
+	assert.Equal("1", out.Annotations[AnnotationEncryptedLayers])
+
+	// the layers are not streamed unless asked to be
+	opts.Stream = false
+	r, w = io.Pipe()
+	go writeSave(w, files, []string{"config.json", "base/layer.tar", "app/layer.tar"}, func() error { return nil })
+	m, err = newManifestFromSave(context.Background(), r, 0, digest.Canonical.FromBytes(config), diffIDs, opts, dir)
+	require.NoError(err)
+	assert.Nil(m.stream)
+}
+
+// waitFor waits for a file that matches pattern to be made
+func waitFor(pattern string) error {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		if found, _ := filepath.Glob(pattern); len(found) > 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.Errorf("no file matches %s", pattern)
+}
+
+func TestNewManifestFromPlainPull(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	// the layers as they are stored in the registry, compressed
+	var layers, diffIDs []digest.Digest
+	files := map[digest.Digest][]byte{}
+	for i := 0; i < 2; i++ {
+		data := make([]byte, 4096)
+		_, err := rand.Read(data)
+		require.NoError(err)
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		_, err = zw.Write(data)
+		require.NoError(err)
+		require.NoError(zw.Close())
+
+		d := digest.Canonical.FromBytes(buf.Bytes())
+		files[d] = buf.Bytes()
+		layers = append(layers, d)
+		diffIDs = append(diffIDs, digest.Canonical.FromBytes(data))
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop) ADD file:base in /"},
+			{"created_by": "/bin/sh -c #(nop) COPY file:app in /"},
+		},
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(err)
+	configDigest := digest.Canonical.FromBytes(config)
+	files[configDigest] = config
+
+	plain := &ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        NewPlainConfig("", configDigest, int64(len(config))),
+		DirName:       dir,
+	}
+	for _, d := range layers {
+		plain.Layers = append(plain.Layers, NewPlainLayer("", d, int64(len(files[d]))))
+	}
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, EncryptAll: true, Stream: true}
+	opts.SetPassphrase("hunter2")
+
+	// the second layer is only downloaded once the first is being encrypted, which
+	// it is only before the download ends if it is encrypted as it is downloaded
+	pull := func(downloaded func(digest.Digest, string) error) error {
+		for i, b := range append([]Blob{plain.Config}, plain.Layers...) {
+			if i == 2 {
+				if err := waitFor(filepath.Join(dir, layers[0].Encoded()+".tar.aes")); err != nil {
+					return err
+				}
+			}
+			fn := filepath.Join(dir, b.GetDigest().Encoded())
+			if err := ioutil.WriteFile(fn, files[b.GetDigest()], 0600); err != nil {
+				return err
+			}
+			b.SetFilename(fn)
+			if err := downloaded(b.GetDigest(), fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	m, err := NewManifestFromPlainPull(context.Background(), plain, opts, pull)
+	require.NoError(err)
+	require.NotNil(m.stream)
+
+	out, err := m.Encrypt(nil, opts)
+	require.NoError(err)
+	require.Len(out.Layers, 2)
+	for i, d := range diffIDs {
+		assert.Equal(m.stream.layers[d].out, out.Layers[i])
+		assert.Implements((*EncryptedBlob)(nil), out.Layers[i])
+	}
+	assert.Equal("2", out.Annotations[AnnotationEncryptedLayers])
+}
+
+func TestLayerStreamStop(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, Stream: true}
+	opts.SetPassphrase("hunter2")
+
+	// the layers that were read before the layers to encrypt were chosen are not
+	// processed once the stream is stopped
+	d := digest.Canonical.FromString("layer")
+	s := newLayerStream(context.Background(), opts, []digest.Digest{d})
+	require.NotNil(s)
+	s.add("layer", d)
+	s.stop()
+	assert.Nil(s.blob(d))
+
+	// nor are layers that are not those of the image
+	s = newLayerStream(context.Background(), opts, []digest.Digest{digest.Canonical.FromString("other")})
+	s.choose(nil)
+	s.add("layer", d)
+	s.finish()
+	assert.Nil(s.blob(d))
+}
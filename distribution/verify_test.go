@@ -0,0 +1,87 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package distribution_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestVerifyDiffIDs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	d1 := digest.Canonical.FromString("layer 1")
+	d2 := digest.Canonical.FromString("layer 2")
+
+	configFile := filepath.Join(dir, "config")
+	require.NoError(ioutil.WriteFile(
+		configFile,
+		[]byte(fmt.Sprintf(`{"rootfs":{"type":"layers","diff_ids":["%s","%s"]}}`, d1, d2)),
+		0600,
+	))
+
+	tests := []struct {
+		layers []distribution.Blob
+		errMsg string
+	}{
+		{
+			[]distribution.Blob{
+				distribution.NewPlainLayer("", d1, 0),
+				distribution.NewPlainLayer("", d2, 0),
+			},
+			"",
+		},
+		{
+			[]distribution.Blob{
+				distribution.NewPlainLayer("", d2, 0),
+				distribution.NewPlainLayer("", d1, 0),
+			},
+			fmt.Sprintf("layer 0 does not match the config: diffID is %s, expected %s", d2, d1),
+		},
+		{
+			[]distribution.Blob{distribution.NewPlainLayer("", d1, 0)},
+			"the image has 1 layers but its config lists 2 diffIDs",
+		},
+	}
+
+	for _, test := range tests {
+		manifest := &distribution.ImageManifest{
+			Config: distribution.NewPlainConfig(configFile, "", 0),
+			Layers: test.layers,
+		}
+		err := manifest.VerifyDiffIDs()
+		if test.errMsg == "" {
+			assert.NoError(err)
+		} else {
+			assert.EqualError(err, test.errMsg)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// PushEncryptedArtifact encrypts files as the blobs of an artifact of any type,
+// such as a helm chart or a WASM module, and pushes it under the tag of ref
+func PushEncryptedArtifact(
+	ref reference.Named,
+	artifactType, mediaType string,
+	files []string,
+	opts *crypto.Opts,
+	tempDir string,
+) (desc *distribution.Descriptor, err error) {
+	token, nTRep, endpoint, err := pushAuthProcedure(ref)
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "dir = %s", dir)
+		return
+	}
+
+	plain := make([]*distribution.NoncryptedBlob, len(files))
+	for i, f := range files {
+		if plain[i], err = distribution.NewFileBlob(f, mediaType); err != nil {
+			return
+		}
+	}
+
+	s := utils.StartSpinner("Encrypting...")
+	artifact, blobs, err := distribution.NewEncryptedArtifact(artifactType, plain, dir, opts)
+	s.Done()
+	if err != nil {
+		return
+	}
+
+	return registry.PushTaggedArtifact(token, nTRep, artifact, blobs, endpoint)
+}
+
+// PullEncryptedArtifact pulls the artifact tagged by ref and writes its blobs,
+// decrypted if necessary, to files in outDir named by their titles
+func PullEncryptedArtifact(ref reference.Named, outDir string, opts *crypto.Opts, tempDir string) (err error) {
+	token, nTRep, endpoint, err := authProcedure(ref)
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "dir = %s", dir)
+		return
+	}
+
+	if err = os.MkdirAll(outDir, 0755); err != nil {
+		return errors.Wrapf(err, "dir = %s", outDir)
+	}
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	artifact, err := registry.PullTaggedArtifact(token, nTRep, bldr)
+	if err != nil {
+		return
+	}
+
+	for _, layer := range artifact.Layers {
+		// validate manifest to prevent local file injections
+		if err = layer.Digest.Validate(); err != nil {
+			return
+		}
+
+		log.Info().Msgf("Downloading blob: %s.", layer.Digest)
+		var filename string
+		if filename, err = registry.PullFromDigest(token, nTRep, layer.Digest, bldr, dir); err != nil {
+			return
+		}
+
+		outfile := filepath.Join(outDir, distribution.ArtifactFilename(layer))
+		if _, ok := layer.Annotations[distribution.AnnotationWrappedKey]; !ok {
+			// a blob without a key is only copied if it is of a plain media type
+			if _, err = distribution.DecryptArtifactBlob(layer, filename, outfile, opts); err != nil {
+				return
+			}
+			if err = copyFile(filename, outfile); err != nil {
+				return
+			}
+			continue
+		}
+
+		s := utils.StartSpinner("Decrypting...")
+		_, err = distribution.DecryptArtifactBlob(layer, filename, outfile, opts)
+		s.Done()
+		if err != nil {
+			return
+		}
+	}
+
+	log.Info().Msgf("Successfully pulled %d files to %s.", len(artifact.Layers), outDir)
+	return nil
+}
+
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(in, err) }()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(out, err) }()
+
+	_, err = io.Copy(out, in)
+	return errors.WithStack(err)
+}
@@ -0,0 +1,72 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// BaseDiffIDs obtains the diffIDs of the layers of the image base, which may
+// be given by tag or digest, from its registry. Only the manifest and config
+// of the image are downloaded.
+func BaseDiffIDs(base reference.Named, tempDir string) (_ []string, err error) {
+	token, nTRep, endpoint, err := authProcedure(base)
+	if err != nil {
+		return
+	}
+
+	var ref reference.Named = nTRep
+	if c, ok := base.(reference.Canonical); ok {
+		ref = names.AppendDigest(names.SeperateRepository(c), c.Digest())
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "dir = %s", dir)
+	}
+	defer func() { err = utils.CleanUp(dir, err) }()
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	log.Info().Msgf("Obtaining manifest for base image: %s", ref)
+	manifest, err := registry.PullManifest(token, ref, bldr, dir)
+	if err != nil {
+		return
+	}
+
+	// validate manifest to prevent local file injections
+	if err = manifest.Config.GetDigest().Validate(); err != nil {
+		return
+	}
+
+	filename, err := registry.PullFromDigest(token, ref, manifest.Config.GetDigest(), bldr, dir)
+	if err != nil {
+		return
+	}
+
+	return distribution.ConfigDiffIDs(filename)
+}
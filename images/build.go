@@ -0,0 +1,56 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Build builds the image ref from the build context contextDir with the build
+// command of the container runtime, so that it may then be encrypted. The args
+// are passed through to the build command, and its output is shown to the user.
+func Build(runtime, namespace string, ref reference.Named, contextDir string, args []string) error {
+	var name string
+	var global []string
+	switch runtime {
+	case RuntimeDocker:
+		name = "docker"
+	case RuntimePodman:
+		name = "podman"
+	case RuntimeContainerd:
+		// nerdctl builds with BuildKit straight into the content store of containerd
+		name = "nerdctl"
+		global = []string{"--namespace", namespace}
+	default:
+		return errors.Errorf("unknown runtime: %s", runtime)
+	}
+
+	args = append(append(global, "build", "--tag", reference.FamiliarString(ref)), append(args, contextDir)...)
+
+	log.Info().Msgf("Building image: %s with %s.", ref, name)
+	cmd := exec.Command(name, args...) // #nosec
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "%s build", name)
+	}
+
+	return nil
+}
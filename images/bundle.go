@@ -0,0 +1,119 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// PushBundle packs an image into a single encrypted blob then pushes it as an artifact
+func PushBundle(ref reference.Named, src Source, opts *crypto.Opts, tempDir string) (err error) {
+	// the bundle is encrypted with new keys, so it is never one that ref holds
+	if err = confirmOverwrite([]reference.Named{ref}, ""); err != nil {
+		return err
+	}
+
+	token, nTRep, endpoint, err := pushAuthProcedure(ref)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := src(nTRep, opts, tempDir)
+	if err != nil {
+		return err
+	}
+	defer func() { err = utils.CleanUp(manifest.DirName, err) }()
+
+	s := utils.StartSpinner("Encrypting...")
+	artifact, blobs, err := manifest.Bundle(nTRep, opts)
+	s.Done()
+	if err != nil {
+		return err
+	}
+
+	desc, err := registry.PushTaggedArtifact(token, nTRep, artifact, blobs, endpoint)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Successfully uploaded bundle: %s.", desc.Digest)
+	return nil
+}
+
+// PullBundle pulls an image that was pushed as a bundle, decrypts it and loads it
+// with sink
+func PullBundle(ref reference.Named, sink Sink, opts *crypto.Opts, tempDir string) (err error) {
+	token, nTRep, endpoint, err := authProcedure(ref)
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "dir = %s", dir)
+		return
+	}
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	artifact, err := registry.PullTaggedArtifact(token, nTRep, bldr)
+	if err != nil {
+		return
+	}
+
+	if artifact.ArtifactType != distribution.ArtifactTypeBundle || len(artifact.Layers) != 1 {
+		return errors.Errorf("%s is not an encrypted bundle", ref)
+	}
+
+	// validate manifest to prevent local file injections
+	if err = artifact.Layers[0].Digest.Validate(); err != nil {
+		return
+	}
+
+	log.Info().Msgf("Downloading bundle: %s.", artifact.Layers[0].Digest)
+	filename, err := registry.PullFromDigest(token, nTRep, artifact.Layers[0].Digest, bldr, dir)
+	if err != nil {
+		return
+	}
+
+	s := utils.StartSpinner("Decrypting...")
+	bundle, err := distribution.OpenBundle(artifact, filename, opts)
+	s.Done()
+	if err != nil {
+		return
+	}
+
+	r, err := bundle.ReadCloser()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(r, err) }()
+
+	return sink(r)
+}
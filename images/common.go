@@ -31,12 +31,18 @@ import (
 	"github.com/Senetas/crypto-cli/utils"
 )
 
-// useTLS determines whether the registry requires TLS
+// useTLS determines whether the registry requires TLS. Only insecure registries
+// are tried over plain HTTP, others are always reached over TLS.
 func useTLS(
 	ref names.NamedRepository,
 	repoInfo dregistry.RepositoryInfo,
 	endpoint dregistry.APIEndpoint,
 ) (_ bool, err error) {
+	if endpoint.TLSConfig == nil || !endpoint.TLSConfig.InsecureSkipVerify {
+		endpoint.URL.Scheme = "https"
+		return true, nil
+	}
+
 	endpoint.URL.Scheme = "http"
 	bldr := v2.NewURLBuilder(endpoint.URL, false)
 
@@ -62,7 +68,10 @@ func useTLS(
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
 	if err != nil {
-		return
+		// the registry may only be served over TLS, with a certificate that is not verified
+		log.Debug().Err(err).Msgf("could not reach %s over plain HTTP", endpoint.URL.Host)
+		endpoint.URL.Scheme = "https"
+		return true, nil
 	}
 
 	switch resp.StatusCode {
@@ -80,16 +89,62 @@ func useTLS(
 	case http.StatusOK:
 		return false, nil
 	default:
-		return false, errors.Errorf("status code %s from server", resp.Status)
+		return false, errors.Wrap(httpclient.NewStatusError(resp), "unexpected response from server")
 	}
 }
 
+// authProcedure authenticates with the registry of ref to pull from it
 func authProcedure(ref reference.Named) (
 	token auth.Token,
 	nTRep names.NamedTaggedRepository,
 	endpoint *dregistry.APIEndpoint,
 	err error,
 ) {
+	return authenticate(ref, pullAccess)
+}
+
+// pushAuthProcedure authenticates with the registry of ref to push to it, first
+// creating its repository in registries that do not create them on push, if
+// configured to
+func pushAuthProcedure(ref reference.Named) (
+	token auth.Token,
+	nTRep names.NamedTaggedRepository,
+	endpoint *dregistry.APIEndpoint,
+	err error,
+) {
+	return authenticate(ref, pushAccess)
+}
+
+// deleteAuthProcedure authenticates with the registry of ref to delete from it
+func deleteAuthProcedure(ref reference.Named) (
+	token auth.Token,
+	nTRep names.NamedTaggedRepository,
+	endpoint *dregistry.APIEndpoint,
+	err error,
+) {
+	return authenticate(ref, deleteAccess)
+}
+
+// access is what is done to the repository that is authenticated with
+type access int
+
+const (
+	pullAccess access = iota
+	pushAccess
+	deleteAccess
+)
+
+// authenticate with the registry of ref for access a to its repository and pull
+// access to those of sources, which must be in the same registry, in a single
+// request to its auth server
+func authenticate(ref reference.Named, a access, sources ...reference.Named) (
+	token auth.Token,
+	nTRep names.NamedTaggedRepository,
+	endpoint *dregistry.APIEndpoint,
+	err error,
+) {
+	push := a == pushAccess
+
 	nTRep, err = names.CastToTagged(ref)
 	if err != nil {
 		return
@@ -113,7 +168,29 @@ func authProcedure(ref reference.Named) (
 		return
 	}
 
-	creds, err := auth.NewDefaultCreds(repoInfo)
+	// ECR only accepts basic authentication, with a token from the ECR API
+	if auth.IsECR(repoInfo) {
+		if push {
+			if err = auth.CreateECRRepository(repoInfo); err != nil {
+				return
+			}
+		}
+		token, err = auth.NewECRToken(repoInfo)
+		if err == nil {
+			log.Info().Msg("Authentication successful.")
+		}
+		return
+	}
+
+	var creds auth.Credentials
+	switch {
+	case auth.IsGCR(repoInfo):
+		creds, err = auth.NewGCRCreds(repoInfo)
+	case auth.IsACR(repoInfo):
+		creds, err = auth.NewACRCreds(repoInfo, *endpoint)
+	default:
+		creds, err = auth.NewDefaultCreds(repoInfo)
+	}
 	if err != nil {
 		return
 	}
@@ -123,17 +200,85 @@ func authProcedure(ref reference.Named) (
 		return
 	}
 
+	// registries such as registry:2 with htpasswd only accept basic authentication,
+	// which is sent with every request, while one that does not challenge at all is
+	// sent no credentials
+	switch {
+	case header == "":
+		log.Debug().Msgf("%s does not require authentication", repoInfo.Index.Name)
+		return
+	case auth.BasicChallenge(header):
+		if token, err = auth.NewBasicToken(creds); err != nil {
+			return
+		}
+		if token != nil {
+			log.Info().Msgf("%s does not issue tokens, using basic authentication.", repoInfo.Index.Name)
+		}
+		return
+	case !auth.BearerChallenge(header):
+		err = errors.Errorf("%s asks for an unsupported authentication scheme: %s", repoInfo.Index.Name, header)
+		return
+	}
+
 	ch, err := auth.ParseChallengeHeader(header)
 	if err != nil {
 		return
 	}
 
+	ch.SetDefaultScope(nTRep, push)
+	if a == deleteAccess {
+		ch.SetDeleteScope(nTRep)
+	}
+	for _, src := range sources {
+		ch.AddScope(src, "pull")
+	}
+
+	// a push to a project of Harbor that does not exist fails with an opaque error,
+	// as does one to an application repository of Quay
+	switch {
+	case push && ch.Harbor():
+		err = auth.EnsureHarborProject(repoInfo, *endpoint, creds)
+	case push && ch.Quay():
+		err = auth.CheckQuayRepository(repoInfo, *endpoint)
+	}
+	if err != nil {
+		return
+	}
+
 	token, err = auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(ch)
 	if err != nil {
 		return
 	}
 
+	// a token without push access is only refused once the first blob is uploaded
+	if push {
+		warnIfNotGranted(token, repoInfo, "push")
+	}
+
 	log.Info().Msg("Authentication successful.")
 
 	return
 }
+
+// warnIfNotGranted warns if the token does not grant the action on the repository of
+// repoInfo, as for a Docker Hub access token with only the Read scope
+func warnIfNotGranted(token auth.Token, repoInfo *dregistry.RepositoryInfo, action string) {
+	name := reference.Path(repoInfo.Name)
+	actions, ok := auth.Granted(token, name)
+	if !ok {
+		return
+	}
+
+	for _, a := range actions {
+		if a == action || a == "*" {
+			return
+		}
+	}
+
+	log.Warn().Msgf(
+		"The credentials for %s do not grant %s access to %s. An access token of Docker Hub must have the Read & Write scope to push.",
+		repoInfo.Index.Name,
+		action,
+		name,
+	)
+}
@@ -0,0 +1,112 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// Confirm asks whether to go ahead with an operation that cannot be undone, such
+// as overwriting the tags of images, with a question. If there is no one to ask,
+// it answers fallback, which is set for operations that went ahead without asking
+// before they were confirmed, such as pushes to tags. Nothing is asked if it is
+// nil, as by programs that use this package as a library.
+var Confirm func(question string, fallback bool) (bool, error)
+
+// Forced is whether Confirm answers yes without asking, as with --yes, or with no one
+// to ask and a fallback of yes, so that what it would ask about need not be found
+// out first, such as by probing a registry. It never is if Forced is nil.
+var Forced func(fallback bool) bool
+
+// ErrNotConfirmed is the error of an operation that Confirm declined
+var ErrNotConfirmed = errors.New("the operation was not confirmed")
+
+// confirm asks Confirm the question, failing with ErrNotConfirmed if it declines
+func confirm(question string, fallback bool) error {
+	if Confirm == nil {
+		return nil
+	}
+	ok, err := Confirm(question, fallback)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.WithStack(ErrNotConfirmed)
+	}
+	return nil
+}
+
+// confirmOverwrite asks whether to push the manifest with digest d over the tags of
+// refs that already hold other images, before anything is pushed, or over any
+// image if d is not yet known. References by digest are not asked about, as they
+// replace no tag, and neither are tags that already hold the manifest, as pushing
+// to them changes nothing. The tags are not probed if the answer is forced.
+func confirmOverwrite(refs []reference.Named, d digest.Digest) error {
+	if Confirm == nil || Forced != nil && Forced(true) {
+		return nil
+	}
+
+	var existing []string
+	for _, ref := range refs {
+		if _, ok := ref.(reference.Digested); ok {
+			continue
+		}
+
+		token, nTRep, endpoint, err := pushAuthProcedure(ref)
+		if err != nil {
+			return err
+		}
+		exists, remote, err := registry.ManifestExists(token, names.ManifestReference(nTRep), v2.NewURLBuilder(endpoint.URL, false))
+		if err != nil {
+			return err
+		}
+		if exists && (d == "" || remote != d) {
+			existing = append(existing, ref.String())
+		}
+	}
+
+	if len(existing) == 0 {
+		return nil
+	}
+	return confirm(fmt.Sprintf("%s already %s an image, which will be replaced. Continue?",
+		strings.Join(existing, ", "), plural(len(existing), "holds", "hold")), true)
+}
+
+// canonicalDigest is the digest of a manifest as it is pushed
+func canonicalDigest(manifest interface{}) (digest.Digest, error) {
+	body, err := utils.CanonicalJSON(manifest)
+	if err != nil {
+		return "", err
+	}
+	return digest.Canonical.FromBytes(body), nil
+}
+
+// plural is one if n is 1, and other otherwise
+func plural(n int, one, other string) string {
+	if n == 1 {
+		return one
+	}
+	return other
+}
@@ -0,0 +1,69 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+)
+
+func TestConfirmOverwriteForced(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(confirm func(string, bool) (bool, error), forced func(bool) bool, insecure []string) {
+		Confirm, Forced, httpclient.InsecureRegistries = confirm, forced, insecure
+	}(Confirm, Forced, httpclient.InsecureRegistries)
+
+	// the registry holds another image at every tag
+	probes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "HEAD" {
+			probes++
+		}
+		rw.Header().Set("Docker-Content-Digest", "sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+	httpclient.InsecureRegistries = []string{u.Host}
+	ref, err := reference.ParseNormalizedNamed(u.Host + "/repo:latest")
+	require.NoError(err)
+
+	var asked []string
+	Confirm = func(question string, fallback bool) (bool, error) {
+		asked = append(asked, question)
+		return true, nil
+	}
+
+	// the tag is probed, and asked about, unless the answer is forced
+	Forced = func(bool) bool { return false }
+	require.NoError(confirmOverwrite([]reference.Named{ref}, ""))
+	assert.Equal(1, probes)
+	assert.Len(asked, 1)
+
+	Forced = func(bool) bool { return true }
+	require.NoError(confirmOverwrite([]reference.Named{ref}, ""))
+	assert.Equal(1, probes)
+	assert.Len(asked, 1)
+}
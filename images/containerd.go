@@ -0,0 +1,239 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// Containerd is a containerd daemon, which images are read from and loaded into
+// with its ctr command. It must be installed for it to be used.
+type Containerd struct {
+	// Address is the socket of the daemon, the default of ctr is used if it is empty
+	Address string
+	// Namespace is the namespace of the images
+	Namespace string
+}
+
+func (c *Containerd) ctr(args ...string) *exec.Cmd {
+	var global []string
+	if c.Address != "" {
+		global = append(global, "--address", c.Address)
+	}
+	global = append(global, "--namespace", c.Namespace)
+	return exec.Command("ctr", append(global, args...)...) // #nosec
+}
+
+// Source reads images from containerd. The blobs of the image are read one at a
+// time from the content store, rather than exported together, so that each layer
+// is copied once as it is stored, and may be encrypted while the rest are read.
+func (c *Containerd) Source() Source {
+	return func(
+		ref names.NamedTaggedRepository,
+		opts *crypto.Opts,
+		tempDir string,
+	) (_ *distribution.ImageManifest, err error) {
+		dir := filepath.Join(tempDir, uuid.New().String())
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "dir = %s", dir)
+		}
+		defer func() {
+			if err != nil {
+				err = utils.CleanUp(dir, err)
+			}
+		}()
+
+		plain, err := c.manifest(ref, dir)
+		if err != nil {
+			return
+		}
+
+		log.Info().Msgf("Reading the %d layers of the image from containerd namespace %s.", len(plain.Layers), c.Namespace)
+		return distribution.NewManifestFromPlainPull(context.Background(), plain, opts,
+			func(read func(d digest.Digest, filename string) error) error {
+				files := make(map[digest.Digest]string)
+				for _, b := range append([]distribution.Blob{plain.Config}, plain.Layers...) {
+					d := b.GetDigest()
+					if fn, ok := files[d]; ok {
+						b.SetFilename(fn)
+						continue
+					}
+					fn := filepath.Join(dir, d.Encoded())
+					if err := c.content(d, fn); err != nil {
+						return err
+					}
+					files[d] = fn
+					b.SetFilename(fn)
+					if err := read(d, fn); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+	}
+}
+
+// manifest reads the manifest of the image ref from the content store, or that of
+// the image for registry.Platform if ref is a multi-platform image
+func (c *Containerd) manifest(ref names.NamedTaggedRepository, dir string) (*distribution.ImageManifest, error) {
+	out, err := output(c.ctr("images", "ls", "name=="+ref.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	// the table has the columns REF, TYPE and DIGEST first
+	var mediaType string
+	var d digest.Digest
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == ref.String() {
+			if d, err = digest.Parse(fields[2]); err != nil {
+				return nil, errors.Wrapf(err, "digest of %s", ref)
+			}
+			mediaType = fields[1]
+		}
+	}
+	if d == "" {
+		return nil, errors.Errorf("containerd namespace %s has no image %s", c.Namespace, ref)
+	}
+
+	body, err := c.blob(d)
+	if err != nil {
+		return nil, err
+	}
+
+	if distribution.IsIndex(mediaType) {
+		index := distribution.NewIndex()
+		if err = json.Unmarshal(body, index); err != nil {
+			return nil, errors.Wrapf(err, "index of %s", ref)
+		}
+		var desc *distribution.Descriptor
+		for i, m := range index.Manifests {
+			if m.Platform != nil && m.Platform.Matches(registry.Platform) {
+				desc = &index.Manifests[i]
+				break
+			}
+		}
+		if desc == nil {
+			return nil, errors.Errorf("the index of %s has no image for %s", ref, registry.Platform)
+		}
+		if d, mediaType = desc.Digest, desc.MediaType; mediaType == "" {
+			mediaType = distribution.MediaTypeOCIManifest
+		}
+		if body, err = c.blob(d); err != nil {
+			return nil, err
+		}
+	}
+
+	if mediaType != distribution.MediaTypeManifest && mediaType != distribution.MediaTypeOCIManifest {
+		return nil, errors.Errorf("the manifest of %s is of the unsupported media type %s", ref, mediaType)
+	}
+
+	manifest := &distribution.ImageManifest{DirName: dir, Digest: d}
+	if err = json.Unmarshal(body, manifest); err != nil {
+		return nil, errors.Wrapf(err, "manifest of %s", ref)
+	}
+	return manifest, nil
+}
+
+// blob reads the blob with the digest d from the content store, verifying it
+func (c *Containerd) blob(d digest.Digest) ([]byte, error) {
+	body, err := output(c.ctr("content", "get", d.String()))
+	if err != nil {
+		return nil, err
+	}
+	if actual := d.Algorithm().FromBytes(body); actual != d {
+		return nil, errors.Errorf("the content of %s in containerd has the digest %s", d, actual)
+	}
+	return body, nil
+}
+
+// content copies the blob with the digest d from the content store to filename,
+// verifying it
+func (c *Containerd) content(d digest.Digest, filename string) (err error) {
+	fh, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "filename = %s", filename)
+	}
+
+	verifier := d.Verifier()
+	cmd := c.ctr("content", "get", d.String())
+	cmd.Stdout = io.MultiWriter(fh, verifier)
+	if err = utils.CheckedClose(fh, run(cmd, nil)); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("the content of %s in containerd does not match its digest", d)
+	}
+	return nil
+}
+
+// Sink loads images into containerd
+func (c *Containerd) Sink() Sink {
+	return func(r io.Reader) error {
+		log.Info().Msgf("Importing image into containerd namespace %s.", c.Namespace)
+		return run(c.ctr("images", "import", "-"), r)
+	}
+}
+
+// output runs cmd, returning what it writes to stdout
+func output(cmd *exec.Cmd) ([]byte, error) {
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	if err := run(cmd, nil); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// run runs cmd with stdin in, returning its stderr in the error if it fails
+func run(cmd *exec.Cmd, in io.Reader) error {
+	stderr := &bytes.Buffer{}
+	cmd.Stdin = in
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return utils.WithClass(errors.Errorf("%s: %v: %s", cmd.Args[0], err, bytes.TrimSpace(stderr.Bytes())), utils.ClassDaemon)
+	}
+
+	return nil
+}
+
+func removeFile(filename string, err error) error {
+	if err2 := os.Remove(filename); err2 != nil && !os.IsNotExist(err2) {
+		if err == nil {
+			return errors.WithStack(err2)
+		}
+		return utils.Errors{err, err2}
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// fakeCtr installs a ctr in dir that lists the image ref with the digest and media
+// type of its target, and gets the blobs in the directory store, named by their
+// encoded digests, logging the blobs it gets to the file gets
+func fakeCtr(t *testing.T, dir, ref, mediaType string, d digest.Digest) (store, gets string) {
+	store, gets = filepath.Join(dir, "store"), filepath.Join(dir, "gets")
+	require.NoError(t, os.MkdirAll(store, 0700))
+
+	script := fmt.Sprintf(`#!/bin/sh
+while [ "${1#--}" != "$1" ]; do shift 2; done
+case "$1 $2" in
+"images ls")
+	echo "REF TYPE DIGEST SIZE PLATFORMS LABELS"
+	[ "$3" = "name==%[1]s" ] && echo "%[1]s %[2]s %[3]s 1.0KiB linux/amd64 -"
+	;;
+"content get")
+	echo "$3" >> %[5]s
+	cat "%[4]s/${3#*:}"
+	;;
+esac
+`, ref, mediaType, d, store, gets)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ctr"), []byte(script), 0700))
+	return
+}
+
+func TestContainerdSource(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+	defer func(path string) { assert.NoError(os.Setenv("PATH", path)) }(os.Getenv("PATH"))
+	require.NoError(os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH")))
+
+	blobs := map[digest.Digest][]byte{}
+	put := func(data []byte) digest.Digest {
+		d := digest.Canonical.FromBytes(data)
+		blobs[d] = data
+		return d
+	}
+
+	// an image of two compressed layers, the first of which is repeated, in an index
+	var layers []distribution.Blob
+	var diffIDs []digest.Digest
+	for i := 0; i < 2; i++ {
+		data := make([]byte, 4096)
+		_, err := rand.Read(data)
+		require.NoError(err)
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		_, err = zw.Write(data)
+		require.NoError(err)
+		require.NoError(zw.Close())
+
+		layers = append(layers, distribution.NewPlainLayer("", put(buf.Bytes()), int64(buf.Len())))
+		diffIDs = append(diffIDs, digest.Canonical.FromBytes(data))
+	}
+	layers = append(layers, layers[0])
+	diffIDs = append(diffIDs, diffIDs[0])
+
+	config, err := json.Marshal(map[string]interface{}{
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	require.NoError(err)
+	manifest, err := json.Marshal(&distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Config:        distribution.NewPlainConfig("", put(config), int64(len(config))),
+		Layers:        layers,
+	})
+	require.NoError(err)
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     distribution.MediaTypeOCIIndex,
+		"manifests": []map[string]interface{}{{
+			"mediaType": distribution.MediaTypeManifest,
+			"digest":    put(manifest),
+			"size":      len(manifest),
+			"platform":  registry.Platform,
+		}},
+	})
+	require.NoError(err)
+
+	named, err := reference.ParseNormalizedNamed("cryptocli/alpine:containerd")
+	require.NoError(err)
+	ref, err := names.CastToTagged(named)
+	require.NoError(err)
+	store, gets := fakeCtr(t, dir, ref.String(), distribution.MediaTypeOCIIndex, put(index))
+	for d, data := range blobs {
+		require.NoError(ioutil.WriteFile(filepath.Join(store, d.Encoded()), data, 0600))
+	}
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm, EncryptAll: true}
+	opts.SetPassphrase("hunter2")
+	c := &Containerd{Namespace: dockerNamespace}
+
+	// each blob is read on its own, once, and the layers are decompressed
+	m, err := c.Source()(ref, opts, filepath.Join(dir, "temp"))
+	require.NoError(err)
+	require.Len(m.Layers, 3)
+	for i, l := range m.Layers {
+		assert.Equal(diffIDs[i], l.GetDigest())
+		data, err := ioutil.ReadFile(l.GetFilename())
+		require.NoError(err)
+		assert.Equal(diffIDs[i], digest.Canonical.FromBytes(data))
+	}
+	got, err := ioutil.ReadFile(gets)
+	require.NoError(err)
+	assert.Len(bytes.Fields(got), 5)
+
+	// and a blob that is not what its digest says fails the read
+	require.NoError(ioutil.WriteFile(filepath.Join(store, layers[1].GetDigest().Encoded()), []byte("tampered"), 0600))
+	_, err = c.Source()(ref, opts, filepath.Join(dir, "temp"))
+	assert.Error(err)
+
+	// as does an image that containerd does not have
+	named, err = reference.ParseNormalizedNamed("cryptocli/alpine:missing")
+	require.NoError(err)
+	missing, err := names.CastToTagged(named)
+	require.NoError(err)
+	_, err = c.Source()(missing, opts, filepath.Join(dir, "temp"))
+	assert.Error(err)
+}
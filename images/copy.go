@@ -0,0 +1,118 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// CopyImage copies the encrypted image src to dst, which may be in another
+// registry, as it is, without decrypting it, so that an image may be promoted
+// between environments without its plaintext being exposed. The image keeps its
+// digest and its keys, detached or not, and is tagged with the tag of dst, or that
+// of src if dst has none, or is copied by digest alone if src is a digest.
+func CopyImage(src, dst reference.Named) (*distribution.Descriptor, error) {
+	if _, ok := dst.(reference.Digested); ok {
+		return nil, errors.Errorf("the destination %s may not have a digest, as the copy has that of the source", dst)
+	}
+
+	_, tagged := dst.(reference.Tagged)
+	if t, ok := src.(reference.Tagged); ok && !tagged {
+		var err error
+		if dst, err = reference.WithTag(dst, t.Tag()); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		tagged = true
+	}
+	_, byDigest := src.(reference.Digested)
+	byDigest = byDigest && !tagged
+
+	c, err := copyAuthProcedure(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	if tagged {
+		var srcDesc *distribution.Descriptor
+		srcDesc, err = registry.ResolveManifest(c.SrcToken, names.ManifestReference(c.Src), v2.NewURLBuilder(c.SrcEndpoint.URL, false))
+		if err != nil {
+			return nil, err
+		}
+		if err = confirmOverwrite([]reference.Named{dst}, srcDesc.Digest); err != nil {
+			return nil, err
+		}
+	}
+	desc, err := c.CopyImage(byDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	if byDigest {
+		log.Info().Msgf("Copied %s to %s@%s.", src, dst.Name(), desc.Digest)
+	} else {
+		log.Info().Msgf("Copied %s to %s.", src, dst)
+	}
+	return desc, nil
+}
+
+// copyAuthProcedure authenticates to pull from src and push to dst. If they are in
+// the same registry, a single token is requested for both repositories, so that
+// blobs may be mounted from src rather than streamed through this host.
+func copyAuthProcedure(src, dst reference.Named) (*registry.Copy, error) {
+	if reference.Domain(src) == reference.Domain(dst) {
+		token, dstRep, endpoint, err := authenticate(dst, pushAccess, src)
+		if err != nil {
+			return nil, err
+		}
+		srcRep, err := names.CastToTagged(src)
+		if err != nil {
+			return nil, err
+		}
+		return &registry.Copy{
+			SrcToken:    token,
+			Src:         srcRep,
+			SrcEndpoint: endpoint,
+			DstToken:    token,
+			Dst:         dstRep,
+			DstEndpoint: endpoint,
+			Mount:       true,
+		}, nil
+	}
+
+	srcToken, srcRep, srcEndpoint, err := authProcedure(src)
+	if err != nil {
+		return nil, err
+	}
+
+	dstToken, dstRep, dstEndpoint, err := pushAuthProcedure(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registry.Copy{
+		SrcToken:    srcToken,
+		Src:         srcRep,
+		SrcEndpoint: srcEndpoint,
+		DstToken:    dstToken,
+		Dst:         dstRep,
+		DstEndpoint: dstEndpoint,
+	}, nil
+}
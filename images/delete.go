@@ -0,0 +1,48 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"fmt"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+)
+
+// DeleteImage deletes the image that ref refers to, by tag or digest, from its
+// registry, returning the descriptor of its manifest. Every other tag of the same
+// manifest is deleted with it.
+func DeleteImage(ref reference.Named) (*distribution.Descriptor, error) {
+	if err := confirm(fmt.Sprintf("Delete %s, and every other tag of the same image?", ref), false); err != nil {
+		return nil, err
+	}
+
+	token, nTRep, endpoint, err := deleteAuthProcedure(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := registry.DeleteManifest(token, nTRep, v2.NewURLBuilder(endpoint.URL, false))
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Msgf("Deleted %s: %s.", ref, desc.Digest)
+	return desc, nil
+}
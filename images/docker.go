@@ -0,0 +1,109 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+const (
+	// dockerContainerdSocket is the socket of the containerd that is started by
+	// docker, if docker is not configured to use the containerd of the system
+	dockerContainerdSocket = "/var/run/docker/containerd/containerd.sock"
+
+	// dockerNamespace is the containerd namespace of the images of docker
+	dockerNamespace = "moby"
+
+	// snapshotterDriverType is the driver type reported by a docker daemon that
+	// keeps its images in the containerd image store
+	snapshotterDriverType = "io.containerd.snapshotter.v1"
+)
+
+// DaemonSource reads images from the docker daemon. If the daemon keeps its images
+// in the containerd image store, the blobs of the image are read one at a time from
+// the content store of containerd, as they are stored, rather than with docker save,
+// which serialises every layer of the image again, including the base layers that
+// will not be encrypted. The docker API has no means to export single layers.
+var DaemonSource Source = daemonSource
+
+func daemonSource(
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+	tempDir string,
+) (*distribution.ImageManifest, error) {
+	ctx := context.Background()
+	cli, err := distribution.NewDockerClient(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if c := dockerContainerd(ctx, cli); c != nil {
+		manifest, err := c.Source()(ref, opts, tempDir)
+		if err == nil {
+			return manifest, nil
+		}
+		log.Warn().Err(err).Msg("Could not read the layers of the image from containerd, saving the whole image from docker instead.")
+	}
+
+	return distribution.NewManifestFromDaemon(ctx, cli, ref, opts, tempDir)
+}
+
+// dockerContainerd returns the containerd that holds the images of the daemon that
+// cli is a client of, or nil if it does not use the containerd image store or ctr
+// is not installed. Only a daemon on the local host shares its containerd.
+func dockerContainerd(ctx context.Context, cli *client.Client) *Containerd {
+	if !strings.HasPrefix(cli.DaemonHost(), "unix://") {
+		return nil
+	}
+
+	info, err := cli.Info(ctx)
+	if err != nil {
+		log.Debug().Err(err).Msg("could not get info of docker daemon")
+		return nil
+	}
+
+	var snapshotter bool
+	for _, s := range info.DriverStatus {
+		if s[0] == "driver-type" && s[1] == snapshotterDriverType {
+			snapshotter = true
+		}
+	}
+	if !snapshotter {
+		return nil
+	}
+
+	if _, err := exec.LookPath("ctr"); err != nil {
+		log.Warn().Msg("Docker uses the containerd image store, but ctr is not installed, so the whole image is saved from docker.")
+		return nil
+	}
+
+	c := &Containerd{Address: os.Getenv("CONTAINERD_ADDRESS"), Namespace: dockerNamespace}
+	if c.Address == "" {
+		if _, err := os.Stat(dockerContainerdSocket); err == nil {
+			c.Address = dockerContainerdSocket
+		}
+	}
+	return c
+}
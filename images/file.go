@@ -0,0 +1,61 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// FileSink writes each archive to filename, or to stdout if it is -, in the format
+// of docker save, so that it may be loaded with docker load on another machine. The
+// file is only readable by its owner, as the image is decrypted, and is replaced
+// whole, so that it is not left half written if the pull fails.
+func FileSink(filename string) Sink {
+	if filename == "-" {
+		return func(r io.Reader) error {
+			_, err := io.Copy(os.Stdout, r)
+			return errors.WithStack(err)
+		}
+	}
+
+	return func(r io.Reader) (err error) {
+		fh, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer func() { err = removeFile(fh.Name(), err) }()
+
+		if _, err = io.Copy(fh, r); err != nil {
+			return utils.CheckedClose(fh, errors.WithStack(err))
+		}
+		if err = utils.CheckedClose(fh, nil); err != nil {
+			return err
+		}
+		if err = os.Rename(fh.Name(), filename); err != nil {
+			return errors.WithStack(err)
+		}
+
+		log.Info().Msgf("Wrote the image to %s.", filename)
+		return nil
+	}
+}
@@ -16,13 +16,16 @@ package images
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/client/auth"
 	"github.com/docker/docker/client"
 	"github.com/pkg/errors"
@@ -39,6 +42,7 @@ import (
 func constructImageArchive(
 	manifest *distribution.ImageManifest,
 	ref auth.Scope,
+	sink Sink,
 	opts *crypto.Opts,
 ) (err error) {
 	contents := make([]string, len(manifest.Layers)+2)
@@ -52,6 +56,11 @@ func constructImageArchive(
 		Layers:   make([]string, len(manifest.Layers)),
 	}
 
+	// an image pulled by digest is loaded untagged, as a digest is not a tag
+	if _, ok := ref.(reference.Digested); ok {
+		archiveManifest.RepoTags = nil
+	}
+
 	contents[1] = archiveManifest.Config
 
 	for i, l := range manifest.Layers {
@@ -70,7 +79,7 @@ func constructImageArchive(
 
 	go mkTar(manifest.DirName, contents, pw, errCh)
 
-	if err = loadArchive(pr); err != nil {
+	if err = sink(pr); err != nil {
 		return
 	}
 
@@ -97,18 +106,28 @@ func writeArchiveManifestFile(
 	return
 }
 
+// Sink loads an image archive, in the format of docker save, into a container
+// runtime
+type Sink func(r io.Reader) error
+
+// DaemonSink loads images into the docker daemon
+var DaemonSink Sink = loadArchive
+
 func loadArchive(pr io.Reader) (err error) {
-	// TODO: stop hardcoding version
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithVersion("1.37"))
+	cli, err := distribution.NewDockerClient(context.Background(), "")
 	if err != nil {
-		err = errors.WithStack(err)
 		return
 	}
 
+	return loadArchiveWith(cli, pr)
+}
+
+// loadArchiveWith loads an image archive into the daemon that cli is a client of
+func loadArchiveWith(cli *client.Client, pr io.Reader) (err error) {
 	resp, err := cli.ImageLoad(context.Background(), pr, false)
 	defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	if err != nil {
-		err = errors.WithStack(err)
+		err = utils.WithClass(errors.WithStack(err), utils.ClassDaemon)
 		return
 	}
 
@@ -136,8 +155,21 @@ func loadArchive(pr io.Reader) (err error) {
 		return errors.New("image load failed for unknown reasons")
 	}
 
-	_, err = io.Copy(os.Stderr, resp.Body)
-	return utils.Errors{errors.New("filed to import image"), err}
+	// podman may reply in plain text
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil && bytes.HasPrefix(body, []byte("Loaded image")) {
+		log.Info().Msg(string(bytes.TrimSpace(body)))
+		return nil
+	}
+
+	errs := utils.Errors{errors.New("failed to import image")}
+	if err != nil {
+		errs = append(errs, errors.WithStack(err))
+	}
+	if _, err = os.Stderr.Write(body); err != nil {
+		errs = append(errs, errors.WithStack(err))
+	}
+	return errs
 }
 
 func mkTar(dir string, contents []string, w io.WriteCloser, errCh chan<- error) {
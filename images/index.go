@@ -0,0 +1,140 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	dauth "github.com/docker/distribution/registry/client/auth"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// CreateIndex publishes an image index under ref that combines the single
+// platform images sources, which must already have been pushed to the same
+// repository. The platform of each is read from its config.
+func CreateIndex(
+	ref reference.Named,
+	sources []reference.Named,
+	tempDir string,
+) (desc *distribution.Descriptor, err error) {
+	token, nTRep, endpoint, err := pushAuthProcedure(ref)
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "dir = %s", dir)
+		return
+	}
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+	index := distribution.NewIndex()
+
+	for _, src := range sources {
+		if src.Name() != ref.Name() {
+			err = errors.Errorf("%s is not in the repository %s", src, ref.Name())
+			return
+		}
+
+		var m *distribution.Descriptor
+		if m, err = platformManifest(token, src, bldr, dir); err != nil {
+			return
+		}
+
+		for _, other := range index.Manifests {
+			if samePlatform(other.Platform, m.Platform) {
+				err = errors.Errorf("more than one image is for the platform %s/%s", m.Platform.OS, m.Platform.Architecture)
+				return
+			}
+		}
+
+		log.Info().Msgf("Adding %s for %s/%s.", m.Digest, m.Platform.OS, m.Platform.Architecture)
+		index.Add(*m)
+	}
+
+	return registry.PushIndex(token, nTRep, index, endpoint)
+}
+
+// platformManifest resolves the manifest of a single platform image and reads its
+// platform from its config
+func platformManifest(
+	token dauth.Scope,
+	ref reference.Named,
+	bldr *v2.URLBuilder,
+	dir string,
+) (desc *distribution.Descriptor, err error) {
+	nTRep, err := names.CastToTagged(ref)
+	if err != nil {
+		return
+	}
+
+	if desc, err = registry.ResolveManifest(token, nTRep, bldr); err != nil {
+		return
+	}
+
+	if desc.MediaType != distribution.MediaTypeManifest && desc.MediaType != distribution.MediaTypeOCIManifest {
+		err = errors.Errorf("%s is not a single platform image: %s", ref, desc.MediaType)
+		return
+	}
+
+	// pull by digest so that the manifest is the one that was resolved
+	can := names.AppendDigest(names.SeperateRepository(nTRep), desc.Digest)
+	manifest, err := registry.PullManifest(token, can, bldr, dir)
+	if err != nil {
+		return
+	}
+
+	// validate manifest to prevent local file injections
+	if err = manifest.Config.GetDigest().Validate(); err != nil {
+		return
+	}
+
+	filename, err := registry.PullFromDigest(token, nTRep, manifest.Config.GetDigest(), bldr, dir)
+	if err != nil {
+		return
+	}
+
+	// filename is named by the validated digest of the config
+	fh, err := os.Open(filename) // #nosec
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	desc.Platform, err = distribution.ReadPlatform(fh)
+	return
+}
+
+// samePlatform determines whether two platforms are the same
+func samePlatform(a, b *distribution.Platform) bool {
+	return a.OS == b.OS &&
+		a.Architecture == b.Architecture &&
+		a.Variant == b.Variant &&
+		a.OSVersion == b.OSVersion
+}
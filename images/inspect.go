@@ -0,0 +1,54 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// InspectImage describes the encrypted image that ref refers to, and how each of
+// its blobs is encrypted, from its manifest alone, so that nothing is downloaded
+// but the manifest and, if its keys are detached, the list of its referrers
+func InspectImage(ref reference.Named) (*distribution.ManifestInfo, error) {
+	token, nTRep, endpoint, err := authProcedure(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	manifest, err := registry.PullManifest(token, names.ManifestReference(nTRep), bldr, "")
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := manifest.Inspect()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range append([]distribution.BlobInfo{info.Config}, info.Layers...) {
+		if l.Detached {
+			info.KeyEnvelopes, err = registry.PullReferrers(token, nTRep, manifest.Digest, distribution.MediaTypeKeyEnvelope, bldr)
+			break
+		}
+	}
+	return info, err
+}
@@ -0,0 +1,284 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// kubeImageRegexp matches the image fields of containers in Kubernetes manifests,
+// written in block style, with the reference and its quotes in groups 2 to 4. The
+// manifests are not parsed as YAML, so it is a heuristic that matches any line of
+// the form image: x, whether or not it is a field of a container, such as one in a
+// ConfigMap or a block scalar. The lines it matches are therefore listed and
+// confirmed before they are rewritten.
+var kubeImageRegexp = regexp.MustCompile(`^(\s*(?:-\s+)?image:\s*)(["']?)([^\s"'#]+)(["']?)(\s*(?:#.*)?)$`)
+
+// KubeImage is a reference to an image in a Kubernetes manifest
+type KubeImage struct {
+	File string
+	// Line is the number of the line of the reference, counting from 1
+	Line int
+	Ref  reference.Named
+}
+
+// FindKubeImages finds the images referred to by the containers in the Kubernetes
+// manifests in filenames. References that cannot be parsed, such as those of helm
+// templates, are skipped with a warning.
+func FindKubeImages(filenames []string) (found []KubeImage, err error) {
+	for _, fn := range filenames {
+		var fh *os.File
+		// the manifests are supplied by the user
+		if fh, err = os.Open(fn); err != nil { // #nosec
+			return nil, errors.WithStack(err)
+		}
+
+		scanner := bufio.NewScanner(fh)
+		for i := 1; scanner.Scan(); i++ {
+			ref, _, _, ok := matchKubeImage(scanner.Text())
+			if !ok {
+				continue
+			}
+			named, err := names.ParseNormalizedNamed(ref)
+			if err != nil {
+				log.Warn().Msgf("%s:%d: skipping image %s: %v", fn, i, ref, err)
+				continue
+			}
+			found = append(found, KubeImage{File: fn, Line: i, Ref: named})
+		}
+
+		if err = utils.CheckedClose(fh, errors.WithStack(scanner.Err())); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// matchKubeImage returns the reference in line if it is an image field, with its
+// position in line
+func matchKubeImage(line string) (ref string, start, end int, ok bool) {
+	m := kubeImageRegexp.FindStringSubmatchIndex(strings.TrimSuffix(line, "\r"))
+	if m == nil || line[m[4]:m[5]] != line[m[8]:m[9]] {
+		return "", 0, 0, false
+	}
+	return line[m[6]:m[7]], m[6], m[7], true
+}
+
+// KubeTarget is the reference that the encrypted image of src is pushed to. Its
+// repository is that of src under prefix, if prefix is not empty, and its tag is
+// that of src, or the hex of the digest of src if src only has a digest, followed
+// by suffix.
+func KubeTarget(src reference.Named, prefix, suffix string) (reference.NamedTagged, error) {
+	name := src.Name()
+	if prefix != "" {
+		name = strings.TrimSuffix(prefix, "/") + "/" + reference.Path(src)
+	}
+
+	tag := "latest"
+	if tagged, ok := src.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	} else if digested, ok := src.(reference.Digested); ok {
+		tag = digested.Digest().Encoded()
+	}
+
+	named, err := names.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "name = %s", name)
+	}
+
+	target, err := reference.WithTag(named, tag+suffix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "tag = %s", tag+suffix)
+	}
+	return target, nil
+}
+
+// EncryptKubeImages encrypts and pushes the images referred to by the Kubernetes
+// manifests in filenames to the references given by target, then rewrites the
+// manifests to refer to the encrypted images. Each image is read from the registry
+// it is referred to in, or from src if it is not nil. The rewritten references are
+// pinned to the digests of the encrypted images if pin is set, or if the original
+// was pinned to a digest. The lines that will be rewritten are listed and must be
+// confirmed before anything is pushed, as they are found by kubeImageRegexp rather
+// than by parsing the manifests, and if dryRun is set they are only listed.
+func EncryptKubeImages(
+	filenames []string,
+	target func(reference.Named) (reference.NamedTagged, error),
+	src Source,
+	existing Existing,
+	pin bool,
+	dryRun bool,
+	opts *crypto.Opts,
+	tempDir string,
+) error {
+	found, err := FindKubeImages(filenames)
+	if err != nil {
+		return err
+	}
+
+	var (
+		refs, targets []reference.Named
+		srcs          []Source
+		seen          = make(map[string]reference.Named)
+	)
+	for _, img := range found {
+		t, ok := seen[img.Ref.String()]
+		if !ok {
+			if t, err = target(img.Ref); err != nil {
+				return err
+			}
+			seen[img.Ref.String()] = t
+		}
+		log.Info().Msgf("%s:%d: %s will be rewritten to %s.", img.File, img.Line,
+			reference.FamiliarString(img.Ref), reference.FamiliarString(t))
+		if ok {
+			continue
+		}
+
+		refs = append(refs, img.Ref)
+		targets = append(targets, t)
+		if src == nil {
+			srcs = append(srcs, RegistrySource(img.Ref))
+		} else {
+			srcs = append(srcs, renamedSource(src, img.Ref))
+		}
+	}
+
+	if len(refs) == 0 {
+		log.Info().Msg("No images were found.")
+		return nil
+	}
+	if dryRun {
+		return nil
+	}
+
+	// whatever matches image: is taken to be an image field, so a line that is not
+	// one must be caught before it is rewritten, and scripts must give --yes
+	if err = confirm(fmt.Sprintf("The %d %s above, which were matched as lines rather than parsed as YAML, will be pushed and rewritten. Continue?",
+		len(found), plural(len(found), "reference", "references")), false); err != nil {
+		return err
+	}
+
+	descs, err := pushImagesFrom(targets, nil, srcs, existing, opts, tempDir)
+	if err != nil {
+		return err
+	}
+
+	rewrites := make(map[string]string, len(refs))
+	for i, ref := range refs {
+		var rewritten reference.Named = targets[i]
+		if _, digested := ref.(reference.Digested); pin || digested {
+			if rewritten, err = reference.WithDigest(targets[i], descs[i].Digest); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		rewrites[ref.String()] = reference.FamiliarString(rewritten)
+	}
+
+	for _, fn := range filenames {
+		if err = rewriteKubeImages(fn, rewrites); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renamedSource reads the image ref from src, whatever the reference it is pushed to
+func renamedSource(src Source, ref reference.Named) Source {
+	return func(
+		_ names.NamedTaggedRepository,
+		opts *crypto.Opts,
+		tempDir string,
+	) (*distribution.ImageManifest, error) {
+		nTRep, err := names.CastToTagged(ref)
+		if err != nil {
+			return nil, err
+		}
+		return src(nTRep, opts, tempDir)
+	}
+}
+
+// rewriteKubeImages replaces the references in the image fields of the manifest in
+// filename with those they map to in rewrites, keeping the rest of the file as it is
+func rewriteKubeImages(filename string, rewrites map[string]string) (err error) {
+	// the manifests are supplied by the user
+	data, err := ioutil.ReadFile(filename) // #nosec
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var n int
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		ref, start, end, ok := matchKubeImage(strings.TrimSuffix(line, "\n"))
+		if !ok {
+			continue
+		}
+		named, err := names.ParseNormalizedNamed(ref)
+		if err != nil {
+			continue
+		}
+		if rewritten, ok := rewrites[named.String()]; ok {
+			lines[i] = line[:start] + rewritten + line[end:]
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// the manifest is replaced whole, so that it is not left half written
+	fh, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() { err = removeFile(fh.Name(), err) }()
+
+	if _, err = fh.WriteString(strings.Join(lines, "")); err != nil {
+		return utils.CheckedClose(fh, errors.WithStack(err))
+	}
+	if err = fh.Chmod(info.Mode()); err != nil {
+		return utils.CheckedClose(fh, errors.WithStack(err))
+	}
+	if err = utils.CheckedClose(fh, nil); err != nil {
+		return err
+	}
+	if err = os.Rename(fh.Name(), filename); err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Info().Msgf("Rewrote %d images in %s.", n, filename)
+	return nil
+}
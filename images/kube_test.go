@@ -0,0 +1,148 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchKubeImage(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		line string
+		ref  string
+		ok   bool
+	}{
+		{`image: nginx:1.19`, "nginx:1.19", true},
+		{`        image: nginx:1.19`, "nginx:1.19", true},
+		{`    image: "nginx:1.19"`, "nginx:1.19", true},
+		{`    image: 'nginx:1.19'`, "nginx:1.19", true},
+		{`  - image: nginx`, "nginx", true},
+		{`  -   image: "registry.example.com:5000/app@sha256:abc"`, "registry.example.com:5000/app@sha256:abc", true},
+		{`    image: nginx # the web server`, "nginx", true},
+		{`    image: "nginx"  # quoted, with a comment`, "nginx", true},
+		{"    image: nginx:1.19\r", "nginx:1.19", true},
+		{"    image: 'nginx'  \r", "nginx", true},
+		{`    image: "nginx'`, "", false},
+		{`    image: 'nginx"`, "", false},
+		{`    image: "nginx`, "", false},
+		{`    image:`, "", false},
+		{`    # image: nginx`, "", false},
+		{`    imagePullPolicy: Always`, "", false},
+		{`    baseimage: nginx`, "", false},
+		{`    image: nginx other`, "", false},
+	}
+
+	for _, test := range tests {
+		ref, start, end, ok := matchKubeImage(test.line)
+		assert.Equal(test.ok, ok, "%q", test.line)
+		assert.Equal(test.ref, ref, "%q", test.line)
+		if ok {
+			assert.Equal(test.ref, test.line[start:end], "%q", test.line)
+		}
+	}
+}
+
+func TestRewriteKubeImages(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	// only the references that are rewritten change, whatever their quotes, comments
+	// and line endings, and the rest of the file is left byte for byte
+	manifest := "# a deployment\r\n" +
+		"apiVersion: apps/v1\r\n" +
+		"kind: Deployment\r\n" +
+		"spec:\r\n" +
+		"  template:\r\n" +
+		"    spec:\r\n" +
+		"      containers:\r\n" +
+		"      - name: web\r\n" +
+		"        image: \"nginx:1.19\"   # the web server\r\n" +
+		"      - name: sidecar\r\n" +
+		"        image: busybox\r\n" +
+		"      initContainers:\r\n" +
+		"      -   image: 'nginx:1.19'\r\n" +
+		"        # image: nginx:1.19\r\n" +
+		"        imagePullPolicy: Always\n" +
+		"        env:\n" +
+		"        - name: IMAGE\n" +
+		"          value: nginx:1.19\n" +
+		"        image: \"nginx:1.19'\n" +
+		"        image: docker.io/library/nginx:1.19"
+	expected := "# a deployment\r\n" +
+		"apiVersion: apps/v1\r\n" +
+		"kind: Deployment\r\n" +
+		"spec:\r\n" +
+		"  template:\r\n" +
+		"    spec:\r\n" +
+		"      containers:\r\n" +
+		"      - name: web\r\n" +
+		"        image: \"registry.example.com/nginx:1.19-enc\"   # the web server\r\n" +
+		"      - name: sidecar\r\n" +
+		"        image: busybox\r\n" +
+		"      initContainers:\r\n" +
+		"      -   image: 'registry.example.com/nginx:1.19-enc'\r\n" +
+		"        # image: nginx:1.19\r\n" +
+		"        imagePullPolicy: Always\n" +
+		"        env:\n" +
+		"        - name: IMAGE\n" +
+		"          value: nginx:1.19\n" +
+		"        image: \"nginx:1.19'\n" +
+		"        image: registry.example.com/nginx:1.19-enc"
+
+	fn := filepath.Join(dir, "deployment.yaml")
+	require.NoError(ioutil.WriteFile(fn, []byte(manifest), 0640))
+
+	found, err := FindKubeImages([]string{fn})
+	require.NoError(err)
+	var lines []int
+	for _, img := range found {
+		lines = append(lines, img.Line)
+	}
+	assert.Equal([]int{9, 11, 13, 20}, lines)
+
+	rewrites := map[string]string{"docker.io/library/nginx:1.19": "registry.example.com/nginx:1.19-enc"}
+	require.NoError(rewriteKubeImages(fn, rewrites))
+
+	data, err := ioutil.ReadFile(fn)
+	require.NoError(err)
+	assert.Equal(expected, string(data))
+	info, err := os.Stat(fn)
+	require.NoError(err)
+	assert.Equal(os.FileMode(0640), info.Mode().Perm())
+
+	// a file without any of the references is not written
+	other := filepath.Join(dir, "other.yaml")
+	require.NoError(ioutil.WriteFile(other, []byte("image: busybox\n"), 0600))
+	require.NoError(rewriteKubeImages(other, rewrites))
+	data, err = ioutil.ReadFile(other)
+	require.NoError(err)
+	assert.Equal("image: busybox\n", string(data))
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(err)
+	assert.Len(entries, 2)
+}
@@ -0,0 +1,141 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// EncryptableImage is an image in a daemon that was built with a LABEL that marks
+// layers for encryption
+type EncryptableImage struct {
+	// Name is the first tag of the image, or its ID if it has none
+	Name string
+	ID   string
+	// Layers is the number of layers of the image
+	Layers int
+	// Encrypt holds the positions of the layers that would be encrypted, counting
+	// the lowest as 0
+	Encrypt []int
+	// Err is why the layers to encrypt could not be found, if they could not
+	Err error
+}
+
+// ListEncryptable lists the images in the docker daemon that were built with the
+// LABEL, and which of their layers would be encrypted on push
+func ListEncryptable(opts *crypto.Opts) ([]EncryptableImage, error) {
+	return (&Daemon{}).ListEncryptable(opts)
+}
+
+// ListEncryptable lists the images in the daemon that were built with the LABEL,
+// and which of their layers would be encrypted on push. The layers are found from
+// the history the daemon reports, so that no image need be exported.
+func (d *Daemon) ListEncryptable(opts *crypto.Opts) (list []EncryptableImage, err error) {
+	ctx := context.Background()
+	cli, err := d.client()
+	if err != nil {
+		return
+	}
+
+	summaries, err := cli.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, utils.WithClass(errors.Wrap(err, "could not list images"), utils.ClassDaemon)
+	}
+
+	for _, s := range summaries {
+		if !hasLabel(s.Labels, opts.LabelNames()) {
+			continue
+		}
+
+		image := EncryptableImage{Name: s.ID, ID: s.ID}
+		if len(s.RepoTags) > 0 {
+			image.Name = s.RepoTags[0]
+		}
+		image.Layers, image.Encrypt, image.Err = daemonLayersToEncrypt(ctx, cli, s.ID, opts)
+		list = append(list, image)
+	}
+	return list, nil
+}
+
+// ListNames lists the names of the images in the daemon, as NAME:TAG, for the
+// completion of commands
+func (d *Daemon) ListNames() (names []string, err error) {
+	cli, err := d.client()
+	if err != nil {
+		return
+	}
+
+	summaries, err := cli.ImageList(context.Background(), types.ImageListOptions{})
+	if err != nil {
+		return nil, utils.WithClass(errors.Wrap(err, "could not list images"), utils.ClassDaemon)
+	}
+
+	for _, s := range summaries {
+		for _, t := range s.RepoTags {
+			if t != "<none>:<none>" {
+				names = append(names, t)
+			}
+		}
+	}
+	return names, nil
+}
+
+// daemonLayersToEncrypt finds the layers of the image id to encrypt from the layers
+// and history the daemon reports. The history does not say which entries made no
+// layer, so entries without size are taken to be empty, and failing that, those of
+// instructions that only change the config.
+func daemonLayersToEncrypt(
+	ctx context.Context,
+	cli *client.Client,
+	id string,
+	opts *crypto.Opts,
+) (layers int, encrypt []int, err error) {
+	inspt, _, err := cli.ImageInspectWithRaw(ctx, id)
+	if err != nil {
+		return 0, nil, utils.WithClass(errors.Wrapf(err, "could not inspect %s", id), utils.ClassDaemon)
+	}
+
+	items, err := cli.ImageHistory(ctx, id)
+	if err != nil {
+		return 0, nil, utils.WithClass(errors.Wrapf(err, "could not get the history of %s", id), utils.ClassDaemon)
+	}
+
+	// the daemon lists the newest entry first
+	history := make([]distribution.History, len(items))
+	for i, h := range items {
+		history[len(items)-1-i] = distribution.History{CreatedBy: h.CreatedBy, EmptyLayer: h.Size == 0}
+	}
+
+	encrypt, err = distribution.LayersToEncrypt(history, inspt.RootFS.Layers, opts)
+	return len(inspt.RootFS.Layers), encrypt, err
+}
+
+// hasLabel reports whether labels has any of names
+func hasLabel(labels map[string]string, names []string) bool {
+	for _, n := range names {
+		if _, ok := labels[n]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"github.com/docker/distribution/reference"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// PlanImage describes what pushing the image ref from src would encrypt, without
+// encrypting it or connecting to the registry of ref. The image is still read from
+// src, so that its layers and the labels of its history are known.
+func PlanImage(
+	ref reference.Named,
+	src Source,
+	opts *crypto.Opts,
+	tempDir string,
+) (plan *distribution.ManifestPlan, err error) {
+	nTRep, err := names.CastToTagged(ref)
+	if err != nil {
+		return
+	}
+
+	manifest, err := src(nTRep, opts, tempDir)
+	if err != nil {
+		return
+	}
+	defer func() { err = utils.CleanUp(manifest.DirName, err) }()
+
+	return manifest.Plan(opts)
+}
@@ -0,0 +1,100 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// podmanRootSocket is the socket of the podman service when it is run as root
+const podmanRootSocket = "/run/podman/podman.sock"
+
+// PodmanSocket returns the socket of the podman service of the user, which is run
+// rootless, or that of the system if it does not exist. It returns the empty
+// string if neither exists.
+func PodmanSocket() string {
+	var sockets []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	sockets = append(sockets, podmanRootSocket)
+
+	for _, s := range sockets {
+		if _, err := os.Stat(s); err == nil {
+			return s
+		}
+	}
+	return ""
+}
+
+// Daemon is a daemon with a docker compatible API other than the one that docker
+// is configured to use, such as the podman service
+type Daemon struct {
+	// Host is the address of the daemon, such as unix:///run/podman/podman.sock
+	Host string
+}
+
+// NewPodman returns the daemon of the podman service found by PodmanSocket
+func NewPodman() (*Daemon, error) {
+	socket := PodmanSocket()
+	if socket == "" {
+		return nil, utils.WithClass(
+			errors.New("the podman service is not running, start it with: systemctl --user start podman.socket"),
+			utils.ClassDaemon,
+		)
+	}
+	return &Daemon{Host: "unix://" + socket}, nil
+}
+
+func (d *Daemon) client() (*client.Client, error) {
+	return distribution.NewDockerClient(context.Background(), d.Host)
+}
+
+// Source reads images from the daemon
+func (d *Daemon) Source() Source {
+	return func(
+		ref names.NamedTaggedRepository,
+		opts *crypto.Opts,
+		tempDir string,
+	) (*distribution.ImageManifest, error) {
+		cli, err := d.client()
+		if err != nil {
+			return nil, err
+		}
+		return distribution.NewManifestFromDaemon(context.Background(), cli, ref, opts, tempDir)
+	}
+}
+
+// Sink loads images into the daemon
+func (d *Daemon) Sink() Sink {
+	return func(r io.Reader) error {
+		cli, err := d.client()
+		if err != nil {
+			return err
+		}
+		return loadArchiveWith(cli, r)
+	}
+}
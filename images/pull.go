@@ -17,10 +17,10 @@ package images
 import (
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/docker/distribution/reference"
 	"github.com/google/uuid"
-	spinner "github.com/janeczku/go-spinner"
 	"github.com/pkg/errors"
 
 	"github.com/Senetas/crypto-cli/crypto"
@@ -28,8 +28,9 @@ import (
 	"github.com/Senetas/crypto-cli/utils"
 )
 
-// PullImage pulls an image from the registry
-func PullImage(ref reference.Named, opts *crypto.Opts, tempDir string) (err error) {
+// PullImage pulls an image from the registry, decrypts it and loads it with sink
+func PullImage(ref reference.Named, sink Sink, opts *crypto.Opts, tempDir string) (err error) {
+	start := time.Now()
 	token, nTRep, endpoint, err := authProcedure(ref)
 	if err != nil {
 		return
@@ -49,12 +50,21 @@ func PullImage(ref reference.Named, opts *crypto.Opts, tempDir string) (err erro
 		return
 	}
 
-	s := spinner.StartNew("Decrypting...")
+	s := utils.StartSpinner("Decrypting...")
 	manifest, err := emanifest.Decrypt(nTRep, opts)
+	s.Done()
 	if err != nil {
 		return
 	}
-	s.Stop()
 
-	return constructImageArchive(manifest, nTRep, opts)
+	if err = manifest.VerifyDiffIDs(); err != nil {
+		return
+	}
+
+	if err = constructImageArchive(manifest, nTRep, sink, opts); err != nil {
+		return
+	}
+
+	report(ref, start, emanifest.Digest, emanifest.Encryption)
+	return
 }
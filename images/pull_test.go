@@ -0,0 +1,98 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+)
+
+func TestPullImageToFile(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	defer func(insecure []string, retries int) {
+		httpclient.InsecureRegistries, httpclient.Retries = insecure, retries
+	}(httpclient.InsecureRegistries, httpclient.Retries)
+	httpclient.Retries = 0
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+	opts.SetPassphrase("hunter2")
+
+	r := newMemRegistry(t)
+	server, host := r.serve()
+	defer server.Close()
+	ref, err := reference.ParseNormalizedNamed(host + "/repo:latest")
+	require.NoError(err)
+
+	img := mkTestImage(t, filepath.Join(dir, "image"), opts)
+	img.push(t, ref)
+
+	out := filepath.Join(dir, "out")
+	require.NoError(os.MkdirAll(out, 0700))
+	output := filepath.Join(out, "image.tar")
+
+	// the decrypted image is written in the format of docker save, readable only by
+	// its owner
+	require.NoError(PullImage(ref, FileSink(output), opts, dir))
+	fi, err := os.Stat(output)
+	require.NoError(err)
+	assert.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	data, err := ioutil.ReadFile(output)
+	require.NoError(err)
+	files := make(map[string][]byte)
+	for _, e := range readArchive(t, bytes.NewReader(data)) {
+		files[e.name] = e.data
+	}
+	var manifests []distribution.ArchiveManifest
+	require.NoError(json.Unmarshal(files["manifest.json"], &manifests))
+	require.Len(manifests, 1)
+	assert.Equal([]string{host + "/repo:latest"}, manifests[0].RepoTags)
+	assert.Equal(img.config, files[manifests[0].Config])
+	if assert.Len(manifests[0].Layers, 1) {
+		assert.Equal(img.layer, files[manifests[0].Layers[0]])
+	}
+	assert.Len(files, 3)
+
+	// a layer that is not what its digest says fails the pull, which leaves the file
+	// that was written before as it was, and no other
+	r.Lock()
+	r.blobs["repo@"+img.manifest.Layers[0].GetDigest().String()] = []byte("tampered")
+	r.Unlock()
+	assert.Error(PullImage(ref, FileSink(output), opts, dir))
+
+	got, err := ioutil.ReadFile(output)
+	require.NoError(err)
+	assert.Equal(data, got)
+	entries, err := ioutil.ReadDir(out)
+	require.NoError(err)
+	assert.Len(entries, 1)
+}
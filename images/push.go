@@ -15,34 +15,591 @@
 package images
 
 import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
 	"github.com/docker/distribution/reference"
-	"github.com/janeczku/go-spinner"
+	"github.com/docker/distribution/registry/api/v2"
+	dauth "github.com/docker/distribution/registry/client/auth"
+	dregistry "github.com/docker/docker/registry"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 
 	"github.com/Senetas/crypto-cli/crypto"
 	"github.com/Senetas/crypto-cli/distribution"
 	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
 	"github.com/Senetas/crypto-cli/utils"
 )
 
+// Source makes the unencrypted manifest (with the data necessary for encryption)
+// of the image to be encrypted
+type Source func(
+	ref names.NamedTaggedRepository,
+	opts *crypto.Opts,
+	tempDir string,
+) (*distribution.ImageManifest, error)
+
+// OCIArchiveSource reads the image from the OCI archive at filename
+func OCIArchiveSource(filename string) Source {
+	return fileSource(filename, distribution.NewManifestFromOCIArchive)
+}
+
+// ArchiveSource reads the image from the image archive at filename, such as one
+// made by docker save, so no container runtime is needed
+func ArchiveSource(filename string) Source {
+	return fileSource(filename, distribution.NewManifestFromArchive)
+}
+
+// RegistrySource reads a plain image from a registry, by downloading its blobs into
+// the temporary directory, so it may be encrypted and pushed to another registry
+// without a container runtime. Each layer is decompressed as soon as it has been
+// downloaded, and if opts.Stream is set encrypted while the rest are downloaded.
+func RegistrySource(src reference.Named) Source {
+	return func(
+		ref names.NamedTaggedRepository,
+		opts *crypto.Opts,
+		tempDir string,
+	) (_ *distribution.ImageManifest, err error) {
+		token, srcRep, endpoint, err := authProcedure(src)
+		if err != nil {
+			return
+		}
+
+		dir := filepath.Join(tempDir, uuid.New().String())
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "dir = %s", dir)
+		}
+
+		bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+		log.Info().Msgf("Obtaining manifest for image: %s", srcRep)
+		plain, err := registry.PullManifest(token, names.ManifestReference(srcRep), bldr, dir)
+		if err != nil {
+			return nil, utils.CleanUp(dir, err)
+		}
+
+		pull := func(downloaded func(digest.Digest, string) error) error {
+			return registry.PullBlobsThen(token, srcRep, plain, bldr, dir, downloaded)
+		}
+		manifest, err := distribution.NewManifestFromPlainPull(context.Background(), plain, opts, pull)
+		if err != nil {
+			return nil, utils.CleanUp(dir, err)
+		}
+		return manifest, nil
+	}
+}
+
+func fileSource(
+	filename string,
+	newManifest func(io.Reader, names.NamedTaggedRepository, *crypto.Opts, string) (*distribution.ImageManifest, error),
+) Source {
+	return func(
+		ref names.NamedTaggedRepository,
+		opts *crypto.Opts,
+		tempDir string,
+	) (_ *distribution.ImageManifest, err error) {
+		// filename is supplied by the user
+		fh, err := os.Open(filename) // #nosec
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer func() { err = utils.CheckedClose(fh, err) }()
+
+		return newManifest(fh, ref, opts, tempDir)
+	}
+}
+
+// Existing is what is done when an image is pushed to a reference that already
+// holds an encrypted image
+type Existing string
+
+const (
+	// ExistingOverwrite encrypts the source and replaces the image
+	ExistingOverwrite Existing = "overwrite"
+	// ExistingSkip leaves the image as it is
+	ExistingSkip Existing = "skip"
+	// ExistingReencrypt decrypts the image in place of the source and encrypts
+	// it again with new keys
+	ExistingReencrypt Existing = "reencrypt"
+)
+
 // PushImage encrypts then pushes an image
-func PushImage(ref reference.Named, opts *crypto.Opts, tempDir string) (err error) {
-	token, nTRep, endpoint, err := authProcedure(ref)
+func PushImage(ref reference.Named, src Source, opts *crypto.Opts, tempDir string) error {
+	return PushImages([]reference.Named{ref}, nil, src, ExistingOverwrite, opts, tempDir)
+}
+
+// PushImages encrypts then pushes several images in turn. Layers that the images
+// share, such as those of a common base image, are encrypted and uploaded only
+// once, and the manifests of all of the images refer to the same encrypted blobs.
+// Each image is also pushed to the same path in each of the mirrors, which are
+// registries such as registry.example.com, possibly with a namespace.
+func PushImages(
+	refs []reference.Named,
+	mirrors []string,
+	src Source,
+	existing Existing,
+	opts *crypto.Opts,
+	tempDir string,
+) error {
+	srcs := make([]Source, len(refs))
+	for i := range srcs {
+		srcs[i] = src
+	}
+	_, err := pushImagesFrom(refs, mirrors, srcs, existing, opts, tempDir)
+	return err
+}
+
+// pushImagesFrom pushes refs like PushImages, each read from the source at the same
+// position in srcs, returning the descriptors of the manifests that the refs hold
+func pushImagesFrom(
+	refs []reference.Named,
+	mirrors []string,
+	srcs []Source,
+	existing Existing,
+	opts *crypto.Opts,
+	tempDir string,
+) (descs []*distribution.Descriptor, err error) {
+	// the mirrors are checked before any image is pushed
+	dests := make([][]reference.Named, len(refs))
+	for i, ref := range refs {
+		dests[i] = []reference.Named{ref}
+		for _, m := range mirrors {
+			mirrored, err := MirrorReference(ref, m)
+			if err != nil {
+				return nil, err
+			}
+			dests[i] = append(dests[i], mirrored)
+		}
+	}
+
+	cache := distribution.NewBlobCache()
+	descs = make([]*distribution.Descriptor, len(refs))
+	for i := range refs {
+		var dir string
+		descs[i], dir, err = pushImage(dests[i], srcs[i], existing, opts, tempDir, cache)
+		if dir != "" {
+			// the encrypted blobs of this image may be those of a later image, so
+			// they are kept until all of the images have been pushed
+			defer func() { err = utils.CleanUp(dir, err) }()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return descs, nil
+}
+
+// MirrorReference is the reference of ref in the registry mirror, which has the
+// same path, tag and digest
+func MirrorReference(ref reference.Named, mirror string) (reference.Named, error) {
+	name := strings.TrimSuffix(mirror, "/") + "/" + reference.Path(ref)
+	mirrored, err := names.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "mirror = %s", mirror)
+	}
+
+	if tagged, ok := ref.(reference.Tagged); ok {
+		if mirrored, err = reference.WithTag(mirrored, tagged.Tag()); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if digested, ok := ref.(reference.Digested); ok {
+		if mirrored, err = reference.WithDigest(mirrored, digested.Digest()); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return mirrored, nil
+}
+
+// pushImage encrypts then pushes the image dests[0], with the encrypted blobs in
+// cache, to each of dests at once. It returns the descriptor of the manifest that
+// dests[0] holds and the directory of its files, which the caller must clean up.
+func pushImage(
+	dests []reference.Named,
+	src Source,
+	existing Existing,
+	opts *crypto.Opts,
+	tempDir string,
+	cache *distribution.BlobCache,
+) (desc *distribution.Descriptor, dir string, err error) {
+	start := time.Now()
+	ref := dests[0]
+	token, nTRep, endpoint, err := pushAuthProcedure(ref)
+	if err != nil {
+		return
+	}
+
+	if existing != ExistingOverwrite {
+		var encrypted bool
+		if encrypted, err = isEncrypted(token, nTRep, endpoint); err != nil {
+			return
+		}
+		switch {
+		case !encrypted:
+		case existing == ExistingSkip:
+			log.Info().Msgf("Skipping %s, which is already encrypted.", ref)
+			desc, err = registry.ResolveManifest(token, names.ManifestReference(nTRep), v2.NewURLBuilder(endpoint.URL, false))
+			if err == nil {
+				report(ref, start, desc.Digest, nil)
+			}
+			return
+		default:
+			log.Info().Msgf("Encrypting %s again with new keys.", ref)
+			src = reencryptSource(token, endpoint, opts)
+		}
+	}
+
+	encManifest, attestations, dir, err := encryptImage(nTRep, src, opts, tempDir, cache)
+	if err != nil {
+		return
+	}
+	defer func() { err = endResume(nTRep, err) }()
+
+	var envelope *distribution.KeyEnvelope
+	if opts.DetachKeys {
+		if encManifest, envelope, err = encManifest.DetachKeys(); err != nil {
+			return
+		}
+	}
+
+	// the tags that would be replaced are only pushed over once it is confirmed, and
+	// an encrypted image that is kept in place is not replaced
+	if existing == ExistingOverwrite {
+		var d digest.Digest
+		if d, err = canonicalDigest(encManifest); err != nil {
+			return
+		}
+		if err = confirmOverwrite(dests, d); err != nil {
+			return
+		}
+	}
+
+	// the manifest is described as it is pushed, with the keys that stay in it
+	var info *distribution.ManifestInfo
+	if Report != nil {
+		var ierr error
+		if info, ierr = encManifest.Inspect(); ierr != nil {
+			log.Debug().Err(ierr).Msgf("could not describe the encryption of %s", ref)
+		}
+	}
+
+	if len(dests) == 1 {
+		if desc, err = pushEncrypted(token, nTRep, endpoint, ref, encManifest, envelope, attestations, opts, dir); err == nil {
+			report(ref, start, desc.Digest, info)
+		}
+		return
+	}
+
+	// the blobs of the image are read from the same files for each destination,
+	// but the artifacts that are attached to it are written to separate directories
+	descs := make([]*distribution.Descriptor, len(dests))
+	errCh := make(chan error, len(dests))
+	for i, dest := range dests {
+		go func(i int, dest reference.Named) {
+			var (
+				err  error
+				ddir = filepath.Join(dir, uuid.New().String())
+			)
+			if err = os.MkdirAll(ddir, 0700); err != nil {
+				errCh <- errors.Wrapf(err, "dir = %s", ddir)
+				return
+			}
+
+			if i == 0 {
+				descs[i], err = pushEncrypted(token, nTRep, endpoint, dest, encManifest, envelope, attestations, opts, ddir)
+			} else {
+				descs[i], err = pushMirror(dest, encManifest, envelope, attestations, opts, ddir)
+			}
+			if err != nil {
+				log.Error().Msgf("Could not push %s: %v", dest, err)
+				errCh <- errors.Wrapf(err, "destination = %s", dest)
+				return
+			}
+			log.Info().Msgf("Pushed %s.", dest)
+			errCh <- nil
+		}(i, dest)
+	}
+
+	if err = utils.ConcatErrChan(errCh, len(dests)); err != nil {
+		return
+	}
+	for i, dest := range dests {
+		report(dest, start, descs[i].Digest, info)
+	}
+	return descs[0], dir, nil
+}
+
+// encryptImage encrypts the image from src that is pushed to ref, with the encrypted
+// blobs in cache, or uses the image that an earlier push to ref encrypted, if it is
+// to be resumed and the source has not changed since. It returns the encrypted
+// manifest, the attestations of the image and the directory of its files, which
+// the caller must clean up.
+func encryptImage(
+	ref names.NamedTaggedRepository,
+	src Source,
+	opts *crypto.Opts,
+	tempDir string,
+	cache *distribution.BlobCache,
+) (encManifest *distribution.ImageManifest, attestations []*distribution.Attestation, dir string, err error) {
+	manifest, err := src(ref, opts, tempDir)
+	if err != nil {
+		return
+	}
+	dir = manifest.DirName
+	attestations = manifest.Attestations
+
+	if encManifest, err = resumedImage(ref, manifest, opts); err != nil || encManifest != nil {
+		return
+	}
+
+	s := utils.StartSpinner("Encrypting...")
+	encManifest, err = manifest.EncryptCached(ref, opts, cache)
+	s.Done()
+	if err != nil {
+		return
+	}
+
+	err = keepForResume(ref, manifest, encManifest, opts)
+	return
+}
+
+// pushMirror pushes an encrypted image to ref like pushEncrypted, once it has
+// authenticated with the registry of ref
+func pushMirror(
+	ref reference.Named,
+	encManifest *distribution.ImageManifest,
+	envelope *distribution.KeyEnvelope,
+	attestations []*distribution.Attestation,
+	opts *crypto.Opts,
+	dir string,
+) (*distribution.Descriptor, error) {
+	token, nTRep, endpoint, err := pushAuthProcedure(ref)
+	if err != nil {
+		return nil, err
+	}
+	return pushEncrypted(token, nTRep, endpoint, ref, encManifest, envelope, attestations, opts, dir)
+}
+
+// pushEncrypted pushes an encrypted image to ref, with its detached keys if
+// envelope is not nil, and its attestations
+func pushEncrypted(
+	token dauth.Scope,
+	nTRep names.NamedTaggedRepository,
+	endpoint *dregistry.APIEndpoint,
+	ref reference.Named,
+	encManifest *distribution.ImageManifest,
+	envelope *distribution.KeyEnvelope,
+	attestations []*distribution.Attestation,
+	opts *crypto.Opts,
+	dir string,
+) (desc *distribution.Descriptor, err error) {
+	// the encrypted image has a digest of its own, so an image referred to by
+	// digest is pushed by that digest rather than with a tag
+	var target reference.Named = nTRep
+	_, byDigest := ref.(reference.Digested)
+	if byDigest {
+		target = names.SeperateRepository(ref)
+	}
+
+	desc, err = registry.PushImage(token, target, encManifest, endpoint)
+	if err != nil {
+		return
+	}
+
+	if byDigest {
+		log.Info().Msgf("Encrypted image pushed as %s@%s.", ref.Name(), desc.Digest)
+	}
+
+	if envelope != nil {
+		if err = registry.PushKeyEnvelope(token, nTRep, envelope, desc, endpoint, dir); err != nil {
+			return
+		}
+	}
+
+	err = pushAttestations(token, nTRep, attestations, desc, endpoint, opts, dir)
+	return
+}
+
+// pushAttestations attaches the attestations of an image, such as its provenance
+// and SBOM, to the encrypted image subject, so that they are not lost
+func pushAttestations(
+	token dauth.Scope,
+	ref reference.Named,
+	attestations []*distribution.Attestation,
+	subject *distribution.Descriptor,
+	endpoint *dregistry.APIEndpoint,
+	opts *crypto.Opts,
+	dir string,
+) error {
+	for _, a := range attestations {
+		// each artifact is written to its own directory, as the files of encrypted
+		// artifacts are named by their positions
+		adir := filepath.Join(dir, uuid.New().String())
+		if err := os.MkdirAll(adir, 0700); err != nil {
+			return errors.Wrapf(err, "dir = %s", adir)
+		}
+
+		artifact, blobs, err := a.Artifact(subject, adir, opts)
+		if err != nil {
+			return err
+		}
+
+		desc, err := registry.PushArtifact(token, ref, artifact, blobs, endpoint)
+		if err != nil {
+			return err
+		}
+		log.Info().Msgf("Successfully uploaded attestation: %s.", desc.Digest)
+	}
+	return nil
+}
+
+// isEncrypted reports whether ref already holds an encrypted image
+func isEncrypted(token dauth.Scope, ref reference.Named, endpoint *dregistry.APIEndpoint) (bool, error) {
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+	manifest, err := registry.PullExistingManifest(token, names.ManifestReference(ref), bldr, "")
+	if err != nil || manifest == nil {
+		return false, err
+	}
+	// the keys of an encrypted image may have been detached, but its annotations
+	// remain
+	return manifest.Encrypted() || manifest.Annotations[distribution.AnnotationEncryptedLayers] != "", nil
+}
+
+// ReencryptSource reads the encrypted image src from its registry by downloading
+// and decrypting it with decOpts, so that it may be encrypted again with new keys,
+// and with another passphrase or cipher if the options it is encrypted with differ
+func ReencryptSource(src reference.Named, decOpts *crypto.Opts) Source {
+	return func(
+		ref names.NamedTaggedRepository,
+		opts *crypto.Opts,
+		tempDir string,
+	) (*distribution.ImageManifest, error) {
+		token, srcRep, endpoint, err := authProcedure(src)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Msgf("Obtaining manifest for image: %s", srcRep)
+		return reencryptSource(token, endpoint, decOpts)(srcRep, opts, tempDir)
+	}
+}
+
+// reencryptSource reads the encrypted image that is to be pushed over by
+// downloading and decrypting it with decOpts, so that it may be encrypted again
+// with new keys
+func reencryptSource(token dauth.Scope, endpoint *dregistry.APIEndpoint, decOpts *crypto.Opts) Source {
+	return func(
+		ref names.NamedTaggedRepository,
+		opts *crypto.Opts,
+		tempDir string,
+	) (_ *distribution.ImageManifest, err error) {
+		dir := filepath.Join(tempDir, uuid.New().String())
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "dir = %s", dir)
+		}
+
+		emanifest, err := registry.PullImage(token, ref, endpoint, decOpts, dir)
+		if err != nil {
+			return nil, utils.CleanUp(dir, err)
+		}
+
+		s := utils.StartSpinner("Decrypting...")
+		dmanifest, err := emanifest.Decrypt(ref, decOpts)
+		s.Done()
+		if err != nil {
+			return nil, utils.CleanUp(dir, err)
+		}
+
+		if err = dmanifest.VerifyDiffIDs(); err != nil {
+			return nil, utils.CleanUp(dir, err)
+		}
+
+		manifest, err := distribution.NewManifestFromDecrypted(emanifest, dmanifest, opts)
+		if err != nil {
+			return nil, utils.CleanUp(dir, err)
+		}
+		return manifest, nil
+	}
+}
+
+// SaveImage encrypts an image then writes it to the OCI image layout at layoutDir
+// instead of pushing it
+func SaveImage(
+	ref reference.Named,
+	src Source,
+	layoutDir string,
+	opts *crypto.Opts,
+	tempDir string,
+) (err error) {
+	if opts.DetachKeys {
+		return errors.New("keys may not be detached from an image written to an OCI layout")
+	}
+
+	nTRep, err := names.CastToTagged(ref)
 	if err != nil {
 		return err
 	}
 
-	manifest, err := distribution.NewManifest(nTRep, opts, tempDir)
+	manifest, err := src(nTRep, opts, tempDir)
 	if err != nil {
 		return err
 	}
 	defer func() { err = utils.CleanUp(manifest.DirName, err) }()
 
-	s := spinner.StartNew("Encrypting...")
-	encManifest, err := manifest.Encrypt(nTRep, opts)
-	s.Stop()
+	encManifest, err := encryptManifest(nTRep, manifest, opts)
+	if err != nil {
+		return err
+	}
+
+	desc, err := distribution.WriteOCILayout(layoutDir, nTRep.Tag(), encManifest)
 	if err != nil {
 		return err
 	}
 
-	return registry.PushImage(token, nTRep, encManifest, endpoint)
+	log.Info().Msgf("Image written to %s as %s.", layoutDir, desc.Digest)
+	return nil
+}
+
+// PushOCILayout pushes an image that has already been encrypted from the OCI image
+// layout at layoutDir, such as one written by SaveImage
+func PushOCILayout(ref reference.Named, layoutDir string) error {
+	token, nTRep, endpoint, err := pushAuthProcedure(ref)
+	if err != nil {
+		return err
+	}
+
+	// the layout belongs to the user, so unlike the manifests made by a Source
+	// its directory is not cleaned up
+	manifest, err := distribution.ReadOCILayout(layoutDir, nTRep)
+	if err != nil {
+		return err
+	}
+
+	d, err := canonicalDigest(manifest)
+	if err != nil {
+		return err
+	}
+	if err = confirmOverwrite([]reference.Named{ref}, d); err != nil {
+		return err
+	}
+
+	_, err = registry.PushImage(token, nTRep, manifest, endpoint)
+	return err
+}
+
+// encryptManifest encrypts the image described by manifest
+func encryptManifest(
+	ref names.NamedTaggedRepository,
+	manifest *distribution.ImageManifest,
+	opts *crypto.Opts,
+) (*distribution.ImageManifest, error) {
+	s := utils.StartSpinner("Encrypting...")
+	defer s.Done()
+	return manifest.Encrypt(ref, opts)
 }
@@ -0,0 +1,147 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// plainSource reads an image of a config and a layer, which it writes to a new
+// directory each time it is read
+func plainSource(t *testing.T) Source {
+	layer := mkArchive(t, []tarEntry{{"etc/motd", []byte("hello")}})
+	config, err := json.Marshal(map[string]interface{}{
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": []digest.Digest{digest.Canonical.FromBytes(layer)}},
+	})
+	require.NoError(t, err)
+
+	return func(ref names.NamedTaggedRepository, opts *crypto.Opts, tempDir string) (*distribution.ImageManifest, error) {
+		dir := filepath.Join(tempDir, uuid.New().String())
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		write := func(name string, data []byte) (string, digest.Digest, int64) {
+			fn := filepath.Join(dir, name)
+			require.NoError(t, ioutil.WriteFile(fn, data, 0600))
+			return fn, digest.Canonical.FromBytes(data), int64(len(data))
+		}
+		return &distribution.ImageManifest{
+			SchemaVersion: 2,
+			MediaType:     distribution.MediaTypeManifest,
+			Config:        distribution.NewPlainConfig(write("config", config)),
+			Layers:        []distribution.Blob{distribution.NewPlainLayer(write("layer", layer))},
+			DirName:       dir,
+		}, nil
+	}
+}
+
+func TestPushImagesMirrors(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	defer func(insecure []string, retries int) {
+		httpclient.InsecureRegistries, httpclient.Retries = insecure, retries
+	}(httpclient.InsecureRegistries, httpclient.Retries)
+	httpclient.Retries = 0
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+	opts.SetPassphrase("hunter2")
+	src := plainSource(t)
+
+	// the image is pushed to a registry and two mirrors, of which those at failing
+	// refuse it
+	tests := []struct {
+		name    string
+		failing []int
+	}{
+		{name: "none"},
+		{name: "one mirror", failing: []int{2}},
+		{name: "both mirrors", failing: []int{1, 2}},
+		{name: "the registry", failing: []int{0}},
+	}
+
+	for _, test := range tests {
+		var (
+			regs    []*memRegistry
+			hosts   []string
+			servers []*httptest.Server
+		)
+		for range []string{"registry", "mirror", "mirror"} {
+			r := newMemRegistry(t)
+			server, host := r.serve()
+			regs, hosts, servers = append(regs, r), append(hosts, host), append(servers, server)
+		}
+		for _, i := range test.failing {
+			regs[i].fail = http.StatusForbidden
+		}
+
+		ref, err := reference.ParseNormalizedNamed(hosts[0] + "/repo:latest")
+		require.NoError(err)
+		err = PushImages([]reference.Named{ref}, hosts[1:], src, ExistingOverwrite, opts, dir)
+		for _, server := range servers {
+			server.Close()
+		}
+
+		// each destination that failed is reported, and the others are pushed to
+		// all the same, with the same manifest
+		failed := make(map[int]bool)
+		for _, i := range test.failing {
+			failed[i] = true
+		}
+		var pushed []byte
+		for i, r := range regs {
+			dest := "destination = " + hosts[i] + "/repo:latest"
+			m, ok := r.manifest("repo", "latest")
+			if failed[i] {
+				if assert.Error(err, test.name) {
+					assert.Contains(err.Error(), dest, test.name)
+				}
+				assert.False(ok, "%s: %s", test.name, hosts[i])
+				continue
+			}
+			if err != nil {
+				assert.NotContains(err.Error(), dest, test.name)
+			}
+			if assert.True(ok, "%s: %s", test.name, hosts[i]) {
+				if pushed != nil {
+					assert.Equal(pushed, m.body, test.name)
+				}
+				pushed = m.body
+			}
+		}
+		if len(test.failing) == 0 {
+			assert.NoError(err, test.name)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// ListReferrers lists the artifacts that are attached to an image, optionally
+// only those of the given artifactType
+func ListReferrers(ref reference.Named, artifactType string) ([]distribution.Descriptor, error) {
+	token, nTRep, endpoint, err := authProcedure(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	subject, err := registry.ResolveManifest(token, nTRep, bldr)
+	if err != nil {
+		return nil, err
+	}
+
+	return registry.PullReferrers(token, nTRep, subject.Digest, artifactType, bldr)
+}
+
+// AttachArtifact uploads files as the blobs of an artifact of the given type that
+// is attached to an image, such as a signature or an SBOM
+func AttachArtifact(
+	ref reference.Named,
+	artifactType, mediaType string,
+	files []string,
+	tempDir string,
+) (desc *distribution.Descriptor, err error) {
+	token, nTRep, endpoint, err := pushAuthProcedure(ref)
+	if err != nil {
+		return
+	}
+
+	subject, err := registry.ResolveManifest(token, nTRep, v2.NewURLBuilder(endpoint.URL, false))
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "dir = %s", dir)
+		return
+	}
+
+	config, err := distribution.NewEmptyConfig(dir)
+	if err != nil {
+		return
+	}
+
+	blobs := make([]distribution.Blob, len(files))
+	for i, f := range files {
+		if blobs[i], err = distribution.NewFileBlob(f, mediaType); err != nil {
+			return
+		}
+	}
+
+	artifact := distribution.NewArtifactManifest(artifactType, config, blobs, subject)
+
+	return registry.PushArtifact(token, nTRep, artifact, append([]distribution.Blob{config}, blobs...), endpoint)
+}
@@ -0,0 +1,242 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+)
+
+// memRegistry is a registry that holds manifests and blobs in memory, keyed by the
+// names of their repositories, whose blobs are uploaded whole. If fail is set,
+// every request that would change the registry is answered with it instead, as by
+// a registry that may only be read from. Each request is logged as its method and
+// path.
+type memRegistry struct {
+	sync.Mutex
+	t *testing.T
+
+	fail      int
+	manifests map[string]tagManifest
+	blobs     map[string][]byte
+	requests  []string
+}
+
+func newMemRegistry(t *testing.T) *memRegistry {
+	return &memRegistry{
+		t:         t,
+		manifests: make(map[string]tagManifest),
+		blobs:     make(map[string][]byte),
+	}
+}
+
+// serve r from a new server, whose host is added to the insecure registries,
+// returning the server and its host
+func (r *memRegistry) serve() (*httptest.Server, string) {
+	server := httptest.NewServer(r)
+	u, err := url.Parse(server.URL)
+	require.NoError(r.t, err)
+	httpclient.InsecureRegistries = append(httpclient.InsecureRegistries, u.Host)
+	return server, u.Host
+}
+
+// count is the number of requests with method whose paths have prefix
+func (r *memRegistry) count(method, prefix string) (n int) {
+	r.Lock()
+	defer r.Unlock()
+	for _, req := range r.requests {
+		if strings.HasPrefix(req, method+" "+prefix) {
+			n++
+		}
+	}
+	return
+}
+
+// manifest is the manifest that the repository name holds under ref, which is a
+// tag or a digest
+func (r *memRegistry) manifest(name, ref string) (tagManifest, bool) {
+	r.Lock()
+	defer r.Unlock()
+	m, ok := r.manifests[name+memSep(ref)+ref]
+	return m, ok
+}
+
+// memSep is the separator of a tag or digest from the name of its repository
+func memSep(ref string) string {
+	if strings.Contains(ref, ":") {
+		return "@"
+	}
+	return ":"
+}
+
+func (r *memRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+
+	if r.fail != 0 && req.Method != "GET" && req.Method != "HEAD" {
+		rw.WriteHeader(r.fail)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case path == "":
+		// the registry does not ask for authentication
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		r.serveManifest(rw, req, path[:i], path[i+len("/manifests/"):])
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.serveUpload(rw, req, path[:strings.LastIndex(path, "/blobs/uploads/")])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		r.serveBlob(rw, req, path[:i], path[i+len("/blobs/"):])
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *memRegistry) serveManifest(rw http.ResponseWriter, req *http.Request, name, ref string) {
+	key := name + memSep(ref) + ref
+	switch req.Method {
+	case "GET", "HEAD":
+		m, ok := r.manifests[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("Content-Type", m.mediaType)
+		rw.Header().Set("Docker-Content-Digest", digest.Canonical.FromBytes(m.body).String())
+		if req.Method == "GET" {
+			_, err := rw.Write(m.body)
+			assert.NoError(r.t, err)
+		}
+	case "PUT":
+		body, err := ioutil.ReadAll(req.Body)
+		if !assert.NoError(r.t, err) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m := tagManifest{mediaType: req.Header.Get("Content-Type"), body: body}
+		d := digest.Canonical.FromBytes(body)
+		r.manifests[name+"@"+d.String()] = m
+		r.manifests[key] = m
+		rw.Header().Set("Docker-Content-Digest", d.String())
+		rw.WriteHeader(http.StatusCreated)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *memRegistry) serveBlob(rw http.ResponseWriter, req *http.Request, name, d string) {
+	data, ok := r.blobs[name+"@"+d]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method == "GET" {
+		_, err := rw.Write(data)
+		assert.NoError(r.t, err)
+	}
+}
+
+func (r *memRegistry) serveUpload(rw http.ResponseWriter, req *http.Request, name string) {
+	switch req.Method {
+	case "POST":
+		rw.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+uuid.New().String())
+		rw.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		body, err := ioutil.ReadAll(req.Body)
+		d := digest.Digest(req.URL.Query().Get("digest"))
+		if err != nil || d != digest.Canonical.FromBytes(body) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[name+"@"+d.String()] = body
+		rw.WriteHeader(http.StatusCreated)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// testImage is an image whose config and layer are encrypted
+type testImage struct {
+	config, layer []byte
+	manifest      *distribution.ImageManifest
+}
+
+// mkTestImage writes a config and a layer to dir, which are encrypted with opts
+func mkTestImage(t *testing.T, dir string, opts *crypto.Opts) *testImage {
+	require := require.New(t)
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	img := &testImage{layer: mkArchive(t, []tarEntry{{"etc/motd", []byte("hello")}})}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []digest.Digest{digest.Canonical.FromBytes(img.layer)},
+		},
+	})
+	require.NoError(err)
+	img.config = config
+
+	encrypt := func(name string, data []byte, newBlob func(string, digest.Digest, int64, *crypto.DeCrypto) distribution.DecryptedBlob) distribution.Blob {
+		fn := filepath.Join(dir, name)
+		require.NoError(ioutil.WriteFile(fn, data, 0600))
+		dec, err := crypto.NewDecrypto(opts)
+		require.NoError(err)
+		blob, err := newBlob(fn, digest.Canonical.FromBytes(data), int64(len(data)), dec).EncryptBlob(opts, fn+".aes")
+		require.NoError(err)
+		return blob
+	}
+
+	img.manifest = &distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Config:        encrypt("config", img.config, distribution.NewConfig),
+		Layers:        []distribution.Blob{encrypt("layer", img.layer, distribution.NewLayer)},
+		DirName:       dir,
+	}
+	return img
+}
+
+// push the image to ref in the registry of its name
+func (img *testImage) push(t *testing.T, ref reference.Named) {
+	token, nTRep, endpoint, err := authProcedure(ref)
+	require.NoError(t, err)
+	_, err = registry.PushImage(token, nTRep, img.manifest, endpoint)
+	require.NoError(t, err)
+}
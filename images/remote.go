@@ -0,0 +1,101 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// DaemonsSink loads images into the docker daemons at hosts, such as those of
+// other machines at ssh://user@host, so that the machine that decrypts an image
+// need not be the one that runs it. Each archive is made once and streamed to
+// every daemon at once, and the daemons that fail do not stop the others.
+func DaemonsSink(hosts ...string) Sink {
+	sinks := make([]Sink, len(hosts))
+	for i, host := range hosts {
+		sink := (&Daemon{Host: host}).Sink()
+		sinks[i] = func(host string) Sink {
+			return func(r io.Reader) error {
+				if err := sink(r); err != nil {
+					log.Error().Msgf("Could not load image into %s: %v", host, err)
+					return errors.Wrapf(err, "host = %s", host)
+				}
+				log.Info().Msgf("Loaded image into %s.", host)
+				return nil
+			}
+		}(host)
+	}
+	return TeeSink(sinks...)
+}
+
+// TeeSink loads each archive into all of sinks at once
+func TeeSink(sinks ...Sink) Sink {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+
+	return func(r io.Reader) error {
+		tw := &teeWriter{ws: make([]*io.PipeWriter, len(sinks)), errs: make([]error, len(sinks))}
+		errCh := make(chan error, len(sinks))
+		for i, sink := range sinks {
+			pr, pw := io.Pipe()
+			tw.ws[i] = pw
+			go func(sink Sink, pr *io.PipeReader) {
+				err := sink(pr)
+				// a sink that stops reading must not hold up the others
+				_ = pr.CloseWithError(errors.New("the sink has stopped"))
+				errCh <- err
+			}(sink, pr)
+		}
+
+		_, err := io.Copy(tw, r)
+		for _, pw := range tw.ws {
+			_ = pw.CloseWithError(err)
+		}
+
+		// the failures of the sinks explain a failure to write to them
+		if sinkErr := utils.ConcatErrChan(errCh, len(sinks)); sinkErr != nil {
+			return sinkErr
+		}
+		return errors.WithStack(err)
+	}
+}
+
+// teeWriter writes to each of ws until writing to it fails, so that one failed
+// writer does not stop the others
+type teeWriter struct {
+	ws   []*io.PipeWriter
+	errs []error
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	for i, w := range t.ws {
+		if t.errs[i] == nil {
+			_, t.errs[i] = w.Write(p)
+		}
+	}
+
+	for _, err := range t.errs {
+		if err == nil {
+			return len(p), nil
+		}
+	}
+	return 0, t.errs[0]
+}
@@ -0,0 +1,86 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDaemon is a docker daemon that keeps the archives that are loaded into it,
+// or fails to load them if fail is set
+type fakeDaemon struct {
+	t      *testing.T
+	fail   bool
+	loaded [][]byte
+}
+
+func (d *fakeDaemon) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" || !strings.HasSuffix(req.URL.Path, "/images/load") {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	assert.NoError(d.t, err)
+
+	rw.Header().Set("Content-Type", "application/json")
+	if d.fail {
+		rw.WriteHeader(http.StatusInternalServerError)
+		_, err = rw.Write([]byte(`{"message":"no space left on device"}`))
+		assert.NoError(d.t, err)
+		return
+	}
+	d.loaded = append(d.loaded, body)
+	_, err = rw.Write([]byte(`{"stream":"Loaded image: repo:latest\n"}`))
+	assert.NoError(d.t, err)
+}
+
+func TestDaemonsSink(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	archive := mkArchive(t, []tarEntry{{"manifest.json", []byte("[]")}})
+
+	// each daemon is reached at its own host, and the one that fails does not stop
+	// the others, which are each sent the whole archive
+	daemons := []*fakeDaemon{{t: t}, {t: t, fail: true}, {t: t}}
+	var hosts []string
+	for _, d := range daemons {
+		server := httptest.NewServer(d)
+		defer server.Close()
+		hosts = append(hosts, "tcp://"+strings.TrimPrefix(server.URL, "http://"))
+	}
+
+	err := DaemonsSink(hosts...)(bytes.NewReader(archive))
+	require.Error(err)
+	assert.Contains(err.Error(), "host = "+hosts[1])
+	assert.NotContains(err.Error(), hosts[0])
+	assert.NotContains(err.Error(), hosts[2])
+
+	assert.Equal([][]byte{archive}, daemons[0].loaded)
+	assert.Empty(daemons[1].loaded)
+	assert.Equal([][]byte{archive}, daemons[2].loaded)
+
+	// and a single daemon is loaded into on its own
+	require.NoError(DaemonsSink(hosts[0])(bytes.NewReader(archive)))
+	assert.Len(daemons[0].loaded, 2)
+}
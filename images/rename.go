@@ -0,0 +1,130 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/distribution"
+)
+
+// RenameSink wraps sink so that the image in each archive it loads is named name,
+// rather than the name the image was saved or pushed under
+func RenameSink(sink Sink, name reference.NamedTagged) Sink {
+	return func(r io.Reader) (err error) {
+		pr, pw := io.Pipe()
+		go func() { _ = pw.CloseWithError(renameArchive(pw, r, name)) }()
+
+		// stop the rewriting if sink gives up on the archive part way through
+		defer func() { _ = pr.CloseWithError(err) }()
+		return sink(pr)
+	}
+}
+
+// renameArchive copies the image archive in r to w, replacing the names of the
+// images it contains with name, both in manifest.json for docker and podman, and
+// in index.json for containerd
+func renameArchive(w io.Writer, r io.Reader, name reference.NamedTagged) (err error) {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+
+	for {
+		var hdr *tar.Header
+		if hdr, err = tr.Next(); err == io.EOF {
+			return errors.WithStack(tw.Close())
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+
+		var rename func([]byte) ([]byte, error)
+		switch hdr.Name {
+		case "manifest.json":
+			rename = func(data []byte) ([]byte, error) { return renameManifest(data, name) }
+		case "index.json":
+			rename = func(data []byte) ([]byte, error) { return renameIndex(data, name) }
+		case "repositories":
+			// the legacy names of the images, which are superseded by manifest.json
+			continue
+		default:
+			if err = tw.WriteHeader(hdr); err != nil {
+				return errors.WithStack(err)
+			}
+			if _, err = io.Copy(tw, tr); err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+
+		var data []byte
+		if data, err = ioutil.ReadAll(tr); err != nil {
+			return errors.WithStack(err)
+		}
+		if data, err = rename(data); err != nil {
+			return err
+		}
+
+		hdr.Size = int64(len(data))
+		if err = tw.WriteHeader(hdr); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err = io.Copy(tw, bytes.NewReader(data)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// renameManifest sets the tags of every image in the manifest.json of an archive
+// made by docker save to name. Other fields are kept as they are.
+func renameManifest(data []byte, name reference.NamedTagged) ([]byte, error) {
+	var manifest []map[string]interface{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.Wrap(err, "could not parse manifest.json")
+	}
+	for _, image := range manifest {
+		image["RepoTags"] = []string{name.String()}
+	}
+	return json.Marshal(manifest)
+}
+
+// renameIndex sets the names of every image in the index.json of an archive to
+// name, in the annotations that containerd and the OCI spec name images by
+func renameIndex(data []byte, name reference.NamedTagged) ([]byte, error) {
+	var index map[string]interface{}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrap(err, "could not parse index.json")
+	}
+	manifests, _ := index["manifests"].([]interface{})
+	for _, m := range manifests {
+		desc, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		annotations, _ := desc["annotations"].(map[string]interface{})
+		if annotations == nil {
+			annotations = make(map[string]interface{})
+			desc["annotations"] = annotations
+		}
+		annotations[distribution.AnnotationContainerdImageName] = name.String()
+		annotations[distribution.AnnotationRefName] = name.Tag()
+	}
+	return json.Marshal(index)
+}
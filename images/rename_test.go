@@ -0,0 +1,149 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+)
+
+// tarEntry is a file of an image archive
+type tarEntry struct {
+	name string
+	data []byte
+}
+
+func mkArchive(t *testing.T, entries []tarEntry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data))}))
+		_, err := tw.Write(e.data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func readArchive(t *testing.T, r io.Reader) []tarEntry {
+	var entries []tarEntry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		require.NoError(t, err)
+		assert.Equal(t, hdr.Size, int64(len(data)), hdr.Name)
+		entries = append(entries, tarEntry{hdr.Name, data})
+	}
+}
+
+func TestRenameSink(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	named, err := reference.ParseNormalizedNamed("app:1.0")
+	require.NoError(err)
+	name := named.(reference.NamedTagged)
+
+	layer := []byte("the layer, which is not a tar itself")
+	config := []byte(`{"architecture":"amd64"}`)
+
+	// an archive made by docker save, with the legacy repositories file
+	saved := []tarEntry{
+		{"repositories", []byte(`{"registry.example.com/enc/app":{"1.0":"abc"}}`)},
+		{"abc/layer.tar", layer},
+		{"abc.json", config},
+		{"manifest.json", []byte(`[{"Config":"abc.json","RepoTags":["registry.example.com/enc/app:1.0"],"Layers":["abc/layer.tar"]}]`)},
+	}
+
+	// and an OCI archive, one of whose manifests has no annotations
+	oci := []tarEntry{
+		{"oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{"blobs/sha256/abc", layer},
+		{"index.json", []byte(`{"schemaVersion":2,"manifests":[` +
+			`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:abc","size":3,` +
+			`"annotations":{"org.opencontainers.image.ref.name":"latest","other":"kept"}},` +
+			`{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:def","size":3}]}`)},
+	}
+
+	var got []tarEntry
+	sink := RenameSink(func(r io.Reader) error {
+		got = readArchive(t, r)
+		return nil
+	}, name)
+
+	// every file but the names is kept byte for byte, and the legacy names are dropped
+	require.NoError(sink(bytes.NewReader(mkArchive(t, saved))))
+	if assert.Len(got, 3) {
+		assert.Equal(saved[1:3], got[:2])
+		var manifest []map[string]interface{}
+		require.NoError(json.Unmarshal(got[2].data, &manifest))
+		assert.Equal([]interface{}{"docker.io/library/app:1.0"}, manifest[0]["RepoTags"])
+		assert.Equal("abc.json", manifest[0]["Config"])
+		assert.Equal([]interface{}{"abc/layer.tar"}, manifest[0]["Layers"])
+	}
+
+	got = nil
+	require.NoError(sink(bytes.NewReader(mkArchive(t, oci))))
+	if assert.Len(got, 3) {
+		assert.Equal(oci[:2], got[:2])
+		var index struct {
+			SchemaVersion int `json:"schemaVersion"`
+			Manifests     []struct {
+				Digest      string            `json:"digest"`
+				Annotations map[string]string `json:"annotations"`
+			} `json:"manifests"`
+		}
+		require.NoError(json.Unmarshal(got[2].data, &index))
+		assert.Equal(2, index.SchemaVersion)
+		require.Len(index.Manifests, 2)
+		for _, m := range index.Manifests {
+			assert.Equal("docker.io/library/app:1.0", m.Annotations[distribution.AnnotationContainerdImageName], m.Digest)
+			assert.Equal("1.0", m.Annotations[distribution.AnnotationRefName], m.Digest)
+		}
+		assert.Equal("kept", index.Manifests[0].Annotations["other"])
+	}
+
+	// names that cannot be parsed fail the load
+	err = RenameSink(func(r io.Reader) error {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	}, name)(bytes.NewReader(mkArchive(t, []tarEntry{{"manifest.json", []byte("{")}})))
+	assert.Error(err)
+
+	// as does a sink that gives up part way through, without the rewriting hanging
+	failed := errors.New("the sink failed")
+	err = RenameSink(func(r io.Reader) error {
+		_, err := r.Read(make([]byte, 1))
+		require.NoError(err)
+		return failed
+	}, name)(bytes.NewReader(mkArchive(t, saved)))
+	assert.Equal(failed, err)
+}
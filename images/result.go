@@ -0,0 +1,69 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"time"
+
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+
+	"github.com/Senetas/crypto-cli/distribution"
+)
+
+// Result describes an image that was pushed, pulled or verified, for programs that
+// read the output of a run rather than its logs
+type Result struct {
+	Image string `json:"image"`
+	// Digest is that of the manifest of the image in the registry
+	Digest digest.Digest `json:"digest,omitempty"`
+	// Size is the total size of the blobs of the image in the registry
+	Size int64 `json:"size"`
+	// Seconds is how long the image took to push, pull or verify
+	Seconds float64 `json:"seconds"`
+	// Manifest describes the blobs of the image and their encryption, if known
+	Manifest *distribution.ManifestInfo `json:"manifest,omitempty"`
+}
+
+// Report, if set, is called with the result of each image that is pushed, pulled or
+// verified
+var Report func(*Result)
+
+// report reports the result of ref, whose manifest has the digest d and is described
+// by info, which may be nil, to Report
+func report(ref reference.Named, start time.Time, d digest.Digest, info *distribution.ManifestInfo) {
+	if Report == nil {
+		return
+	}
+
+	r := &Result{
+		Image:    ref.String(),
+		Digest:   d,
+		Seconds:  time.Since(start).Seconds(),
+		Manifest: info,
+	}
+	if info != nil {
+		// the manifest of an image that was pushed is described before it has a digest
+		if info.Digest == "" {
+			described := *info
+			described.Digest = d
+			r.Manifest = &described
+		}
+		for _, b := range append([]distribution.BlobInfo{info.Config}, info.Layers...) {
+			r.Size += b.Size
+		}
+	}
+	Report(r)
+}
@@ -0,0 +1,204 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// ResumeDir, if set, is the directory that encrypted images are kept in until they
+// have been pushed, so that a push that fails part way through the upload may be
+// resumed without encrypting the image again
+var ResumeDir string
+
+// resumeSourceFile is the file in the layout of a kept image that holds the digest
+// of the config of the source it was encrypted from
+const resumeSourceFile = "source"
+
+// resumeOptionsFile is the file in the layout of a kept image that holds the digest
+// of the options it was encrypted with
+const resumeOptionsFile = "options"
+
+// resumeLayout is the OCI image layout in ResumeDir that the encrypted image that
+// is pushed to ref is kept in
+func resumeLayout(ref names.NamedTaggedRepository) string {
+	return filepath.Join(ResumeDir, digest.FromString(ref.String()).Hex())
+}
+
+// resumedImage reads the encrypted image that an earlier push to ref left in
+// ResumeDir, or returns nil if there is none. The image is only used if it was
+// encrypted from the config of source with the same options, and each of its
+// blobs is verified against its digest. Otherwise it is discarded, to be encrypted
+// again. It is an error if the passphrase of opts does not unwrap its keys, as
+// they would be pushed wrapped with another passphrase.
+func resumedImage(
+	ref names.NamedTaggedRepository,
+	source *distribution.ImageManifest,
+	opts *crypto.Opts,
+) (*distribution.ImageManifest, error) {
+	if ResumeDir == "" {
+		return nil, nil
+	}
+
+	dir := resumeLayout(ref)
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	d, err := sourceDigest(source)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := keptDigest(dir, resumeSourceFile, d); err != nil {
+		return nil, err
+	} else if !ok {
+		log.Warn().Msgf("The image pushed to %s has changed since the encrypted image kept in %s was encrypted, so it is encrypted again.", ref, dir)
+		return nil, utils.CleanUp(dir, nil)
+	}
+
+	if d, err = optionsDigest(opts); err != nil {
+		return nil, err
+	}
+	if ok, err := keptDigest(dir, resumeOptionsFile, d); err != nil {
+		return nil, err
+	} else if !ok {
+		log.Warn().Msgf("The encrypted image kept in %s was encrypted with other options, so %s is encrypted again.", dir, ref)
+		return nil, utils.CleanUp(dir, nil)
+	}
+
+	manifest, err := distribution.ReadOCILayout(dir, ref)
+	if err == nil {
+		for _, b := range append([]distribution.Blob{manifest.Config}, manifest.LayerBlobs()...) {
+			if err = b.Verify(); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Warn().Msgf("The encrypted image kept in %s could not be used, so %s is encrypted again: %v", dir, ref, err)
+		return nil, utils.CleanUp(dir, nil)
+	}
+
+	// the keys are unwrapped in a copy, as they are pushed wrapped
+	unwrapped, err := distribution.ReadOCILayout(dir, ref)
+	if err != nil {
+		return nil, err
+	}
+	if err = unwrapped.DecryptKeys(ref, opts); err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"the keys of the encrypted image kept in %s are wrapped with another passphrase, give that passphrase to resume, or remove %s to encrypt the image again",
+			dir,
+			dir,
+		)
+	}
+
+	log.Info().Msgf("Resuming the push of %s with the image that was encrypted before.", ref)
+	return manifest, nil
+}
+
+// keepForResume keeps the encrypted image that is pushed to ref in ResumeDir until
+// the push succeeds, if it is set, with the digests of the config of the source it
+// was encrypted from and of the options it was encrypted with
+func keepForResume(
+	ref names.NamedTaggedRepository,
+	source, manifest *distribution.ImageManifest,
+	opts *crypto.Opts,
+) error {
+	if ResumeDir == "" {
+		return nil
+	}
+
+	d, err := sourceDigest(source)
+	if err != nil {
+		return err
+	}
+	od, err := optionsDigest(opts)
+	if err != nil {
+		return err
+	}
+
+	// the layout is made readable by all, so its directory must not be
+	if err = os.MkdirAll(ResumeDir, 0700); err != nil {
+		return errors.Wrapf(err, "dir = %s", ResumeDir)
+	}
+
+	dir := resumeLayout(ref)
+	log.Info().Msgf("Keeping the encrypted image in %s until it is pushed.", dir)
+	if _, err = distribution.WriteOCILayout(dir, ref.Tag(), manifest); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, resumeOptionsFile), []byte(od), 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(filepath.Join(dir, resumeSourceFile), []byte(d), 0600))
+}
+
+// keptDigest reports whether the file name in the layout at dir holds d. It does
+// not if it is missing, as in the layouts of older versions.
+func keptDigest(dir, name string, d digest.Digest) (bool, error) {
+	// the layout is written by this program
+	kept, err := ioutil.ReadFile(filepath.Join(dir, name)) // #nosec
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.WithStack(err)
+	}
+	return digest.Digest(kept) == d, nil
+}
+
+// optionsDigest returns the digest of the options that an image is encrypted with,
+// but for the passphrase, which is checked by unwrapping the keys of the image
+func optionsDigest(opts *crypto.Opts) (digest.Digest, error) {
+	body, err := utils.CanonicalJSON(opts)
+	if err != nil {
+		return "", err
+	}
+	return digest.Canonical.FromBytes(body), nil
+}
+
+// sourceDigest returns the digest of the config of the plain image source, which
+// changes whenever the image is rebuilt or changed, as the config lists the
+// digests of its layers
+func sourceDigest(source *distribution.ImageManifest) (_ digest.Digest, err error) {
+	fh, err := os.Open(source.Config.GetFilename())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	d, err := digest.Canonical.FromReader(fh)
+	return d, errors.WithStack(err)
+}
+
+// endResume removes the encrypted image that was kept for the push to ref, once it
+// has succeeded
+func endResume(ref names.NamedTaggedRepository, err error) error {
+	if ResumeDir == "" || err != nil {
+		return err
+	}
+	return utils.CleanUp(resumeLayout(ref), nil)
+}
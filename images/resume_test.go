@@ -0,0 +1,147 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// mkResumeImage writes a plain config and layer to dir, and returns the source
+// manifest of the config, and the image encrypted from them with opts
+func mkResumeImage(t *testing.T, dir string, opts *crypto.Opts) (source, encrypted *distribution.ImageManifest) {
+	require := require.New(t)
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	configFile := filepath.Join(dir, "config")
+	require.NoError(ioutil.WriteFile(configFile, config, 0600))
+	layer := make([]byte, 1024)
+	_, err := rand.Read(layer)
+	require.NoError(err)
+	layerFile := filepath.Join(dir, "layer")
+	require.NoError(ioutil.WriteFile(layerFile, layer, 0600))
+
+	dec, err := crypto.NewDecrypto(opts)
+	require.NoError(err)
+	encConfig, err := distribution.NewConfig(configFile, digest.Canonical.FromBytes(config), int64(len(config)), dec).
+		EncryptBlob(opts, configFile+".aes")
+	require.NoError(err)
+	dec, err = crypto.NewDecrypto(opts)
+	require.NoError(err)
+	encLayer, err := distribution.NewLayer(layerFile, digest.Canonical.FromBytes(layer), int64(len(layer)), dec).
+		EncryptBlob(opts, layerFile+".aes")
+	require.NoError(err)
+
+	source = &distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Config:        distribution.NewPlainConfig(configFile, digest.Canonical.FromBytes(config), int64(len(config))),
+		DirName:       dir,
+	}
+	encrypted = &distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Config:        encConfig,
+		Layers:        []distribution.Blob{encLayer},
+		DirName:       dir,
+	}
+	return
+}
+
+func TestResume(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	defer func(resumeDir string) { ResumeDir = resumeDir }(ResumeDir)
+	ResumeDir = filepath.Join(dir, "resume")
+
+	named, err := reference.ParseNormalizedNamed("cryptocli/alpine:resume")
+	require.NoError(err)
+	ref, err := names.CastToTagged(named)
+	require.NoError(err)
+
+	newOpts := func(passphrase string) *crypto.Opts {
+		opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+		opts.SetPassphrase(passphrase)
+		return opts
+	}
+	keep := func() *distribution.ImageManifest {
+		source, encrypted := mkResumeImage(t, filepath.Join(dir, uuid.New().String()), newOpts("hunter2"))
+		require.NoError(keepForResume(ref, source, encrypted, newOpts("hunter2")))
+		return source
+	}
+
+	// the same source, options and passphrase resume the kept image
+	source := keep()
+	resumed, err := resumedImage(ref, source, newOpts("hunter2"))
+	require.NoError(err)
+	require.NotNil(resumed)
+	assert.True(resumed.Encrypted())
+
+	// another passphrase does not, and the kept image is left for the right one
+	_, err = resumedImage(ref, source, newOpts("hunter3"))
+	assert.Error(err)
+	assert.FileExists(filepath.Join(resumeLayout(ref), "index.json"))
+
+	// nor do other options, which discard the kept image
+	other := newOpts("hunter2")
+	other.EncryptAll = true
+	resumed, err = resumedImage(ref, source, other)
+	require.NoError(err)
+	assert.Nil(resumed)
+	_, err = os.Stat(resumeLayout(ref))
+	assert.True(os.IsNotExist(err))
+
+	// nor does another source
+	keep()
+	other.EncryptAll = false
+	resumed, err = resumedImage(ref, mkOtherSource(t, filepath.Join(dir, "other")), other)
+	require.NoError(err)
+	assert.Nil(resumed)
+
+	// and once the push succeeds, the kept image is removed
+	source = keep()
+	require.NoError(endResume(ref, nil))
+	resumed, err = resumedImage(ref, source, newOpts("hunter2"))
+	require.NoError(err)
+	assert.Nil(resumed)
+}
+
+// mkOtherSource writes a config that no image is kept for to dir
+func mkOtherSource(t *testing.T, dir string) *distribution.ImageManifest {
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	config := []byte(`{"architecture":"arm64","os":"linux"}`)
+	fn := filepath.Join(dir, "config")
+	require.NoError(t, ioutil.WriteFile(fn, config, 0600))
+	return &distribution.ImageManifest{
+		Config: distribution.NewPlainConfig(fn, digest.Canonical.FromBytes(config), int64(len(config))),
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"os"
+
+	"github.com/Senetas/crypto-cli/distribution"
+)
+
+// The container runtimes that images may be read from and loaded into
+const (
+	RuntimeDocker     = "docker"
+	RuntimePodman     = "podman"
+	RuntimeContainerd = "containerd"
+)
+
+const (
+	dockerSocket     = "/var/run/docker.sock"
+	containerdSocket = "/run/containerd/containerd.sock"
+)
+
+// DetectRuntime chooses the container runtime to use when none is given. Docker
+// is used if it is configured, such as by a docker context, or its socket exists,
+// then podman if a socket of its service exists, then containerd if its socket
+// exists, otherwise docker.
+func DetectRuntime() string {
+	if distribution.DockerHost != "" || distribution.DefaultDockerHost() != "" {
+		return RuntimeDocker
+	}
+	if _, err := os.Stat(dockerSocket); err == nil {
+		return RuntimeDocker
+	}
+	if PodmanSocket() != "" {
+		return RuntimePodman
+	}
+	if os.Getenv("CONTAINERD_ADDRESS") != "" {
+		return RuntimeContainerd
+	}
+	if _, err := os.Stat(containerdSocket); err == nil {
+		return RuntimeContainerd
+	}
+	return RuntimeDocker
+}
@@ -0,0 +1,70 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// TagImage tags the image that src refers to, by tag or digest, with the tag of
+// dst, which must be in the same repository. Only the manifest is uploaded again,
+// so an encrypted image may be promoted between tags without transferring any of
+// its layers, and without it being decrypted.
+func TagImage(src reference.Named, dst reference.Named) (*distribution.Descriptor, error) {
+	tagged, ok := dst.(reference.NamedTagged)
+	if !ok {
+		return nil, errors.Errorf("the destination %s must have a tag", dst)
+	} else if _, ok = dst.(reference.Digested); ok {
+		return nil, errors.Errorf("the destination %s may not have a digest, as it has that of the source", dst)
+	}
+	if src.Name() != dst.Name() {
+		return nil, errors.Errorf("%s is not in the repository of %s, use copy to copy it there", dst, src)
+	}
+
+	token, _, endpoint, err := pushAuthProcedure(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	srcRep, err := names.CastToTagged(src)
+	if err != nil {
+		return nil, err
+	}
+	srcRef := names.ManifestReference(srcRep)
+
+	// a tag that already holds the image is not asked about, as it is not changed
+	srcDesc, err := registry.ResolveManifest(token, srcRef, v2.NewURLBuilder(endpoint.URL, false))
+	if err != nil {
+		return nil, err
+	}
+	if err = confirmOverwrite([]reference.Named{dst}, srcDesc.Digest); err != nil {
+		return nil, err
+	}
+
+	desc, err := registry.TagManifest(token, srcRef, tagged, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Msgf("Tagged %s as %s: %s.", src, dst, desc.Digest)
+	return desc, nil
+}
@@ -0,0 +1,130 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// RemoteTag is a tag of a repository in a registry, and how the image that it
+// refers to is encrypted
+type RemoteTag struct {
+	Tag    string        `json:"tag"`
+	Digest digest.Digest `json:"digest,omitempty"`
+	// Encrypted is set if the config or any layer of the image is encrypted
+	Encrypted bool `json:"encrypted"`
+	// Layers is the number of layers of the image, of which EncryptedLayers are
+	// encrypted
+	Layers          int `json:"layers"`
+	EncryptedLayers int `json:"encryptedLayers"`
+	// Size is the total size of the config and layers of the image
+	Size int64 `json:"size"`
+	// Ciphers are the ciphers that the blobs of the image are encrypted with, which
+	// are not known for blobs whose keys are detached
+	Ciphers  []string `json:"ciphers,omitempty"`
+	Detached bool     `json:"detached,omitempty"`
+	// Error is why the manifest of the tag could not be read, such as it being that
+	// of an artifact rather than an image
+	Error string `json:"error,omitempty"`
+}
+
+// ListRemoteTags lists the tags of the repository of ref and describes how the image
+// of each is encrypted, from its manifest alone, so that the encryption of a whole
+// repository may be audited. The manifests are fetched concurrently, at most
+// registry.MaxConcurrentDownloads at a time.
+func ListRemoteTags(ref reference.Named) ([]*RemoteTag, error) {
+	token, nTRep, endpoint, err := authProcedure(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	tags, err := registry.ListTags(token, nTRep, bldr)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tags)
+
+	n := registry.MaxConcurrentDownloads
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+
+	list := make([]*RemoteTag, len(tags))
+	var wg sync.WaitGroup
+	for i, tag := range tags {
+		wg.Add(1)
+		go func(i int, tag string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			list[i] = &RemoteTag{Tag: tag}
+			tagged := names.WithTag(names.SeperateRepository(nTRep), tag)
+			manifest, err := registry.PullManifest(token, names.ManifestReference(tagged), bldr, "")
+			if err != nil {
+				// a tag may hold an artifact, such as the referrers of an image
+				log.Debug().Err(err).Msgf("could not read the manifest of %s", tagged)
+				list[i].Error = err.Error()
+				return
+			}
+
+			info, err := manifest.Inspect()
+			if err != nil {
+				list[i].Error = err.Error()
+				return
+			}
+			describeTag(list[i], info)
+		}(i, tag)
+	}
+	wg.Wait()
+
+	return list, nil
+}
+
+// describeTag summarises the encryption of the image of t from info
+func describeTag(t *RemoteTag, info *distribution.ManifestInfo) {
+	t.Digest = info.Digest
+	t.Layers = len(info.Layers)
+
+	seen := make(map[string]bool)
+	for i, b := range append([]distribution.BlobInfo{info.Config}, info.Layers...) {
+		t.Size += b.Size
+		if !b.Encrypted {
+			continue
+		}
+		t.Encrypted = true
+		t.Detached = t.Detached || b.Detached
+		if i > 0 {
+			t.EncryptedLayers++
+		}
+		if b.Cipher != "" && !seen[b.Cipher] {
+			seen[b.Cipher] = true
+			t.Ciphers = append(t.Ciphers, b.Cipher)
+		}
+	}
+}
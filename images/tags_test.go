@@ -0,0 +1,212 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+)
+
+// tagManifest is a manifest that a tag of a repository refers to
+type tagManifest struct {
+	mediaType string
+	body      []byte
+}
+
+// taggedRepo serves the list of the tags of the repository repo, and the manifest
+// that each refers to. A tag that is listed without a manifest is not found.
+type taggedRepo struct {
+	t         *testing.T
+	tags      []string
+	manifests map[string]tagManifest
+}
+
+func (r *taggedRepo) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/v2/repo/tags/list":
+		assert.NoError(r.t, json.NewEncoder(rw).Encode(map[string]interface{}{"name": "repo", "tags": r.tags}))
+	case strings.HasPrefix(req.URL.Path, "/v2/repo/manifests/"):
+		m, ok := r.manifests[strings.TrimPrefix(req.URL.Path, "/v2/repo/manifests/")]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("Content-Type", m.mediaType)
+		rw.Header().Set("Docker-Content-Digest", digest.Canonical.FromBytes(m.body).String())
+		_, err := rw.Write(m.body)
+		assert.NoError(r.t, err)
+	}
+}
+
+func TestListRemoteTags(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	defer func(insecure []string, retries int) {
+		httpclient.InsecureRegistries, httpclient.Retries = insecure, retries
+	}(httpclient.InsecureRegistries, httpclient.Retries)
+	httpclient.Retries = 0
+
+	opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+	opts.SetPassphrase("hunter2")
+	_, encrypted := mkResumeImage(t, dir, opts)
+	detached, _, err := encrypted.DetachKeys()
+	require.NoError(err)
+
+	plain := []byte(`{"schemaVersion":2,"mediaType":"` + distribution.MediaTypeManifest + `",` +
+		`"config":{"mediaType":"` + distribution.MediaTypeImageConfig + `","size":7,"digest":"` + digest.Canonical.FromString("config").String() + `"},` +
+		`"layers":[{"mediaType":"` + distribution.MediaTypeLayer + `","size":100,"digest":"` + digest.Canonical.FromString("a").String() + `"},` +
+		`{"mediaType":"` + distribution.MediaTypeLayer + `","size":200,"digest":"` + digest.Canonical.FromString("b").String() + `"}]}`)
+	encBody, err := json.Marshal(encrypted)
+	require.NoError(err)
+	detachedBody, err := json.Marshal(detached)
+	require.NoError(err)
+
+	repo := &taggedRepo{
+		t: t,
+		// the tags are listed out of order, and one of them is gone
+		tags: []string{"plain", "enc", "gone", "detached", "artifact"},
+		manifests: map[string]tagManifest{
+			"plain":    {distribution.MediaTypeManifest, plain},
+			"enc":      {distribution.MediaTypeManifest, encBody},
+			"detached": {distribution.MediaTypeManifest, detachedBody},
+			"artifact": {"application/vnd.example.artifact.v1+json", []byte(`{"schemaVersion":2}`)},
+		},
+	}
+	server := httptest.NewServer(repo)
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+	httpclient.InsecureRegistries = []string{u.Host}
+	ref, err := reference.ParseNormalizedNamed(u.Host + "/repo")
+	require.NoError(err)
+
+	list, err := ListRemoteTags(ref)
+	require.NoError(err)
+	require.Len(list, 5)
+
+	byTag := make(map[string]*RemoteTag)
+	var tags []string
+	for _, tag := range list {
+		tags = append(tags, tag.Tag)
+		byTag[tag.Tag] = tag
+	}
+	assert.Equal([]string{"artifact", "detached", "enc", "gone", "plain"}, tags)
+
+	cipher, _, _ := crypto.Describe(crypto.Pbkdf2Aes256Gcm)
+	size := encrypted.Config.GetSize() + encrypted.Layers[0].GetSize()
+
+	// a plain image is described by its manifest alone
+	assert.Equal(&RemoteTag{
+		Tag:    "plain",
+		Digest: digest.Canonical.FromBytes(plain),
+		Layers: 2,
+		Size:   307,
+	}, byTag["plain"])
+
+	// as is an encrypted one, with the ciphers of its blobs
+	assert.Equal(&RemoteTag{
+		Tag:             "enc",
+		Digest:          digest.Canonical.FromBytes(encBody),
+		Encrypted:       true,
+		Layers:          1,
+		EncryptedLayers: 1,
+		Size:            size,
+		Ciphers:         []string{cipher},
+	}, byTag["enc"])
+
+	// whose ciphers are not known once its keys are detached
+	assert.Equal(&RemoteTag{
+		Tag:             "detached",
+		Digest:          digest.Canonical.FromBytes(detachedBody),
+		Encrypted:       true,
+		Layers:          1,
+		EncryptedLayers: 1,
+		Size:            size,
+		Detached:        true,
+	}, byTag["detached"])
+
+	// and the tags whose manifests cannot be read are listed with why, rather than
+	// failing the list
+	assert.Contains(byTag["artifact"].Error, "unsupported media type")
+	assert.False(byTag["artifact"].Encrypted)
+	assert.NotEmpty(byTag["gone"].Error)
+	assert.Empty(byTag["gone"].Digest)
+}
+
+func TestDescribeTag(t *testing.T) {
+	assert := assert.New(t)
+
+	d := digest.Canonical.FromString("manifest")
+	blob := func(size int64, encrypted bool, cipher string) distribution.BlobInfo {
+		return distribution.BlobInfo{Size: size, Encrypted: encrypted, Cipher: cipher, Detached: encrypted && cipher == ""}
+	}
+
+	tests := []struct {
+		name string
+		info *distribution.ManifestInfo
+		want RemoteTag
+	}{
+		{
+			name: "plain",
+			info: &distribution.ManifestInfo{Digest: d, Config: blob(1, false, ""), Layers: []distribution.BlobInfo{blob(2, false, ""), blob(4, false, "")}},
+			want: RemoteTag{Digest: d, Layers: 2, Size: 7},
+		},
+		{
+			// an encrypted config alone encrypts the image, but none of its layers
+			name: "config only",
+			info: &distribution.ManifestInfo{Digest: d, Config: blob(1, true, "A"), Layers: []distribution.BlobInfo{blob(2, false, "")}},
+			want: RemoteTag{Digest: d, Encrypted: true, Layers: 1, Size: 3, Ciphers: []string{"A"}},
+		},
+		{
+			// each cipher is listed once, in the order of the blobs
+			name: "mixed",
+			info: &distribution.ManifestInfo{Digest: d, Config: blob(1, true, "A"), Layers: []distribution.BlobInfo{
+				blob(2, true, "B"), blob(4, false, ""), blob(8, true, "A"),
+			}},
+			want: RemoteTag{Digest: d, Encrypted: true, Layers: 3, EncryptedLayers: 2, Size: 15, Ciphers: []string{"A", "B"}},
+		},
+		{
+			name: "detached",
+			info: &distribution.ManifestInfo{Digest: d, Config: blob(1, true, ""), Layers: []distribution.BlobInfo{blob(2, true, "")}},
+			want: RemoteTag{Digest: d, Encrypted: true, Layers: 1, EncryptedLayers: 1, Size: 3, Detached: true},
+		},
+	}
+
+	for _, test := range tests {
+		got := RemoteTag{Tag: test.name}
+		test.want.Tag = test.name
+		describeTag(&got, test.info)
+		assert.Equal(test.want, got, test.name)
+	}
+}
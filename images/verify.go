@@ -0,0 +1,72 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// VerifyImage checks that the image ref may be pulled and decrypted with opts, by
+// decrypting its keys and checking that the registry has each of its blobs, without
+// downloading any but the key envelope of detached keys
+func VerifyImage(ref reference.Named, opts *crypto.Opts, tempDir string) (err error) {
+	start := time.Now()
+	token, nTRep, endpoint, err := authProcedure(ref)
+	if err != nil {
+		return
+	}
+
+	dir := filepath.Join(tempDir, uuid.New().String())
+
+	err = os.MkdirAll(dir, 0700)
+	defer func() { err = utils.CleanUp(dir, err) }()
+	if err != nil {
+		err = errors.Wrapf(err, "dir = %s", dir)
+		return
+	}
+
+	manifest, err := registry.VerifyImage(token, nTRep, endpoint, opts, dir)
+	if err != nil {
+		return
+	}
+
+	keys := 0
+	for _, b := range append([]distribution.Blob{manifest.Config}, manifest.Layers...) {
+		if _, ok := b.(distribution.KeyDecryptedBlob); ok {
+			keys++
+		}
+	}
+
+	if keys == 0 {
+		log.Info().Msgf("%s is not encrypted, and may be pulled.", ref)
+	} else {
+		log.Info().Msgf("The keys of the %d encrypted blobs of %s were decrypted, and it may be pulled.", keys, ref)
+	}
+
+	report(ref, start, manifest.Digest, manifest.Encryption)
+	return
+}
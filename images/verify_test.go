@@ -0,0 +1,110 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package images
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/reference"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestVerifyImage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	defer func(insecure []string, retries int) {
+		httpclient.InsecureRegistries, httpclient.Retries = insecure, retries
+	}(httpclient.InsecureRegistries, httpclient.Retries)
+	httpclient.Retries = 0
+
+	newOpts := func(passphrase string) *crypto.Opts {
+		opts := &crypto.Opts{Algos: crypto.Pbkdf2Aes256Gcm}
+		opts.SetPassphrase(passphrase)
+		return opts
+	}
+
+	r := newMemRegistry(t)
+	server, host := r.serve()
+	defer server.Close()
+	ref, err := reference.ParseNormalizedNamed(host + "/repo:latest")
+	require.NoError(err)
+
+	img := mkTestImage(t, filepath.Join(dir, "image"), newOpts("hunter2"))
+	img.push(t, ref)
+	r.Lock()
+	r.requests = nil
+	r.Unlock()
+
+	// the keys of an image that is whole are decrypted, and its blobs are only asked
+	// about, not downloaded
+	require.NoError(VerifyImage(ref, newOpts("hunter2"), dir))
+	assert.Equal(2, r.count("HEAD", "/v2/repo/blobs/"))
+	assert.Zero(r.count("GET", "/v2/repo/blobs/"))
+
+	// but not with another passphrase
+	err = VerifyImage(ref, newOpts("hunter3"), dir)
+	if assert.Error(err) {
+		assert.Equal(utils.ClassDecrypt, utils.ClassOf(err))
+	}
+
+	// nor if the key of a layer has been tampered with
+	m, ok := r.manifest("repo", "latest")
+	require.True(ok)
+	var manifest map[string]interface{}
+	require.NoError(json.Unmarshal(m.body, &manifest))
+	layer := manifest["layers"].([]interface{})[0].(map[string]interface{})
+	ek := layer["crypto"].(map[string]interface{})
+	key, err := base64.StdEncoding.DecodeString(ek["key"].(string))
+	require.NoError(err)
+	key[len(key)/2] ^= 0xff
+	ek["key"] = base64.StdEncoding.EncodeToString(key)
+	tampered, err := json.Marshal(manifest)
+	require.NoError(err)
+	r.Lock()
+	r.manifests["repo:tampered"] = tagManifest{distribution.MediaTypeManifest, tampered}
+	r.Unlock()
+
+	tamperedRef, err := reference.ParseNormalizedNamed(host + "/repo:tampered")
+	require.NoError(err)
+	err = VerifyImage(tamperedRef, newOpts("hunter2"), dir)
+	if assert.Error(err) {
+		assert.Equal(utils.ClassDecrypt, utils.ClassOf(err))
+	}
+
+	// and an image whose layer the registry has lost may not be pulled, for all that
+	// its keys are decrypted
+	r.Lock()
+	delete(r.blobs, "repo@"+img.manifest.Layers[0].GetDigest().String())
+	r.Unlock()
+	err = VerifyImage(ref, newOpts("hunter2"), dir)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "1 of the 2 blobs")
+	}
+	assert.Zero(r.count("GET", "/v2/repo/blobs/"))
+}
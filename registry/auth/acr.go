@@ -0,0 +1,272 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	dregistry "github.com/docker/docker/registry"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// acrRE matches the hosts of the registries of Azure Container Registry, in the
+// public and sovereign clouds
+var acrRE = regexp.MustCompile(`^[a-z0-9]+\.azurecr\.(io|cn|us)$`)
+
+const (
+	azureAuthorityHost = "https://login.microsoftonline.com"
+	// azureResource is the resource that AAD tokens are requested for, which ACR
+	// accepts in exchange for its own
+	azureResource = "https://management.azure.com/"
+	imdsHost      = "169.254.169.254"
+)
+
+// IsACR is whether the registry of repoInfo is one of Azure Container Registry
+func IsACR(repoInfo *dregistry.RepositoryInfo) bool {
+	return acrRE.MatchString(repoInfo.Index.Name)
+}
+
+// NewACRCreds gives credentials for the registry of Azure at endpoint of repoInfo,
+// which are a refresh token of ACR that an Azure AD access token is exchanged for.
+// The access token is taken from the first of the service principal of
+// $AZURE_CLIENT_ID, $AZURE_TENANT_ID and $AZURE_CLIENT_SECRET, the workload identity
+// of $AZURE_FEDERATED_TOKEN_FILE, the managed identity of the host and az, as the
+// Azure SDKs find them. Without any, the credentials of docker for the registry are
+// used, such as docker login with a service principal or az acr login gives.
+func NewACRCreds(
+	repoInfo *dregistry.RepositoryInfo,
+	endpoint dregistry.APIEndpoint,
+) (_ Credentials, err error) {
+	sources := []struct {
+		name  string
+		token func() (string, error)
+	}{
+		{"service principal", servicePrincipalToken},
+		{"workload identity", workloadIdentityToken},
+		{"managed identity", managedIdentityToken},
+		{"Azure CLI", azToken},
+	}
+
+	for _, s := range sources {
+		aadToken, err := s.token()
+		switch {
+		case err == errNoAAD:
+			continue
+		case err != nil:
+			return nil, errors.Wrapf(err, "could not get an access token from the %s", s.name)
+		}
+		log.Debug().Msgf("using an access token from the %s for %s", s.name, repoInfo.Index.Name)
+
+		refresh, err := exchangeACRToken(repoInfo.Index.Name, endpoint, aadToken)
+		if err != nil {
+			return nil, err
+		}
+		return &identityToken{refresh}, nil
+	}
+
+	log.Debug().Msgf("no Azure AD credentials for %s, using those of docker", repoInfo.Index.Name)
+	return NewDefaultCreds(repoInfo)
+}
+
+// errNoAAD is the error of a source of Azure AD credentials that has none
+var errNoAAD = errors.New("no Azure AD credentials")
+
+// exchangeACRToken exchanges an Azure AD access token for a refresh token of the
+// registry of service at endpoint
+func exchangeACRToken(service string, endpoint dregistry.APIEndpoint, aadToken string) (_ string, err error) {
+	u := *endpoint.URL
+	u.Path = "/oauth2/exchange"
+
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", service)
+	form.Set("access_token", aadToken)
+	if tenant := os.Getenv("AZURE_TENANT_ID"); tenant != "" {
+		form.Set("tenant", tenant)
+	}
+
+	req, err := http.NewRequest("POST", u.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrapf(err, "url = %s", u.String())
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// the request and response hold credentials, so neither is logged
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, false, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "url = %s", u.String())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Wrapf(httpclient.NewStatusError(resp), "token exchange with %s failed", service)
+	}
+
+	var t struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if t.RefreshToken == "" {
+		return "", errors.Errorf("malformed token exchange response from %s", service)
+	}
+
+	return t.RefreshToken, nil
+}
+
+// aadTokenURL is the token endpoint of the tenant of $AZURE_TENANT_ID, at
+// $AZURE_AUTHORITY_HOST if it is set
+func aadTokenURL() string {
+	host := os.Getenv("AZURE_AUTHORITY_HOST")
+	if host == "" {
+		host = azureAuthorityHost
+	}
+	return strings.TrimSuffix(host, "/") + "/" + os.Getenv("AZURE_TENANT_ID") + "/oauth2/v2.0/token"
+}
+
+// clientCredentialsToken gets an access token for the application of
+// $AZURE_CLIENT_ID with the client credentials grant, with the secret or assertion
+// in form
+func clientCredentialsToken(form url.Values) (string, error) {
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", os.Getenv("AZURE_CLIENT_ID"))
+	form.Set("scope", azureResource+".default")
+
+	req, err := http.NewRequest("POST", aadTokenURL(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrapf(err, "url = %s", aadTokenURL())
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return accessToken(httpclient.DefaultClient, req)
+}
+
+// servicePrincipalToken gets an access token for the service principal of
+// $AZURE_CLIENT_ID with the secret of $AZURE_CLIENT_SECRET
+func servicePrincipalToken() (string, error) {
+	secret := os.Getenv("AZURE_CLIENT_SECRET")
+	if secret == "" || os.Getenv("AZURE_CLIENT_ID") == "" || os.Getenv("AZURE_TENANT_ID") == "" {
+		return "", errNoAAD
+	}
+
+	form := url.Values{}
+	form.Set("client_secret", secret)
+	return clientCredentialsToken(form)
+}
+
+// workloadIdentityToken gets an access token for the workload identity of AKS, with
+// the token of the service account of the pod in $AZURE_FEDERATED_TOKEN_FILE
+func workloadIdentityToken() (string, error) {
+	filename := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	if filename == "" || os.Getenv("AZURE_CLIENT_ID") == "" || os.Getenv("AZURE_TENANT_ID") == "" {
+		return "", errNoAAD
+	}
+
+	assertion, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	form := url.Values{}
+	form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	return clientCredentialsToken(form)
+}
+
+// managedIdentityToken gets an access token for the managed identity of the host,
+// that of $AZURE_CLIENT_ID if it has several, from $IDENTITY_ENDPOINT in App Service
+// and Container Apps, or else the instance metadata service of VMs and AKS nodes
+func managedIdentityToken() (_ string, err error) {
+	q := url.Values{}
+	q.Set("resource", azureResource)
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		q.Set("client_id", id)
+	}
+
+	var u string
+	header := http.Header{}
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		q.Set("api-version", "2019-08-01")
+		u = endpoint + "?" + q.Encode()
+		header.Set("X-IDENTITY-HEADER", os.Getenv("IDENTITY_HEADER"))
+	} else {
+		q.Set("api-version", "2018-02-01")
+		u = "http://" + imdsHost + "/metadata/identity/oauth2/token?" + q.Encode()
+		header.Set("Metadata", "true")
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "url = %s", u)
+	}
+	req.Header = header
+
+	// the metadata service is not retried, as there is none outside of Azure
+	client := &http.Client{Timeout: metadataTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debug().Err(err).Msg("no managed identity endpoint")
+		return "", errNoAAD
+	}
+	defer func() { err = utils.CheckedClose(resp.Body, err) }()
+
+	// a host without a managed identity is answered with a client error
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound {
+		log.Debug().Msgf("no managed identity: %s", resp.Status)
+		return "", errNoAAD
+	}
+
+	return tokenFromResp(resp)
+}
+
+// azToken gets an access token for the account that az is logged in as
+func azToken() (string, error) {
+	path, err := exec.LookPath("az")
+	if err != nil {
+		return "", errNoAAD
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(
+		path, "account", "get-access-token",
+		"--resource", azureResource,
+		"--query", "accessToken",
+		"--output", "tsv",
+	)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// az may be installed without being logged in
+		log.Debug().Err(err).Msgf("az account get-access-token: %s", stderr.String())
+		return "", errNoAAD
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
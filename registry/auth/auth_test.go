@@ -16,16 +16,31 @@ package auth_test
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/docker/cli/cli/config"
 	"github.com/docker/distribution/reference"
 	dregistry "github.com/docker/docker/registry"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -246,7 +261,7 @@ func TestChallengeHeader(t *testing.T) {
 	}{
 		{nTRep, *repoInfo, endpoint, creds, ""},
 		{nTRep, *repoInfo, endpoint1, creds1, "login error"},
-		{nTRep, *repoInfo, endpoint2, creds2, "login not supported"},
+		{nTRep, *repoInfo, endpoint2, creds2, ""},
 	}
 
 	for _, test := range tests {
@@ -289,3 +304,814 @@ func TestToken(t *testing.T) {
 		assert.Equal(req.Header.Get("Authorization"), fmt.Sprintf("Bearer %s", test.tokenStr))
 	}
 }
+
+func TestCredentialHelper(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "docker-config")
+	require.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	old := config.Dir()
+	config.SetDir(dir)
+	defer config.SetDir(old)
+
+	// a helper that gives a password for one registry and an identity token for
+	// the other
+	helper := `#!/bin/sh
+read server
+case "$server" in
+registry.example.com) echo '{"ServerURL":"registry.example.com","Username":"ahab","Secret":"hunter2"}' ;;
+*) echo '{"ServerURL":"'"$server"'","Username":"<token>","Secret":"refresh"}' ;;
+esac
+`
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0700))
+	defer func(path string) { assert.NoError(os.Setenv("PATH", path)) }(os.Getenv("PATH"))
+	require.NoError(os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH")))
+
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(dir, "config.json"),
+		[]byte(`{"credHelpers":{"registry.example.com":"test","tokens.example.com":"test"}}`),
+		0600,
+	))
+
+	creds := func(name string) auth.Credentials {
+		ref, err := reference.ParseNormalizedNamed(name)
+		require.NoError(err)
+		repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+		require.NoError(err)
+		creds, err := auth.NewDefaultCreds(repoInfo)
+		require.NoError(err)
+		return creds
+	}
+
+	req, err := http.NewRequest("GET", "https://registry.example.com/token?service=registry&scope=repository:app:pull", nil)
+	require.NoError(err)
+	req = creds("registry.example.com/app:1.0").SetAuth(req)
+	username, password, ok := req.BasicAuth()
+	assert.True(ok)
+	assert.Equal("ahab", username)
+	assert.Equal("hunter2", password)
+
+	// an identity token is exchanged for a token with the service and scope
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !assert.Equal("POST", r.Method) || !assert.NoError(r.ParseForm()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		form = r.PostForm
+		fmt.Fprint(w, `{"access_token": "access"}`)
+	}))
+	defer server.Close()
+
+	ch, err := auth.ParseChallengeHeader(fmt.Sprintf(
+		`Bearer realm="%s",service="registry",scope="repository:app:pull"`,
+		server.URL,
+	))
+	require.NoError(err)
+
+	_, err = auth.NewAuthenticator(httpclient.DefaultClient, creds("tokens.example.com/app:1.0")).Authenticate(ch)
+	require.NoError(err)
+	assert.Equal("refresh_token", form.Get("grant_type"))
+	assert.Equal("refresh", form.Get("refresh_token"))
+	assert.Equal("registry", form.Get("service"))
+	assert.Equal("repository:app:pull", form.Get("scope"))
+
+	token, err := auth.NewTokenFromResp(bytes.NewBufferString(`{"access_token": "access"}`))
+	require.NoError(err)
+	assert.Equal("access", token.String())
+}
+
+func TestTokenCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	var mu sync.Mutex
+	issued := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		issued++
+		n := issued
+		mu.Unlock()
+		fmt.Fprintf(w, `{"token": "token %d", "expires_in": 1}`, n)
+	}))
+	defer server.Close()
+
+	creds := auth.NewCreds("ahab", "hunter2")
+	challenge := func(scope string) *auth.Challenge {
+		ch, err := auth.ParseChallengeHeader(fmt.Sprintf(
+			`Bearer realm="%s",service="registry.example.com",scope="%s"`,
+			server.URL,
+			scope,
+		))
+		require.NoError(err)
+		return ch
+	}
+
+	token, err := auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(challenge("repository:app:pull"))
+	require.NoError(err)
+	assert.Equal("token 1", token.String())
+
+	// the same scope and credentials share the token
+	again, err := auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(challenge("repository:app:pull"))
+	require.NoError(err)
+	assert.Equal("token 1", again.String())
+
+	// but other scopes or credentials do not
+	other, err := auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(challenge("repository:app:push"))
+	require.NoError(err)
+	assert.Equal("token 2", other.String())
+
+	other, err = auth.NewAuthenticator(httpclient.DefaultClient, auth.NewCreds("ishmael", "hunter2")).
+		Authenticate(challenge("repository:app:pull"))
+	require.NoError(err)
+	assert.Equal("token 3", other.String())
+
+	// the token is refreshed when it is about to expire
+	time.Sleep(800 * time.Millisecond)
+	assert.Equal("token 4", token.String())
+	assert.Equal("token 4", again.String())
+}
+
+func TestOAuth(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	logs := &bytes.Buffer{}
+	log.Logger = zerolog.New(logs).Level(zerolog.DebugLevel)
+
+	var grants []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !assert.Equal("POST", r.Method) || !assert.NoError(r.ParseForm()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		grants = append(grants, r.PostForm)
+		fmt.Fprintf(w, `{"access_token": "token %d", "refresh_token": "refresh", "expires_in": 1}`, len(grants))
+	}))
+	defer server.Close()
+
+	ch, err := auth.ParseChallengeHeader(fmt.Sprintf(
+		`Bearer realm="%s",service="registry.example.com",scope="repository:oauth:pull"`,
+		server.URL,
+	))
+	require.NoError(err)
+
+	token, err := auth.NewAuthenticator(httpclient.DefaultClient, auth.NewCreds("ahab", "hunter2")).Authenticate(ch)
+	require.NoError(err)
+	assert.Equal("token 1", token.String())
+
+	// the password is sent once, and the refresh token after that
+	time.Sleep(800 * time.Millisecond)
+	assert.Equal("token 2", token.String())
+
+	require.Len(grants, 2)
+	assert.Equal("password", grants[0].Get("grant_type"))
+	assert.Equal("ahab", grants[0].Get("username"))
+	assert.Equal("hunter2", grants[0].Get("password"))
+	assert.Equal("offline", grants[0].Get("access_type"))
+	assert.Equal("registry.example.com", grants[0].Get("service"))
+	assert.Equal("repository:oauth:pull", grants[0].Get("scope"))
+	assert.Equal("refresh_token", grants[1].Get("grant_type"))
+	assert.Equal("refresh", grants[1].Get("refresh_token"))
+	assert.Empty(grants[1].Get("password"))
+
+	// the tokens are not logged, even at debug level
+	assert.NotEmpty(logs.String())
+	assert.NotContains(logs.String(), "access_token")
+	assert.NotContains(logs.String(), "refresh_token")
+}
+
+func TestOAuthFallback(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "ahab" || password != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token": "basic"}`)
+	}))
+	defer server.Close()
+
+	ch, err := auth.ParseChallengeHeader(fmt.Sprintf(
+		`Bearer realm="%s",service="registry.example.com",scope="repository:fallback:pull"`,
+		server.URL,
+	))
+	require.NoError(err)
+
+	token, err := auth.NewAuthenticator(httpclient.DefaultClient, auth.NewCreds("ahab", "hunter2")).Authenticate(ch)
+	require.NoError(err)
+	assert.Equal("basic", token.String())
+}
+
+func TestAnonymous(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "docker-config")
+	require.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	old := config.Dir()
+	config.SetDir(dir)
+	defer config.SetDir(old)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !assert.Equal("GET", r.Method) || !assert.Empty(r.Header.Get("Authorization")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token": "anonymous"}`)
+	}))
+	defer server.Close()
+
+	ref, err := reference.ParseNormalizedNamed("ghcr.io/public/app:1.0")
+	require.NoError(err)
+	repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+	require.NoError(err)
+	creds, err := auth.NewDefaultCreds(repoInfo)
+	require.NoError(err)
+
+	ch, err := auth.ParseChallengeHeader(fmt.Sprintf(
+		`Bearer realm="%s",service="ghcr.io",scope="repository:public/app:pull"`,
+		server.URL,
+	))
+	require.NoError(err)
+
+	token, err := auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(ch)
+	require.NoError(err)
+	assert.Equal("anonymous", token.String())
+}
+
+func TestECR(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	basic := base64.StdEncoding.EncodeToString([]byte("AWS:password"))
+	created := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(
+			r.Header.Get("Authorization"),
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/",
+		)
+		assert.Contains(r.Header.Get("Authorization"), "/us-west-2/ecr/aws4_request")
+		assert.Equal("session", r.Header.Get("X-Amz-Security-Token"))
+
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken":
+			fmt.Fprintf(w, `{"authorizationData":[{"authorizationToken":"%s","expiresAt":%d}]}`,
+				basic, time.Now().Add(12*time.Hour).Unix())
+		case "AmazonEC2ContainerRegistry_V20150921.CreateRepository":
+			body, err := ioutil.ReadAll(r.Body)
+			assert.NoError(err)
+			assert.JSONEq(`{"registryId":"123456789012","repositoryName":"app"}`, string(body))
+			if created++; created > 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"__type":"RepositoryAlreadyExistsException","message":"exists"}`)
+				return
+			}
+			fmt.Fprint(w, `{"repository":{}}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	env := map[string]string{
+		"AWS_ENDPOINT_URL_ECR":  server.URL,
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "session",
+	}
+	for k, v := range env {
+		defer func(k, v string) { assert.NoError(os.Setenv(k, v)) }(k, os.Getenv(k))
+		require.NoError(os.Setenv(k, v))
+	}
+
+	ref, err := reference.ParseNormalizedNamed("123456789012.dkr.ecr.us-west-2.amazonaws.com/app:1.0")
+	require.NoError(err)
+	repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+	require.NoError(err)
+	require.True(auth.IsECR(repoInfo))
+
+	// ECR is sent the token from its API as basic authentication
+	token, err := auth.NewECRToken(repoInfo)
+	require.NoError(err)
+	assert.True(token.Fresh())
+
+	req, err := http.NewRequest("GET", "https://123456789012.dkr.ecr.us-west-2.amazonaws.com/v2/", nil)
+	require.NoError(err)
+	auth.AddToRequest(token, req)
+	username, password, ok := req.BasicAuth()
+	assert.True(ok)
+	assert.Equal("AWS", username)
+	assert.Equal("password", password)
+
+	// the repository is only created if asked, and may already exist
+	require.NoError(auth.CreateECRRepository(repoInfo))
+	assert.Equal(0, created)
+
+	defer func() { auth.ECRCreateRepository = false }()
+	auth.ECRCreateRepository = true
+	require.NoError(auth.CreateECRRepository(repoInfo))
+	require.NoError(auth.CreateECRRepository(repoInfo))
+	assert.Equal(2, created)
+}
+
+func TestGCR(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(err)
+
+	// a token server that checks the assertion of a service account, or the refresh
+	// token of a user
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !assert.NoError(r.ParseForm()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.PostForm.Get("grant_type") {
+		case "urn:ietf:params:oauth:grant-type:jwt-bearer":
+			parts := strings.Split(r.PostForm.Get("assertion"), ".")
+			require.Len(parts, 3)
+			sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+			require.NoError(err)
+			sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			assert.NoError(rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig))
+
+			claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+			require.NoError(err)
+			var c map[string]interface{}
+			require.NoError(json.Unmarshal(claims, &c))
+			assert.Equal("ci@project.iam.gserviceaccount.com", c["iss"])
+			fmt.Fprint(w, `{"access_token":"sa-token","expires_in":3600}`)
+		case "refresh_token":
+			assert.Equal("refresh", r.PostForm.Get("refresh_token"))
+			fmt.Fprint(w, `{"access_token":"user-token","expires_in":3600}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gcloud")
+	require.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	keyFiles := map[string]map[string]string{
+		"sa-token": {
+			"type":           "service_account",
+			"client_email":   "ci@project.iam.gserviceaccount.com",
+			"private_key_id": "1",
+			"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+			"token_uri":      server.URL,
+		},
+		"user-token": {
+			"type":          "authorized_user",
+			"client_id":     "id",
+			"client_secret": "secret",
+			"refresh_token": "refresh",
+			"token_uri":     server.URL,
+		},
+	}
+
+	defer func(v string) { assert.NoError(os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", v)) }(
+		os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"),
+	)
+
+	ref, err := reference.ParseNormalizedNamed("europe-docker.pkg.dev/project/repo/app:1.0")
+	require.NoError(err)
+	repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+	require.NoError(err)
+	require.True(auth.IsGCR(repoInfo))
+
+	for token, keyFile := range keyFiles {
+		b, err := json.Marshal(keyFile)
+		require.NoError(err)
+		filename := filepath.Join(dir, token+".json")
+		require.NoError(ioutil.WriteFile(filename, b, 0600))
+		require.NoError(os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", filename))
+
+		creds, err := auth.NewGCRCreds(repoInfo)
+		require.NoError(err)
+
+		req, err := http.NewRequest("GET", "https://europe-docker.pkg.dev/v2/token", nil)
+		require.NoError(err)
+		username, password, ok := creds.SetAuth(req).BasicAuth()
+		assert.True(ok)
+		assert.Equal("oauth2accesstoken", username)
+		assert.Equal(token, password)
+	}
+}
+
+func TestACR(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Azure AD and the registry, which exchanges an AAD token for a refresh token
+	// and that for an access token
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !assert.NoError(r.ParseForm()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/tenant/oauth2/v2.0/token":
+			assert.Equal("client_credentials", r.PostForm.Get("grant_type"))
+			assert.Equal("app", r.PostForm.Get("client_id"))
+			assert.Equal("secret", r.PostForm.Get("client_secret"))
+			fmt.Fprint(w, `{"access_token":"aad","expires_in":"3599"}`)
+		case "/oauth2/exchange":
+			assert.Equal("access_token", r.PostForm.Get("grant_type"))
+			assert.Equal("aad", r.PostForm.Get("access_token"))
+			assert.Equal("myregistry.azurecr.io", r.PostForm.Get("service"))
+			assert.Equal("tenant", r.PostForm.Get("tenant"))
+			fmt.Fprint(w, `{"refresh_token":"acr-refresh"}`)
+		case "/oauth2/token":
+			assert.Equal("refresh_token", r.PostForm.Get("grant_type"))
+			assert.Equal("acr-refresh", r.PostForm.Get("refresh_token"))
+			fmt.Fprint(w, `{"access_token":"acr-access"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	env := map[string]string{
+		"AZURE_AUTHORITY_HOST": server.URL,
+		"AZURE_TENANT_ID":      "tenant",
+		"AZURE_CLIENT_ID":      "app",
+		"AZURE_CLIENT_SECRET":  "secret",
+	}
+	for k, v := range env {
+		defer func(k, v string) { assert.NoError(os.Setenv(k, v)) }(k, os.Getenv(k))
+		require.NoError(os.Setenv(k, v))
+	}
+
+	ref, err := reference.ParseNormalizedNamed("myregistry.azurecr.io/app:1.0")
+	require.NoError(err)
+	repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+	require.NoError(err)
+	require.True(auth.IsACR(repoInfo))
+
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	creds, err := auth.NewACRCreds(repoInfo, dregistry.APIEndpoint{URL: u})
+	require.NoError(err)
+
+	ch, err := auth.ParseChallengeHeader(fmt.Sprintf(
+		`Bearer realm="%s/oauth2/token",service="myregistry.azurecr.io",scope="repository:app:pull"`,
+		server.URL,
+	))
+	require.NoError(err)
+
+	token, err := auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(ch)
+	require.NoError(err)
+	assert.Equal("acr-access", token.String())
+}
+
+func TestHarbor(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	projects := map[string]bool{"library": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		assert.True(ok)
+		assert.Equal("robot$ci+push", username)
+		assert.Equal("secret", password)
+		assert.Equal("/api/v2.0/projects", r.URL.Path)
+
+		switch r.Method {
+		case "HEAD":
+			if !projects[r.URL.Query().Get("project_name")] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "POST":
+			var body struct {
+				ProjectName string `json:"project_name"`
+			}
+			assert.NoError(json.NewDecoder(r.Body).Decode(&body))
+			projects[body.ProjectName] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	ch, err := auth.ParseChallengeHeader(
+		`Bearer realm="https://harbor.example.com/service/token",service="harbor-registry"`,
+	)
+	require.NoError(err)
+	assert.True(ch.Harbor())
+
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+	endpoint := dregistry.APIEndpoint{URL: u}
+	creds := auth.NewCreds("robot$ci+push", "secret")
+
+	repoInfo := func(name string) *dregistry.RepositoryInfo {
+		ref, err := reference.ParseNormalizedNamed(name)
+		require.NoError(err)
+		repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+		require.NoError(err)
+		return repoInfo
+	}
+
+	assert.NoError(auth.EnsureHarborProject(repoInfo("harbor.example.com/library/app:1.0"), endpoint, creds))
+
+	// a project that does not exist is only created if asked
+	err = auth.EnsureHarborProject(repoInfo("harbor.example.com/team/app:1.0"), endpoint, creds)
+	require.Error(err)
+	assert.Contains(err.Error(), "project team does not exist")
+
+	defer func() { auth.HarborCreateProject = false }()
+	auth.HarborCreateProject = true
+	assert.NoError(auth.EnsureHarborProject(repoInfo("harbor.example.com/team/app:1.0"), endpoint, creds))
+	assert.True(projects["team"])
+}
+
+func TestQuay(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// a registry that behaves as Quay does: its challenges have no scope, its token
+	// service only supports GET, and its API gives the kind of repositories
+	var realm string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/auth" && r.Method == "GET":
+			username, password, ok := r.BasicAuth()
+			assert.True(ok)
+			assert.Equal("org+robot", username)
+			assert.Equal("secret", password)
+			assert.Equal("repository:org/app:pull,push", r.URL.Query().Get("scope"))
+			fmt.Fprint(w, `{"token":"quay"}`)
+		case r.URL.Path == "/v2/auth":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.URL.Path == "/api/v1/repository/org/app":
+			fmt.Fprint(w, `{"namespace":"org","name":"app","kind":"image"}`)
+		case r.URL.Path == "/api/v1/repository/org/charts":
+			fmt.Fprint(w, `{"namespace":"org","name":"charts","kind":"application"}`)
+		case r.URL.Path == "/api/v1/repository/org/private":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="quay.io"`, realm))
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+	realm = server.URL + "/v2/auth"
+
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+	endpoint := dregistry.APIEndpoint{URL: u}
+
+	repoInfo := func(name string) (names.NamedTaggedRepository, *dregistry.RepositoryInfo) {
+		ref, err := reference.ParseNormalizedNamed(name)
+		require.NoError(err)
+		nTRep, err := names.CastToTagged(ref)
+		require.NoError(err)
+		repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+		require.NoError(err)
+		return nTRep, repoInfo
+	}
+
+	nTRep, info := repoInfo("quay.io/org/app:1.0")
+	creds := auth.NewCreds("org+robot", "secret")
+
+	header, err := auth.ChallengeHeader(nTRep, *info, endpoint, creds)
+	require.NoError(err)
+	ch, err := auth.ParseChallengeHeader(header)
+	require.NoError(err)
+	assert.True(ch.Quay())
+
+	// the scope of the repository is requested for the push
+	ch.SetDefaultScope(nTRep, true)
+	token, err := auth.NewAuthenticator(httpclient.DefaultClient, creds).Authenticate(ch)
+	require.NoError(err)
+	assert.Equal("quay", token.String())
+
+	assert.NoError(auth.CheckQuayRepository(info, endpoint))
+
+	_, info = repoInfo("quay.io/org/charts:1.0")
+	err = auth.CheckQuayRepository(info, endpoint)
+	require.Error(err)
+	assert.Contains(err.Error(), "application repository")
+
+	// private repositories may not be checked
+	_, info = repoInfo("quay.io/org/private:1.0")
+	assert.NoError(auth.CheckQuayRepository(info, endpoint))
+}
+
+func TestDeleteScope(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("repository:org/app:pull,delete", r.FormValue("scope"))
+		fmt.Fprint(w, `{"token":"delete"}`)
+	}))
+	defer server.Close()
+
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/org/app:1.0")
+	require.NoError(err)
+
+	// registries challenge for pulling and pushing, but deletion is a scope of its own
+	ch, err := auth.ParseChallengeHeader(fmt.Sprintf(
+		`Bearer realm="%s/token",service="registry.example.com",scope="repository:org/app:pull,push"`,
+		server.URL,
+	))
+	require.NoError(err)
+	ch.SetDeleteScope(ref)
+
+	token, err := auth.NewAuthenticator(httpclient.DefaultClient, auth.NewCreds("user", "pass")).Authenticate(ch)
+	require.NoError(err)
+	assert.Equal("delete", token.String())
+}
+
+func TestMultipleScopes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// both the POST flow and the GET flow that it falls back to send every scope
+	methods := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if !assert.NoError(r.ParseForm()) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		assert.Equal([]string{"repository:dst/app:pull,push", "repository:src/app:pull"}, r.Form["scope"])
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"token":"both"}`)
+	}))
+	defer server.Close()
+
+	src, err := reference.ParseNormalizedNamed("registry.example.com/src/app:1.0")
+	require.NoError(err)
+	dst, err := reference.ParseNormalizedNamed("registry.example.com/dst/app:1.0")
+	require.NoError(err)
+
+	ch, err := auth.ParseChallengeHeader(fmt.Sprintf(
+		`Bearer realm="%s/token",service="registry.example.com"`,
+		server.URL,
+	))
+	require.NoError(err)
+	ch.SetDefaultScope(dst, true)
+	ch.AddScope(src, "pull")
+	ch.AddScope(src, "pull")
+
+	token, err := auth.NewAuthenticator(httpclient.DefaultClient, auth.NewCreds("multi", "scopes")).Authenticate(ch)
+	require.NoError(err)
+	assert.Equal("both", token.String())
+	assert.Equal([]string{"POST", "GET"}, methods)
+}
+
+func TestBasic(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// a registry with htpasswd, which never issues Bearer challenges, and one without
+	// auth, which does not challenge at all
+	challenge := `Basic realm="Registry Realm"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if challenge == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Www-Authenticate", challenge)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+	endpoint := dregistry.APIEndpoint{URL: u}
+
+	ref, err := reference.ParseNormalizedNamed("registry.example.com/app:1.0")
+	require.NoError(err)
+	nTRep, err := names.CastToTagged(ref)
+	require.NoError(err)
+	repoInfo, err := dregistry.ParseRepositoryInfo(ref)
+	require.NoError(err)
+
+	creds := auth.NewCreds(user, pass)
+	header, err := auth.ChallengeHeader(nTRep, *repoInfo, endpoint, creds)
+	require.NoError(err)
+	assert.False(auth.BearerChallenge(header))
+	assert.True(auth.BasicChallenge(header))
+	assert.True(auth.BearerChallenge(validHeader))
+	assert.False(auth.BasicChallenge(validHeader))
+
+	// the credentials are sent with every request
+	token, err := auth.NewBasicToken(creds)
+	require.NoError(err)
+	req, err := http.NewRequest("GET", server.URL+"/v2/app/manifests/1.0", nil)
+	require.NoError(err)
+	auth.AddToRequest(token, req)
+	username, password, ok := req.BasicAuth()
+	assert.True(ok)
+	assert.Equal(user, username)
+	assert.Equal(pass, password)
+
+	// no challenge at all is not a basic one, so no credentials are sent
+	challenge = ""
+	header, err = auth.ChallengeHeader(nTRep, *repoInfo, endpoint, creds)
+	require.NoError(err)
+	assert.Empty(header)
+	assert.False(auth.BearerChallenge(header))
+	assert.False(auth.BasicChallenge(header))
+
+	// which must be a username and password
+	token, err = auth.NewBasicToken(nil)
+	assert.Error(err)
+	assert.Nil(token)
+}
+
+func TestAuthFailure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	body := `{"details":"incorrect username or password"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		body   string
+		reason string
+	}{
+		{`{"details":"incorrect username or password"}`, ": incorrect username or password"},
+		{`{"error":"invalid_grant","error_description":"access token expired"}`, ": access token expired"},
+		{`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`, ": authentication required"},
+		{`<html>`, ""},
+	}
+
+	for i, test := range tests {
+		body = test.body
+		ch, err := auth.ParseChallengeHeader(fmt.Sprintf(
+			`Bearer realm="%s/token",service="registry",scope="repository:app%d:pull"`,
+			server.URL,
+			i,
+		))
+		require.NoError(err)
+
+		_, err = auth.NewAuthenticator(httpclient.DefaultClient, auth.NewCreds(user, "dckr_pat_x")).Authenticate(ch)
+		assert.EqualError(err, "authentication failed with status: 401 Unauthorized"+test.reason)
+	}
+}
+
+func TestGranted(t *testing.T) {
+	assert := assert.New(t)
+
+	jwt := func(claims string) auth.Token {
+		enc := base64.RawURLEncoding
+		token, err := auth.NewTokenFromResp(bytes.NewBufferString(fmt.Sprintf(
+			`{"token":"%s.%s.sig"}`,
+			enc.EncodeToString([]byte(`{"alg":"RS256"}`)),
+			enc.EncodeToString([]byte(claims)),
+		)))
+		assert.NoError(err)
+		return token
+	}
+
+	actions, ok := auth.Granted(jwt(`{"access":[{"type":"repository","name":"ahab/app","actions":["pull"]}]}`), "ahab/app")
+	assert.True(ok)
+	assert.Equal([]string{"pull"}, actions)
+
+	actions, ok = auth.Granted(jwt(`{"access":[{"type":"repository","name":"ahab/other","actions":["pull","push"]}]}`), "ahab/app")
+	assert.True(ok)
+	assert.Empty(actions)
+
+	_, ok = auth.Granted(jwt(`{"sub":"ahab"}`), "ahab/app")
+	assert.False(ok)
+
+	token, err := auth.NewTokenFromResp(bytes.NewBufferString(`{"token":"opaque"}`))
+	assert.NoError(err)
+	_, ok = auth.Granted(token, "ahab/app")
+	assert.False(ok)
+}
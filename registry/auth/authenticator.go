@@ -15,11 +15,20 @@
 package auth
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Senetas/crypto-cli/registry/httpclient"
 	"github.com/Senetas/crypto-cli/utils"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
 // Authenticator produces a Bearer token to authenticate with the HTTP API
@@ -40,7 +49,92 @@ func NewAuthenticator(client *http.Client, credentials Credentials) Authenticato
 	}
 }
 
-func (a *authenticator) Authenticate(c *Challenge) (_ Token, err error) {
+// Authenticate gives a token for the challenge. Tokens are cached for each realm,
+// service, scope and credentials, so the many requests of a push or pull share one,
+// which refreshes itself shortly before it expires.
+func (a *authenticator) Authenticate(c *Challenge) (Token, error) {
+	return tokens.get(a, c)
+}
+
+// granter is implemented by credentials that may be exchanged for a token with
+// the OAuth2 POST token flow, which gives nil if they may not
+type granter interface {
+	grant() url.Values
+}
+
+// errPostNotSupported is the error of a POST to an auth server that only
+// supports the GET token flow
+var errPostNotSupported = errors.New("auth server does not support the POST token flow")
+
+// fetch a token for the challenge, with the refresh token if there is one, or the
+// credentials. The POST token flow is used where possible, so that the basic
+// credentials are sent once for the refresh token, falling back to the GET flow
+// for auth servers without it.
+func (a *authenticator) fetch(c *Challenge, refresh string) (t *token, err error) {
+	var form url.Values
+	if refresh != "" {
+		form = refreshGrant(refresh)
+	} else if g, ok := a.credentials.(granter); ok {
+		form = g.grant()
+	}
+
+	if form != nil {
+		t, err = a.post(c, form)
+		switch {
+		case err == nil:
+			if t.RefreshToken == "" {
+				t.RefreshToken = refresh
+			}
+			return
+		case errors.Cause(err) != errPostNotSupported || form.Get("grant_type") != "password":
+			return
+		}
+		log.Debug().Msgf("falling back to the GET token flow for %s", c.realm)
+	}
+
+	return a.get(c)
+}
+
+// post requests a token with an OAuth2 grant
+func (a *authenticator) post(c *Challenge, form url.Values) (_ *token, err error) {
+	form.Set("client_id", clientID)
+	form.Set("service", c.service)
+	for _, scope := range c.scopes {
+		form.Add("scope", scope)
+	}
+
+	req, err := http.NewRequest("POST", c.realm.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		err = errors.Wrapf(err, "url = %s", c.realm)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// neither the credentials of the request nor the tokens of the response are logged
+	resp, err := httpclient.DoRequest(a.httpClient, req, false, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		err = errors.Wrapf(err, "url = %s", c.realm)
+		return
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		err = errors.WithStack(errPostNotSupported)
+		return
+	default:
+		err = a.failure(c, resp)
+		return
+	}
+
+	return newTokenFromResp(resp.Body)
+}
+
+// get requests a token with the basic credentials
+func (a *authenticator) get(c *Challenge) (_ *token, err error) {
 	reqURL := c.buildURL()
 	req, err := http.NewRequest("GET", reqURL.String(), nil)
 	if err != nil {
@@ -50,7 +144,8 @@ func (a *authenticator) Authenticate(c *Challenge) (_ Token, err error) {
 
 	req = a.credentials.SetAuth(req)
 
-	resp, err := httpclient.DoRequest(a.httpClient, req, true, true)
+	// the tokens of the response are not logged
+	resp, err := httpclient.DoRequest(a.httpClient, req, true, false)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
@@ -60,9 +155,117 @@ func (a *authenticator) Authenticate(c *Challenge) (_ Token, err error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		err = errors.Errorf("authentication failed with status: %s", resp.Status)
+		if _, ok := a.credentials.(anonymous); ok {
+			log.Warn().Msgf("Anonymous access to %s was denied, use docker login to authenticate.", c.realm.Host)
+		}
+		err = a.failure(c, resp)
+		return
+	}
+
+	return newTokenFromResp(resp.Body)
+}
+
+// maxErrorBody bounds how much of the body of a failed token request is read
+const maxErrorBody = 4096
+
+// failure is the error of a token request that failed with resp, with the reason
+// that the auth server gives in its body, such as that Docker Hub gives for a
+// password of an account with two-factor authentication
+func (a *authenticator) failure(c *Challenge, resp *http.Response) error {
+	var body struct {
+		// Details is the reason that Docker Hub gives
+		Details string `json:"details"`
+		// Error and ErrorDescription are those of an OAuth2 error
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+		// Errors are those of the distribution API
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+
+	var reason string
+	if json.NewDecoder(io.LimitReader(resp.Body, maxErrorBody)).Decode(&body) == nil {
+		switch {
+		case body.Details != "":
+			reason = body.Details
+		case body.ErrorDescription != "":
+			reason = body.ErrorDescription
+		case body.Error != "":
+			reason = body.Error
+		case len(body.Errors) > 0:
+			reason = body.Errors[0].Message
+		}
+	}
+
+	if creds, ok := a.credentials.(*credentials); ok && c.realm.Host == dockerHubAuth &&
+		resp.StatusCode == http.StatusUnauthorized && !hubAccessToken(creds.Password) {
+		log.Warn().Msg("Docker Hub accounts with two-factor authentication must log in with a personal access token in place of their password.")
+	}
+
+	if reason == "" {
+		return utils.WithClass(errors.Errorf("authentication failed with status: %s", resp.Status), utils.ClassAuth)
+	}
+	return utils.WithClass(errors.Errorf("authentication failed with status: %s: %s", resp.Status, reason), utils.ClassAuth)
+}
+
+// tokens are the tokens obtained in this run
+var tokens = &tokenCache{tokens: make(map[string]*cachedToken)}
+
+type tokenCache struct {
+	sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+// get the cached token of the challenge, or fetch one if there is none
+func (tc *tokenCache) get(a *authenticator, c *Challenge) (_ Token, err error) {
+	key := fmt.Sprintf("%s %x", c.buildURL(), sha256.Sum256([]byte(fmt.Sprintf("%#v", a.credentials))))
+
+	tc.Lock()
+	defer tc.Unlock()
+
+	if t, ok := tc.tokens[key]; ok {
+		return t, nil
+	}
+
+	tok, err := a.fetch(c, "")
+	if err != nil {
 		return
 	}
 
-	return NewTokenFromResp(resp.Body)
+	t := &cachedToken{authenticator: a, challenge: c, token: tok}
+	tc.tokens[key] = t
+	return t, nil
+}
+
+// cachedToken is a token that is fetched again when it goes stale
+type cachedToken struct {
+	sync.Mutex
+	authenticator *authenticator
+	challenge     *Challenge
+	token         *token
+}
+
+func (t *cachedToken) String() string {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.token.stale(time.Now()) {
+		tok, err := t.authenticator.fetch(t.challenge, t.token.RefreshToken)
+		if err != nil {
+			// the old token may yet be accepted, so the request is left to fail
+			log.Warn().Err(err).Msg("could not refresh token")
+		} else {
+			log.Debug().Msgf("refreshed token for %s", t.challenge.buildURL())
+			t.token = tok
+		}
+	}
+
+	return t.token.String()
+}
+
+func (t *cachedToken) Fresh() bool {
+	t.Lock()
+	defer t.Unlock()
+	return t.token.Fresh()
 }
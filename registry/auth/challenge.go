@@ -15,9 +15,11 @@
 package auth
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
 
 	"github.com/Senetas/crypto-cli/registry/httpclient"
 	"github.com/Senetas/crypto-cli/utils"
@@ -25,6 +27,7 @@ import (
 	"github.com/docker/distribution/registry/api/v2"
 	dregistry "github.com/docker/docker/registry"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
 var challengeRE = regexp.MustCompile(`^\s*Bearer\s+realm="([^"]+)",service="([^"]+)"(,scope="([^"]+)")?\s*$`)
@@ -33,7 +36,7 @@ var challengeRE = regexp.MustCompile(`^\s*Bearer\s+realm="([^"]+)",service="([^"
 type Challenge struct {
 	realm   *url.URL
 	service string
-	scope   string
+	scopes  []string
 }
 
 // ParseChallengeHeader parses the challenge header and extract the relevant parts
@@ -45,9 +48,9 @@ func ParseChallengeHeader(header string) (ch *Challenge, err error) {
 		return
 	}
 
-	ch = &Challenge{
-		service: match[0][2],
-		scope:   match[0][4],
+	ch = &Challenge{service: match[0][2]}
+	if match[0][4] != "" {
+		ch.scopes = []string{match[0][4]}
 	}
 
 	ch.realm, err = url.Parse(match[0][1])
@@ -59,13 +62,56 @@ func ParseChallengeHeader(header string) (ch *Challenge, err error) {
 	return
 }
 
+// SetDefaultScope sets the scope of a challenge that has none to the repository of
+// ref, with push access if push is set, as the challenges of some registries, such
+// as Quay, do not say the scope and their tokens otherwise give no access
+func (c *Challenge) SetDefaultScope(ref reference.Named, push bool) {
+	if len(c.scopes) != 0 {
+		return
+	}
+	actions := "pull"
+	if push {
+		actions = "pull,push"
+	}
+	c.AddScope(ref, actions)
+}
+
+// SetDeleteScope sets the scope of a challenge to deleting from the repository of
+// ref, as registries only challenge for pulling and pushing
+func (c *Challenge) SetDeleteScope(ref reference.Named) {
+	c.scopes = []string{fmt.Sprintf("repository:%s:pull,delete", reference.Path(ref))}
+}
+
+// AddScope adds the actions on the repository of ref to the scopes of a challenge,
+// so that a single token grants access to several repositories, as a cross
+// repository copy or mount needs, in one request to the auth server
+func (c *Challenge) AddScope(ref reference.Named, actions string) {
+	scope := fmt.Sprintf("repository:%s:%s", reference.Path(ref), actions)
+	for _, s := range c.scopes {
+		if s == scope {
+			return
+		}
+	}
+	c.scopes = append(c.scopes, scope)
+}
+
+// Quay is whether the challenge is from the token service of Quay
+func (c *Challenge) Quay() bool {
+	return c.realm.Path == "/v2/auth"
+}
+
+// Harbor is whether the challenge is from the token service of Harbor
+func (c *Challenge) Harbor() bool {
+	return c.realm.Path == "/service/token"
+}
+
 // buildURL creates the url to respond to the challenge
 func (c *Challenge) buildURL() *url.URL {
 	authURL := *c.realm
 	authParams := make(url.Values)
 	authParams.Set("service", c.service)
-	if c.scope != "" {
-		authParams.Set("scope", c.scope)
+	for _, scope := range c.scopes {
+		authParams.Add("scope", scope)
 	}
 	authURL.RawQuery = authParams.Encode()
 	return &authURL
@@ -105,9 +151,21 @@ func ChallengeHeader(
 		if auth == "" {
 			err = errors.New("login error")
 		}
-	case http.StatusOK:
 	default:
-		err = errors.New("login not supported")
+		// such as the error of the empty manifest, from a registry without auth
+		log.Debug().Msgf("%s did not challenge: %s", endpoint.URL.Host, resp.Status)
 	}
 	return
 }
+
+// BearerChallenge is whether the challenge header is a challenge for a Bearer token,
+// rather than that of a registry that only supports basic authentication, or none
+func BearerChallenge(header string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(header)), "bearer ")
+}
+
+// BasicChallenge is whether the challenge header asks for basic authentication, which
+// is the only case in which the username and password may be sent without a token
+func BasicChallenge(header string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(header)), "basic ")
+}
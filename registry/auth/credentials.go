@@ -16,12 +16,16 @@ package auth
 
 import (
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
 	"github.com/docker/docker/api/types"
 	dregistry "github.com/docker/docker/registry"
 
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
 // Credentials represents a username password pair
@@ -29,6 +33,9 @@ type Credentials interface {
 	SetAuth(r *http.Request) *http.Request
 }
 
+// clientID identifies crypto-cli to the auth servers of registries
+const clientID = "crypto-cli"
+
 type credentials struct {
 	types.AuthConfig
 }
@@ -43,23 +50,45 @@ func NewCreds(username, password string) Credentials {
 	}
 }
 
-// NewDefaultCreds creates a credentials struct from the credentials in
-// the default conf file, typically ~/.docker/config.json. the struct is lazy,
-// i.e. the file is only read if the username or password is accessed
+// ConfigCredentials are the credentials of registries that were given in the
+// configuration file of crypto-cli, by host, which are used in place of those kept
+// by docker
+var ConfigCredentials = make(map[string]types.AuthConfig)
+
+// NewDefaultCreds creates a credentials struct from the credentials of the registry
+// of repoInfo in ConfigCredentials, or else in the default conf file, typically
+// ~/.docker/config.json. These are obtained from the docker-credential-* helper of
+// the registry in credHelpers, or that of credsStore, if either is configured, as
+// docker does.
 func NewDefaultCreds(repoInfo *dregistry.RepositoryInfo) (creds Credentials, err error) {
-	confFile, err := config.Load("")
-	if err != nil {
-		err = errors.WithStack(err)
-		return
+	serverAddress := registryServer(repoInfo)
+
+	authConfig, ok := ConfigCredentials[repoInfo.Index.Name]
+	if !ok {
+		authConfig, ok = ConfigCredentials[serverAddress]
 	}
+	if !ok {
+		var confFile *configfile.ConfigFile
+		if confFile, err = config.Load(""); err != nil {
+			err = errors.WithStack(err)
+			return
+		}
 
-	serverAddress := dregistry.IndexServer
-	store := confFile.GetCredentialsStore(serverAddress)
+		store := confFile.GetCredentialsStore(serverAddress)
+		if authConfig, err = store.Get(serverAddress); err != nil {
+			// public repositories may still be pulled, so this is not fatal
+			log.Warn().Err(err).Msgf("could not get credentials for %s, authenticating anonymously", serverAddress)
+			return anonymous{}, nil
+		}
+	}
 
-	authConfig, err := store.Get(serverAddress)
-	if err != nil {
-		err = errors.WithStack(err)
-		return
+	if authConfig.IdentityToken != "" {
+		return &identityToken{authConfig.IdentityToken}, nil
+	}
+
+	if authConfig.Username == "" {
+		log.Info().Msgf("No credentials for %s, authenticating anonymously.", serverAddress)
+		return anonymous{}, nil
 	}
 
 	creds = NewCreds(authConfig.Username, authConfig.Password)
@@ -67,6 +96,33 @@ func NewDefaultCreds(repoInfo *dregistry.RepositoryInfo) (creds Credentials, err
 	return
 }
 
+// dockerHubAuth is the host of the auth server of Docker Hub
+const dockerHubAuth = "auth.docker.io"
+
+// hubAccessToken is whether password is a personal or organization access token of
+// Docker Hub, which accounts with two-factor authentication or SSO must use in
+// place of their password, with their username or the name of the organization
+func hubAccessToken(password string) bool {
+	return strings.HasPrefix(password, "dckr_pat_") || strings.HasPrefix(password, "dckr_oat_")
+}
+
+// anonymous are the credentials of a user that has not logged in to the registry,
+// which auth servers give tokens for public repositories to
+type anonymous struct{}
+
+func (anonymous) SetAuth(req *http.Request) *http.Request {
+	return req
+}
+
+// registryServer is the address that the credentials of the registry of repoInfo
+// are stored under, which for docker hub is that of its index
+func registryServer(repoInfo *dregistry.RepositoryInfo) string {
+	if repoInfo.Index.Official {
+		return dregistry.IndexServer
+	}
+	return repoInfo.Index.Name
+}
+
 func (c *credentials) SetAuth(req *http.Request) *http.Request {
 	req.SetBasicAuth(c.Username, c.Password)
 	q := req.URL.Query()
@@ -74,3 +130,42 @@ func (c *credentials) SetAuth(req *http.Request) *http.Request {
 	req.URL.RawQuery = q.Encode()
 	return req
 }
+
+// grant is the OAuth2 password grant of the credentials, which the auth server
+// answers with a refresh token as well as an access token
+func (c *credentials) grant() url.Values {
+	if c.Username == "" {
+		return nil
+	}
+	form := url.Values{}
+	form.Set("grant_type", "password")
+	form.Set("username", c.Username)
+	form.Set("password", c.Password)
+	form.Set("access_type", "offline")
+	return form
+}
+
+// identityToken is a refresh token for the registry, such as docker login and
+// some credential helpers give in place of a password, which is exchanged for a
+// bearer token with the OAuth2 refresh token grant
+type identityToken struct {
+	token string
+}
+
+// SetAuth leaves the request as it is, as an identity token may only be used
+// with the POST token flow
+func (c *identityToken) SetAuth(req *http.Request) *http.Request {
+	return req
+}
+
+func (c *identityToken) grant() url.Values {
+	return refreshGrant(c.token)
+}
+
+// refreshGrant is the OAuth2 refresh token grant of the token
+func refreshGrant(token string) url.Values {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", token)
+	return form
+}
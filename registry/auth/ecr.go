@@ -0,0 +1,372 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/pkg/homedir"
+	dregistry "github.com/docker/docker/registry"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// ECRCreateRepository is whether a repository of Amazon ECR that is pushed to is
+// created if it does not exist, as ECR does not create them on push
+var ECRCreateRepository bool
+
+// ecrRE matches the hosts of the registries of Amazon ECR, capturing the account,
+// whether the endpoint is FIPS, the region and the suffix of the partition
+var ecrRE = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.(amazonaws\.com(?:\.cn)?)$`)
+
+// ecrRegistry is a registry of Amazon ECR
+type ecrRegistry struct {
+	account, region, endpoint string
+}
+
+// IsECR is whether the registry of repoInfo is one of Amazon ECR
+func IsECR(repoInfo *dregistry.RepositoryInfo) bool {
+	_, ok := parseECR(repoInfo.Index.Name)
+	return ok
+}
+
+// parseECR parses the host of a registry of ECR
+func parseECR(host string) (r *ecrRegistry, ok bool) {
+	match := ecrRE.FindStringSubmatch(host)
+	if match == nil {
+		return nil, false
+	}
+
+	r = &ecrRegistry{account: match[1], region: match[3]}
+	switch {
+	case os.Getenv("AWS_ENDPOINT_URL_ECR") != "":
+		r.endpoint = os.Getenv("AWS_ENDPOINT_URL_ECR")
+	case os.Getenv("AWS_ENDPOINT_URL") != "":
+		r.endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	default:
+		r.endpoint = fmt.Sprintf("https://api.ecr%s.%s.%s", match[2], match[3], match[4])
+	}
+	return r, true
+}
+
+// NewECRToken gives a token for the registry of ECR of repoInfo. It is obtained from
+// the ECR API with the AWS credentials in the environment or the shared credentials
+// file, as the AWS CLI does, so that aws ecr get-login need not be run first. Without
+// AWS credentials, those in the docker config, such as docker-credential-ecr-login
+// gives, are used instead.
+func NewECRToken(repoInfo *dregistry.RepositoryInfo) (_ Token, err error) {
+	r, ok := parseECR(repoInfo.Index.Name)
+	if !ok {
+		return nil, errors.Errorf("%s is not a registry of Amazon ECR", repoInfo.Index.Name)
+	}
+
+	awsCreds, err := loadAWSCredentials()
+	if err == errNoAWSCredentials {
+		log.Debug().Msgf("no AWS credentials for %s, using those of docker", repoInfo.Index.Name)
+		return dockerECRToken(repoInfo)
+	}
+	if err != nil {
+		return
+	}
+
+	var out struct {
+		AuthorizationData []struct {
+			AuthorizationToken string  `json:"authorizationToken"`
+			ExpiresAt          float64 `json:"expiresAt"`
+		} `json:"authorizationData"`
+	}
+
+	in := map[string]interface{}{"registryIds": []string{r.account}}
+	if err = r.call(awsCreds, "GetAuthorizationToken", in, &out); err != nil {
+		return
+	}
+
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == "" {
+		return nil, errors.New("malformed response from the ECR API")
+	}
+
+	data := out.AuthorizationData[0]
+	return &basicToken{
+		credentials: data.AuthorizationToken,
+		expiresAt:   time.Unix(int64(data.ExpiresAt), 0),
+	}, nil
+}
+
+// dockerECRToken gives a token with the credentials of docker for the registry of
+// repoInfo, which must be a username and password as ECR only accepts them
+func dockerECRToken(repoInfo *dregistry.RepositoryInfo) (_ Token, err error) {
+	creds, err := NewDefaultCreds(repoInfo)
+	if err != nil {
+		return
+	}
+
+	token, err := NewBasicToken(creds)
+	if err == nil && token == nil {
+		err = errors.Errorf(
+			"no credentials for %s, set AWS credentials or use docker login",
+			repoInfo.Index.Name,
+		)
+	}
+	return token, err
+}
+
+// CreateECRRepository creates the repository of repoInfo in its registry of ECR, if
+// ECRCreateRepository is set and it does not already exist
+func CreateECRRepository(repoInfo *dregistry.RepositoryInfo) (err error) {
+	r, ok := parseECR(repoInfo.Index.Name)
+	if !ECRCreateRepository || !ok {
+		return
+	}
+
+	name := reference.Path(repoInfo.Name)
+	awsCreds, err := loadAWSCredentials()
+	if err != nil {
+		return errors.Wrapf(err, "could not create repository %s", name)
+	}
+
+	in := map[string]interface{}{
+		"registryId":     r.account,
+		"repositoryName": name,
+	}
+
+	err = r.call(awsCreds, "CreateRepository", in, nil)
+	if e, ok := errors.Cause(err).(*ecrError); ok && e.Type == "RepositoryAlreadyExistsException" {
+		log.Debug().Msgf("repository %s already exists", name)
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	log.Info().Msgf("Created repository %s in %s.", name, repoInfo.Index.Name)
+	return
+}
+
+// ecrError is an error returned by the ECR API
+type ecrError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *ecrError) Error() string {
+	return fmt.Sprintf("ECR API: %s: %s", e.Type, e.Message)
+}
+
+// call the action of the ECR API with the input in, decoding its output into out
+func (r *ecrRegistry) call(creds *awsCredentials, action string, in, out interface{}) (err error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req, err := http.NewRequest("POST", r.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "url = %s", r.endpoint)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921."+action)
+	creds.sign(req, body, r.region, "ecr", time.Now())
+
+	// the response may hold a token, so it is not logged
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "ECR API %s", action)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := &ecrError{}
+		if json.NewDecoder(resp.Body).Decode(e) != nil || e.Type == "" {
+			return errors.Wrapf(httpclient.NewStatusError(resp), "ECR API %s failed", action)
+		}
+		// the type may be qualified by its namespace
+		e.Type = e.Type[strings.LastIndex(e.Type, "#")+1:]
+		return errors.WithStack(e)
+	}
+
+	if out == nil {
+		return
+	}
+
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(out))
+}
+
+// errNoAWSCredentials is the error if no AWS credentials are configured
+var errNoAWSCredentials = errors.New("no AWS credentials")
+
+// awsCredentials are the credentials of an AWS access key
+type awsCredentials struct {
+	accessKeyID, secretAccessKey, sessionToken string
+}
+
+// loadAWSCredentials loads the AWS credentials from the environment, or else the
+// profile of $AWS_PROFILE, or default, in the shared credentials file
+func loadAWSCredentials() (_ *awsCredentials, err error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			accessKeyID:     id,
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		filename = filepath.Join(homedir.Get(), ".aws", "credentials")
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	fh, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, errNoAWSCredentials
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	creds := &awsCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			section = strings.TrimSpace(strings.Trim(line, "[]"))
+		case section == profile:
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v := strings.TrimSpace(kv[1])
+			switch strings.TrimSpace(kv[0]) {
+			case "aws_access_key_id":
+				creds.accessKeyID = v
+			case "aws_secret_access_key":
+				creds.secretAccessKey = v
+			case "aws_session_token":
+				creds.sessionToken = v
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "could not read %s", filename)
+	}
+
+	if creds.accessKeyID == "" {
+		return nil, errNoAWSCredentials
+	}
+
+	return creds, nil
+}
+
+// sign the request with AWS signature version 4 for the service in region at now
+func (c *awsCredentials) sign(req *http.Request, body []byte, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + c.secretAccessKey)
+	for _, s := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		c.accessKeyID,
+		scope,
+		signedHeaders,
+		hmacSHA256(key, stringToSign),
+	))
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,313 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/homedir"
+	dregistry "github.com/docker/docker/registry"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// gcrRE matches the hosts of the registries of Google Container Registry and Artifact
+// Registry
+var gcrRE = regexp.MustCompile(`^(([a-z]+\.)?gcr\.io|[a-z0-9-]+-docker\.pkg\.dev)$`)
+
+// gcrUsername is the username that registries of Google are sent an OAuth2 access
+// token as the password of
+const gcrUsername = "oauth2accesstoken"
+
+const (
+	googleTokenURL = "https://oauth2.googleapis.com/token"
+	googleScope    = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// metadataTimeout bounds how long the metadata server is waited for, which does not
+// exist outside of Google Cloud
+const metadataTimeout = 2 * time.Second
+
+// IsGCR is whether the registry of repoInfo is one of Google Container Registry or
+// Artifact Registry
+func IsGCR(repoInfo *dregistry.RepositoryInfo) bool {
+	return gcrRE.MatchString(repoInfo.Index.Name)
+}
+
+// NewGCRCreds gives credentials for the registry of Google of repoInfo, with an
+// access token from the Application Default Credentials, as the Google Cloud client
+// libraries find them: the key file of $GOOGLE_APPLICATION_CREDENTIALS, then that
+// of gcloud auth application-default login, then the metadata server of GCE, GKE and
+// Cloud Build, then gcloud auth print-access-token. Without any, the credentials of
+// docker for the registry are used, such as docker-credential-gcloud gives.
+func NewGCRCreds(repoInfo *dregistry.RepositoryInfo) (_ Credentials, err error) {
+	sources := []struct {
+		name  string
+		token func() (string, error)
+	}{
+		{"key file", adcKeyFileToken},
+		{"metadata server", metadataToken},
+		{"gcloud", gcloudToken},
+	}
+
+	for _, s := range sources {
+		token, err := s.token()
+		switch {
+		case err == errNoADC:
+			continue
+		case err != nil:
+			return nil, errors.Wrapf(err, "could not get an access token from the %s", s.name)
+		}
+		log.Debug().Msgf("using an access token from the %s for %s", s.name, repoInfo.Index.Name)
+		return NewCreds(gcrUsername, token), nil
+	}
+
+	log.Debug().Msgf("no application default credentials for %s, using those of docker", repoInfo.Index.Name)
+	return NewDefaultCreds(repoInfo)
+}
+
+// errNoADC is the error of a source of Application Default Credentials that has none
+var errNoADC = errors.New("no application default credentials")
+
+// adcKeyFile is the key file of service account or user credentials, as downloaded
+// from the console or written by gcloud
+type adcKeyFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// adcKeyFileToken gets an access token with the key file of
+// $GOOGLE_APPLICATION_CREDENTIALS, or else that of gcloud
+func adcKeyFileToken() (_ string, err error) {
+	filename := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if filename == "" {
+		filename = wellKnownADCFile()
+		if _, err = os.Stat(filename); os.IsNotExist(err) {
+			return "", errNoADC
+		}
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	key := &adcKeyFile{}
+	if err = json.Unmarshal(b, key); err != nil {
+		return "", errors.Wrapf(err, "could not parse %s", filename)
+	}
+
+	if key.TokenURI == "" {
+		key.TokenURI = googleTokenURL
+	}
+
+	form := url.Values{}
+	switch key.Type {
+	case "service_account":
+		var assertion string
+		if assertion, err = key.assertion(time.Now()); err != nil {
+			return "", errors.Wrapf(err, "could not sign with the key of %s", filename)
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", key.ClientID)
+		form.Set("client_secret", key.ClientSecret)
+		form.Set("refresh_token", key.RefreshToken)
+	default:
+		return "", errors.Errorf("credentials of type %q in %s are not supported", key.Type, filename)
+	}
+
+	req, err := http.NewRequest("POST", key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrapf(err, "url = %s", key.TokenURI)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return accessToken(httpclient.DefaultClient, req)
+}
+
+// wellKnownADCFile is the key file that gcloud auth application-default login writes
+func wellKnownADCFile() string {
+	dir := os.Getenv("CLOUDSDK_CONFIG")
+	if dir == "" {
+		if runtime.GOOS == "windows" {
+			dir = filepath.Join(os.Getenv("APPDATA"), "gcloud")
+		} else {
+			dir = filepath.Join(homedir.Get(), ".config", "gcloud")
+		}
+	}
+	return filepath.Join(dir, "application_default_credentials.json")
+}
+
+// assertion is a JWT signed with the key of the service account at now, which is
+// exchanged for an access token
+func (k *adcKeyFile) assertion(now time.Time) (_ string, err error) {
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return "", errors.New("malformed private key")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private key is not an RSA key")
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": k.PrivateKeyID})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   k.ClientEmail,
+		"scope": googleScope,
+		"aud":   k.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// metadataToken gets an access token for the service account of the instance from
+// the metadata server, at $GCE_METADATA_HOST if it is set
+func metadataToken() (_ string, err error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+
+	u := "http://" + host + "/computeMetadata/v1/instance/service-accounts/default/token"
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "url = %s", u)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	// the metadata server is not retried, as there is none outside of Google Cloud
+	client := &http.Client{Timeout: metadataTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debug().Err(err).Msg("no metadata server")
+		return "", errNoADC
+	}
+	defer func() { err = utils.CheckedClose(resp.Body, err) }()
+
+	if resp.Header.Get("Metadata-Flavor") != "Google" {
+		return "", errNoADC
+	}
+
+	return tokenFromResp(resp)
+}
+
+// gcloudToken gets an access token for the account that gcloud is logged in as
+func gcloudToken() (string, error) {
+	path, err := exec.LookPath("gcloud")
+	if err != nil {
+		return "", errNoADC
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, "auth", "print-access-token")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// gcloud may be installed without being logged in
+		log.Debug().Err(err).Msgf("gcloud auth print-access-token: %s", stderr.String())
+		return "", errNoADC
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// accessToken sends the request for an access token
+func accessToken(client *http.Client, req *http.Request) (_ string, err error) {
+	// the request and response hold credentials, so neither is logged
+	resp, err := httpclient.DoRequest(client, req, false, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "url = %s", req.URL)
+	}
+
+	return tokenFromResp(resp)
+}
+
+// tokenFromResp gives the access token in the response. Only the access token is
+// decoded, as some servers give its lifetime as a string.
+func tokenFromResp(resp *http.Response) (string, error) {
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Wrap(httpclient.NewStatusError(resp), "access token request failed")
+	}
+
+	var t struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if t.AccessToken == "" {
+		return "", errors.New("malformed response from token server")
+	}
+	return t.AccessToken, nil
+}
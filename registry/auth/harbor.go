@@ -0,0 +1,148 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	dregistry "github.com/docker/docker/registry"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// HarborCreateProject is whether the project of a repository of Harbor that is
+// pushed to is created if it does not exist, as Harbor only creates repositories
+// in projects that do
+var HarborCreateProject bool
+
+// EnsureHarborProject checks that the project of the repository of repoInfo exists
+// in the registry of Harbor at endpoint, creating it with the credentials if
+// HarborCreateProject is set, so that a push to a project that does not exist fails
+// with an error that says so
+func EnsureHarborProject(
+	repoInfo *dregistry.RepositoryInfo,
+	endpoint dregistry.APIEndpoint,
+	creds Credentials,
+) (err error) {
+	project := strings.SplitN(reference.Path(repoInfo.Name), "/", 2)[0]
+
+	exists, err := harborProjectExists(endpoint, project, creds)
+	if err != nil || exists {
+		return
+	}
+
+	if !HarborCreateProject {
+		return errors.Errorf(
+			"project %s does not exist in %s, create it or use --harbor-create-project",
+			project,
+			repoInfo.Index.Name,
+		)
+	}
+
+	return createHarborProject(repoInfo.Index.Name, endpoint, project, creds)
+}
+
+// harborProjectExists is whether the project exists in the registry of Harbor at
+// endpoint, which is assumed if the credentials may not see the projects
+func harborProjectExists(endpoint dregistry.APIEndpoint, project string, creds Credentials) (_ bool, err error) {
+	u := *endpoint.URL
+	u.Path = "/api/v2.0/projects"
+	u.RawQuery = "project_name=" + project
+
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "url = %s", u.String())
+	}
+	req = creds.SetAuth(req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "url = %s", u.String())
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		// such as for a robot account without access to the list of projects, which
+		// is left to the push to report
+		log.Debug().Msgf("could not check that project %s exists: %s", project, resp.Status)
+		return true, nil
+	}
+}
+
+// createHarborProject creates a private project in the registry of Harbor at endpoint
+func createHarborProject(
+	host string,
+	endpoint dregistry.APIEndpoint,
+	project string,
+	creds Credentials,
+) (err error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"project_name": project,
+		"metadata":     map[string]string{"public": "false"},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	u := *endpoint.URL
+	u.Path = "/api/v2.0/projects"
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "url = %s", u.String())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = creds.SetAuth(req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "url = %s", u.String())
+	}
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		log.Info().Msgf("Created project %s in %s.", project, host)
+		return nil
+	case http.StatusConflict:
+		// created by another push since it was checked
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return utils.WithClass(errors.Errorf(
+			"not permitted to create project %s in %s, which robot accounts usually are not: %s",
+			project,
+			host,
+			resp.Status,
+		), utils.ClassAuth)
+	default:
+		return errors.Wrapf(httpclient.NewStatusError(resp), "could not create project %s in %s", project, host)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/docker/distribution/reference"
+	dregistry "github.com/docker/docker/registry"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// CheckQuayRepository checks that the repository of repoInfo in the registry of Quay
+// at endpoint is not an application repository, which only holds application
+// bundles and rejects images with an opaque error. Only public repositories may be
+// checked, as the API of Quay does not accept the credentials of the registry.
+func CheckQuayRepository(repoInfo *dregistry.RepositoryInfo, endpoint dregistry.APIEndpoint) (err error) {
+	name := reference.Path(repoInfo.Name)
+
+	u := *endpoint.URL
+	u.Path = "/api/v1/repository/" + name
+	u.RawQuery = "includeTags=false"
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return errors.Wrapf(err, "url = %s", u.String())
+	}
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "url = %s", u.String())
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// a private repository, or one that is created by the push
+		log.Debug().Msgf("could not check the kind of repository %s: %s", name, resp.Status)
+		return nil
+	}
+
+	var repo struct {
+		Kind string `json:"kind"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&repo); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if repo.Kind == "application" {
+		return errors.Errorf(
+			"%s in %s is an application repository, which may not hold images",
+			name,
+			repoInfo.Index.Name,
+		)
+	}
+
+	return nil
+}
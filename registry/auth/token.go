@@ -15,10 +15,13 @@
 package auth
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/docker/distribution/registry/client/auth"
 	"github.com/pkg/errors"
@@ -32,10 +35,49 @@ type Token interface {
 
 type token struct {
 	Token string `json:"token"`
-	fresh bool
+	// AccessToken is the token in the response to an OAuth2 request
+	AccessToken string `json:"access_token"`
+	// RefreshToken is given in response to an OAuth2 request for offline access,
+	// and may be exchanged for another token without the credentials
+	RefreshToken string `json:"refresh_token"`
+	// ExpiresIn is the lifetime of the token in seconds
+	ExpiresIn int `json:"expires_in"`
+	// IssuedAt is when the auth server issued the token
+	IssuedAt time.Time `json:"issued_at"`
+	fresh    bool
+}
+
+// defaultExpiresIn is the lifetime of a token that the auth server does not give
+// one for, as in the docker token specification
+const defaultExpiresIn = 60
+
+// maxRefreshMargin bounds how long before it expires that a token is refreshed
+const maxRefreshMargin = 30 * time.Second
+
+// expiry is when the token expires
+func (t *token) expiry() time.Time {
+	expiresIn := t.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = defaultExpiresIn
+	}
+	return t.IssuedAt.Add(time.Duration(expiresIn) * time.Second)
+}
+
+// stale is whether the token is close enough to expiring at now that it should be
+// refreshed, which is when less than a quarter of its lifetime remains
+func (t *token) stale(now time.Time) bool {
+	expiry := t.expiry()
+	margin := expiry.Sub(t.IssuedAt) / 4
+	if margin > maxRefreshMargin {
+		margin = maxRefreshMargin
+	}
+	return !now.Before(expiry.Add(-margin))
 }
 
 func (t *token) String() string {
+	if t.Token == "" {
+		return t.AccessToken
+	}
 	return t.Token
 }
 
@@ -44,21 +86,112 @@ func (t *token) Fresh() bool {
 }
 
 // NewTokenFromResp creates a new token from a http response
-func NewTokenFromResp(respBody io.Reader) (t Token, err error) {
+func NewTokenFromResp(respBody io.Reader) (Token, error) {
+	return newTokenFromResp(respBody)
+}
+
+func newTokenFromResp(respBody io.Reader) (t *token, err error) {
+	received := time.Now()
 	t = &token{}
-	if err = json.NewDecoder(respBody).Decode(&t); err != nil {
+	if err = json.NewDecoder(respBody).Decode(t); err != nil {
 		err = errors.WithStack(err)
 		return
 	}
 	if t.String() == "" {
 		err = errors.New("malformed response from auth server")
+		return
+	}
+	// the clocks of the auth server and this host may disagree, so a token is
+	// taken to be issued when it is received unless the server says it was earlier
+	if t.IssuedAt.IsZero() || t.IssuedAt.After(received) {
+		t.IssuedAt = received
 	}
 	return
 }
 
-// AddToRequest adds a token as a Bearer Authorization of a request
+// schemer is implemented by tokens that are not Bearer tokens, which give the scheme
+// of the Authorization that they are sent as
+type schemer interface {
+	scheme() string
+}
+
+// AddToRequest adds a token as a Bearer Authorization of a request, or that of its
+// scheme if it has another
 func AddToRequest(t auth.Scope, req *http.Request) {
 	if t != nil && t.String() != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t))
+		scheme := "Bearer"
+		if s, ok := t.(schemer); ok {
+			scheme = s.scheme()
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("%s %s", scheme, t))
+	}
+}
+
+// Granted gives the actions on the repository that a token grants, as in the access
+// claim of a JWT of the docker token specification, and false if the token is not
+// such a JWT, as those of some registries are opaque
+func Granted(t Token, repository string) (actions []string, ok bool) {
+	parts := strings.Split(t.String(), ".")
+	if len(parts) != 3 {
+		return nil, false
 	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, false
+	}
+
+	var claims struct {
+		Access *[]struct {
+			Type    string   `json:"type"`
+			Name    string   `json:"name"`
+			Actions []string `json:"actions"`
+		} `json:"access"`
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.Access == nil {
+		return nil, false
+	}
+
+	for _, access := range *claims.Access {
+		if access.Type == "repository" && access.Name == repository {
+			actions = append(actions, access.Actions...)
+		}
+	}
+	return actions, true
+}
+
+// NewBasicToken gives a token that sends the username and password of the
+// credentials with basic authentication, for registries that do not issue Bearer
+// tokens, or nil for anonymous credentials, which need no Authorization
+func NewBasicToken(creds Credentials) (Token, error) {
+	switch c := creds.(type) {
+	case *credentials:
+		return &basicToken{
+			credentials: base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password)),
+		}, nil
+	case anonymous:
+		return nil, nil
+	default:
+		return nil, errors.New("only a username and password may be sent with basic authentication")
+	}
+}
+
+// basicToken is the base64 encoded username and password that a registry that only
+// accepts basic authentication, such as ECR, is sent in place of a bearer token
+type basicToken struct {
+	credentials string
+	// expiresAt is when the credentials expire, which is zero if they do not
+	expiresAt time.Time
+}
+
+func (t *basicToken) String() string {
+	return t.credentials
+}
+
+func (t *basicToken) Fresh() bool {
+	return t.expiresAt.IsZero() || time.Now().Before(t.expiresAt)
+}
+
+func (t *basicToken) scheme() string {
+	return "Basic"
 }
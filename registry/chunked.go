@@ -0,0 +1,248 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	dauth "github.com/docker/distribution/registry/client/auth"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// ChunkSize is the size of the chunks that blobs larger than it are uploaded in, so
+// that an upload that is interrupted may be resumed from the last chunk that the
+// registry committed. If it is not positive, blobs are uploaded whole.
+var ChunkSize int64 = 32 << 20
+
+// chunkedUpload is the upload of a blob in chunks with PATCH requests
+type chunkedUpload struct {
+	token dauth.Scope
+	dig   reference.Canonical
+	bldr  *v2.URLBuilder
+	blob  distribution.Blob
+
+	// loc is the location of the upload session
+	loc string
+	// offset is the number of bytes that the registry has committed
+	offset   int64
+	progress *blobProgress
+}
+
+// uploadChunks uploads the blob in chunks of ChunkSize. A chunk that fails transiently
+// is sent again from the offset that the registry reports it has, in a new session if
+// the registry has forgotten the old one.
+func uploadChunks(
+	token dauth.Scope,
+	dig reference.Canonical,
+	bldr *v2.URLBuilder,
+	blob distribution.Blob,
+	p *blobProgress,
+) (err error) {
+	u := &chunkedUpload{
+		token:    token,
+		dig:      dig,
+		bldr:     bldr,
+		blob:     blob,
+		progress: p,
+	}
+
+	if u.loc, err = getUploadLoc(token, dig, bldr); err != nil {
+		return
+	}
+
+	fh, err := os.Open(blob.GetFilename())
+	if err != nil {
+		return errors.Wrapf(err, "could not open: %s", blob.GetFilename())
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	for u.offset < blob.GetSize() {
+		resume := false
+		err = httpclient.Retry("Upload of blob "+blob.GetDigest().String(), func() error {
+			if resume {
+				if err := u.resume(); err != nil {
+					return err
+				}
+			}
+			resume = true
+			return u.patch(fh)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	return u.commit()
+}
+
+// patch sends the next chunk
+func (u *chunkedUpload) patch(fh *os.File) (err error) {
+	n := ChunkSize
+	if rest := u.blob.GetSize() - u.offset; n > rest {
+		n = rest
+	}
+
+	// the upload is abandoned if it stalls
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timer := time.AfterFunc(20*time.Second, cancel)
+	defer timer.Stop()
+
+	chunk := &utils.ProgressReader{Reader: io.NewSectionReader(fh, u.offset, n), Progress: u.progress}
+	body := utils.NewResetReader(chunk, func() { timer.Reset(20 * time.Second) })
+
+	req, err := http.NewRequest("PATCH", u.loc, body)
+	if err != nil {
+		return errors.Wrapf(err, "url = %s", u.loc)
+	}
+
+	req = req.WithContext(ctx)
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", u.offset, u.offset+n-1))
+	auth.AddToRequest(u.token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.TransferClient, req, false, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = httpclient.ErrStalled
+		}
+		return errors.Wrapf(err, "upload of blob %s at %d", u.blob.GetDigest(), u.offset)
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		return errors.Wrapf(
+			httpclient.NewStatusError(resp),
+			"upload of blob %s at %d failed",
+			u.blob.GetDigest(),
+			u.offset,
+		)
+	}
+
+	return u.update(resp, u.offset+n)
+}
+
+// resume finds the offset that the registry has committed, or starts a new session
+// if it has forgotten the old one
+func (u *chunkedUpload) resume() (err error) {
+	req, err := http.NewRequest("GET", u.loc, nil)
+	if err != nil {
+		return errors.Wrapf(err, "url = %s", u.loc)
+	}
+	auth.AddToRequest(u.token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		if err = u.update(resp, 0); err != nil {
+			return
+		}
+		log.Info().Msgf("Resuming the upload of blob %s at %d.", u.blob.GetDigest(), u.offset)
+	case http.StatusNotFound:
+		log.Info().Msgf("The upload of blob %s has expired, starting again.", u.blob.GetDigest())
+		if u.loc, err = getUploadLoc(u.token, u.dig, u.bldr); err != nil {
+			return
+		}
+		u.offset = 0
+	default:
+		return errors.Wrapf(httpclient.NewStatusError(resp), "could not get the status of the upload of blob %s", u.blob.GetDigest())
+	}
+
+	// the chunk that failed was reported as sent
+	u.progress.reset(u.offset)
+	return nil
+}
+
+// update the location and offset from the response of the registry, which is
+// assumed to have committed up to offset if it does not say
+func (u *chunkedUpload) update(resp *http.Response, offset int64) (err error) {
+	if loc := resp.Header.Get("Location"); loc != "" {
+		var next *url.URL
+		if next, err = resp.Request.URL.Parse(loc); err != nil {
+			return errors.Wrapf(err, "invalid location %s", loc)
+		}
+		u.loc = next.String()
+	}
+
+	// the range is inclusive, and may be given with or without a unit
+	if r := resp.Header.Get("Range"); r != "" {
+		i := strings.Index(r, "-")
+		if i < 0 {
+			return errors.Errorf("invalid range %q", r)
+		}
+		end, err := strconv.ParseInt(r[i+1:], 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "invalid range %q", r)
+		}
+		offset = end + 1
+	}
+
+	u.offset = offset
+	return nil
+}
+
+// commit completes the upload
+func (u *chunkedUpload) commit() (err error) {
+	loc, err := withDigest(u.loc, u.blob.GetDigest())
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest("PUT", loc, nil)
+	if err != nil {
+		return errors.Wrapf(err, "url = %s", loc)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	auth.AddToRequest(u.token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Wrapf(httpclient.NewStatusError(resp), "upload of blob %s failed", u.blob.GetFilename())
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry_test
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// uploadRegistry is a registry that takes chunked uploads, failing the PATCH
+// requests that fail selects and forgetting the sessions that expire selects
+type uploadRegistry struct {
+	sync.Mutex
+	t *testing.T
+
+	fail   func(n int) bool
+	expire func(n int) bool
+
+	sessions map[string][]byte
+	blobs    map[digest.Digest][]byte
+	// patches are the ranges of the PATCH requests, in order
+	patches []string
+	posts   int
+}
+
+func newUploadRegistry(t *testing.T) *uploadRegistry {
+	return &uploadRegistry{
+		t:        t,
+		fail:     func(int) bool { return false },
+		expire:   func(int) bool { return false },
+		sessions: make(map[string][]byte),
+		blobs:    make(map[digest.Digest][]byte),
+	}
+}
+
+func (r *uploadRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+
+	const uploads = "/v2/repo/blobs/uploads/"
+	switch {
+	case req.Method == "HEAD" && strings.HasPrefix(req.URL.Path, "/v2/repo/blobs/"):
+		if _, ok := r.blobs[digest.Digest(strings.TrimPrefix(req.URL.Path, "/v2/repo/blobs/"))]; !ok {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	case req.Method == "POST" && req.URL.Path == uploads:
+		r.posts++
+		id := uuid.New().String()
+		r.sessions[id] = nil
+		rw.Header().Set("Location", uploads+id)
+		rw.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(req.URL.Path, uploads):
+		id := strings.TrimPrefix(req.URL.Path, uploads)
+		data, ok := r.sessions[id]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "PATCH":
+			r.patch(rw, req, id, data)
+		case "GET":
+			if r.expire(len(r.patches)) {
+				delete(r.sessions, id)
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			rw.Header().Set("Location", uploads+id)
+			rw.Header().Set("Range", fmt.Sprintf("0-%d", len(data)-1))
+			rw.WriteHeader(http.StatusNoContent)
+		case "PUT":
+			// the blob is uploaded whole in the body of the PUT if it is not chunked
+			body, err := ioutil.ReadAll(req.Body)
+			require.NoError(r.t, err)
+			data = append(data, body...)
+			d := digest.Digest(req.URL.Query().Get("digest"))
+			if !assert.Equal(r.t, d, digest.Canonical.FromBytes(data)) {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.blobs[d] = data
+			delete(r.sessions, id)
+			rw.WriteHeader(http.StatusCreated)
+		}
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *uploadRegistry) patch(rw http.ResponseWriter, req *http.Request, id string, data []byte) {
+	cr := req.Header.Get("Content-Range")
+	r.patches = append(r.patches, cr)
+
+	body, err := ioutil.ReadAll(req.Body)
+	require.NoError(r.t, err)
+	if r.fail(len(r.patches)) {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	start, err := strconv.Atoi(strings.Split(cr, "-")[0])
+	require.NoError(r.t, err)
+	if start != len(data) {
+		rw.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	r.sessions[id] = append(data, body...)
+	rw.Header().Set("Location", "/v2/repo/blobs/uploads/"+id)
+	rw.Header().Set("Range", fmt.Sprintf("0-%d", len(r.sessions[id])-1))
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// pushChunked pushes a random blob of size bytes to r in chunks of 1024 bytes
+func pushChunked(t *testing.T, r *uploadRegistry, size int) {
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	chunkSize, retryDelay := registry.ChunkSize, httpclient.RetryDelay
+	defer func() { registry.ChunkSize, httpclient.RetryDelay = chunkSize, retryDelay }()
+	registry.ChunkSize, httpclient.RetryDelay = 1024, time.Nanosecond
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(t, utils.CleanUp(dir, nil)) }()
+	require.NoError(t, os.MkdirAll(dir, 0700))
+
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	fn := filepath.Join(dir, "blob")
+	require.NoError(t, ioutil.WriteFile(fn, data, 0600))
+	layer := distribution.NewPlainLayer(fn, digest.Canonical.FromBytes(data), int64(size))
+
+	ref, endpoint := testEndpoint(t, server, "repo:latest")
+	require.NoError(t, registry.PushLayer(nil, ref, layer, endpoint))
+
+	assert.Equal(t, data, r.blobs[layer.GetDigest()])
+}
+
+func TestChunkedUpload(t *testing.T) {
+	r := newUploadRegistry(t)
+	pushChunked(t, r, 3000)
+
+	assert.Equal(t, []string{"0-1023", "1024-2047", "2048-2999"}, r.patches)
+	assert.Equal(t, 1, r.posts)
+}
+
+func TestChunkedUploadResume(t *testing.T) {
+	// the second chunk fails, and is sent again from the offset that the registry
+	// has committed, rather than from the start
+	r := newUploadRegistry(t)
+	r.fail = func(n int) bool { return n == 2 }
+	pushChunked(t, r, 3000)
+
+	assert.Equal(t, []string{"0-1023", "1024-2047", "1024-2047", "2048-2999"}, r.patches)
+	assert.Equal(t, 1, r.posts)
+}
+
+func TestChunkedUploadExpired(t *testing.T) {
+	// the session is forgotten after the second chunk fails, so the upload starts
+	// again in a new one
+	r := newUploadRegistry(t)
+	r.fail = func(n int) bool { return n == 2 }
+	r.expire = func(n int) bool { return n == 2 }
+	pushChunked(t, r, 3000)
+
+	assert.Equal(t, []string{"0-1023", "1024-2047", "0-1023", "1024-2047", "2048-2999"}, r.patches)
+	assert.Equal(t, 2, r.posts)
+}
+
+func TestUploadWhole(t *testing.T) {
+	// blobs no larger than a chunk are uploaded in a single request
+	r := newUploadRegistry(t)
+	pushChunked(t, r, 1000)
+
+	assert.Empty(t, r.patches)
+	assert.Equal(t, 1, r.posts)
+}
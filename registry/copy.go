@@ -0,0 +1,435 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	dauth "github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/docker/registry"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// Copy is a copy of manifests and the blobs they refer to from a repository to
+// another, which may be in another registry. Nothing is decrypted, and neither is
+// changed by a single byte, so that their digests, and the encrypted layers and
+// keys that they hold, are those of the source.
+type Copy struct {
+	SrcToken    dauth.Scope
+	Src         names.NamedTaggedRepository
+	SrcEndpoint *registry.APIEndpoint
+	DstToken    dauth.Scope
+	Dst         names.NamedTaggedRepository
+	DstEndpoint *registry.APIEndpoint
+	// Mount is whether blobs are mounted from the source, which must be in the same
+	// registry, with DstToken granting pull access to it
+	Mount bool
+}
+
+// CopyImage copies the manifest that the source refers to, by tag or digest, to
+// the tag of the destination, or by digest alone if byDigest is set. The manifests
+// of an index, the blobs of each manifest and the artifacts that refer to them,
+// such as their detached keys, are copied first, and the blobs are streamed from
+// one registry to the other without being written to disk.
+func (c *Copy) CopyImage(byDigest bool) (*distribution.Descriptor, error) {
+	var target reference.Named = c.Dst
+	if byDigest {
+		target = nil
+	}
+	desc, _, err := c.copyManifest(names.ManifestReference(c.Src), target)
+	return desc, err
+}
+
+// copyManifest copies the manifest that src refers to, and all that it refers to,
+// to target, or by digest if target is nil, returning its descriptor and the
+// headers of the response to its upload
+func (c *Copy) copyManifest(src, target reference.Named) (_ *distribution.Descriptor, _ http.Header, err error) {
+	srcBldr := v2.NewURLBuilder(c.SrcEndpoint.URL, false)
+	body, mediaType, err := pullRawManifest(c.SrcToken, src, srcBldr)
+	if err != nil {
+		return
+	}
+	d := digest.Canonical.FromBytes(body)
+
+	if target != nil {
+		remote, err := manifestDigest(c.DstToken, target, v2.NewURLBuilder(c.DstEndpoint.URL, false), distribution.ManifestMediaTypes...)
+		if err != nil {
+			return nil, nil, err
+		} else if remote == d {
+			log.Info().Msgf("%s is up to date: %s.", target, d)
+			return &distribution.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(body))}, nil, nil
+		}
+	}
+
+	var m struct {
+		Config    *distribution.Descriptor  `json:"config"`
+		Layers    []distribution.Descriptor `json:"layers"`
+		Manifests []distribution.Descriptor `json:"manifests"`
+		Subject   *distribution.Descriptor  `json:"subject"`
+	}
+	if err = json.Unmarshal(body, &m); err != nil {
+		err = errors.Wrapf(err, "manifest of %s", src)
+		return
+	}
+
+	// the manifests of an index must be present before it is
+	for _, child := range m.Manifests {
+		if _, _, err = c.copyManifest(names.AppendDigest(names.SeperateRepository(c.Src), child.Digest), nil); err != nil {
+			return
+		}
+	}
+
+	var blobs []distribution.Descriptor
+	if m.Config != nil {
+		blobs = append(blobs, *m.Config)
+	}
+	if err = c.copyBlobs(append(blobs, m.Layers...)); err != nil {
+		return
+	}
+
+	if target == nil {
+		target = names.AppendDigest(names.SeperateRepository(c.Dst), d)
+	}
+	desc, header, err := putManifest(c.DstToken, target, mediaType, body, c.DstEndpoint)
+	if err != nil {
+		return
+	}
+	log.Info().Msgf("Copied manifest %s.", desc.Digest)
+
+	// the artifacts that refer to an image, such as its detached keys, are copied with
+	// it, but not those that refer to artifacts
+	if m.Subject == nil {
+		err = c.copyReferrers(d)
+	}
+	return desc, header, err
+}
+
+// copyReferrers copies the artifacts that refer to the manifest with digest subject
+func (c *Copy) copyReferrers(subject digest.Digest) error {
+	referrers, err := PullReferrers(c.SrcToken, c.Src, subject, "", v2.NewURLBuilder(c.SrcEndpoint.URL, false))
+	if err != nil {
+		return err
+	}
+
+	for _, r := range referrers {
+		desc, header, err := c.copyManifest(names.AppendDigest(names.SeperateRepository(c.Src), r.Digest), nil)
+		if err != nil {
+			return err
+		}
+
+		if header.Get("OCI-Subject") != "" {
+			continue
+		}
+		desc.ArtifactType = r.ArtifactType
+		desc.Annotations = r.Annotations
+		if err = updateReferrersTag(c.DstToken, c.Dst, subject, *desc, c.DstEndpoint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBlobs copies the blobs that are not already in the destination concurrently,
+// at most MaxConcurrentUploads at a time, with the progress of each reported on its
+// own and in their total
+func (c *Copy) copyBlobs(blobs []distribution.Descriptor) error {
+	var total int64
+	unique := make([]distribution.Descriptor, 0, len(blobs))
+	seen := make(map[digest.Digest]bool)
+	for _, b := range blobs {
+		if err := b.Digest.Validate(); err != nil {
+			return errors.WithStack(err)
+		}
+		if seen[b.Digest] {
+			continue
+		}
+		seen[b.Digest] = true
+		unique = append(unique, b)
+		total += b.Size
+	}
+
+	if len(unique) == 0 {
+		return nil
+	}
+
+	g := utils.StartProgressGroup(utils.ProgressUpload, c.Dst.String(), total)
+	defer g.Done()
+
+	n := MaxConcurrentUploads
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	errCh := make(chan error)
+
+	var existing int32
+	for _, b := range unique {
+		go func(b distribution.Descriptor) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			p := g.Start(b.Digest.String(), b.Size)
+			defer p.Done()
+			exists, err := c.copyBlob(b, p)
+			if exists {
+				atomic.AddInt32(&existing, 1)
+			}
+			errCh <- err
+		}(b)
+	}
+
+	if err := utils.ConcatErrChan(errCh, len(unique)); err != nil {
+		return err
+	}
+
+	if existing > 0 {
+		log.Info().Msgf("%d of %d blobs were already in the registry and were not copied.", existing, len(unique))
+	}
+	return nil
+}
+
+// copyBlob copies a blob, unless the destination already has it, reporting its
+// progress to p. The copy is started again if it fails transiently.
+func (c *Copy) copyBlob(b distribution.Descriptor, p utils.Progress) (exists bool, err error) {
+	dstBldr := v2.NewURLBuilder(c.DstEndpoint.URL, false)
+	dig := names.AppendDigest(names.SeperateRepository(c.Dst), b.Digest)
+
+	if exists, err = layerExists(c.DstToken, dig, dstBldr); err != nil {
+		return
+	} else if exists {
+		log.Info().Msgf("Blob %s exists.", b.Digest)
+		p.Add(b.Size)
+		return
+	}
+
+	if c.Mount {
+		var mounted bool
+		if mounted, err = mountBlob(c.DstToken, dig, c.Src, dstBldr); err != nil {
+			return
+		} else if mounted {
+			log.Info().Msgf("Blob %s mounted from %s.", b.Digest, reference.Path(c.Src))
+			p.Add(b.Size)
+			return
+		}
+	}
+
+	bp := &blobProgress{Progress: p}
+	err = httpclient.Retry("Copy of blob "+b.Digest.String(), func() error {
+		bp.reset(0)
+		return c.streamBlob(b, dig, dstBldr, bp)
+	})
+	return
+}
+
+// mountBlob mounts the blob dig from the repository from in the same registry, so
+// that it need not be copied. It is not mounted if the registry does not support
+// mounting or the token does not grant pull access to from, in which case the
+// registry starts an upload instead, which is left to expire.
+func mountBlob(token dauth.Scope, dig reference.Canonical, from reference.Named, bldr *v2.URLBuilder) (mounted bool, err error) {
+	mountURLStr, err := bldr.BuildBlobUploadURL(dig, url.Values{
+		"mount": {dig.Digest().String()},
+		"from":  {reference.Path(from)},
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "%#v", dig)
+		return
+	}
+
+	req, err := http.NewRequest("POST", mountURLStr, nil)
+	if err != nil {
+		err = errors.Wrapf(err, "POST %s", mountURLStr)
+		return
+	}
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode == http.StatusCreated {
+		return true, nil
+	}
+	log.Debug().Msgf("blob %s was not mounted from %s: %s", dig.Digest(), reference.Path(from), resp.Status)
+	return false, nil
+}
+
+// streamBlob uploads the blob dig as it is downloaded from the source, verifying it
+// against its digest, and abandons the copy if either stalls
+func (c *Copy) streamBlob(
+	b distribution.Descriptor,
+	dig reference.Canonical,
+	dstBldr *v2.URLBuilder,
+	p utils.Progress,
+) (err error) {
+	loc, err := getUploadLoc(c.DstToken, dig, dstBldr)
+	if err != nil {
+		return
+	}
+	if loc, err = withDigest(loc, b.Digest); err != nil {
+		return
+	}
+
+	srcURLStr, err := v2.NewURLBuilder(c.SrcEndpoint.URL, false).
+		BuildBlobURL(names.AppendDigest(names.SeperateRepository(c.Src), b.Digest))
+	if err != nil {
+		return errors.Wrapf(err, "%#v", c.Src)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timer := time.AfterFunc(100*time.Second, cancel)
+	defer timer.Stop()
+
+	get, err := http.NewRequest("GET", srcURLStr, nil)
+	if err != nil {
+		return errors.Wrapf(err, "GET %s", srcURLStr)
+	}
+	get.Header.Set("Accept-Encoding", "identity")
+	auth.AddToRequest(c.SrcToken, get)
+
+	resp, err := httpclient.DoRequest(httpclient.TransferClient, get.WithContext(ctx), true, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return stalled(ctx, err, b.Digest)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Wrapf(httpclient.NewStatusError(resp), "could not download blob %s", b.Digest)
+	}
+
+	// the source is verified, as the destination is only told the digest once all of
+	// the blob has been sent
+	vr := &verifiedReader{Reader: resp.Body, Verifier: b.Digest.Verifier(), d: b.Digest}
+	pr := &utils.ProgressReader{Reader: vr, Progress: p}
+	trr := utils.NewResetReader(pr, func() { timer.Reset(100 * time.Second) })
+
+	put, err := http.NewRequest("PUT", loc, trr)
+	if err != nil {
+		return errors.Wrapf(err, "PUT %s", loc)
+	}
+	put.ContentLength = b.Size
+	put.Header.Set("Content-Type", "application/octet-stream")
+	auth.AddToRequest(c.DstToken, put)
+
+	presp, err := httpclient.DoRequest(httpclient.TransferClient, put.WithContext(ctx), false, true)
+	if presp != nil {
+		defer func() { err = utils.CheckedClose(presp.Body, err) }()
+	}
+	if err != nil {
+		return stalled(ctx, err, b.Digest)
+	}
+
+	if presp.StatusCode != http.StatusCreated {
+		return errors.Wrapf(httpclient.NewStatusError(presp), "upload of blob %s failed", b.Digest)
+	}
+	return nil
+}
+
+// stalled is err, or ErrStalled if the copy of the blob with digest d was abandoned
+// as it stalled
+func stalled(ctx context.Context, err error, d digest.Digest) error {
+	if ctx.Err() != nil {
+		return errors.Wrapf(httpclient.ErrStalled, "copy of blob %s", d)
+	}
+	return err
+}
+
+// verifiedReader fails rather than giving the end of a blob that does not verify
+type verifiedReader struct {
+	io.Reader
+	digest.Verifier
+	d digest.Digest
+}
+
+func (r *verifiedReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	_, _ = r.Verifier.Write(p[:n])
+	if err == io.EOF && !r.Verified() {
+		err = errors.Errorf("digest verification of blob %s failed", r.d)
+	}
+	return
+}
+
+// pullRawManifest downloads the manifest that ref refers to as it is, with its
+// media type, verifying it against its digest
+func pullRawManifest(
+	token dauth.Scope,
+	ref reference.Named,
+	bldr *v2.URLBuilder,
+) (body []byte, mediaType string, err error) {
+	urlStr, err := bldr.BuildManifestURL(ref)
+	if err != nil {
+		err = errors.Wrapf(err, "ref = %v", ref)
+		return
+	}
+
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		err = errors.Wrapf(err, "GET %s", urlStr)
+		return
+	}
+
+	acceptManifests(req)
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Wrapf(httpclient.NewStatusError(resp), "download of the manifest of %s failed", ref)
+		return
+	}
+
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if _, err = verifyManifest(ref, resp, body); err != nil {
+		return
+	}
+
+	if mediaType, err = manifestMediaType(ref, resp, body); err != nil {
+		return
+	}
+	return body, mediaType, nil
+}
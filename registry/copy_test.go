@@ -0,0 +1,209 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry_test
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+)
+
+// copyImage is an image in the repository src of a fakeRegistry, with the key
+// envelope that refers to it
+type copyImage struct {
+	blobs    []digest.Digest
+	manifest digest.Digest
+	keys     digest.Digest
+	keysBlob digest.Digest
+}
+
+// putCopyImage puts an image of a config and two layers under src:latest in r,
+// and an artifact of its keys that refers to it. The manifests are not in canonical
+// form, so that they are only copied as they are if they are copied byte for byte.
+func putCopyImage(r *fakeRegistry) *copyImage {
+	img := &copyImage{}
+	for _, data := range []string{`{"os":"linux"}`, "first layer", "second layer"} {
+		img.blobs = append(img.blobs, r.putBlob("src", []byte(data)))
+	}
+	manifest := fmt.Sprintf(`{
+  "schemaVersion": 2,
+  "mediaType": %q,
+  "config": {"mediaType": %q, "size": 14, "digest": %q},
+  "layers": [
+    {"mediaType": %q, "size": 11, "digest": %q},
+    {"mediaType": %q, "size": 12, "digest": %q}
+  ]
+}`,
+		distribution.MediaTypeManifest,
+		distribution.MediaTypeImageConfig, img.blobs[0],
+		distribution.MediaTypeLayer, img.blobs[1],
+		distribution.MediaTypeLayer, img.blobs[2],
+	)
+	img.manifest = r.putManifest("src", distribution.MediaTypeManifest, []byte(manifest), "latest")
+
+	empty := r.putBlob("src", []byte("{}"))
+	img.keysBlob = r.putBlob("src", []byte(`{"keys":"wrapped"}`))
+	keys := fmt.Sprintf(`{
+  "schemaVersion": 2,
+  "mediaType": %q,
+  "artifactType": %q,
+  "config": {"mediaType": %q, "size": 2, "digest": %q},
+  "layers": [{"mediaType": %q, "size": 18, "digest": %q}],
+  "subject": {"mediaType": %q, "size": %d, "digest": %q}
+}`,
+		distribution.MediaTypeOCIManifest, distribution.MediaTypeKeyEnvelope,
+		distribution.MediaTypeEmptyJSON, empty,
+		distribution.MediaTypeKeyEnvelope, img.keysBlob,
+		distribution.MediaTypeManifest, len(manifest), img.manifest,
+	)
+	img.keys = r.putManifest("src", distribution.MediaTypeOCIManifest, []byte(keys))
+	return img
+}
+
+// newCopy is a copy from src:latest to dst:latest in the registry of server
+func newCopy(t *testing.T, server *httptest.Server, mount bool) *registry.Copy {
+	src, endpoint := taggedEndpoint(t, server, "src:latest")
+	dst, _ := taggedEndpoint(t, server, "dst:latest")
+	return &registry.Copy{Src: src, SrcEndpoint: endpoint, Dst: dst, DstEndpoint: endpoint, Mount: mount}
+}
+
+func TestCopyImage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	tests := []struct {
+		name string
+		// mount is whether the blobs are mounted if the registry mounts them, which it
+		// does if mounted is set
+		mount   bool
+		mounted bool
+		// existing is the number of the blobs of the image already in dst
+		existing int
+	}{
+		{name: "mounted", mount: true, mounted: true},
+		{name: "mount refused", mount: true},
+		{name: "streamed"},
+		{name: "existing blobs", existing: 2},
+	}
+
+	for _, test := range tests {
+		r := newFakeRegistry(t)
+		r.mount = test.mounted
+		img := putCopyImage(r)
+		for _, d := range img.blobs[:test.existing] {
+			data, _ := r.blob("src", d)
+			r.putBlob("dst", data)
+		}
+
+		server := httptest.NewServer(r)
+		c := newCopy(t, server, test.mount)
+		desc, err := c.CopyImage(false)
+		server.Close()
+		require.NoError(err, test.name)
+
+		// the manifest is under the tag of the destination, byte for byte
+		assert.Equal(img.manifest, desc.Digest, test.name)
+		src, _ := r.manifest("src", "latest")
+		dst, ok := r.manifest("dst", "latest")
+		if assert.True(ok, test.name) {
+			assert.Equal(src, dst, test.name)
+		}
+
+		// as is every blob, whether it was mounted, streamed or already there
+		for _, d := range append(img.blobs, img.keysBlob) {
+			data, ok := r.blob("dst", d)
+			if assert.True(ok, "%s: %s", test.name, d) {
+				assert.Equal(d, digest.Canonical.FromBytes(data), test.name)
+			}
+		}
+
+		// and the keys that refer to the image, by their digest
+		src, _ = r.manifest("src", img.keys.String())
+		dst, ok = r.manifest("dst", img.keys.String())
+		if assert.True(ok, test.name) {
+			assert.Equal(src, dst, test.name)
+		}
+
+		// the blobs that were mounted are not downloaded, and those that were already
+		// there are neither downloaded nor uploaded
+		streamed := 0
+		if !test.mounted {
+			streamed = len(img.blobs) + 2 - test.existing
+		}
+		assert.Equal(streamed, r.count("GET", "/v2/src/blobs/"), test.name)
+		assert.Equal(streamed, r.count("PUT", "/v2/dst/blobs/uploads/"), test.name)
+		if test.mount && !test.mounted {
+			// each blob that was not mounted was then uploaded in an upload of its own
+			assert.Equal(2*streamed, r.count("POST", "/v2/dst/blobs/uploads/"), test.name)
+		}
+		if test.existing > 0 {
+			assert.Equal(len(img.blobs)+2, r.count("HEAD", "/v2/dst/blobs/"), test.name)
+		}
+	}
+}
+
+func TestCopyImageVerify(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(retries int) { httpclient.Retries = retries }(httpclient.Retries)
+	httpclient.Retries = 0
+
+	// a layer of the source that is not what its digest says is not uploaded
+	r := newFakeRegistry(t)
+	img := putCopyImage(r)
+	r.Lock()
+	r.blobs["src@"+img.blobs[2].String()] = []byte("second layEr")
+	r.Unlock()
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	_, err := newCopy(t, server, false).CopyImage(false)
+	require.Error(err)
+	assert.Contains(err.Error(), "digest verification of blob "+img.blobs[2].String()+" failed")
+
+	_, ok := r.blob("dst", img.blobs[2])
+	assert.False(ok)
+	_, ok = r.manifest("dst", "latest")
+	assert.False(ok)
+}
+
+func TestCopyImageByDigest(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	r := newFakeRegistry(t)
+	img := putCopyImage(r)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	// an image copied by digest is not tagged in the destination
+	desc, err := newCopy(t, server, false).CopyImage(true)
+	require.NoError(err)
+	assert.Equal(img.manifest, desc.Digest)
+	_, ok := r.manifest("dst", img.manifest.String())
+	assert.True(ok)
+	_, ok = r.manifest("dst", "latest")
+	assert.False(ok)
+}
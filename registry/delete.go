@@ -0,0 +1,85 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"net/http"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	dauth "github.com/docker/distribution/registry/client/auth"
+	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// DeleteManifest deletes the manifest that ref refers to, by tag or digest, from the
+// registry, returning its descriptor. As the registry deletes a manifest by its
+// digest, every tag of the manifest is removed with it.
+func DeleteManifest(
+	token dauth.Scope,
+	ref reference.Named,
+	bldr *v2.URLBuilder,
+) (_ *distribution.Descriptor, err error) {
+	// the manifest may be an index, such as that of a multi-platform image
+	d, err := manifestDigest(token, names.ManifestReference(ref), bldr, distribution.ManifestMediaTypes...)
+	if err != nil {
+		return nil, err
+	} else if d == "" {
+		return nil, errors.Errorf("could not find the manifest of %s", ref)
+	}
+
+	can := names.AppendDigest(names.SeperateRepository(ref), d)
+	urlStr, err := bldr.BuildManifestURL(can)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ref = %v", can)
+	}
+
+	req, err := http.NewRequest("DELETE", urlStr, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DELETE %s", urlStr)
+	}
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return &distribution.Descriptor{Digest: d}, nil
+	case http.StatusMethodNotAllowed, http.StatusBadRequest:
+		// registry:2 refuses deletion unless REGISTRY_STORAGE_DELETE_ENABLED is set,
+		// and Docker Hub only deletes through its website
+		return nil, errors.Errorf(
+			"%s does not allow manifests to be deleted (status: %s), deletion may be disabled in its configuration",
+			req.URL.Host, resp.Status,
+		)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, utils.WithClass(errors.Errorf("this account is not authorised to delete from the repository: %s", ref.Name()), utils.ClassAuth)
+	case http.StatusNotFound:
+		return nil, errors.Errorf("could not find the manifest of %s", ref)
+	default:
+		return nil, errors.Wrapf(httpclient.NewStatusError(resp), "could not delete %s", ref)
+	}
+}
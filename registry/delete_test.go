@@ -0,0 +1,98 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/docker/distribution/registry/api/v2"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestDeleteManifest(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(retries int) { httpclient.Retries = retries }(httpclient.Retries)
+	httpclient.Retries = 0
+
+	d := digest.Canonical.FromString("manifest")
+
+	tests := []struct {
+		status int
+		ok     bool
+		// contains is a part of the message of the error, and class its class
+		contains string
+		class    utils.Class
+	}{
+		{status: http.StatusAccepted, ok: true},
+		{status: http.StatusOK, ok: true},
+		{status: http.StatusMethodNotAllowed, contains: "deletion may be disabled"},
+		{status: http.StatusBadRequest, contains: "deletion may be disabled"},
+		{status: http.StatusUnauthorized, contains: "not authorised to delete", class: utils.ClassAuth},
+		{status: http.StatusForbidden, contains: "not authorised to delete", class: utils.ClassAuth},
+		{status: http.StatusNotFound, contains: "could not find the manifest"},
+		{status: http.StatusInternalServerError, contains: "could not delete"},
+	}
+
+	for _, test := range tests {
+		// the manifest is deleted by the digest that its tag resolves to
+		var deleted []string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			switch req.Method {
+			case "HEAD":
+				if req.URL.Path != "/v2/repo/manifests/latest" {
+					rw.WriteHeader(http.StatusNotFound)
+					return
+				}
+				rw.Header().Set("Docker-Content-Digest", d.String())
+			case "DELETE":
+				deleted = append(deleted, req.URL.Path)
+				rw.WriteHeader(test.status)
+			}
+		}))
+		ref, endpoint := taggedEndpoint(t, server, "repo:latest")
+
+		desc, err := registry.DeleteManifest(nil, ref, v2.NewURLBuilder(endpoint.URL, false))
+		server.Close()
+
+		assert.Equal([]string{"/v2/repo/manifests/" + d.String()}, deleted, "%d", test.status)
+		if test.ok {
+			if assert.NoError(err, "%d", test.status) {
+				assert.Equal(d, desc.Digest)
+			}
+			continue
+		}
+		if assert.Error(err, "%d", test.status) {
+			assert.Contains(err.Error(), test.contains, "%d", test.status)
+			assert.Equal(test.class, utils.ClassOf(err), "%d", test.status)
+		}
+	}
+
+	// a tag that the registry does not have is not deleted
+	server := httptest.NewServer(newFakeRegistry(t))
+	defer server.Close()
+	ref, endpoint := taggedEndpoint(t, server, "repo:missing")
+	_, err := registry.DeleteManifest(nil, ref, v2.NewURLBuilder(endpoint.URL, false))
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "could not find the manifest")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/registry"
 	"github.com/pkg/errors"
+
+	"github.com/Senetas/crypto-cli/registry/httpclient"
 )
 
 // GetEndpoint returns the endpoint associated with the reference
@@ -14,8 +16,7 @@ func GetEndpoint(
 	_ *registry.APIEndpoint,
 	err error,
 ) {
-	options := registry.ServiceOptions{}
-	options.InsecureRegistries = append(options.InsecureRegistries, "0.0.0.0/0")
+	options := httpclient.ServiceOptions()
 
 	var registryService *registry.DefaultService
 	registryService, err = registry.NewService(options)
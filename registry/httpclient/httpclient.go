@@ -15,6 +15,8 @@
 package httpclient
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -28,24 +30,156 @@ var (
 	// DefaultClient is a http client with timeouts set
 	DefaultClient = &http.Client{
 		Timeout:   100 * time.Second,
-		Transport: defaultTransport,
+		Transport: &tlsTransport{},
 	}
-	defaultTransport = &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout: 20 * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout: 20 * time.Second,
+	// TransferClient is DefaultClient without its timeout, for the transfers of blobs
+	// that may take longer, which are abandoned if they stall instead
+	TransferClient = &http.Client{
+		Transport: DefaultClient.Transport,
 	}
 )
 
-// DoRequest wraps http.Client.Do but dumps the request and response with optional bodies
-func DoRequest(client *http.Client, req *http.Request, dumpReqBody, dumpRespBody bool) (*http.Response, error) {
+var (
+	// Transport, if set, sends every request to registries and their auth servers in
+	// place of the transports created here, so that they may be sent to a mock
+	// server or through a recording proxy, or served by a store of blobs that is not
+	// a registry. The TLS and proxy settings are then those of Transport.
+	Transport http.RoundTripper
+)
+
+// RoundTripperFunc is a function that is a http.RoundTripper, which may be set as
+// Transport
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls f(req)
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+var (
+	// DialTimeout bounds how long a connection to a registry or proxy takes to open
+	DialTimeout = 20 * time.Second
+	// TLSHandshakeTimeout bounds how long the TLS handshake with a registry takes
+	TLSHandshakeTimeout = 20 * time.Second
+	// ResponseHeaderTimeout bounds how long a registry takes to respond once a request
+	// is sent, so that a request that a slow proxy holds fails and is retried rather
+	// than hanging, which is 0 for no bound
+	ResponseHeaderTimeout = 2 * time.Minute
+	// IdleConnTimeout is how long an idle connection to a registry is kept open to be
+	// used again
+	IdleConnTimeout = 90 * time.Second
+	// MaxIdleConnsPerHost is how many idle connections to each registry are kept open,
+	// which is enough for the concurrent transfers of blobs to reuse them
+	MaxIdleConnsPerHost = 16
+	// MaxConnsPerHost bounds the connections to each registry, which is 0 for no bound
+	MaxConnsPerHost = 0
+)
+
+// keepAlive is the interval of the TCP keep-alive probes of connections
+const keepAlive = 30 * time.Second
+
+// newTransport creates a transport with timeouts set, the TLS config and the proxy
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   DialTimeout,
+			KeepAlive: keepAlive,
+		}).DialContext,
+		TLSHandshakeTimeout:   TLSHandshakeTimeout,
+		TLSClientConfig:       tlsConfig,
+		ResponseHeaderTimeout: ResponseHeaderTimeout,
+		IdleConnTimeout:       IdleConnTimeout,
+		MaxIdleConnsPerHost:   MaxIdleConnsPerHost,
+		MaxConnsPerHost:       MaxConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// transportSettings are the settings that transports are created with, as a string
+func transportSettings() string {
+	return fmt.Sprintf(
+		"%v\x00%v\x00%v\x00%v\x00%d\x00%d",
+		DialTimeout,
+		TLSHandshakeTimeout,
+		ResponseHeaderTimeout,
+		IdleConnTimeout,
+		MaxIdleConnsPerHost,
+		MaxConnsPerHost,
+	)
+}
+
+// DoRequest wraps http.Client.Do but dumps the request and response with optional bodies.
+// A request that fails transiently is retried with exponential backoff if its body can
+// be sent again, and one that is rate limited is retried when the registry says to, if
+// that is soon enough, or else fails with a RateLimitError. A request that it gives up
+// retrying is not retried again by Retry.
+func DoRequest(client *http.Client, req *http.Request, dumpReqBody, dumpRespBody bool) (resp *http.Response, err error) {
+	for attempt := 0; ; attempt++ {
+		resp, err = doRequest(client, req, dumpReqBody, dumpRespBody)
+
+		var limit *RateLimitError
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			limit = NewRateLimitError(req.URL.Host, resp)
+		}
+
+		retry := retryRequest(req, resp, err)
+		if attempt >= Retries || !retry || limit != nil && !Temporary(limit) {
+			if limit != nil {
+				discard(resp)
+				if retry && attempt > 0 {
+					// the limit has been waited out here as often as it may be
+					return nil, errors.WithStack(&retriedError{limit})
+				}
+				return nil, errors.WithStack(limit)
+			}
+			// what was retried here is not retried again by the caller
+			if retry && attempt > 0 {
+				if err != nil {
+					err = &retriedError{err}
+				} else {
+					resp.Body = &retriedBody{resp.Body}
+				}
+			}
+			return
+		}
+
+		delay := retryDelay(attempt, limit)
+		switch {
+		case limit != nil:
+			log.Warn().Msgf("%s %s was %s, retrying in %v.", req.Method, req.URL, limit, delay)
+			discard(resp)
+		case err != nil:
+			log.Warn().Err(err).Msgf("%s %s failed, retrying in %v.", req.Method, req.URL, delay)
+		default:
+			log.Warn().Msgf("%s %s failed with status %s, retrying in %v.", req.Method, req.URL, resp.Status, delay)
+			discard(resp)
+		}
+
+		if err = wait(req.Context(), delay); err != nil {
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	}
+}
+
+func doRequest(client *http.Client, req *http.Request, dumpReqBody, dumpRespBody bool) (*http.Response, error) {
+	// set here rather than by the transport, so that it is dumped
+	if UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", UserAgent)
+	}
+
 	dump, err := httputil.DumpRequestOut(req, dumpReqBody)
 	if err != nil {
 		return nil, errors.Wrapf(err, "%#v", req)
 	}
-	log.Debug().Msg(req.URL.String())
-	log.Debug().Msgf("%s", dump)
+	log.Debug().Msg(redactURL(req.URL).String())
+	log.Debug().Msgf("%s", redactDump(dump, req.URL))
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -55,7 +189,7 @@ func DoRequest(client *http.Client, req *http.Request, dumpReqBody, dumpRespBody
 	if dump, err = httputil.DumpResponse(resp, dumpRespBody); err != nil {
 		return nil, errors.Wrapf(err, "%#v", resp)
 	}
-	log.Debug().Msgf("%s", dump)
+	log.Debug().Msgf("%s", redactDump(dump, nil))
 
 	return resp, err
 }
@@ -16,12 +16,29 @@ package httpclient_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/Senetas/crypto-cli/registry/httpclient"
 )
@@ -49,3 +66,500 @@ func TestHTTPClient(t *testing.T) {
 
 	assert.Equal(body.String(), "OK")
 }
+
+func TestTransport(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// a registry that does not exist, served by the transport alone
+	var requests []string
+	httpclient.Transport = httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.String())
+		assert.Equal(httpclient.UserAgent, req.Header.Get("User-Agent"))
+		return &http.Response{
+			Status:     "200 OK",
+			StatusCode: http.StatusOK,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Docker-Distribution-Api-Version": {"registry/2.0"}},
+			Body:       ioutil.NopCloser(bytes.NewBufferString("{}")),
+			Request:    req,
+		}, nil
+	})
+	defer func() { httpclient.Transport = nil }()
+
+	for _, client := range []*http.Client{httpclient.DefaultClient, httpclient.TransferClient} {
+		req, err := http.NewRequest("GET", "https://registry.invalid/v2/", nil)
+		require.NoError(err)
+
+		resp, err := httpclient.DoRequest(client, req, false, false)
+		require.NoError(err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(err)
+		require.NoError(resp.Body.Close())
+		assert.Equal("{}", string(body))
+		assert.Equal("registry/2.0", resp.Header.Get("Docker-Distribution-Api-Version"))
+	}
+
+	assert.Equal([]string{"GET https://registry.invalid/v2/", "GET https://registry.invalid/v2/"}, requests)
+}
+
+func TestClientCertificates(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if assert.Len(req.TLS.PeerCertificates, 1) {
+			_, _ = rw.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "certs.d")
+	require.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	defer func(certsDir string) { httpclient.CertsDir = certsDir }(httpclient.CertsDir)
+	httpclient.CertsDir = dir
+
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+	hostDir := filepath.Join(dir, u.Host)
+	require.NoError(os.Mkdir(hostDir, 0700))
+
+	// the server's certificate is trusted as a CA root
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(hostDir, "ca.crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+		0600,
+	))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ahab"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(err)
+
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(hostDir, "client.cert"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		0600,
+	))
+	require.NoError(ioutil.WriteFile(
+		filepath.Join(hostDir, "client.key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		0600,
+	))
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	require.NoError(err)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	require.NoError(err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(err)
+	assert.Equal("ahab", string(body))
+}
+
+func TestInsecure(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(insecure []string) { httpclient.InsecureRegistries = insecure }(httpclient.InsecureRegistries)
+
+	tests := []struct {
+		insecureRegistries []string
+		host               string
+		insecure           bool
+	}{
+		{nil, "127.0.0.1:5000", true},
+		{nil, "localhost:5000", true},
+		{nil, "[::1]:5000", true},
+		{nil, "[::1]", true},
+		{nil, "[2001:db8::1]:5000", false},
+		{[]string{"2001:db8::/32"}, "[2001:db8::1]:5000", true},
+		{nil, "registry.invalid", false},
+		{[]string{"registry.invalid"}, "registry.invalid", true},
+		{[]string{"registry.invalid"}, "registry.invalid:5000", false},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:5000", true},
+		{[]string{"10.0.0.0/8"}, "192.168.1.1", false},
+	}
+
+	for _, test := range tests {
+		httpclient.InsecureRegistries = test.insecureRegistries
+		insecure, err := httpclient.Insecure(test.host)
+		if assert.NoError(err) {
+			assert.Equal(test.insecure, insecure, test.host)
+		}
+	}
+}
+
+func TestRegistryCA(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(caFile string) { httpclient.CAFile = caFile }(httpclient.CAFile)
+
+	dir, err := ioutil.TempDir("", "registry-ca")
+	require.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	httpclient.CAFile = filepath.Join(dir, "ca.pem")
+	require.NoError(ioutil.WriteFile(httpclient.CAFile, []byte("not a certificate"), 0600))
+
+	req, err := http.NewRequest("GET", "https://registry.invalid/v2/", nil)
+	require.NoError(err)
+
+	_, err = httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "no CA certificates in "+httpclient.CAFile)
+	}
+
+	// the CAs of a registry are only read for that registry
+	httpclient.CAFile = ""
+	caFile := filepath.Join(dir, "registry.pem")
+	require.NoError(ioutil.WriteFile(caFile, []byte("not a certificate"), 0600))
+	httpclient.RegistryCAFiles["registry.invalid"] = caFile
+	defer delete(httpclient.RegistryCAFiles, "registry.invalid")
+
+	_, err = httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "no CA certificates in "+caFile)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(proxy string, noProxy []string) {
+		httpclient.Proxy, httpclient.NoProxy = proxy, noProxy
+	}(httpclient.Proxy, httpclient.NoProxy)
+
+	// the proxy answers every request itself
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("proxied " + req.URL.Host))
+	}))
+	defer server.Close()
+
+	httpclient.Proxy = server.URL
+	httpclient.NoProxy = []string{"internal.invalid", "10.0.0.0/8", "registry.invalid:5000"}
+
+	tests := []struct {
+		url     string
+		proxied bool
+	}{
+		{"http://registry.invalid/v2/", true},
+		{"http://registry.invalid:5000/v2/", false},
+		{"http://harbor.internal.invalid/v2/", false},
+		{"http://internal.invalid/v2/", false},
+		{"http://10.1.2.3/v2/", false},
+		{"http://192.168.1.1/v2/", true},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		require.NoError(err)
+
+		client := *httpclient.DefaultClient
+		client.Timeout = time.Second
+
+		resp, err := httpclient.DoRequest(&client, req, true, true)
+		if !test.proxied {
+			// the host does not exist, so the request fails if it is not proxied
+			assert.Error(err, test.url)
+			continue
+		}
+		if !assert.NoError(err, test.url) {
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.NoError(err)
+		assert.NoError(resp.Body.Close())
+		assert.Equal("proxied "+req.URL.Host, string(body))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(delay time.Duration) { httpclient.RetryDelay = delay }(httpclient.RetryDelay)
+	httpclient.RetryDelay = time.Millisecond
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NoError(err)
+		assert.Equal("manifest", string(body))
+		if attempts < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// a body that can be sent again is
+	req, err := http.NewRequest("PUT", server.URL, bytes.NewReader([]byte("manifest")))
+	require.NoError(err)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	require.NoError(err)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	assert.Equal(3, attempts)
+
+	// but a stream is not
+	attempts = 0
+	req, err = http.NewRequest("PUT", server.URL, ioutil.NopCloser(bytes.NewReader([]byte("manifest"))))
+	require.NoError(err)
+
+	resp, err = httpclient.DoRequest(httpclient.DefaultClient, req, false, true)
+	require.NoError(err)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(1, attempts)
+
+	// which is retried by its caller instead
+	attempts = 0
+	err = httpclient.Retry("upload", func() error {
+		req, err := http.NewRequest("PUT", server.URL, ioutil.NopCloser(bytes.NewReader([]byte("manifest"))))
+		require.NoError(err)
+
+		resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, false, true)
+		require.NoError(err)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			return httpclient.NewStatusError(resp)
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(3, attempts)
+
+	// a request that DoRequest gave up retrying is not retried again by its caller
+	attempts = 0
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	err = httpclient.Retry("download", func() error {
+		resp, err := httpclient.DoRequest(httpclient.DefaultClient, newGet(t, failing.URL), false, false)
+		require.NoError(err)
+		defer resp.Body.Close()
+		return httpclient.NewStatusError(resp)
+	})
+	assert.Error(err)
+	assert.False(httpclient.Temporary(err))
+	assert.Equal(httpclient.Retries+1, attempts)
+}
+
+func TestTemporary(t *testing.T) {
+	assert := assert.New(t)
+
+	// nothing listens on the port of a closed server
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	_, refused := http.Get(server.URL)
+
+	tests := []struct {
+		err       error
+		temporary bool
+	}{
+		{nil, false},
+		{errors.New("digest verification failed"), false},
+		{errors.Wrap(httpclient.ErrStalled, "upload"), true},
+		{errors.Wrap(io.ErrUnexpectedEOF, "download"), true},
+		{&httpclient.StatusError{StatusCode: http.StatusBadGateway}, true},
+		{&httpclient.StatusError{StatusCode: http.StatusUnauthorized}, false},
+		{refused, true},
+		{&httpclient.RateLimitError{RetryAfter: time.Minute}, true},
+		{&httpclient.RateLimitError{RetryAfter: time.Hour}, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.temporary, httpclient.Temporary(test.err), "%v", test.err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	attempts := 0
+	retryAfter := "1"
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 2 {
+			rw.Header().Set("Retry-After", retryAfter)
+			rw.Header().Set("RateLimit-Limit", "100;w=21600")
+			rw.Header().Set("RateLimit-Remaining", "0;w=21600")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// a request that is rate limited is retried when the registry says
+	start := time.Now()
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, newGet(t, server.URL), false, false)
+	require.NoError(err)
+	assert.NoError(resp.Body.Close())
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(2, attempts)
+	assert.True(time.Since(start) >= time.Second)
+
+	// unless that is too long to wait
+	attempts = 0
+	retryAfter = "86400"
+	_, err = httpclient.DoRequest(httpclient.DefaultClient, newGet(t, server.URL), false, false)
+	require.Error(err)
+	assert.Equal(1, attempts)
+
+	limit, ok := errors.Cause(err).(*httpclient.RateLimitError)
+	require.True(ok)
+	assert.Equal(24*time.Hour, limit.RetryAfter)
+	assert.Equal("100", limit.Limit)
+	assert.Equal("0", limit.Remaining)
+	assert.Equal(6*time.Hour, limit.Window)
+	assert.Contains(err.Error(), "0 of 100 requests remain per 6h0m0s")
+
+	// and a limit that DoRequest waited out as often as it may is not waited out
+	// again by the caller
+	defer func(retries int) { httpclient.Retries = retries }(httpclient.Retries)
+	httpclient.Retries = 1
+	attempts = 0
+	retryAfter = "1"
+	limited := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attempts++
+		rw.Header().Set("Retry-After", retryAfter)
+		rw.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+
+	err = httpclient.Retry("download", func() error {
+		_, err := httpclient.DoRequest(httpclient.DefaultClient, newGet(t, limited.URL), false, false)
+		return err
+	})
+	require.Error(err)
+	assert.False(httpclient.Temporary(err))
+	assert.Equal(2, attempts)
+	_, ok = errors.Cause(err).(*httpclient.RateLimitError)
+	assert.True(ok)
+}
+
+func newGet(t *testing.T, u string) *http.Request {
+	req, err := http.NewRequest("GET", u, nil)
+	require.NoError(t, err)
+	return req
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(retries int, timeout time.Duration) {
+		httpclient.Retries, httpclient.ResponseHeaderTimeout = retries, timeout
+	}(httpclient.Retries, httpclient.ResponseHeaderTimeout)
+	httpclient.Retries = 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	// a registry that does not respond in time fails the request
+	httpclient.ResponseHeaderTimeout = 50 * time.Millisecond
+	_, err := httpclient.DoRequest(httpclient.DefaultClient, newGet(t, server.URL), false, false)
+	require.Error(err)
+	assert.True(httpclient.Temporary(err))
+
+	// and the setting may be changed once requests have been made
+	httpclient.ResponseHeaderTimeout = time.Second
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, newGet(t, server.URL), false, false)
+	require.NoError(err)
+	assert.NoError(resp.Body.Close())
+}
+
+func TestDumpRedacted(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(logger zerolog.Logger) { log.Logger = logger }(log.Logger)
+	logs := &bytes.Buffer{}
+	log.Logger = zerolog.New(logs).Level(zerolog.DebugLevel)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// the headers that requests are signed with are not dumped
+	req := newGet(t, server.URL)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=secret-credential")
+	req.Header.Set("X-Amz-Security-Token", "secret-session-token")
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	require.NoError(err)
+	assert.NoError(resp.Body.Close())
+
+	assert.Contains(logs.String(), "X-Amz-Security-Token: REDACTED")
+	assert.NotContains(logs.String(), "secret")
+}
+
+func TestDebugHTTP(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(logger zerolog.Logger, debugHTTP bool, userAgent string) {
+		log.Logger, httpclient.DebugHTTP, httpclient.UserAgent = logger, debugHTTP, userAgent
+	}(log.Logger, httpclient.DebugHTTP, httpclient.UserAgent)
+
+	logs := &bytes.Buffer{}
+	log.Logger = zerolog.New(logs)
+	httpclient.DebugHTTP = true
+	httpclient.UserAgent = "crypto-cli/test"
+
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	req := newGet(t, server.URL+"/v2/?X-Amz-Signature=secret-signature")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("X-Amz-Security-Token", "secret-session-token")
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, false, false)
+	require.NoError(err)
+	assert.NoError(resp.Body.Close())
+
+	// the request is identified to the registry
+	id := header.Get("X-Request-ID")
+	assert.Len(id, 16)
+	assert.Equal("crypto-cli/test", header.Get("User-Agent"))
+
+	// and logged, without its credentials
+	assert.Contains(logs.String(), "HTTP "+id+" GET "+server.URL+"/v2/?X-Amz-Signature=REDACTED 202 Accepted")
+	assert.Contains(logs.String(), "Authorization: REDACTED")
+	assert.Contains(logs.String(), "X-Amz-Security-Token: REDACTED")
+	assert.NotContains(logs.String(), "secret")
+}
@@ -0,0 +1,135 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// Proxy is the URL of the proxy that requests to registries are sent through,
+	// which if empty is $HTTPS_PROXY or $HTTP_PROXY, depending on the scheme of the
+	// request, as for other programs
+	Proxy string
+
+	// NoProxy are the hosts that are reached without the proxy, given as domains,
+	// which match their subdomains too, with ports if only those ports should match,
+	// IP addresses or CIDRs, or * for every host. If nil, they are $NO_PROXY.
+	NoProxy []string
+)
+
+// proxy is the proxy of the request, or nil if it is sent directly
+func proxy(req *http.Request) (*url.URL, error) {
+	if Proxy == "" && NoProxy == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	proxy := Proxy
+	if proxy == "" {
+		if req.URL.Scheme == "https" {
+			proxy = getenv("HTTPS_PROXY")
+		}
+		if proxy == "" {
+			proxy = getenv("HTTP_PROXY")
+		}
+	}
+
+	if proxy == "" || !useProxy(req.URL) {
+		return nil, nil
+	}
+
+	// a proxy is often given as a host and port alone
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, errors.Errorf("invalid proxy address %q", proxy)
+	}
+
+	return proxyURL, nil
+}
+
+// useProxy is whether a request to u is sent through the proxy, which it is
+// unless its host is on the loopback interface or matches NoProxy
+func useProxy(u *url.URL) bool {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if host == "localhost" {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return false
+	}
+
+	noProxy := NoProxy
+	if noProxy == nil {
+		noProxy = strings.Split(getenv("NO_PROXY"), ",")
+	}
+
+	for _, p := range noProxy {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch {
+		case p == "":
+			continue
+		case p == "*":
+			return false
+		}
+
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+
+		if pHost, pPort, err := net.SplitHostPort(p); err == nil {
+			if pPort != port {
+				continue
+			}
+			p = pHost
+		}
+
+		if pIP := net.ParseIP(p); pIP != nil {
+			if pIP.Equal(ip) {
+				return false
+			}
+			continue
+		}
+
+		p = strings.TrimPrefix(p, ".")
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getenv gets the environment variable in upper case, or else in lower case
+func getenv(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(key))
+}
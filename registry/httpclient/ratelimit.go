@@ -0,0 +1,131 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// MaxRateLimitWait is the longest that a request that a registry has rate limited
+// waits to be retried. Requests that must wait longer fail.
+var MaxRateLimitWait = 5 * time.Minute
+
+// countdownInterval is how often the time left to wait for a retry is logged
+const countdownInterval = 15 * time.Second
+
+// RateLimitError is the error of a request that a registry refused with status 429
+// as too many have been made, which says how long to wait if the registry did
+type RateLimitError struct {
+	Host string
+	// RetryAfter is how long the registry asked to wait, 0 if it did not
+	RetryAfter time.Duration
+	// Limit and Remaining are the number of requests allowed in the window and that
+	// remain of them, as given by the registry, such as Docker Hub, if it did
+	Limit, Remaining string
+	// Window is the period that the limit applies to
+	Window time.Duration
+}
+
+// NewRateLimitError creates a RateLimitError from the response to a request to host
+func NewRateLimitError(host string, resp *http.Response) *RateLimitError {
+	e := &RateLimitError{Host: host}
+	e.RetryAfter = retryAfter(resp.Header.Get("Retry-After"))
+	e.Limit, e.Window = rateLimit(resp.Header.Get("RateLimit-Limit"))
+	e.Remaining, _ = rateLimit(resp.Header.Get("RateLimit-Remaining"))
+	return e
+}
+
+func (e *RateLimitError) Error() string {
+	msg := "rate limited by " + e.Host
+	if e.Limit != "" {
+		msg += fmt.Sprintf(", %s of %s requests remain", e.Remaining, e.Limit)
+		if e.Window > 0 {
+			msg += fmt.Sprintf(" per %v", e.Window)
+		}
+	}
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %v", e.RetryAfter)
+	}
+	if e.Host == "registry-1.docker.io" || e.Host == "auth.docker.io" {
+		msg += ", logging in with docker login raises the limit"
+	}
+	return msg
+}
+
+// retryAfter parses the value of a Retry-After header, which is a number of seconds
+// or a date
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(strings.TrimSpace(v)); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d.Round(time.Second)
+		}
+	}
+	return 0
+}
+
+// rateLimit parses a value of a RateLimit-Limit or RateLimit-Remaining header, such
+// as 100;w=21600, into the number and the window
+func rateLimit(v string) (n string, window time.Duration) {
+	parts := strings.Split(v, ";")
+	n = strings.TrimSpace(parts[0])
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "w=") {
+			if secs, err := strconv.Atoi(p[2:]); err == nil {
+				window = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return
+}
+
+// wait for delay, logging how long is left every countdownInterval, so that a long
+// wait is seen to be one
+func wait(ctx context.Context, delay time.Duration) error {
+	deadline := time.Now().Add(delay)
+	for {
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil
+		}
+		if left > countdownInterval {
+			left = countdownInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		case <-time.After(left):
+		}
+
+		if left = time.Until(deadline); left > 0 {
+			log.Info().Msgf("Retrying in %v.", left.Round(time.Second))
+		}
+	}
+}
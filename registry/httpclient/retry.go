@@ -0,0 +1,216 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Retries is how many times a request that fails transiently is retried
+	Retries = 4
+
+	// RetryDelay is about how long to wait before the first retry, which doubles for
+	// each retry after it, up to maxRetryDelay
+	RetryDelay = time.Second
+
+	maxRetryDelay = 30 * time.Second
+)
+
+// ErrStalled is the error of a transfer that was abandoned as no data was sent or
+// received for too long
+var ErrStalled = errors.New("transfer stalled")
+
+// StatusError is the error of a response with a status that the request failed with
+type StatusError struct {
+	StatusCode int
+	Status     string
+
+	// retried is whether DoRequest already retried the request that got the status
+	retried bool
+}
+
+// NewStatusError creates a StatusError from the status of the response
+func NewStatusError(resp *http.Response) *StatusError {
+	_, retried := resp.Body.(*retriedBody)
+	return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, retried: retried}
+}
+
+func (e *StatusError) Error() string {
+	return "status " + e.Status
+}
+
+// retriedError is the error of a request that DoRequest gave up retrying, which
+// Retry does not retry again, so that a request that keeps failing is not sent
+// Retries times for each of the attempts of what sends it
+type retriedError struct {
+	error
+}
+
+func (e *retriedError) Cause() error {
+	return e.error
+}
+
+// retriedBody is the body of a response with a status that DoRequest gave up
+// retrying on, whose StatusError is therefore not retried again
+type retriedBody struct {
+	io.ReadCloser
+}
+
+// retried is whether err, or any error that it wraps, was given up on by DoRequest
+func retried(err error) bool {
+	for err != nil {
+		if _, ok := err.(*retriedError); ok {
+			return true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+// Temporary is whether err may not happen if what failed with it is tried again:
+// a timeout, a connection that was refused, reset or closed early, a stalled
+// transfer, or a response with a status that says the server is at fault. An error
+// that DoRequest has already retried is not.
+func Temporary(err error) bool {
+	if retried(err) {
+		return false
+	}
+	for err != nil {
+		err = errors.Cause(err)
+		switch e := err.(type) {
+		case *StatusError:
+			return !e.retried && retryStatus(e.StatusCode)
+		case *RateLimitError:
+			return e.RetryAfter <= MaxRateLimitWait
+		case *url.Error:
+			if e.Timeout() {
+				return true
+			}
+			err = e.Err
+		case *net.OpError:
+			if e.Timeout() {
+				return true
+			}
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return true
+			}
+			switch err {
+			case ErrStalled,
+				io.EOF,
+				io.ErrUnexpectedEOF,
+				syscall.ECONNREFUSED,
+				syscall.ECONNRESET,
+				syscall.ECONNABORTED,
+				syscall.EPIPE:
+				return true
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// retryStatus is whether a request that failed with the status code may succeed if
+// it is sent again
+func retryStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Retry calls f until it succeeds, fails with an error that is not Temporary, or
+// has been retried Retries times. The failures are logged as those of what.
+func Retry(what string, f func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		if err = f(); err == nil || attempt >= Retries || !Temporary(err) {
+			return
+		}
+		var limit *RateLimitError
+		if e, ok := errors.Cause(err).(*RateLimitError); ok {
+			limit = e
+		}
+		delay := retryDelay(attempt, limit)
+		log.Warn().Err(err).Msgf("%s failed, retrying in %v.", what, delay)
+		_ = wait(context.Background(), delay)
+	}
+}
+
+// retryDelay is how long to wait before the retry after attempt, which is as long as
+// the registry asked if it rate limited the attempt
+func retryDelay(attempt int, limit *RateLimitError) time.Duration {
+	if limit != nil && limit.RetryAfter > 0 {
+		return limit.RetryAfter
+	}
+	return backoff(attempt)
+}
+
+// backoff is how long to wait before the retry after attempt, which is between
+// half and all of the exponentially increasing delay, so that clients that failed
+// together do not retry together
+func backoff(attempt int) time.Duration {
+	delay := maxRetryDelay
+	if attempt < 32 && RetryDelay<<uint(attempt) < maxRetryDelay {
+		delay = RetryDelay << uint(attempt)
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// retryRequest is whether the request, that got resp or failed with err, should be
+// sent again, which it may only be if its body can be
+func retryRequest(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return Temporary(err)
+	}
+	return retryStatus(resp.StatusCode)
+}
+
+// discard the rest of the body of the response so that its connection is reused
+func discard(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+	_ = resp.Body.Close()
+}
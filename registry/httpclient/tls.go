@@ -0,0 +1,235 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/pkg/homedir"
+	dregistry "github.com/docker/docker/registry"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// CertsDir is the directory with the TLS certificates of each registry, in a
+	// subdirectory named for its host and port, laid out as docker's certs.d: extra CA
+	// roots in *.crt files, and client certificates in *.cert files with their keys in
+	// *.key files of the same name
+	CertsDir = defaultCertsDir()
+
+	// CAFile is a PEM bundle of CA certificates that are trusted for every registry,
+	// as well as those of the system
+	CAFile string
+
+	// RegistryCAFiles are PEM bundles of CA certificates that are trusted for the
+	// registry at each host, as well as those of CAFile and the system
+	RegistryCAFiles = make(map[string]string)
+
+	// InsecureRegistries are the registries that may be reached over plain HTTP, or
+	// over TLS without verifying their certificates, given as hosts, with ports if
+	// they are not the default, or CIDRs of their addresses
+	InsecureRegistries []string
+)
+
+// defaultCertsDir is the certs.d of docker, which for a user other than root is
+// that of rootless docker if it exists
+func defaultCertsDir() string {
+	if os.Geteuid() == 0 {
+		return dregistry.CertsDir
+	}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		configHome = filepath.Join(homedir.Get(), ".config")
+	}
+
+	dir := filepath.Join(configHome, "docker", "certs.d")
+	if _, err := os.Stat(dir); err != nil {
+		return dregistry.CertsDir
+	}
+	return dir
+}
+
+// Insecure is whether the registry at host is one of InsecureRegistries, which as
+// for docker always include those on the loopback interface
+func Insecure(host string) (bool, error) {
+	service, err := dregistry.NewService(ServiceOptions())
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid insecure registries %v", InsecureRegistries)
+	}
+
+	config := service.ServiceConfig()
+	if index, ok := config.IndexConfigs[host]; ok {
+		return !index.Secure, nil
+	}
+
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+
+	addrs, err := net.LookupIP(hostname)
+	if err != nil {
+		if ip := net.ParseIP(hostname); ip != nil {
+			addrs = []net.IP{ip}
+		}
+	}
+
+	for _, addr := range addrs {
+		for _, cidr := range config.InsecureRegistryCIDRs {
+			if (*net.IPNet)(cidr).Contains(addr) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// ServiceOptions are the options of the registry service of docker, with the
+// insecure registries, to which the loopback addresses of IPv6 are added as docker
+// adds those of IPv4, so that a registry on localhost is insecure either way
+func ServiceOptions() dregistry.ServiceOptions {
+	return dregistry.ServiceOptions{
+		InsecureRegistries: append([]string{"::1/128"}, InsecureRegistries...),
+	}
+}
+
+// tlsTransport uses the TLS settings of the host of each request
+type tlsTransport struct {
+	sync.Mutex
+	transports map[string]http.RoundTripper
+}
+
+func (t *tlsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if Transport != nil {
+		return trace(Transport, req)
+	}
+
+	rt, err := t.transport(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	return trace(rt, req)
+}
+
+// transport is the transport for requests to the host of u. Transports are kept
+// so that their connections are used again, and the settings are part of their
+// keys so that they may be changed.
+func (t *tlsTransport) transport(u *url.URL) (_ http.RoundTripper, err error) {
+	settings := transportSettings()
+	key := "\x00" + settings
+	if u.Scheme == "https" {
+		key = fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%v\x00%s", u.Host, CertsDir, CAFile, RegistryCAFiles[u.Host], InsecureRegistries, settings)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if rt, ok := t.transports[key]; ok {
+		return rt, nil
+	}
+
+	if t.transports == nil {
+		t.transports = make(map[string]http.RoundTripper)
+	}
+
+	var tlsConfig *tls.Config
+	if u.Scheme == "https" {
+		if tlsConfig, err = hostTLSConfig(u.Host); err != nil {
+			return
+		}
+	}
+
+	// hosts with the default TLS settings share the transport of plain HTTP
+	var rt http.RoundTripper
+	if tlsConfig == nil {
+		plain := "\x00" + settings
+		if rt = t.transports[plain]; rt == nil {
+			rt = newTransport(nil)
+			t.transports[plain] = rt
+		}
+	} else {
+		rt = newTransport(tlsConfig)
+	}
+
+	t.transports[key] = rt
+	return rt, nil
+}
+
+// hostTLSConfig is the TLS config for the registry at host, which is nil if the
+// defaults are used
+func hostTLSConfig(host string) (_ *tls.Config, err error) {
+	insecure, err := Insecure(host)
+	if err != nil {
+		return
+	}
+
+	// client certificates are still presented to insecure registries
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if insecure {
+		log.Debug().Msgf("not verifying the certificate of the insecure registry %s", host)
+	}
+
+	for _, caFile := range []string{CAFile, RegistryCAFiles[host]} {
+		if caFile == "" {
+			continue
+		}
+
+		var pem []byte
+		if pem, err = ioutil.ReadFile(caFile); err != nil {
+			err = errors.Wrapf(err, "could not read CA certificates")
+			return
+		}
+
+		if tlsConfig.RootCAs == nil {
+			if tlsConfig.RootCAs, err = tlsconfig.SystemCertPool(); err != nil {
+				err = errors.Wrapf(err, "could not read the CA certificates of the system")
+				return
+			}
+		}
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			err = errors.Errorf("no CA certificates in %s", caFile)
+			return
+		}
+	}
+
+	if CertsDir != "" {
+		dir := filepath.Join(CertsDir, host)
+		if err = dregistry.ReadCertsDirectory(tlsConfig, dir); err != nil {
+			err = errors.Wrapf(err, "could not read certificates in %s", dir)
+			return
+		}
+		log.Debug().Msgf("using %d client certificates from %s", len(tlsConfig.Certificates), dir)
+	}
+
+	if !insecure && tlsConfig.RootCAs == nil && len(tlsConfig.Certificates) == 0 {
+		return nil, nil
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,165 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// DebugHTTP is whether every request to a registry is logged, with its status,
+	// how long it took, its headers and a request ID, which is also sent in the
+	// X-Request-ID header so that the request may be found in the logs of the registry
+	DebugHTTP = false
+	// UserAgent is the User-Agent of the requests to registries
+	UserAgent = "crypto-cli"
+)
+
+// redacted replaces the secrets of the requests that are logged
+const redacted = "REDACTED"
+
+// secretHeaders are the headers whose values are not logged
+var secretHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Registry-Auth",
+	// the session token of the temporary credentials that requests to ECR are signed with
+	"X-Amz-Security-Token",
+}
+
+// secretParams are the parts of the names of the query parameters whose values are
+// not logged, such as the signatures of the URLs of blobs in storage
+var secretParams = []string{"signature", "credential", "token", "sig", "key"}
+
+// secretDumpRE matches the lines of dumped requests and responses with secret headers
+var secretDumpRE = regexp.MustCompile(`(?im)^(` + strings.Join(secretHeaders, "|") + `):[^\r\n]*`)
+
+// trace sends req with rt, adding the User-Agent, and logs it if DebugHTTP is set
+func trace(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req = cloneHeader(req)
+		req.Header.Set("User-Agent", UserAgent)
+	}
+
+	if !DebugHTTP {
+		return rt.RoundTrip(req)
+	}
+
+	id := requestID()
+	req = cloneHeader(req)
+	req.Header.Set("X-Request-ID", id)
+
+	start := time.Now()
+	resp, err := rt.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	if err != nil {
+		log.Info().Msgf("HTTP %s %s %s failed after %v: %v %s",
+			id, req.Method, redactURL(req.URL).String(), elapsed, err, redactHeader(req.Header))
+		return nil, err
+	}
+
+	log.Info().Msgf("HTTP %s %s %s %s in %v %s",
+		id, req.Method, redactURL(req.URL).String(), resp.Status, elapsed, redactHeader(req.Header))
+	return resp, nil
+}
+
+// cloneHeader is a shallow copy of req with a copy of its header, as a RoundTripper
+// must not change the request it is given
+func cloneHeader(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	return r
+}
+
+// requestID generates an ID for a request
+func requestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "-"
+	}
+	return hex.EncodeToString(b)
+}
+
+// redactHeader formats h, with the values of its secret headers redacted
+func redactHeader(h http.Header) string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.Join(h[k], ", ")
+		for _, s := range secretHeaders {
+			if http.CanonicalHeaderKey(k) == s {
+				v = redacted
+			}
+		}
+		fields = append(fields, k+": "+v)
+	}
+	return "[" + strings.Join(fields, "; ") + "]"
+}
+
+// redactURL is u, with its user info and the values of its secret query
+// parameters redacted
+func redactURL(u *url.URL) *url.URL {
+	r := *u
+	if r.User != nil {
+		r.User = url.User(redacted)
+	}
+
+	q := r.Query()
+	changed := false
+	for k := range q {
+		for _, s := range secretParams {
+			if strings.Contains(strings.ToLower(k), s) {
+				q.Set(k, redacted)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		r.RawQuery = q.Encode()
+	}
+
+	return &r
+}
+
+// redactDump redacts the values of the secret headers of a dumped request or
+// response, and the secret query parameters of the request line of a request to u
+func redactDump(dump []byte, u *url.URL) []byte {
+	if u != nil {
+		dump = bytes.Replace(dump, []byte(u.RequestURI()), []byte(redactURL(u).RequestURI()), 1)
+	}
+	return secretDumpRE.ReplaceAll(dump, []byte("$1: "+redacted))
+}
@@ -0,0 +1,177 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	dauth "github.com/docker/distribution/registry/client/auth"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// PageSize is the number of tags or repositories that are asked for in each page of
+// a list, which registries may reduce
+var PageSize = 100
+
+// ListTags lists the tags of the repository of ref, following the pages of the list
+func ListTags(token dauth.Scope, ref reference.Named, bldr *v2.URLBuilder) (_ []string, err error) {
+	urlStr, err := bldr.BuildTagsURL(ref)
+	if err != nil {
+		err = errors.Wrapf(err, "ref = %v", ref)
+		return
+	}
+
+	return listPages(token, urlStr, "tags")
+}
+
+// ListRepositories lists the repositories of the registry with its catalog, following
+// the pages of the list. The token must have the scope registry:catalog:*.
+func ListRepositories(token dauth.Scope, bldr *v2.URLBuilder) (_ []string, err error) {
+	urlStr, err := bldr.BuildCatalogURL()
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	return listPages(token, urlStr, "repositories")
+}
+
+// listPages gets each page of the list at urlStr, the entries of which are under key.
+// The next page is that of the Link header of the last, as RFC 5988 describes, and
+// the list ends with the first page without one, however many entries it has.
+func listPages(token dauth.Scope, urlStr, key string) (list []string, err error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	q := u.Query()
+	q.Set("n", strconv.Itoa(PageSize))
+	u.RawQuery = q.Encode()
+
+	// registries that ignore n and last give the whole list again, which ends it
+	seen := make(map[string]bool)
+	for u != nil {
+		var page []string
+		var next *url.URL
+		if page, next, err = listPage(token, u, key); err != nil {
+			return
+		}
+
+		added := 0
+		for _, entry := range page {
+			if !seen[entry] {
+				seen[entry] = true
+				list = append(list, entry)
+				added++
+			}
+		}
+		if added == 0 {
+			break
+		}
+
+		u = next
+	}
+
+	log.Debug().Msgf("listed %d %s", len(list), key)
+	return
+}
+
+// listPage gets the page of the list at u, giving the URL of the next page if the
+// registry gives one
+func listPage(token dauth.Scope, u *url.URL, key string) (page []string, next *url.URL, err error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		err = errors.Wrapf(err, "GET %s", u)
+		return
+	}
+
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// a repository without tags, on some registries
+		return
+	default:
+		err = errors.Wrapf(httpclient.NewStatusError(resp), "listing %s failed", key)
+		return
+	}
+
+	var body map[string]json.RawMessage
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		err = errors.Wrapf(err, "could not decode the list of %s", key)
+		return
+	}
+	// the list is null for a repository without tags, on some registries
+	if entries, ok := body[key]; ok {
+		if err = json.Unmarshal(entries, &page); err != nil {
+			err = errors.Wrapf(err, "could not decode the list of %s", key)
+			return
+		}
+	}
+
+	if link := nextLink(resp.Header); link != "" {
+		if next, err = u.Parse(link); err != nil {
+			err = errors.Wrapf(err, "link = %s", link)
+		}
+	}
+	return
+}
+
+// linkRE matches a link of a Link header, capturing its URL and parameters
+var linkRE = regexp.MustCompile(`<([^>]*)>\s*((?:;\s*[^;,]+)*)`)
+
+// nextLink is the URL of the link with the relation next in the Link headers, if
+// there is one
+func nextLink(header http.Header) string {
+	for _, value := range header["Link"] {
+		for _, match := range linkRE.FindAllStringSubmatch(value, -1) {
+			for _, param := range strings.Split(match[2], ";") {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(kv[0], "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(kv[1], `"`)) {
+					if rel == "next" {
+						return match[1]
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
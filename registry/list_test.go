@@ -0,0 +1,98 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/registry"
+)
+
+// pagedList serves the list of tags of a repository in pages of at most max tags,
+// fewer than are asked for, with a Link header to the next page if link is set
+type pagedList struct {
+	t    *testing.T
+	tags []string
+	max  int
+	link bool
+	// queries are those of the requests, in order
+	queries []url.Values
+}
+
+func (l *pagedList) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	l.queries = append(l.queries, q)
+
+	n, err := strconv.Atoi(q.Get("n"))
+	if err != nil || n > l.max {
+		n = l.max
+	}
+	start := sort.SearchStrings(l.tags, q.Get("last"))
+	if q.Get("last") != "" {
+		start++
+	}
+	end := start + n
+	if end > len(l.tags) {
+		end = len(l.tags)
+	}
+
+	if l.link && end < len(l.tags) {
+		rw.Header().Set("Link", fmt.Sprintf(`</v2/repo/tags/list?n=%d&last=%s>; rel="next"`, n, l.tags[end-1]))
+	}
+	assert.NoError(l.t, json.NewEncoder(rw).Encode(map[string]interface{}{"name": "repo", "tags": l.tags[start:end]}))
+}
+
+func TestListTags(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(size int) { registry.PageSize = size }(registry.PageSize)
+	registry.PageSize = 3
+
+	tags := []string{"a", "b", "c", "d", "e", "f", "g"}
+
+	// the pages are followed by their links, for all that they are shorter than asked
+	list := &pagedList{t: t, tags: tags, max: 2, link: true}
+	server := httptest.NewServer(list)
+	defer server.Close()
+	ref, endpoint := testEndpoint(t, server, "repo:latest")
+
+	got, err := registry.ListTags(nil, ref, v2.NewURLBuilder(endpoint.URL, false))
+	require.NoError(err)
+	assert.Equal(tags, got)
+	if assert.Len(list.queries, 4) {
+		assert.Equal("3", list.queries[0].Get("n"))
+		assert.Equal("", list.queries[0].Get("last"))
+		assert.Equal("f", list.queries[3].Get("last"))
+	}
+
+	// and a page without a link ends the list, even if it is full
+	list.max, list.link, list.queries = 3, false, nil
+	got, err = registry.ListTags(nil, ref, v2.NewURLBuilder(endpoint.URL, false))
+	require.NoError(err)
+	assert.Equal(tags[:3], got)
+	assert.Len(list.queries, 1)
+}
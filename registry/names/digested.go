@@ -24,3 +24,22 @@ type digestedReference struct {
 func (r *digestedReference) Digest() digest.Digest {
 	return r.d
 }
+
+type digestedTaggedRepository struct {
+	taggedRepository
+	d digest.Digest
+}
+
+func (r *digestedTaggedRepository) String() (w string) {
+	if r.domain != "" {
+		w = r.domain + "/"
+	}
+	if r.path != "" {
+		w = w + r.path + "@" + r.d.String()
+	}
+	return w
+}
+
+func (r *digestedTaggedRepository) Digest() digest.Digest {
+	return r.d
+}
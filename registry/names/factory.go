@@ -47,9 +47,20 @@ func SeperateTaggedRepository(ref reference.NamedTagged) NamedTaggedRepository {
 }
 
 // CastToTagged converts a Named into a NamedTaggedRepository, choosing the
-// default "latest" tag if necessary
+// default "latest" tag if necessary. The digest of a canonical reference is kept,
+// and takes the place of the tag in its string form.
 func CastToTagged(ref reference.Named) (NamedTaggedRepository, error) {
 	switch r := ref.(type) {
+	case reference.Canonical:
+		sep := SeperateRepository(r)
+		tag := "latest"
+		if tagged, ok := r.(reference.Tagged); ok {
+			tag = tagged.Tag()
+		}
+		return &digestedTaggedRepository{
+			taggedRepository{tag, sep.Domain(), sep.Path()},
+			r.Digest(),
+		}, nil
 	case reference.NamedTagged:
 		return SeperateTaggedRepository(r), nil
 	default:
@@ -58,6 +69,20 @@ func CastToTagged(ref reference.Named) (NamedTaggedRepository, error) {
 	}
 }
 
+// ManifestReference converts a Named into the reference its manifest is found at
+// in a registry, which is its digest if it has one, rather than its tag
+func ManifestReference(ref reference.Named) reference.Named {
+	if d, ok := ref.(reference.Digested); ok {
+		return AppendDigest(SeperateRepository(ref), d.Digest())
+	}
+	return ref
+}
+
+// WithTag appends a tag to a named repository
+func WithTag(ref NamedRepository, tag string) NamedTaggedRepository {
+	return &taggedRepository{tag: tag, domain: ref.Domain(), path: ref.Path()}
+}
+
 // AppendDigest appends a digest to a named repository
 func AppendDigest(ref NamedRepository, d digest.Digest) reference.Canonical {
 	return &digestedReference{ref, d}
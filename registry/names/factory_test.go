@@ -152,6 +152,21 @@ func TestCastToTagged(t *testing.T) {
 	}
 }
 
+func TestWithTag(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	ref, err := reference.ParseNamed(fmt.Sprintf("%s/%s", domain, repo))
+	require.NoError(err)
+
+	tagged := names.WithTag(names.SeperateRepository(ref), tag)
+	assert.Equal(tagged.String(), fmt.Sprintf("%s/%s:%s", domain, repo, tag))
+	assert.Equal(tagged.Domain(), domain)
+	assert.Equal(tagged.Path(), repo)
+	assert.Equal(tagged.Name(), repo)
+	assert.Equal(tagged.Tag(), tag)
+}
+
 func TestAppendDigest(t *testing.T) {
 	assert := assert.New(t)
 	require := require.New(t)
@@ -167,3 +182,111 @@ func TestAppendDigest(t *testing.T) {
 	assert.Equal(dig.Name(), repo)
 	assert.Equal(dig.Digest(), d)
 }
+
+func TestCastToTaggedDigest(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	d := digest.Canonical.FromString("foobar")
+
+	ref1, err := reference.ParseNamed(fmt.Sprintf("%s/%s@%s", domain, repo, d))
+	require.NoError(err)
+	ref2, err := reference.ParseNamed(fmt.Sprintf("%s/%s:%s@%s", domain, repo, tag, d))
+	require.NoError(err)
+
+	tests := []struct {
+		ref reference.Named
+		tag string
+	}{
+		{ref1, defaultTag},
+		{ref2, tag},
+	}
+
+	for _, test := range tests {
+		cast, err := names.CastToTagged(test.ref)
+		require.NoError(err)
+		assert.Equal(fmt.Sprintf("%s/%s@%s", domain, repo, d), cast.String())
+		assert.Equal(repo, cast.Name())
+		assert.Equal(test.tag, cast.Tag())
+
+		digested, ok := cast.(reference.Digested)
+		require.True(ok)
+		assert.Equal(d, digested.Digest())
+	}
+}
+
+func TestManifestReference(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	d := digest.Canonical.FromString("foobar")
+
+	ref, err := reference.ParseNamed(fmt.Sprintf("%s/%s:%s@%s", domain, repo, tag, d))
+	require.NoError(err)
+	cast, err := names.CastToTagged(ref)
+	require.NoError(err)
+
+	mref := names.ManifestReference(cast)
+	_, tagged := mref.(reference.Tagged)
+	assert.False(tagged)
+	digested, ok := mref.(reference.Digested)
+	require.True(ok)
+	assert.Equal(d, digested.Digest())
+	assert.Equal(repo, mref.Name())
+
+	ref, err = reference.ParseNamed(fmt.Sprintf("%s/%s:%s", domain, repo, tag))
+	require.NoError(err)
+	assert.Equal(ref, names.ManifestReference(ref))
+}
+
+func TestParseNormalizedNamed(t *testing.T) {
+	assert := assert.New(t)
+
+	d := digest.FromString("manifest")
+
+	tests := []struct {
+		ref    string
+		domain string
+		path   string
+		tag    string
+		digest digest.Digest
+		errMsg string
+	}{
+		{ref: "localhost:5000/app:1.0", domain: "localhost:5000", path: "app", tag: "1.0"},
+		{ref: "127.0.0.1:5000/team/app", domain: "127.0.0.1:5000", path: "team/app"},
+		{ref: "registry:5000/app:1.0", domain: "registry:5000", path: "app", tag: "1.0"},
+		{ref: "alpine", domain: defaultDomain, path: "library/alpine"},
+		{ref: "[::1]:5000/app:1.0", domain: "[::1]:5000", path: "app", tag: "1.0"},
+		{ref: "[fd00::1]/team/app", domain: "[fd00::1]", path: "team/app"},
+		{ref: "[::1]:5000/app@" + d.String(), domain: "[::1]:5000", path: "app", digest: d},
+		{ref: "[::1]:5000/app:1.0@" + d.String(), domain: "[::1]:5000", path: "app", tag: "1.0", digest: d},
+		{ref: "[::1]:5000", errMsg: "could not parse [::1]:5000: a registry must be followed by a repository"},
+		{ref: "[registry]:5000/app", errMsg: "could not parse [registry]:5000/app: [registry]:5000 is not an IPv6 address"},
+	}
+
+	for _, test := range tests {
+		ref, err := names.ParseNormalizedNamed(test.ref)
+		if test.errMsg != "" {
+			assert.EqualError(err, test.errMsg)
+			continue
+		}
+		if !assert.NoError(err, test.ref) {
+			continue
+		}
+
+		assert.Equal(test.domain, reference.Domain(ref), test.ref)
+		assert.Equal(test.path, reference.Path(ref), test.ref)
+
+		if tagged, ok := ref.(reference.Tagged); ok {
+			assert.Equal(test.tag, tagged.Tag(), test.ref)
+		} else {
+			assert.Empty(test.tag, test.ref)
+		}
+
+		if digested, ok := ref.(reference.Digested); ok {
+			assert.Equal(test.digest, digested.Digest(), test.ref)
+		} else {
+			assert.Empty(test.digest, test.ref)
+		}
+	}
+}
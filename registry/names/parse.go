@@ -0,0 +1,71 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package names
+
+import (
+	"net"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// ParseNormalizedNamed parses a reference as reference.ParseNormalizedNamed does,
+// but also accepts the domain of a registry that is an IPv6 address in brackets,
+// with or without a port, such as [::1]:5000/app:1.0, which it does not
+func ParseNormalizedNamed(s string) (reference.Named, error) {
+	if !strings.HasPrefix(s, "[") {
+		named, err := reference.ParseNormalizedNamed(s)
+		return named, errors.WithStack(err)
+	}
+
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return nil, errors.Errorf("could not parse %s: a registry must be followed by a repository", s)
+	}
+	domain, remainder := s[:i], s[i+1:]
+
+	host := domain
+	if h, port, err := net.SplitHostPort(domain); err == nil && port != "" {
+		host = "[" + h + "]"
+	}
+	if !strings.HasSuffix(host, "]") || net.ParseIP(host[1:len(host)-1]) == nil {
+		return nil, errors.Errorf("could not parse %s: %s is not an IPv6 address", s, domain)
+	}
+
+	// the rest is parsed with a domain that is valid in its place
+	named, err := reference.ParseNamed("localhost/" + remainder)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse %s", s)
+	}
+
+	repo := &repository{domain: domain, path: reference.Path(named)}
+	tagged, isTagged := named.(reference.Tagged)
+	digested, isDigested := named.(reference.Digested)
+
+	switch {
+	case isTagged && isDigested:
+		return &digestedTaggedRepository{
+			taggedRepository{tagged.Tag(), repo.domain, repo.path},
+			digested.Digest(),
+		}, nil
+	case isTagged:
+		return WithTag(repo, tagged.Tag()), nil
+	case isDigested:
+		return AppendDigest(repo, digested.Digest()), nil
+	default:
+		return repo, nil
+	}
+}
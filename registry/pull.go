@@ -17,10 +17,16 @@ package registry
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -38,7 +44,6 @@ import (
 	"github.com/Senetas/crypto-cli/registry/httpclient"
 	"github.com/Senetas/crypto-cli/registry/names"
 	"github.com/Senetas/crypto-cli/utils"
-	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
 // PullImage pulls an image from a remote repository
@@ -51,64 +56,179 @@ func PullImage(
 ) (manifest *distribution.ImageManifest, err error) {
 	bldr := v2.NewURLBuilder(endpoint.URL, false)
 
-	manifest, err = PullManifest(token, ref, bldr, downloadDir)
+	if manifest, err = PullKeys(token, ref, bldr, opts, downloadDir); err != nil {
+		return
+	}
+
+	err = PullBlobs(token, ref, manifest, bldr, downloadDir)
+	return
+}
+
+// PullKeys pulls the manifest of an image, and the key envelope of its keys if they
+// are detached, and decrypts the keys of its blobs, without pulling the blobs
+func PullKeys(
+	token dauth.Scope,
+	ref names.NamedTaggedRepository,
+	bldr *v2.URLBuilder,
+	opts *crypto.Opts,
+	downloadDir string,
+) (manifest *distribution.ImageManifest, err error) {
+	manifest, err = PullManifest(token, names.ManifestReference(ref), bldr, downloadDir)
 	if err != nil {
 		return nil, err
 	}
 	log.Info().Msg("Manifest obtained.")
 
-	if err = manifest.DecryptKeys(ref, opts); err != nil {
+	if err = attachKeyEnvelope(token, ref, manifest, bldr, downloadDir); err != nil {
 		return
 	}
 
-	// validate manifest to prevent local file injections
-	if err = manifest.Config.GetDigest().Validate(); err != nil {
-		return
-	}
+	err = manifest.DecryptKeys(ref, opts)
+	return
+}
 
-	log.Info().Msgf("Downloading config: %s.", manifest.Config.GetDigest())
-	filename, err := PullFromDigest(
-		token,
-		ref,
-		manifest.Config.GetDigest(),
-		bldr,
-		downloadDir,
-	)
-	if err != nil {
-		return
-	}
-	manifest.Config.SetFilename(filename)
+// MaxConcurrentDownloads is the most blobs of an image that are downloaded at once
+var MaxConcurrentDownloads = 3
+
+// PullBlobs downloads the config and layers of a manifest to downloadDir concurrently,
+// at most MaxConcurrentDownloads at a time, setting the filename of each blob
+func PullBlobs(
+	token dauth.Scope,
+	ref reference.Named,
+	manifest *distribution.ImageManifest,
+	bldr *v2.URLBuilder,
+	downloadDir string,
+) (err error) {
+	return PullBlobsThen(token, ref, manifest, bldr, downloadDir, nil)
+}
 
-	log.Info().Msg("Downloading layers:")
-	for _, l := range manifest.Layers {
+// PullBlobsThen downloads the blobs of a manifest like PullBlobs, and if then is not
+// nil calls it with the digest of each blob and the file it was downloaded to as
+// soon as it has been, while the others are still being downloaded, so that each
+// may be processed without waiting for the rest. Each distinct blob is passed to
+// then once, and the download fails if then does.
+func PullBlobsThen(
+	token dauth.Scope,
+	ref reference.Named,
+	manifest *distribution.ImageManifest,
+	bldr *v2.URLBuilder,
+	downloadDir string,
+	then func(d digest.Digest, filename string) error,
+) (err error) {
+	blobs := append([]distribution.Blob{manifest.Config}, manifest.LayerBlobs()...)
+
+	var total int64
+	unique := make([]distribution.Blob, 0, len(blobs))
+	seen := make(map[digest.Digest]bool)
+	for _, b := range blobs {
 		// validate manifest to prevent local file injections
-		if err = l.GetDigest().Validate(); err != nil {
+		if err = b.GetDigest().Validate(); err != nil {
 			return
 		}
 
-		log.Info().Msgf("Downloading: %s.", l.GetDigest())
-		filename, err = PullFromDigest(
-			token,
-			ref,
-			l.GetDigest(),
-			bldr,
-			downloadDir,
-		)
-		if err != nil {
-			return
+		// identical layers share a blob, which need only be downloaded once
+		if seen[b.GetDigest()] {
+			continue
 		}
-		l.SetFilename(filename)
+		seen[b.GetDigest()] = true
+		unique = append(unique, b)
+		total += b.GetSize()
+	}
+
+	log.Info().Msgf("Downloading config and %d layers.", len(unique)-1)
+	g := utils.StartProgressGroup(utils.ProgressDownload, ref.String(), total)
+	defer g.Done()
+
+	n := MaxConcurrentDownloads
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	errCh := make(chan error)
+
+	var mu sync.Mutex
+	downloaded := make(map[digest.Digest]string)
+	for _, b := range unique {
+		go func(d digest.Digest, size int64) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			log.Info().Msgf("Downloading: %s.", d)
+			p := g.Start(d.String(), size)
+			defer p.Done()
+			filename, err := pullBlob(token, ref, d, bldr, downloadDir, p)
+			if err == nil {
+				mu.Lock()
+				downloaded[d] = filename
+				mu.Unlock()
+				if then != nil {
+					err = then(d, filename)
+				}
+			}
+			errCh <- err
+		}(b.GetDigest(), b.GetSize())
+	}
+
+	if err = utils.ConcatErrChan(errCh, len(unique)); err != nil {
+		return
+	}
+
+	for _, b := range blobs {
+		b.SetFilename(downloaded[b.GetDigest()])
 	}
 
 	return
 }
 
+// attachKeyEnvelope looks for keys stored in a referrer of a manifest that carries
+// no keys of its own, and attaches them to the manifest if they are found
+func attachKeyEnvelope(
+	token dauth.Scope,
+	ref reference.Named,
+	manifest *distribution.ImageManifest,
+	bldr *v2.URLBuilder,
+	dir string,
+) error {
+	if manifest.Encrypted() {
+		return nil
+	}
+
+	envelope, err := PullKeyEnvelope(token, ref, manifest.Digest, bldr, dir)
+	if err != nil || envelope == nil {
+		return err
+	}
+
+	log.Info().Msg("Keys obtained.")
+	return manifest.AttachKeys(envelope)
+}
+
 // PullManifest pulls a manifest from the registry and parses it
 func PullManifest(
 	token dauth.Scope,
 	ref reference.Named,
 	bldr *v2.URLBuilder,
 	dir string,
+) (*distribution.ImageManifest, error) {
+	return pullManifest(token, ref, bldr, dir, false)
+}
+
+// PullExistingManifest pulls a manifest like PullManifest, but returns nil rather
+// than an error if the registry has no manifest for ref
+func PullExistingManifest(
+	token dauth.Scope,
+	ref reference.Named,
+	bldr *v2.URLBuilder,
+	dir string,
+) (*distribution.ImageManifest, error) {
+	return pullManifest(token, ref, bldr, dir, true)
+}
+
+func pullManifest(
+	token dauth.Scope,
+	ref reference.Named,
+	bldr *v2.URLBuilder,
+	dir string,
+	mayBeMissing bool,
 ) (_ *distribution.ImageManifest, err error) {
 	urlStr, err := bldr.BuildManifestURL(ref)
 	if err != nil {
@@ -120,9 +240,8 @@ func PullManifest(
 		return nil, errors.Wrapf(err, "GET %s", urlStr)
 	}
 
-	// TODO: Handle list manifests
-	req.Header.Set("Accept", distribution.MediaTypeManifest)
-	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	// the body is decompressed by the transport, so that its digest is verified
+	acceptManifests(req)
 	auth.AddToRequest(token, req)
 
 	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
@@ -133,12 +252,48 @@ func PullManifest(
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("manifest download failed with status: " + resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusNotFound && mayBeMissing:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.Wrap(httpclient.NewStatusError(resp), "manifest download failed")
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	d, err := verifyManifest(ref, resp, body)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, err := manifestMediaType(ref, resp, body)
+	if err != nil {
+		return nil, err
 	}
 
-	manifest := &distribution.ImageManifest{DirName: dir}
-	if err = json.NewDecoder(resp.Body).Decode(manifest); err != nil {
+	switch {
+	case mediaType == distribution.MediaTypeManifest, mediaType == distribution.MediaTypeOCIManifest:
+	case distribution.IsIndex(mediaType):
+		// the image of the platform is pulled from an index of several
+		index := distribution.NewIndex()
+		if err = json.Unmarshal(body, index); err != nil {
+			return nil, errors.Wrapf(err, "index of %s", ref)
+		}
+		desc, err := platformManifest(ref, index)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Msgf("Pulling %s from the index of %s.", desc.Platform, ref)
+		return pullManifest(token, names.AppendDigest(names.SeperateRepository(ref), desc.Digest), bldr, dir, false)
+	default:
+		return nil, errors.Errorf("the manifest of %s is of the unsupported media type %s", ref, mediaType)
+	}
+
+	manifest := &distribution.ImageManifest{DirName: dir, Digest: d}
+	if err = json.Unmarshal(body, manifest); err != nil {
 		return nil, errors.WithStack(err)
 	}
 
@@ -147,10 +302,148 @@ func PullManifest(
 	return manifest, nil
 }
 
+// acceptManifests makes req accept the manifests of images and of indexes
+func acceptManifests(req *http.Request) {
+	req.Header.Set("Accept", strings.Join(distribution.ManifestMediaTypes, ", "))
+}
+
+// manifestMediaType is the media type of the manifest body of ref, which is read
+// from the body if the registry does not give it
+func manifestMediaType(ref reference.Named, resp *http.Response, body []byte) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err == nil && mediaType != "application/json" && mediaType != "text/plain" {
+		return mediaType, nil
+	}
+
+	var typed struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err = json.Unmarshal(body, &typed); err != nil {
+		return "", errors.Wrapf(err, "manifest of %s", ref)
+	}
+	if typed.MediaType == "" {
+		// an OCI manifest need not say its media type
+		return distribution.MediaTypeOCIManifest, nil
+	}
+	return typed.MediaType, nil
+}
+
+// Platform is the platform whose image is pulled from an index of several,
+// which is linux on the architecture of this machine by default
+var Platform = &distribution.Platform{OS: "linux", Architecture: runtime.GOARCH}
+
+// platformManifest is the descriptor of the manifest in the index of ref of the
+// image for Platform
+func platformManifest(ref reference.Named, index *distribution.Index) (*distribution.Descriptor, error) {
+	var platforms []string
+	for i, m := range index.Manifests {
+		if m.Platform == nil {
+			continue
+		}
+		if m.Platform.Matches(Platform) {
+			return &index.Manifests[i], nil
+		}
+		platforms = append(platforms, m.Platform.String())
+	}
+	return nil, errors.Errorf(
+		"the index of %s has no image for %s, only for: %s",
+		ref, Platform, strings.Join(platforms, ", "),
+	)
+}
+
+// ResolveManifest obtains the descriptor of the manifest that ref refers to
+func ResolveManifest(
+	token dauth.Scope,
+	ref reference.Named,
+	bldr *v2.URLBuilder,
+) (_ *distribution.Descriptor, err error) {
+	urlStr, err := bldr.BuildManifestURL(ref)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ref = %v", ref)
+	}
+
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "GET %s", urlStr)
+	}
+
+	acceptManifests(req)
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, false)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Wrap(httpclient.NewStatusError(resp), "manifest download failed")
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	d, err := verifyManifest(ref, resp, body)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, err := manifestMediaType(ref, resp, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &distribution.Descriptor{
+		MediaType: mediaType,
+		Digest:    d,
+		Size:      int64(len(body)),
+	}, nil
+}
+
+// verifyManifest verifies the body of the manifest that ref refers to against the
+// Docker-Content-Digest header of the response, if the registry sent one, and the
+// digest of ref, if it has one, each with its own algorithm, so that nothing is
+// decrypted from a manifest that a registry or proxy has altered. It gives the
+// canonical digest of the body.
+func verifyManifest(ref reference.Named, resp *http.Response, body []byte) (_ digest.Digest, err error) {
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" {
+		d, err := digest.Parse(header)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid Docker-Content-Digest %q", header)
+		}
+		if err = verifyDigest(d, body); err != nil {
+			return "", errors.Wrapf(err, "Docker-Content-Digest of %s", ref)
+		}
+	}
+
+	if digested, ok := ref.(reference.Digested); ok {
+		if err = verifyDigest(digested.Digest(), body); err != nil {
+			return "", errors.Wrapf(err, "manifest of %s", ref)
+		}
+	}
+
+	return digest.Canonical.FromBytes(body), nil
+}
+
+// verifyDigest verifies that d is the digest of b
+func verifyDigest(d digest.Digest, b []byte) error {
+	if !d.Algorithm().Available() {
+		return errors.Errorf("the algorithm of %s is not supported", d)
+	}
+	if actual := d.Algorithm().FromBytes(b); actual != d {
+		return errors.Errorf("manifest digest %s does not match %s", actual, d)
+	}
+	return nil
+}
+
 // PullFromDigest downloads a blob (refereced by its digest) from the registry to a temporary file.
 // It verifies that the downloaded file matches its digest, deleting if it does not. While the
 // digest is used to name the file, it is first verified to be a valid digest, so this cannot lead
-// to a file inclusion vulrenability.
+// to a file inclusion vulrenability. A download that fails transiently is started again.
 func PullFromDigest(
 	token dauth.Scope,
 	ref reference.Named,
@@ -158,22 +451,80 @@ func PullFromDigest(
 	bldr *v2.URLBuilder,
 	dir string,
 ) (fn string, err error) {
+	return pullBlob(token, ref, d, bldr, dir, nil)
+}
+
+// errRangeMismatch is the error of a download that the registry resumed from
+// another byte than the one after what was received
+var errRangeMismatch = errors.New("the download was resumed from the wrong byte")
+
+// pullBlob downloads a blob, reporting its progress to p, or to its own progress
+// if p is nil. A download that breaks is resumed from what was received of it.
+func pullBlob(
+	token dauth.Scope,
+	ref reference.Named,
+	d digest.Digest,
+	bldr *v2.URLBuilder,
+	dir string,
+	p utils.Progress,
+) (fn string, err error) {
+	var bp *blobProgress
+	if p != nil {
+		bp = &blobProgress{Progress: p}
+	}
+
+	fn = filepath.Join(dir, d.Encoded())
+	pb := newPartialBlob(fn, d)
+
+	err = httpclient.Retry("Download of blob "+d.String(), func() (err error) {
+		if bp != nil {
+			// what was received of an attempt that failed is kept
+			bp.reset(pb.received)
+		}
+		err = pullFromDigest(token, ref, d, bldr, pb, bp)
+		cause := errors.Cause(err)
+		if e, ok := cause.(*httpclient.StatusError); ok &&
+			e.StatusCode == http.StatusRequestedRangeNotSatisfiable || cause == errRangeMismatch {
+			// the registry cannot resume from what was received, so all of it is received again
+			log.Debug().Msgf("Download of blob %s could not be resumed from byte %d.", d, pb.received)
+			pb.restart()
+			if bp != nil {
+				bp.reset(0)
+			}
+			err = pullFromDigest(token, ref, d, bldr, pb, bp)
+		}
+		return
+	})
+	return
+}
+
+func pullFromDigest(
+	token dauth.Scope,
+	ref reference.Named,
+	d digest.Digest,
+	bldr *v2.URLBuilder,
+	pb *partialBlob,
+	bp *blobProgress,
+) (err error) {
 	sep := names.SeperateRepository(ref)
 	can := names.AppendDigest(sep, d)
-	fn = filepath.Join(dir, d.Encoded())
 
 	urlStr, err := bldr.BuildBlobURL(can)
 	if err != nil {
-		return "", errors.Wrapf(err, "%#v", ref)
+		return errors.Wrapf(err, "%#v", ref)
 	}
 
 	req, err := http.NewRequest("GET", urlStr, nil)
 	if err != nil {
-		return "", errors.Wrapf(err, "GET %s", urlStr)
+		return errors.Wrapf(err, "GET %s", urlStr)
 	}
 
+	// the blob is not compressed in transit, so that ranges are of its own bytes
 	req.Header.Set("Accept", distribution.MediaTypeLayer)
-	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	req.Header.Set("Accept-Encoding", "identity")
+	if pb.received > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", pb.received))
+	}
 	auth.AddToRequest(token, req)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -185,7 +536,7 @@ func PullFromDigest(
 	// timeout
 	timer := time.AfterFunc(100*time.Second, cancel)
 
-	go download(ctx, req, timer, dir, fn, d, errCh)
+	go download(ctx, req, timer, d, pb, bp, errCh)
 
 	select {
 	case <-ctx.Done():
@@ -194,7 +545,9 @@ func PullFromDigest(
 	default:
 	}
 
-	err = <-errCh
+	if err = <-errCh; err != nil && ctx.Err() != nil {
+		err = errors.Wrapf(httpclient.ErrStalled, "download of blob %s", d)
+	}
 	return
 }
 
@@ -203,14 +556,15 @@ func download(
 	ctx context.Context,
 	req *http.Request,
 	timer *time.Timer,
-	dir, fn string,
 	d digest.Digest,
+	pb *partialBlob,
+	bp *blobProgress,
 	errCh chan<- error,
 ) {
 	var err error
 	defer func() { errCh <- err }()
 
-	resp, err := httpclient.DoRequest(&http.Client{}, req, true, false)
+	resp, err := httpclient.DoRequest(httpclient.TransferClient, req, true, false)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
@@ -218,19 +572,44 @@ func download(
 		return
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err = errors.Errorf("Failed to download blob %s", fn)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && pb.received > 0:
+		if !pb.resumes(resp) {
+			err = errors.Wrapf(errRangeMismatch, "download of blob %s resumed with Content-Range %q rather than from byte %d",
+				d, resp.Header.Get("Content-Range"), pb.received)
+			pb.restart()
+			return
+		}
+		log.Info().Msgf("Resuming download of blob %s from byte %d.", d, pb.received)
+	case resp.StatusCode == http.StatusOK:
+		// the whole blob is sent by a registry that ignores ranges
+		pb.restart()
+		if bp != nil {
+			bp.reset(0)
+		}
+	default:
+		err = errors.Wrapf(httpclient.NewStatusError(resp), "Failed to download blob %s", pb.fn)
 		return
 	}
 
-	fh, err := os.Create(fn)
+	fh, err := pb.open()
 	if err != nil {
-		err = errors.Wrapf(err, "filename = %s", fn)
 		return
 	}
 	defer func() { err = utils.CheckedClose(fh, err) }()
 
-	err = processResp(resp, d, fn, fh, timer)
+	var p utils.Progress = bp
+	if bp == nil {
+		total := resp.ContentLength
+		if total >= 0 {
+			total += pb.received
+		}
+		p = utils.StartProgress(utils.ProgressDownload, d.String(), total)
+		p.Add(pb.received)
+		defer p.Done()
+	}
+
+	err = processResp(resp, d, pb, fh, timer, p)
 }
 
 // processResp handles the response to the request to download a blob
@@ -239,15 +618,12 @@ func download(
 func processResp(
 	resp *http.Response,
 	d digest.Digest,
-	fn string,
+	pb *partialBlob,
 	fh io.WriteCloser,
 	timer *time.Timer,
+	p utils.Progress,
 ) (err error) {
-	bar := pb.New(int(resp.ContentLength)).SetUnits(pb.U_BYTES)
-	vw := d.Verifier()
-	mw := io.MultiWriter(vw, fh, bar)
-
-	bar.Start()
+	mw := &utils.ProgressWriter{Writer: pb.writer(fh), Progress: p}
 
 	// reset timeout everytime 1 KiB is downloaded
 	for {
@@ -256,20 +632,81 @@ func processResp(
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			err = errors.Wrapf(err, "filename = %s", fn)
+			err = errors.Wrapf(err, "filename = %s", pb.fn)
 			return
 		}
 	}
 
-	bar.Finish()
-
-	if !vw.Verified() {
-		return quitUnVerified(fn, fh, err)
+	if pb.digester.Digest() != d {
+		// a download that is tried again starts from the beginning
+		pb.restart()
+		return quitUnVerified(pb.fn, fh, err)
 	}
 
 	return nil
 }
 
+// partialBlob is what has been received of a blob by the attempts to download it,
+// which is hashed as it is received, so that an attempt that breaks is resumed
+// from where it broke rather than started again
+type partialBlob struct {
+	fn       string
+	alg      digest.Algorithm
+	digester digest.Digester
+	received int64
+}
+
+func newPartialBlob(fn string, d digest.Digest) *partialBlob {
+	return &partialBlob{fn: fn, alg: d.Algorithm(), digester: d.Algorithm().Digester()}
+}
+
+// restart discards what has been received
+func (pb *partialBlob) restart() {
+	pb.digester = pb.alg.Digester()
+	pb.received = 0
+}
+
+// resumes is whether the partial content of resp is the rest of the blob
+func (pb *partialBlob) resumes(resp *http.Response) bool {
+	var first int64
+	_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &first)
+	return err == nil && first == pb.received
+}
+
+// open opens the file that the blob is written to, with what was received of it
+func (pb *partialBlob) open() (_ *os.File, err error) {
+	fh, err := os.OpenFile(pb.fn, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "filename = %s", pb.fn)
+	}
+
+	// anything written after what was received was not hashed
+	if err = fh.Truncate(pb.received); err == nil {
+		_, err = fh.Seek(pb.received, io.SeekStart)
+	}
+	if err != nil {
+		return nil, utils.CheckedClose(fh, errors.Wrapf(err, "filename = %s", pb.fn))
+	}
+	return fh, nil
+}
+
+// writer writes what is received to w, hashing and counting what is written
+func (pb *partialBlob) writer(w io.Writer) io.Writer {
+	return &partialWriter{Writer: w, pb: pb}
+}
+
+type partialWriter struct {
+	io.Writer
+	pb *partialBlob
+}
+
+func (w *partialWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	w.pb.digester.Hash().Write(p[:n])
+	w.pb.received += int64(n)
+	return
+}
+
 // quitUnVerified cleans up downloaded files in the case that the digest does
 // not match the download
 func quitUnVerified(fn string, fh io.Closer, err error) error {
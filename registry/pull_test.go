@@ -0,0 +1,390 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry_test
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+func TestPullBlobsThen(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	config, first, second := []byte(`{"os":"linux"}`), []byte("first layer"), []byte("second layer")
+	blobs := map[digest.Digest][]byte{}
+	for _, b := range [][]byte{config, first, second} {
+		blobs[digest.Canonical.FromBytes(b)] = b
+	}
+
+	// the second layer is only sent once the first has been handed on, which it
+	// is only before every download ends if each is handed on as soon as it ends
+	handed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		d := digest.Digest(strings.TrimPrefix(req.URL.Path, "/v2/repo/blobs/"))
+		data, ok := blobs[d]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if d == digest.Canonical.FromBytes(second) {
+			select {
+			case <-handed:
+			case <-time.After(5 * time.Second):
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		_, err := rw.Write(data)
+		assert.NoError(err)
+	}))
+	defer server.Close()
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	manifest := &distribution.ImageManifest{
+		Config: distribution.NewPlainConfig("", digest.Canonical.FromBytes(config), int64(len(config))),
+		Layers: []distribution.Blob{
+			distribution.NewPlainLayer("", digest.Canonical.FromBytes(first), int64(len(first))),
+			distribution.NewPlainLayer("", digest.Canonical.FromBytes(second), int64(len(second))),
+			distribution.NewPlainLayer("", digest.Canonical.FromBytes(first), int64(len(first))),
+		},
+	}
+
+	var mu sync.Mutex
+	got := map[digest.Digest]int{}
+	ref, endpoint := testEndpoint(t, server, "repo:latest")
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+	err := registry.PullBlobsThen(nil, ref, manifest, bldr, dir, func(d digest.Digest, filename string) error {
+		data, err := ioutil.ReadFile(filename)
+		require.NoError(err)
+		assert.Equal(blobs[d], data)
+
+		mu.Lock()
+		got[d]++
+		mu.Unlock()
+		if d == digest.Canonical.FromBytes(first) {
+			close(handed)
+		}
+		return nil
+	})
+	require.NoError(err)
+
+	// each distinct blob is handed on once, and every blob has its file
+	assert.Len(got, 3)
+	for d, n := range got {
+		assert.Equal(1, n, "%s", d)
+	}
+	for _, b := range append(manifest.Layers, manifest.Config) {
+		assert.NotEmpty(b.GetFilename())
+	}
+}
+
+func TestPullBlobsConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(n int) { registry.MaxConcurrentDownloads = n }(registry.MaxConcurrentDownloads)
+
+	r := newFakeRegistry(t)
+	config := r.putBlob("repo", []byte(`{"os":"linux"}`))
+	manifest := &distribution.ImageManifest{Config: distribution.NewPlainConfig("", config, 14)}
+	for i := 0; i < 7; i++ {
+		data := []byte(fmt.Sprintf("layer %d", i))
+		manifest.Layers = append(manifest.Layers, distribution.NewPlainLayer("", r.putBlob("repo", data), int64(len(data))))
+	}
+
+	// no more blobs are downloaded at once than the limit, which is reached, and a
+	// limit of less than one downloads them one at a time
+	for _, test := range []struct{ limit, max int }{{1, 1}, {3, 3}, {0, 1}} {
+		registry.MaxConcurrentDownloads = test.limit
+		downloads := &inFlight{Handler: r, method: "GET", prefix: "/v2/repo/blobs/"}
+		server := httptest.NewServer(downloads)
+
+		dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+		require.NoError(os.MkdirAll(dir, 0700))
+
+		ref, endpoint := taggedEndpoint(t, server, "repo:latest")
+		err := registry.PullBlobs(nil, ref, manifest, v2.NewURLBuilder(endpoint.URL, false), dir)
+		server.Close()
+		assert.NoError(err, "%d", test.limit)
+		assert.Equal(test.max, downloads.max, "%d", test.limit)
+		assert.NoError(utils.CleanUp(dir, nil))
+	}
+	assert.Equal(3*8, r.count("GET", "/v2/repo/blobs/"))
+}
+
+func TestPullManifestVerify(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	body := []byte(`{"schemaVersion":2,"mediaType":"` + distribution.MediaTypeManifest + `",` +
+		`"config":{"mediaType":"application/vnd.docker.container.image.v1+json","size":14,` +
+		`"digest":"` + digest.Canonical.FromString(`{"os":"linux"}`).String() + `"},"layers":[]}`)
+	tampered := append([]byte(" "), body...)
+	d := digest.Canonical.FromBytes(body)
+
+	tests := []struct {
+		name   string
+		body   []byte
+		header string
+		pinned bool
+		ok     bool
+	}{
+		{name: "matching header", body: body, header: d.String(), ok: true},
+		{name: "missing header", body: body, ok: true},
+		{name: "missing header, pinned", body: body, pinned: true, ok: true},
+		{name: "tampered body", body: tampered, header: d.String()},
+		{name: "tampered body, pinned", body: tampered, pinned: true},
+		{name: "mismatched header", body: body, header: digest.Canonical.FromString("other").String()},
+		{name: "mismatched header, pinned", body: body, header: digest.Canonical.FromString("other").String(), pinned: true},
+		{name: "invalid header", body: body, header: "sha256:invalid"},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if test.header != "" {
+				rw.Header().Set("Docker-Content-Digest", test.header)
+			}
+			rw.Header().Set("Content-Type", distribution.MediaTypeManifest)
+			_, err := rw.Write(test.body)
+			assert.NoError(err)
+		}))
+
+		named, endpoint := testEndpoint(t, server, "repo:latest")
+		ref := reference.Named(named)
+		if test.pinned {
+			var err error
+			ref, err = reference.WithDigest(reference.TrimNamed(named), d)
+			require.NoError(err)
+		}
+
+		manifest, err := registry.PullManifest(nil, ref, v2.NewURLBuilder(endpoint.URL, false), os.TempDir())
+		if test.ok {
+			if assert.NoError(err, test.name) {
+				assert.Equal(d, manifest.Digest, test.name)
+			}
+		} else {
+			assert.Error(err, test.name)
+		}
+		server.Close()
+	}
+}
+
+func TestPullManifestNegotiate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(platform *distribution.Platform) { registry.Platform = platform }(registry.Platform)
+	registry.Platform = &distribution.Platform{OS: "linux", Architecture: "amd64"}
+
+	config := digest.Canonical.FromString(`{"os":"linux"}`)
+	image := func(mediaType, configType, arch string) []byte {
+		return []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"config":{"mediaType":%q,"size":14,"digest":%q},`+
+			`"layers":[],"annotations":{"arch":%q}}`, mediaType, configType, config, arch))
+	}
+	index := func(mediaType, imageType string, manifests ...[]byte) []byte {
+		var descs []string
+		for i, arch := range []string{"arm64", "amd64"} {
+			descs = append(descs, fmt.Sprintf(`{"mediaType":%q,"size":%d,"digest":%q,"platform":{"architecture":%q,"os":"linux"}}`,
+				imageType, len(manifests[i]), digest.Canonical.FromBytes(manifests[i]), arch))
+		}
+		return []byte(fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[%s]}`, mediaType, strings.Join(descs, ",")))
+	}
+
+	oci := image(distribution.MediaTypeOCIManifest, distribution.MediaTypeOCIConfig, "amd64")
+	ociArm := image(distribution.MediaTypeOCIManifest, distribution.MediaTypeOCIConfig, "arm64")
+	docker := image(distribution.MediaTypeManifest, distribution.MediaTypeImageConfig, "amd64")
+	dockerArm := image(distribution.MediaTypeManifest, distribution.MediaTypeImageConfig, "arm64")
+
+	// each server has only the manifests of one of OCI and Docker v2 schema 2, and
+	// only serves those of the types that are accepted
+	ociOnly := newFakeRegistry(t)
+	ociOnly.putManifest("repo", distribution.MediaTypeOCIManifest, oci, "image")
+	ociOnly.putManifest("repo", distribution.MediaTypeOCIManifest, ociArm)
+	ociOnly.putManifest("repo", distribution.MediaTypeOCIIndex, index(distribution.MediaTypeOCIIndex, distribution.MediaTypeOCIManifest, ociArm, oci), "index")
+	dockerOnly := newFakeRegistry(t)
+	dockerOnly.putManifest("repo", distribution.MediaTypeManifest, docker, "image")
+	dockerOnly.putManifest("repo", distribution.MediaTypeManifest, dockerArm)
+	dockerOnly.putManifest("repo", distribution.MediaTypeManifestList, index(distribution.MediaTypeManifestList, distribution.MediaTypeManifest, dockerArm, docker), "index")
+	dockerOnly.putManifest("repo", "application/vnd.docker.distribution.manifest.v1+prettyjws", []byte(`{"schemaVersion":1}`), "schema1")
+
+	tests := []struct {
+		name string
+		r    *fakeRegistry
+		tag  string
+		// want is the body of the manifest that is pulled, if it is
+		want      []byte
+		mediaType string
+	}{
+		{name: "oci manifest", r: ociOnly, tag: "image", want: oci, mediaType: distribution.MediaTypeOCIManifest},
+		{name: "oci index", r: ociOnly, tag: "index", want: oci, mediaType: distribution.MediaTypeOCIManifest},
+		{name: "docker manifest", r: dockerOnly, tag: "image", want: docker, mediaType: distribution.MediaTypeManifest},
+		{name: "docker manifest list", r: dockerOnly, tag: "index", want: docker, mediaType: distribution.MediaTypeManifest},
+		{name: "schema 1", r: dockerOnly, tag: "schema1"},
+	}
+
+	for _, test := range tests {
+		var accepts []string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			accept := req.Header.Get("Accept")
+			accepts = append(accepts, accept)
+
+			path := strings.TrimPrefix(req.URL.Path, "/v2/repo/manifests/")
+			if m, ok := test.r.manifest("repo", path); ok && !strings.Contains(accept, m.mediaType) {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			test.r.ServeHTTP(rw, req)
+		}))
+
+		ref, endpoint := taggedEndpoint(t, server, "repo:"+test.tag)
+		manifest, err := registry.PullManifest(nil, ref, v2.NewURLBuilder(endpoint.URL, false), os.TempDir())
+		server.Close()
+
+		// every type of manifest that is pulled is accepted, in each request
+		require.NotEmpty(accepts, test.name)
+		for _, accept := range accepts {
+			for _, mediaType := range distribution.ManifestMediaTypes {
+				assert.Contains(accept, mediaType, test.name)
+			}
+		}
+
+		if test.want == nil {
+			assert.Error(err, test.name)
+			continue
+		}
+		if assert.NoError(err, test.name) {
+			assert.Equal(digest.Canonical.FromBytes(test.want), manifest.Digest, test.name)
+			assert.Equal(test.mediaType, manifest.MediaType, test.name)
+			assert.Equal("amd64", manifest.Annotations["arch"], test.name)
+		}
+	}
+}
+
+func TestPullFromDigestResume(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(delay time.Duration) { httpclient.RetryDelay = delay }(httpclient.RetryDelay)
+	httpclient.RetryDelay = time.Millisecond
+
+	data := make([]byte, 4096)
+	_, err := rand.Read(data)
+	require.NoError(err)
+	d := digest.Canonical.FromBytes(data)
+	half := len(data) / 2
+	resumed := fmt.Sprintf("bytes=%d-", half)
+
+	tests := []struct {
+		name string
+		// resume answers a request with a Range
+		resume func(rw http.ResponseWriter)
+		ranges []string
+	}{
+		{
+			name: "partial content",
+			resume: func(rw http.ResponseWriter) {
+				rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(data)-1, len(data)))
+				rw.WriteHeader(http.StatusPartialContent)
+				_, err := rw.Write(data[half:])
+				assert.NoError(err)
+			},
+			ranges: []string{"", resumed},
+		},
+		{
+			name: "range ignored",
+			resume: func(rw http.ResponseWriter) {
+				_, err := rw.Write(data)
+				assert.NoError(err)
+			},
+			ranges: []string{"", resumed},
+		},
+		{
+			// the whole blob is downloaded again
+			name: "mismatched range",
+			resume: func(rw http.ResponseWriter) {
+				rw.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(data)-1, len(data)))
+				rw.WriteHeader(http.StatusPartialContent)
+				_, err := rw.Write(data)
+				assert.NoError(err)
+			},
+			ranges: []string{"", resumed, ""},
+		},
+	}
+
+	for _, test := range tests {
+		var ranges []string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			ranges = append(ranges, req.Header.Get("Range"))
+			switch {
+			case len(ranges) == 1:
+				// the first download breaks half way
+				conn, buf, err := rw.(http.Hijacker).Hijack()
+				if !assert.NoError(err) {
+					return
+				}
+				fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", len(data))
+				_, err = buf.Write(data[:half])
+				assert.NoError(err)
+				assert.NoError(buf.Flush())
+				assert.NoError(conn.Close())
+			case req.Header.Get("Range") != "":
+				test.resume(rw)
+			default:
+				_, err := rw.Write(data)
+				assert.NoError(err)
+			}
+		}))
+
+		dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+		require.NoError(os.MkdirAll(dir, 0700))
+
+		ref, endpoint := testEndpoint(t, server, "repo:latest")
+		fn, err := registry.PullFromDigest(nil, ref, d, v2.NewURLBuilder(endpoint.URL, false), dir)
+		if assert.NoError(err, test.name) {
+			got, err := ioutil.ReadFile(fn)
+			require.NoError(err)
+			assert.Equal(data, got, test.name)
+		}
+		assert.Equal(test.ranges, ranges, test.name)
+
+		server.Close()
+		assert.NoError(os.RemoveAll(dir))
+	}
+}
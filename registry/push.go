@@ -15,21 +15,22 @@
 package registry
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
-	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/distribution/reference"
 	"github.com/docker/distribution/registry/api/v2"
 	dauth "github.com/docker/distribution/registry/client/auth"
 	"github.com/docker/docker/registry"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
-	pb "gopkg.in/cheggaaa/pb.v1"
 
 	"github.com/Senetas/crypto-cli/distribution"
 	"github.com/Senetas/crypto-cli/registry/auth"
@@ -38,32 +39,34 @@ import (
 	"github.com/Senetas/crypto-cli/utils"
 )
 
-// PushImage pushes the config, layers and mainifest to the nominated registry, in that order
+// PushImage pushes the config and layers, and then the mainifest to the nominated registry
+// It returns the descriptor of the uploaded manifest
 func PushImage(
 	token dauth.Scope,
 	ref reference.Named,
 	manifest *distribution.ImageManifest,
 	endpoint *registry.APIEndpoint,
-) error {
+) (*distribution.Descriptor, error) {
 	trimed := names.TrimNamed(ref)
 
-	if err := PushLayer(token, trimed, manifest.Config, endpoint); err != nil {
-		return err
+	// nothing is uploaded if ref already holds the same manifest
+	if desc, err := upToDate(token, ref, manifest, endpoint); err != nil || desc != nil {
+		return desc, err
 	}
-	for _, l := range manifest.Layers {
-		if err := PushLayer(token, trimed, l, endpoint); err != nil {
-			return err
-		}
+
+	blobs := append([]distribution.Blob{manifest.Config}, manifest.LayerBlobs()...)
+	if err := pushBlobs(token, trimed, blobs, endpoint); err != nil {
+		return nil, err
 	}
 	log.Info().Msg("Layers and config uploaded successfully.")
 
-	mdigest, err := PushManifest(token, ref, manifest, endpoint)
+	desc, err := PushManifest(token, ref, manifest, endpoint)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Info().Msgf("Successfully uploaded manifest: %s.", mdigest)
+	log.Info().Msgf("Successfully uploaded manifest: %s.", desc.Digest)
 
-	return nil
+	return desc, nil
 }
 
 // PushManifest puts a manifest on the registry
@@ -72,7 +75,166 @@ func PushManifest(
 	ref reference.Named,
 	manifest *distribution.ImageManifest,
 	endpoint *registry.APIEndpoint,
-) (_ string, err error) {
+) (_ *distribution.Descriptor, err error) {
+	body, err := utils.CanonicalJSON(manifest)
+	if err != nil {
+		return
+	}
+
+	// a reference without a tag pushes the manifest by its digest alone
+	if _, ok := ref.(reference.Tagged); !ok {
+		ref = names.AppendDigest(names.SeperateRepository(ref), digest.Canonical.FromBytes(body))
+	}
+
+	desc, _, err := putManifest(token, ref, distribution.MediaTypeManifest, body, endpoint)
+	return desc, err
+}
+
+// upToDate gives the descriptor of manifest if ref already holds it, or nil if it
+// does not, or if the registry does not say
+func upToDate(
+	token dauth.Scope,
+	ref reference.Named,
+	manifest *distribution.ImageManifest,
+	endpoint *registry.APIEndpoint,
+) (*distribution.Descriptor, error) {
+	body, err := utils.CanonicalJSON(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := &distribution.Descriptor{
+		MediaType: distribution.MediaTypeManifest,
+		Digest:    digest.Canonical.FromBytes(body),
+		Size:      int64(len(body)),
+	}
+
+	if _, ok := ref.(reference.Tagged); !ok {
+		ref = names.AppendDigest(names.SeperateRepository(ref), desc.Digest)
+	}
+
+	remote, err := manifestDigest(token, ref, v2.NewURLBuilder(endpoint.URL, false), distribution.MediaTypeManifest)
+	if err != nil || remote != desc.Digest {
+		return nil, err
+	}
+
+	log.Info().Msgf("%s is up to date: %s.", ref, desc.Digest)
+	return desc, nil
+}
+
+// manifestDigest asks the registry for the digest of the manifest of one of the
+// accepted media types that ref holds, which is empty if it holds none, or if the
+// registry does not say
+func manifestDigest(
+	token dauth.Scope,
+	ref reference.Named,
+	bldr *v2.URLBuilder,
+	accept ...string,
+) (_ digest.Digest, err error) {
+	urlStr, err := bldr.BuildManifestURL(ref)
+	if err != nil {
+		return "", errors.Wrapf(err, "ref = %v", ref)
+	}
+
+	req, err := http.NewRequest("HEAD", urlStr, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "HEAD %s", urlStr)
+	}
+
+	req.Header.Set("Accept", strings.Join(accept, ", "))
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// the manifest is pushed, and any error is found then
+		log.Debug().Msgf("could not find the manifest of %s: %s", ref, resp.Status)
+		return "", nil
+	}
+
+	d, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		log.Debug().Msgf("the registry did not give the digest of the manifest of %s", ref)
+		return "", nil
+	}
+	return d, nil
+}
+
+// ManifestExists determines whether the registry has a manifest for ref, such as
+// one that pushing to its tag would replace, and its digest, which is empty if the
+// registry does not say
+func ManifestExists(
+	token dauth.Scope,
+	ref reference.Named,
+	bldr *v2.URLBuilder,
+) (_ bool, _ digest.Digest, err error) {
+	urlStr, err := bldr.BuildManifestURL(ref)
+	if err != nil {
+		return false, "", errors.Wrapf(err, "ref = %v", ref)
+	}
+
+	req, err := http.NewRequest("HEAD", urlStr, nil)
+	if err != nil {
+		return false, "", errors.Wrapf(err, "HEAD %s", urlStr)
+	}
+
+	acceptManifests(req)
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		d, err := digest.Parse(resp.Header.Get("Docker-Content-Digest"))
+		if err != nil {
+			log.Debug().Msgf("the registry did not give the digest of the manifest of %s", ref)
+			return true, "", nil
+		}
+		return true, d, nil
+	case http.StatusNotFound:
+		return false, "", nil
+	default:
+		return false, "", errors.Wrapf(httpclient.NewStatusError(resp), "could not find whether %s exists", ref)
+	}
+}
+
+// PushIndex puts an image index on the registry
+func PushIndex(
+	token dauth.Scope,
+	ref reference.Named,
+	index *distribution.Index,
+	endpoint *registry.APIEndpoint,
+) (_ *distribution.Descriptor, err error) {
+	body, err := utils.CanonicalJSON(index)
+	if err != nil {
+		return
+	}
+
+	desc, _, err := putManifest(token, ref, index.MediaType, body, endpoint)
+	return desc, err
+}
+
+// putManifest uploads the serialised manifest body of the given mediaType,
+// returning its descriptor and the headers of the response
+func putManifest(
+	token dauth.Scope,
+	ref reference.Named,
+	mediaType string,
+	body []byte,
+	endpoint *registry.APIEndpoint,
+) (_ *distribution.Descriptor, _ http.Header, err error) {
 	builder := v2.NewURLBuilder(endpoint.URL, false)
 	urlStr, err := builder.BuildManifestURL(ref)
 	if err != nil {
@@ -80,20 +242,7 @@ func PushManifest(
 		return
 	}
 
-	// a pipe allows using the struct directly as the http body
-	// w/o copying to a buffer
-	pr, pw := io.Pipe()
-	errChan := make(chan error, 1)
-	defer close(errChan)
-
-	go func() {
-		defer func() { errChan <- pw.Close() }()
-		enc := json.NewEncoder(pw)
-		enc.SetIndent("", "\t")
-		errChan <- enc.Encode(manifest)
-	}()
-
-	req, err := http.NewRequest("PUT", urlStr, pr)
+	req, err := http.NewRequest("PUT", urlStr, bytes.NewReader(body))
 	if err != nil {
 		err = errors.Wrapf(err, "url = %v", urlStr)
 		return
@@ -101,7 +250,7 @@ func PushManifest(
 
 	req.Header.Set("Accept", "application/json, */*")
 	req.Header.Set("Accept-Encoding", "gzip, deflate")
-	req.Header.Set("Content-Type", distribution.MediaTypeManifest)
+	req.Header.Set("Content-Type", mediaType)
 	auth.AddToRequest(token, req)
 
 	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
@@ -112,18 +261,79 @@ func PushManifest(
 		return
 	}
 
-	// close the channel after request is done
-	if err = utils.ConcatErrChan(errChan, 2); err != nil {
-		err = errors.WithStack(err)
+	if resp.StatusCode != http.StatusCreated {
+		err = errors.Wrap(httpclient.NewStatusError(resp), "manifest upload failed")
 		return
 	}
 
-	if resp.StatusCode != http.StatusCreated {
-		err = errors.New("manifest upload failed with status: " + resp.Status)
-		return
+	return &distribution.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.Canonical.FromBytes(body),
+		Size:      int64(len(body)),
+	}, resp.Header, nil
+}
+
+// MaxConcurrentUploads is the most blobs of an image that are uploaded at once
+var MaxConcurrentUploads = 4
+
+// pushBlobs pushes the blobs concurrently, at most MaxConcurrentUploads at a time, with
+// the progress of each reported on its own and in their total. Identical blobs are
+// only pushed once.
+func pushBlobs(
+	token dauth.Scope,
+	ref reference.Named,
+	blobs []distribution.Blob,
+	endpoint *registry.APIEndpoint,
+) error {
+	var total int64
+	unique := make([]distribution.Blob, 0, len(blobs))
+	pushed := make(map[digest.Digest]bool)
+	for _, b := range blobs {
+		if pushed[b.GetDigest()] {
+			continue
+		}
+		pushed[b.GetDigest()] = true
+		unique = append(unique, b)
+		total += b.GetSize()
+	}
+
+	if len(unique) == 0 {
+		return nil
+	}
+
+	g := utils.StartProgressGroup(utils.ProgressUpload, ref.String(), total)
+	defer g.Done()
+
+	n := MaxConcurrentUploads
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	errCh := make(chan error)
+
+	var existing int32
+	for _, b := range unique {
+		go func(b distribution.Blob) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			p := g.Start(b.GetDigest().String(), b.GetSize())
+			defer p.Done()
+			exists, err := pushLayer(token, ref, b, endpoint, p)
+			if exists {
+				atomic.AddInt32(&existing, 1)
+			}
+			errCh <- err
+		}(b)
+	}
+
+	if err := utils.ConcatErrChan(errCh, len(unique)); err != nil {
+		return err
 	}
 
-	return resp.Header.Get("Docker-Content-Digest"), nil
+	if existing > 0 {
+		log.Info().Msgf("%d of %d blobs were already in the registry and were not uploaded.", existing, len(unique))
+	}
+	return nil
 }
 
 // PushLayer pushes a layer to the registry, checking if it exists
@@ -132,29 +342,102 @@ func PushLayer(
 	ref reference.Named,
 	layer distribution.Blob,
 	endpoint *registry.APIEndpoint,
-) (err error) {
+) error {
+	_, err := pushLayer(token, ref, layer, endpoint, nil)
+	return err
+}
+
+// pushLayer pushes a layer, reporting its progress to p, or to its own progress if
+// p is nil. The registry is first asked if it has the layer, which is not uploaded
+// if it does.
+func pushLayer(
+	token dauth.Scope,
+	ref reference.Named,
+	layer distribution.Blob,
+	endpoint *registry.APIEndpoint,
+	p utils.Progress,
+) (exists bool, err error) {
 	sep := names.SeperateRepository(ref)
 	dig := names.AppendDigest(sep, layer.GetDigest())
 	bldr := v2.NewURLBuilder(endpoint.URL, false)
 
-	exists, err := layerExists(token, dig, bldr)
+	exists, err = layerExists(token, dig, bldr)
 	if err != nil {
 		return
 	} else if exists {
 		log.Info().Msgf("Blob %s exists.", layer.GetDigest())
+		if p != nil {
+			p.Add(layer.GetSize())
+		}
 		return
 	}
 
 	log.Info().Msgf("Blob %s is new, proceed to upload.", layer.GetDigest())
 
-	// query the server for which location to upload to
-	loc, err := getUploadLoc(token, dig, bldr, layer)
-	if err != nil {
+	// catch a file that has changed since it was written
+	if err = layer.Verify(); err != nil {
+		return
+	}
+
+	if p == nil {
+		p = utils.StartProgress(utils.ProgressUpload, layer.GetDigest().String(), layer.GetSize())
+		defer p.Done()
+	}
+	bp := &blobProgress{Progress: p}
+
+	if ChunkSize > 0 && layer.GetSize() > ChunkSize {
+		err = uploadChunks(token, dig, bldr, layer, bp)
 		return
 	}
 
-	// now actually upload the blob
-	return uploadBlob(loc, token, dig, bldr, layer)
+	// the upload is started again if it fails transiently, as its body is the file
+	retry := false
+	err = httpclient.Retry("Upload of blob "+layer.GetDigest().String(), func() error {
+		// the registry may have committed the blob of an attempt that seemed to fail
+		if retry {
+			exists, err := layerExists(token, dig, bldr)
+			if err != nil {
+				return err
+			} else if exists {
+				bp.reset(layer.GetSize())
+				return nil
+			}
+		}
+		retry = true
+
+		// what was sent of an attempt that failed is sent again
+		bp.reset(0)
+
+		// query the server for which location to upload to
+		loc, err := getUploadLoc(token, dig, bldr)
+		if err != nil {
+			return err
+		}
+
+		// now actually upload the blob
+		return uploadBlob(loc, token, dig, bldr, layer, bp)
+	})
+	return
+}
+
+// blobProgress reports the progress of the upload of a blob, which may take back
+// what was sent of an attempt that failed
+type blobProgress struct {
+	utils.Progress
+	sent int64
+}
+
+func (p *blobProgress) Add(n int64) {
+	atomic.AddInt64(&p.sent, n)
+	p.Progress.Add(n)
+}
+
+// Done does nothing, as the progress that is reported to is done by its owner
+func (p *blobProgress) Done() {}
+
+// reset the progress to the number of bytes that have been sent
+func (p *blobProgress) reset(sent int64) {
+	p.Progress.Add(sent - atomic.SwapInt64(&p.sent, sent))
 }
 
 // layerExists checks if the layer already exists on the repository
@@ -190,9 +473,11 @@ func layerExists(token dauth.Scope, ref reference.Canonical, bldr *v2.URLBuilder
 	case http.StatusNotFound:
 		b = false
 	case http.StatusUnauthorized:
-		err = errors.Errorf("this account is not authorised to access the repository: %s", ref.Name())
+		err = utils.WithClass(errors.Errorf("this account is not authorised to access the repository: %s", ref.Name()), utils.ClassAuth)
 	default:
-		err = errors.New("error testing exsistence of layer")
+		// some registries do not answer HEAD requests for blobs, so it is uploaded
+		// and any error is found then
+		log.Debug().Msgf("could not test the existence of blob %s: %s", ref.Digest(), resp.Status)
 	}
 
 	return
@@ -201,9 +486,8 @@ func layerExists(token dauth.Scope, ref reference.Canonical, bldr *v2.URLBuilder
 // getUploadLoc optains the urlString to upload the blob to by querying the API
 func getUploadLoc(
 	token dauth.Scope,
-	dig reference.Named,
+	dig reference.Canonical,
 	bldr *v2.URLBuilder,
-	layerData distribution.Blob,
 ) (loc string, err error) {
 	// get the location to upload the blob
 	uploadURLStr, err := bldr.BuildBlobUploadURL(dig, nil)
@@ -233,11 +517,19 @@ func getUploadLoc(
 		loc = resp.Header.Get("Location")
 		if loc == "" {
 			err = errors.New("server did not return location to upload to")
+			return
+		}
+		// the location may be relative to the request
+		var u *url.URL
+		if u, err = resp.Request.URL.Parse(loc); err != nil {
+			err = errors.Wrapf(err, "invalid location to upload to %s", loc)
+			return
 		}
+		loc = u.String()
 	case http.StatusUnauthorized:
-		err = errors.Errorf("this account is not authorised to access the repository: %s", dig.Name())
+		err = utils.WithClass(errors.Errorf("this account is not authorised to access the repository: %s", dig.Name()), utils.ClassAuth)
 	default:
-		err = errors.Errorf("upload of layer %v was not accepted", layerData.GetDigest())
+		err = errors.Wrapf(httpclient.NewStatusError(resp), "upload of layer %v was not accepted", dig.Digest())
 	}
 
 	return
@@ -250,21 +542,11 @@ func uploadBlob(
 	dig reference.Canonical,
 	bldr *v2.URLBuilder,
 	blob distribution.Blob,
+	p utils.Progress,
 ) error {
-	u, err := url.Parse(loc)
+	loc, err := withDigest(loc, blob.GetDigest())
 	if err != nil {
-		return errors.Wrapf(err, "loc = %v", loc)
-	}
-
-	q, err := url.ParseQuery(u.RawQuery)
-	if err != nil {
-		return errors.Wrapf(err, "rawquery = %v", u.RawQuery)
-	}
-
-	q.Add("digest", blob.GetDigest().String())
-	u.RawQuery, err = url.QueryUnescape(q.Encode())
-	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 
 	// open the layer file to get size and upload
@@ -277,14 +559,13 @@ func uploadBlob(
 	// timeout
 	ctx, cancel := context.WithCancel(context.Background())
 	timer := time.AfterFunc(10*time.Second, cancel)
-	bar := pb.New64(blob.GetSize()).SetUnits(pb.U_BYTES)
-	pr := bar.NewProxyReader(blobFH)
+	pr := &utils.ProgressReader{Reader: blobFH, Progress: p}
 	trr := utils.NewResetReader(pr, func() { timer.Reset(20 * time.Second) })
 
 	errCh := make(chan error)
 	defer close(errCh)
 
-	req, err := http.NewRequest("PUT", u.String(), trr)
+	req, err := http.NewRequest("PUT", loc, trr)
 	if err != nil {
 		return errors.Wrapf(err, "could not make req = %v", req)
 	}
@@ -294,7 +575,7 @@ func uploadBlob(
 	req.Header.Set("Content-Type", "application/octect-stream")
 	auth.AddToRequest(token, req)
 
-	go upload(req, bar, blob, errCh)
+	go upload(req, blob, errCh)
 
 	select {
 	case <-ctx.Done():
@@ -302,33 +583,53 @@ func uploadBlob(
 	default:
 	}
 
-	return <-errCh
+	if err = <-errCh; err != nil && ctx.Err() != nil {
+		return errors.Wrapf(httpclient.ErrStalled, "upload of blob %s", blob.GetDigest())
+	}
+	return err
+}
+
+// withDigest adds the digest of the blob to the location of its upload, which
+// completes the upload when it is put
+func withDigest(loc string, d digest.Digest) (_ string, err error) {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return "", errors.Wrapf(err, "loc = %v", loc)
+	}
+
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", errors.Wrapf(err, "rawquery = %v", u.RawQuery)
+	}
+
+	q.Add("digest", d.String())
+	u.RawQuery, err = url.QueryUnescape(q.Encode())
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return u.String(), nil
 }
 
 // upload executes the upload request in uploadBlob
 func upload(
 	req *http.Request,
-	bar *pb.ProgressBar,
 	blob distribution.Blob,
 	errCh chan<- error,
 ) {
 	var err error
 	defer func() { errCh <- err }()
 
-	bar.Start()
-
-	resp, err := httpclient.DoRequest(http.DefaultClient, req, false, true)
+	resp, err := httpclient.DoRequest(httpclient.TransferClient, req, false, true)
 	if resp != nil {
 		defer func() { err = utils.CheckedClose(resp.Body, err) }()
 	}
 
-	bar.Finish()
-
 	if err != nil {
 		return
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		err = errors.Errorf("upload of blob %s failed with status %s", blob.GetFilename(), resp.Status)
+		err = errors.Wrapf(httpclient.NewStatusError(resp), "upload of blob %s failed", blob.GetFilename())
 	}
 }
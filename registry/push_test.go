@@ -0,0 +1,207 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// mkPushImage writes a config and n distinct layers to dir, and returns the manifest
+// of the image that they make
+func mkPushImage(t *testing.T, dir string, n int) *distribution.ImageManifest {
+	require := require.New(t)
+	require.NoError(os.MkdirAll(dir, 0700))
+
+	write := func(name string, data []byte) (string, digest.Digest, int64) {
+		fn := filepath.Join(dir, name)
+		require.NoError(ioutil.WriteFile(fn, data, 0600))
+		return fn, digest.Canonical.FromBytes(data), int64(len(data))
+	}
+
+	manifest := &distribution.ImageManifest{
+		SchemaVersion: 2,
+		MediaType:     distribution.MediaTypeManifest,
+		Config:        distribution.NewPlainConfig(write("config", []byte(`{"os":"linux"}`))),
+		DirName:       dir,
+	}
+	for i := 0; i < n; i++ {
+		manifest.Layers = append(manifest.Layers, distribution.NewPlainLayer(write(fmt.Sprintf("layer%d", i), []byte(fmt.Sprintf("layer %d", i)))))
+	}
+	return manifest
+}
+
+func TestPushBlobsConcurrently(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(n int) { registry.MaxConcurrentUploads = n }(registry.MaxConcurrentUploads)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	manifest := mkPushImage(t, dir, 7)
+
+	// no more blobs are uploaded at once than the limit, which is reached, and a
+	// limit of less than one uploads them one at a time
+	for _, test := range []struct{ limit, max int }{{1, 1}, {4, 4}, {0, 1}} {
+		registry.MaxConcurrentUploads = test.limit
+		r := newFakeRegistry(t)
+		uploads := &inFlight{Handler: r, method: "PUT", prefix: "/v2/repo/blobs/uploads/"}
+		server := httptest.NewServer(uploads)
+
+		ref, endpoint := taggedEndpoint(t, server, "repo:latest")
+		_, err := registry.PushImage(nil, ref, manifest, endpoint)
+		server.Close()
+		assert.NoError(err, "%d", test.limit)
+		assert.Equal(test.max, uploads.max, "%d", test.limit)
+		assert.Equal(8, r.count("PUT", "/v2/repo/blobs/uploads/"), "%d", test.limit)
+		_, ok := r.manifest("repo", "latest")
+		assert.True(ok, "%d", test.limit)
+	}
+}
+
+func TestPushExistingBlobs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	manifest := mkPushImage(t, dir, 3)
+	blobs := append([]distribution.Blob{manifest.Config}, manifest.Layers...)
+
+	// each blob is asked about before it is uploaded, and only those that the
+	// registry does not have are
+	for existing := 0; existing <= len(blobs); existing += 2 {
+		r := newFakeRegistry(t)
+		for _, b := range blobs[:existing] {
+			data, err := ioutil.ReadFile(b.GetFilename())
+			require.NoError(err)
+			r.putBlob("repo", data)
+		}
+		server := httptest.NewServer(r)
+
+		ref, endpoint := taggedEndpoint(t, server, "repo:latest")
+		_, err := registry.PushImage(nil, ref, manifest, endpoint)
+		server.Close()
+		require.NoError(err, "%d", existing)
+
+		uploaded := len(blobs) - existing
+		assert.Equal(len(blobs), r.count("HEAD", "/v2/repo/blobs/"), "%d", existing)
+		assert.Equal(uploaded, r.count("POST", "/v2/repo/blobs/uploads/"), "%d", existing)
+		assert.Equal(uploaded, r.count("PUT", "/v2/repo/blobs/uploads/"), "%d", existing)
+		assert.Zero(r.count("PATCH", "/v2/repo/blobs/uploads/"), "%d", existing)
+		for _, b := range blobs {
+			_, ok := r.blob("repo", b.GetDigest())
+			assert.True(ok, "%d: %s", existing, b.GetDigest())
+		}
+	}
+}
+
+func TestPushCommittedBlob(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	defer func(retries int, delay time.Duration) {
+		httpclient.Retries, httpclient.RetryDelay = retries, delay
+	}(httpclient.Retries, httpclient.RetryDelay)
+	httpclient.Retries, httpclient.RetryDelay = 2, time.Millisecond
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	manifest := mkPushImage(t, dir, 0)
+
+	// the registry commits the blob, but the upload seems to fail, so the blob is
+	// found on the retry rather than uploaded again
+	r := newFakeRegistry(t)
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "PUT" && !failed {
+			failed = true
+			r.ServeHTTP(httptest.NewRecorder(), req)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		r.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+
+	ref, endpoint := taggedEndpoint(t, server, "repo:latest")
+	_, err := registry.PushImage(nil, ref, manifest, endpoint)
+	require.NoError(err)
+
+	assert.True(failed)
+	assert.Equal(1, r.count("POST", "/v2/repo/blobs/uploads/"))
+	assert.Equal(1, r.count("PUT", "/v2/repo/blobs/uploads/"))
+	assert.Equal(2, r.count("HEAD", "/v2/repo/blobs/"))
+	_, ok := r.blob("repo", manifest.Config.GetDigest())
+	assert.True(ok)
+}
+
+func TestPushUpToDate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(utils.CleanUp(dir, nil)) }()
+	manifest := mkPushImage(t, dir, 2)
+
+	r := newFakeRegistry(t)
+	server := httptest.NewServer(r)
+	defer server.Close()
+	ref, endpoint := taggedEndpoint(t, server, "repo:latest")
+
+	first, err := registry.PushImage(nil, ref, manifest, endpoint)
+	require.NoError(err)
+	require.Equal(1, r.count("PUT", "/v2/repo/manifests/latest"))
+
+	// a tag that already holds the manifest is only asked about, and neither its
+	// blobs nor the manifest are put again
+	r.requests = nil
+	desc, err := registry.PushImage(nil, ref, manifest, endpoint)
+	require.NoError(err)
+	assert.Equal(first, desc)
+	assert.Equal(1, r.count("HEAD", "/v2/repo/manifests/latest"))
+	assert.Len(r.requests, 1)
+
+	// while one that holds another manifest is put, without the blobs that it has
+	other, _ := taggedEndpoint(t, server, "repo:other")
+	r.putManifest("repo", distribution.MediaTypeManifest, []byte(`{"schemaVersion":2}`), "other")
+	r.requests = nil
+	desc, err = registry.PushImage(nil, other, manifest, endpoint)
+	require.NoError(err)
+	assert.Equal(first.Digest, desc.Digest)
+	assert.Equal(1, r.count("PUT", "/v2/repo/manifests/other"))
+	assert.Zero(r.count("POST", "/v2/repo/blobs/uploads/"))
+	assert.Zero(r.count("PUT", "/v2/repo/blobs/uploads/"))
+	m, ok := r.manifest("repo", "other")
+	if assert.True(ok) {
+		assert.Equal(first.Digest, digest.Canonical.FromBytes(m.body))
+	}
+}
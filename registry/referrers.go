@@ -0,0 +1,508 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	dauth "github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/docker/registry"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/auth"
+	"github.com/Senetas/crypto-cli/registry/httpclient"
+	"github.com/Senetas/crypto-cli/registry/names"
+	"github.com/Senetas/crypto-cli/utils"
+)
+
+// PushKeyEnvelope uploads a key envelope as an artifact whose subject is the
+// manifest it holds the keys for
+func PushKeyEnvelope(
+	token dauth.Scope,
+	ref reference.Named,
+	envelope *distribution.KeyEnvelope,
+	subject *distribution.Descriptor,
+	endpoint *registry.APIEndpoint,
+	dir string,
+) (err error) {
+	artifact, blobs, err := envelope.Artifact(dir, subject)
+	if err != nil {
+		return
+	}
+
+	desc, err := PushArtifact(token, ref, artifact, blobs, endpoint)
+	if err != nil {
+		return
+	}
+
+	log.Info().Msgf("Successfully uploaded keys: %s.", desc.Digest)
+	return
+}
+
+// PushArtifact uploads the blobs of an artifact and then its manifest, which is
+// addressed by digest. If the artifact has a subject and the registry does not
+// process it, the referrers tag of the subject is updated instead.
+func PushArtifact(
+	token dauth.Scope,
+	ref reference.Named,
+	artifact *distribution.ArtifactManifest,
+	blobs []distribution.Blob,
+	endpoint *registry.APIEndpoint,
+) (_ *distribution.Descriptor, err error) {
+	desc, header, err := pushArtifact(token, ref, nil, artifact, blobs, endpoint)
+	if err != nil {
+		return
+	}
+
+	if artifact.Subject == nil || header.Get("OCI-Subject") != "" {
+		return desc, nil
+	}
+
+	log.Debug().Msg("registry did not process the subject, falling back to the referrers tag")
+	if err = updateReferrersTag(token, ref, artifact.Subject.Digest, *desc, endpoint); err != nil {
+		return
+	}
+
+	return desc, nil
+}
+
+// PushTaggedArtifact uploads the blobs of an artifact and then its manifest,
+// which is tagged with the tag of ref
+func PushTaggedArtifact(
+	token dauth.Scope,
+	ref reference.NamedTagged,
+	artifact *distribution.ArtifactManifest,
+	blobs []distribution.Blob,
+	endpoint *registry.APIEndpoint,
+) (desc *distribution.Descriptor, err error) {
+	desc, _, err = pushArtifact(token, ref, ref, artifact, blobs, endpoint)
+	return
+}
+
+// pushArtifact uploads the blobs of an artifact and then its manifest to target,
+// or by digest if target is nil
+func pushArtifact(
+	token dauth.Scope,
+	ref reference.Named,
+	target reference.Named,
+	artifact *distribution.ArtifactManifest,
+	blobs []distribution.Blob,
+	endpoint *registry.APIEndpoint,
+) (_ *distribution.Descriptor, _ http.Header, err error) {
+	if err = pushBlobs(token, names.TrimNamed(ref), blobs, endpoint); err != nil {
+		return
+	}
+
+	body, err := utils.CanonicalJSON(artifact)
+	if err != nil {
+		return
+	}
+
+	if target == nil {
+		target = names.AppendDigest(names.SeperateRepository(ref), digest.Canonical.FromBytes(body))
+	}
+
+	desc, header, err := putManifest(token, target, artifact.MediaType, body, endpoint)
+	if err != nil {
+		return
+	}
+	desc.ArtifactType = artifact.ArtifactType
+	desc.Annotations = artifact.Annotations
+
+	return desc, header, nil
+}
+
+// referrersTag is the tag under which the index of the referrers of the
+// manifest with digest d is stored by registries without a referrers API
+func referrersTag(d digest.Digest) string {
+	return d.Algorithm().String() + "-" + d.Encoded()
+}
+
+// updateReferrersTag adds desc to the index of referrers stored under the
+// referrers tag of subject
+func updateReferrersTag(
+	token dauth.Scope,
+	ref reference.Named,
+	subject digest.Digest,
+	desc distribution.Descriptor,
+	endpoint *registry.APIEndpoint,
+) (err error) {
+	tagged := names.WithTag(names.SeperateRepository(ref), referrersTag(subject))
+
+	index, err := pullIndex(token, tagged, v2.NewURLBuilder(endpoint.URL, false))
+	if err != nil {
+		return
+	}
+	index.Add(desc)
+
+	body, err := utils.CanonicalJSON(index)
+	if err != nil {
+		return
+	}
+
+	_, _, err = putManifest(token, tagged, index.MediaType, body, endpoint)
+	return
+}
+
+// PullKeyEnvelope finds the key envelope that refers to the manifest with digest
+// subject and downloads it, which is the newest if there are several, such as after
+// its keys have been wrapped again. It returns nil if there is no such envelope.
+func PullKeyEnvelope(
+	token dauth.Scope,
+	ref reference.Named,
+	subject digest.Digest,
+	bldr *v2.URLBuilder,
+	dir string,
+) (_ *distribution.KeyEnvelope, err error) {
+	referrers, err := PullReferrers(token, ref, subject, distribution.MediaTypeKeyEnvelope, bldr)
+	if err != nil || len(referrers) == 0 {
+		return
+	}
+
+	newest, err := newestKeyEnvelope(subject, referrers)
+	if err != nil {
+		return
+	}
+
+	artifact, err := pullArtifactManifest(token, ref, newest.Digest, bldr)
+	if err != nil {
+		return
+	}
+
+	for _, l := range artifact.Layers {
+		if l.MediaType != distribution.MediaTypeKeyEnvelope {
+			continue
+		}
+
+		// validate digest to prevent local file injections
+		if err = l.Digest.Validate(); err != nil {
+			return
+		}
+
+		var filename string
+		filename, err = PullFromDigest(token, ref, l.Digest, bldr, dir)
+		if err != nil {
+			return
+		}
+
+		return readKeyEnvelope(filename)
+	}
+
+	return nil, errors.New("key artifact does not contain a key envelope")
+}
+
+// newestKeyEnvelope picks the newest of the key envelopes that refer to subject by
+// the time they were created, as the order of referrers is not specified. It fails,
+// listing them, if that is not known of each or two were created at once.
+func newestKeyEnvelope(subject digest.Digest, referrers []distribution.Descriptor) (*distribution.Descriptor, error) {
+	if len(referrers) == 1 {
+		return &referrers[0], nil
+	}
+
+	var (
+		newest  *distribution.Descriptor
+		latest  time.Time
+		unknown bool
+	)
+	for i, r := range referrers {
+		created, err := time.Parse(time.RFC3339Nano, r.Annotations[distribution.AnnotationCreated])
+		switch {
+		case err != nil:
+			unknown = true
+		case newest == nil || created.After(latest):
+			newest, latest = &referrers[i], created
+		case created.Equal(latest):
+			unknown = true
+		}
+	}
+
+	if unknown || newest == nil {
+		candidates := make([]string, len(referrers))
+		for i, r := range referrers {
+			candidates[i] = r.Digest.String()
+		}
+		return nil, errors.Errorf("%d key envelopes refer to %s and which is the newest is not known: %s",
+			len(referrers), subject, strings.Join(candidates, ", "))
+	}
+
+	log.Debug().Msgf("using the newest of %d key envelopes of %s: %s", len(referrers), subject, newest.Digest)
+	return newest, nil
+}
+
+func readKeyEnvelope(filename string) (_ *distribution.KeyEnvelope, err error) {
+	// the filename is a validated digest in the download dir
+	fh, err := os.Open(filename) // #nosec
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+	defer func() { err = utils.CheckedClose(fh, err) }()
+
+	return distribution.NewKeyEnvelope(fh)
+}
+
+// PullReferrers lists the descriptors of the manifests that refer to the manifest
+// with digest subject using the referrers API, filtered by artifactType if it is
+// not empty. The pages of the list are followed by their Link headers.
+func PullReferrers(
+	token dauth.Scope,
+	ref reference.Named,
+	subject digest.Digest,
+	artifactType string,
+	bldr *v2.URLBuilder,
+) (_ []distribution.Descriptor, err error) {
+	base, err := bldr.BuildBaseURL()
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	u, err := url.Parse(base + ref.Name() + "/referrers/" + subject.String())
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if artifactType != "" {
+		u.RawQuery = url.Values{"artifactType": {artifactType}}.Encode()
+	}
+
+	index := distribution.NewIndex()
+	for first := true; u != nil; first = false {
+		var page *distribution.Index
+		if page, u, err = pullReferrersPage(token, u); err != nil {
+			return
+		}
+
+		if page == nil {
+			if !first {
+				return nil, errors.New("a page of the referrers was not found")
+			}
+			log.Debug().Msg("the registry has no referrers API, falling back to the referrers tag")
+			tagged := names.WithTag(names.SeperateRepository(ref), referrersTag(subject))
+			if index, err = pullIndex(token, tagged, bldr); err != nil {
+				return nil, err
+			}
+			return index.Filter(artifactType), nil
+		}
+
+		index.Manifests = append(index.Manifests, page.Manifests...)
+	}
+
+	// registries may ignore the filter, so apply it again
+	return index.Filter(artifactType), nil
+}
+
+// pullReferrersPage downloads the page of the referrers at u, giving the URL of the
+// next page if there is one, or a nil page if the registry has no referrers API
+func pullReferrersPage(
+	token dauth.Scope,
+	u *url.URL,
+) (index *distribution.Index, next *url.URL, err error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		err = errors.Wrapf(err, "GET %s", u)
+		return
+	}
+
+	req.Header.Set("Accept", distribution.MediaTypeOCIIndex)
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return
+	default:
+		err = errors.Wrap(httpclient.NewStatusError(resp), "referrers request failed")
+		return
+	}
+
+	index = distribution.NewIndex()
+	if err = json.NewDecoder(resp.Body).Decode(index); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if link := nextLink(resp.Header); link != "" {
+		if next, err = u.Parse(link); err != nil {
+			err = errors.Wrapf(err, "link = %s", link)
+		}
+	}
+	return
+}
+
+// pullIndex downloads the index stored under a tag. If there is no such tag, an
+// empty index is returned.
+func pullIndex(
+	token dauth.Scope,
+	ref reference.NamedTagged,
+	bldr *v2.URLBuilder,
+) (_ *distribution.Index, err error) {
+	urlStr, err := bldr.BuildManifestURL(ref)
+	if err != nil {
+		err = errors.Wrapf(err, "ref = %v", ref)
+		return
+	}
+
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		err = errors.Wrapf(err, "GET %s", urlStr)
+		return
+	}
+
+	req.Header.Set("Accept", distribution.MediaTypeOCIIndex)
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return
+	}
+
+	index := distribution.NewIndex()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return index, nil
+	default:
+		err = errors.Wrap(httpclient.NewStatusError(resp), "index download failed")
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	if _, err = verifyManifest(ref, resp, body); err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(body, index); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	return index, nil
+}
+
+// pullArtifactManifest downloads the artifact manifest with digest d
+func pullArtifactManifest(
+	token dauth.Scope,
+	ref reference.Named,
+	d digest.Digest,
+	bldr *v2.URLBuilder,
+) (_ *distribution.ArtifactManifest, err error) {
+	dig := names.AppendDigest(names.SeperateRepository(ref), d)
+	artifact, actual, err := pullArtifact(token, dig, bldr)
+	if err != nil {
+		return
+	}
+
+	if actual != d {
+		err = errors.Errorf("artifact manifest does not match digest %s", d)
+		return
+	}
+
+	return artifact, nil
+}
+
+// PullTaggedArtifact downloads the artifact manifest that ref refers to
+func PullTaggedArtifact(
+	token dauth.Scope,
+	ref reference.NamedTagged,
+	bldr *v2.URLBuilder,
+) (artifact *distribution.ArtifactManifest, err error) {
+	artifact, _, err = pullArtifact(token, ref, bldr)
+	return
+}
+
+// pullArtifact downloads the artifact manifest that target refers to, returning
+// it and its digest
+func pullArtifact(
+	token dauth.Scope,
+	target reference.Named,
+	bldr *v2.URLBuilder,
+) (_ *distribution.ArtifactManifest, _ digest.Digest, err error) {
+	urlStr, err := bldr.BuildManifestURL(target)
+	if err != nil {
+		err = errors.Wrapf(err, "ref = %v", target)
+		return
+	}
+
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		err = errors.Wrapf(err, "GET %s", urlStr)
+		return
+	}
+
+	req.Header.Set("Accept", distribution.MediaTypeOCIManifest)
+	auth.AddToRequest(token, req)
+
+	resp, err := httpclient.DoRequest(httpclient.DefaultClient, req, true, true)
+	if resp != nil {
+		defer func() { err = utils.CheckedClose(resp.Body, err) }()
+	}
+	if err != nil {
+		return
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = errors.Wrap(httpclient.NewStatusError(resp), "artifact download failed")
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	d, err := verifyManifest(target, resp, body)
+	if err != nil {
+		return
+	}
+
+	artifact := &distribution.ArtifactManifest{}
+	if err = json.Unmarshal(body, artifact); err != nil {
+		err = errors.WithStack(err)
+		return
+	}
+
+	return artifact, d, nil
+}
@@ -0,0 +1,312 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	dregistry "github.com/docker/docker/registry"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// testEndpoint is the reference to name in the registry of server, and its endpoint
+func testEndpoint(t *testing.T, server *httptest.Server, name string) (reference.Named, *dregistry.APIEndpoint) {
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	ref, err := reference.ParseNormalizedNamed(u.Host + "/" + name)
+	require.NoError(t, err)
+	return ref, &dregistry.APIEndpoint{URL: u}
+}
+
+// taggedEndpoint is the tagged reference to name in the registry of server, as it
+// is named in its requests, and its endpoint
+func taggedEndpoint(t *testing.T, server *httptest.Server, name string) (names.NamedTaggedRepository, *dregistry.APIEndpoint) {
+	ref, endpoint := testEndpoint(t, server, name)
+	tagged, err := names.CastToTagged(ref)
+	require.NoError(t, err)
+	return tagged, endpoint
+}
+
+// fakeManifest is a manifest held by a fakeRegistry, as it was put
+type fakeManifest struct {
+	mediaType string
+	body      []byte
+}
+
+// fakeRegistry is a registry that holds manifests and blobs in memory, keyed by the
+// names of their repositories. Blobs are uploaded whole, and are mounted from other
+// repositories if mount is set. The referrers of manifests are listed from those
+// that name them as their subject. Each request is logged as its method and path.
+type fakeRegistry struct {
+	sync.Mutex
+	t *testing.T
+
+	mount     bool
+	manifests map[string]fakeManifest
+	blobs     map[string][]byte
+	sessions  map[string]string
+	requests  []string
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	return &fakeRegistry{
+		t:         t,
+		manifests: make(map[string]fakeManifest),
+		blobs:     make(map[string][]byte),
+		sessions:  make(map[string]string),
+	}
+}
+
+// putBlob adds data to the repository name as a blob
+func (r *fakeRegistry) putBlob(name string, data []byte) digest.Digest {
+	r.Lock()
+	defer r.Unlock()
+	d := digest.Canonical.FromBytes(data)
+	r.blobs[name+"@"+d.String()] = data
+	return d
+}
+
+// putManifest adds the manifest body of mediaType to the repository name, by its
+// digest and under the tags
+func (r *fakeRegistry) putManifest(name, mediaType string, body []byte, tags ...string) digest.Digest {
+	r.Lock()
+	defer r.Unlock()
+	return r.store(name, mediaType, body, tags...)
+}
+
+func (r *fakeRegistry) store(name, mediaType string, body []byte, tags ...string) digest.Digest {
+	d := digest.Canonical.FromBytes(body)
+	m := fakeManifest{mediaType: mediaType, body: body}
+	r.manifests[name+"@"+d.String()] = m
+	for _, tag := range tags {
+		r.manifests[name+":"+tag] = m
+	}
+	return d
+}
+
+// blob is the blob with digest d in the repository name, if it has it
+func (r *fakeRegistry) blob(name string, d digest.Digest) ([]byte, bool) {
+	r.Lock()
+	defer r.Unlock()
+	data, ok := r.blobs[name+"@"+d.String()]
+	return data, ok
+}
+
+// manifest is the manifest that the repository name holds under ref, which is a
+// tag or a digest
+func (r *fakeRegistry) manifest(name, ref string) (fakeManifest, bool) {
+	r.Lock()
+	defer r.Unlock()
+	m, ok := r.manifests[name+sep(ref)+ref]
+	return m, ok
+}
+
+// count is the number of requests with method whose paths have prefix
+func (r *fakeRegistry) count(method, prefix string) (n int) {
+	r.Lock()
+	defer r.Unlock()
+	for _, req := range r.requests {
+		if strings.HasPrefix(req, method+" "+prefix) {
+			n++
+		}
+	}
+	return
+}
+
+// sep is the separator of a tag or digest from the name of its repository
+func sep(ref string) string {
+	if strings.Contains(ref, ":") {
+		return "@"
+	}
+	return ":"
+}
+
+func (r *fakeRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	for _, route := range []struct {
+		sep   string
+		serve func(rw http.ResponseWriter, req *http.Request, name, rest string)
+	}{
+		{"/manifests/", r.serveManifest},
+		{"/blobs/uploads/", r.serveUpload},
+		{"/blobs/", r.serveBlob},
+		{"/referrers/", r.serveReferrers},
+	} {
+		if i := strings.LastIndex(path, route.sep); i >= 0 {
+			route.serve(rw, req, path[:i], path[i+len(route.sep):])
+			return
+		}
+	}
+	rw.WriteHeader(http.StatusNotFound)
+}
+
+func (r *fakeRegistry) serveManifest(rw http.ResponseWriter, req *http.Request, name, ref string) {
+	key := name + sep(ref) + ref
+	switch req.Method {
+	case "GET", "HEAD":
+		m, ok := r.manifests[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("Content-Type", m.mediaType)
+		rw.Header().Set("Content-Length", strconv.Itoa(len(m.body)))
+		rw.Header().Set("Docker-Content-Digest", digest.Canonical.FromBytes(m.body).String())
+		if req.Method == "GET" {
+			_, err := rw.Write(m.body)
+			assert.NoError(r.t, err)
+		}
+	case "PUT":
+		body, err := ioutil.ReadAll(req.Body)
+		if !assert.NoError(r.t, err) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var tags []string
+		if sep(ref) == ":" {
+			tags = append(tags, ref)
+		} else if digest.Canonical.FromBytes(body).String() != ref {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		d := r.store(name, req.Header.Get("Content-Type"), body, tags...)
+
+		var m struct {
+			Subject *distribution.Descriptor `json:"subject"`
+		}
+		if json.Unmarshal(body, &m) == nil && m.Subject != nil {
+			rw.Header().Set("OCI-Subject", m.Subject.Digest.String())
+		}
+		rw.Header().Set("Docker-Content-Digest", d.String())
+		rw.WriteHeader(http.StatusCreated)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveBlob(rw http.ResponseWriter, req *http.Request, name, d string) {
+	data, ok := r.blobs[name+"@"+d]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if req.Method == "GET" {
+		_, err := rw.Write(data)
+		assert.NoError(r.t, err)
+	}
+}
+
+func (r *fakeRegistry) serveUpload(rw http.ResponseWriter, req *http.Request, name, id string) {
+	switch {
+	case req.Method == "POST" && id == "":
+		q := req.URL.Query()
+		if data, ok := r.blobs[q.Get("from")+"@"+q.Get("mount")]; ok && r.mount {
+			r.blobs[name+"@"+q.Get("mount")] = data
+			rw.WriteHeader(http.StatusCreated)
+			return
+		}
+		id = uuid.New().String()
+		r.sessions[id] = name
+		rw.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+		rw.WriteHeader(http.StatusAccepted)
+	case req.Method == "PUT" && r.sessions[id] == name:
+		// a body that could not be read whole was not what the client meant to send
+		body, err := ioutil.ReadAll(req.Body)
+		d := digest.Digest(req.URL.Query().Get("digest"))
+		if err != nil || d != digest.Canonical.FromBytes(body) {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[name+"@"+d.String()] = body
+		delete(r.sessions, id)
+		rw.WriteHeader(http.StatusCreated)
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *fakeRegistry) serveReferrers(rw http.ResponseWriter, req *http.Request, name, subject string) {
+	index := distribution.NewIndex()
+	for key, m := range r.manifests {
+		if !strings.HasPrefix(key, name+"@") {
+			continue
+		}
+		var manifest struct {
+			ArtifactType string                   `json:"artifactType"`
+			Subject      *distribution.Descriptor `json:"subject"`
+		}
+		if json.Unmarshal(m.body, &manifest) != nil || manifest.Subject == nil || manifest.Subject.Digest.String() != subject {
+			continue
+		}
+		index.Add(distribution.Descriptor{
+			MediaType:    m.mediaType,
+			ArtifactType: manifest.ArtifactType,
+			Digest:       digest.Canonical.FromBytes(m.body),
+			Size:         int64(len(m.body)),
+		})
+	}
+	rw.Header().Set("Content-Type", distribution.MediaTypeOCIIndex)
+	assert.NoError(r.t, json.NewEncoder(rw).Encode(index))
+}
+
+// inFlight serves requests with a handler, counting those of method whose paths
+// have prefix while they are being served. Each of those is held for a while, so
+// that any that may be served at once are.
+type inFlight struct {
+	http.Handler
+	method, prefix string
+
+	mu     sync.Mutex
+	n, max int
+}
+
+func (f *inFlight) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == f.method && strings.HasPrefix(req.URL.Path, f.prefix) {
+		f.mu.Lock()
+		f.n++
+		if f.n > f.max {
+			f.max = f.n
+		}
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			f.n--
+			f.mu.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	f.Handler.ServeHTTP(rw, req)
+}
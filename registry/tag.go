@@ -0,0 +1,58 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"github.com/docker/distribution/reference"
+	"github.com/docker/distribution/registry/api/v2"
+	dauth "github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/docker/registry"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/distribution"
+)
+
+// TagManifest puts the manifest that src refers to, by tag or digest, under the tag
+// of dst in the same repository, as it is. As the blobs it refers to are already in
+// the repository, none of them are transferred, and the manifest keeps its digest.
+func TagManifest(
+	token dauth.Scope,
+	src reference.Named,
+	dst reference.NamedTagged,
+	endpoint *registry.APIEndpoint,
+) (*distribution.Descriptor, error) {
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+	body, mediaType, err := pullRawManifest(token, src, bldr)
+	if err != nil {
+		return nil, err
+	}
+	desc := &distribution.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.Canonical.FromBytes(body),
+		Size:      int64(len(body)),
+	}
+
+	remote, err := manifestDigest(token, dst, bldr, distribution.ManifestMediaTypes...)
+	if err != nil {
+		return nil, err
+	} else if remote == desc.Digest {
+		log.Info().Msgf("%s is up to date: %s.", dst, desc.Digest)
+		return desc, nil
+	}
+
+	desc, _, err = putManifest(token, dst, mediaType, body, endpoint)
+	return desc, err
+}
@@ -0,0 +1,76 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry"
+)
+
+func TestTagManifest(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// an OCI manifest, not in canonical form, that is only kept by being put as it is
+	body := []byte(`{"schemaVersion": 2, "mediaType": "` + distribution.MediaTypeOCIManifest + `",
+  "config": {"mediaType": "` + distribution.MediaTypeOCIConfig + `", "size": 2, "digest": "` +
+		digest.Canonical.FromString("{}").String() + `"}, "layers": []}`)
+
+	r := newFakeRegistry(t)
+	d := r.putManifest("repo", distribution.MediaTypeOCIManifest, body, "old")
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	src, endpoint := taggedEndpoint(t, server, "repo:old")
+	dst, _ := taggedEndpoint(t, server, "repo:new")
+
+	desc, err := registry.TagManifest(nil, src, dst, endpoint)
+	require.NoError(err)
+	assert.Equal(d, desc.Digest)
+	assert.Equal(distribution.MediaTypeOCIManifest, desc.MediaType)
+	assert.Equal(int64(len(body)), desc.Size)
+
+	// the manifest is put under the new tag byte for byte, with its media type, and
+	// no blob is touched
+	m, ok := r.manifest("repo", "new")
+	if assert.True(ok) {
+		assert.Equal(body, m.body)
+		assert.Equal(distribution.MediaTypeOCIManifest, m.mediaType)
+	}
+	assert.Equal(1, r.count("PUT", "/v2/repo/manifests/new"))
+	assert.Zero(r.count("GET", "/v2/repo/blobs/"))
+	assert.Zero(r.count("POST", "/v2/repo/blobs/uploads/"))
+
+	// a tag that already holds the manifest is not put again
+	_, err = registry.TagManifest(nil, src, dst, endpoint)
+	require.NoError(err)
+	assert.Equal(1, r.count("PUT", "/v2/repo/manifests/new"))
+
+	// and a source that is missing fails the tag, without putting anything
+	missing, _ := taggedEndpoint(t, server, "repo:missing")
+	other, _ := taggedEndpoint(t, server, "repo:other")
+	_, err = registry.TagManifest(nil, missing, other, endpoint)
+	assert.Error(err)
+	assert.Zero(r.count("PUT", "/v2/repo/manifests/other"))
+	_, ok = r.manifest("repo", "other")
+	assert.False(ok)
+}
@@ -0,0 +1,68 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"github.com/docker/distribution/registry/api/v2"
+	dauth "github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/docker/registry"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/Senetas/crypto-cli/crypto"
+	"github.com/Senetas/crypto-cli/distribution"
+	"github.com/Senetas/crypto-cli/registry/names"
+)
+
+// VerifyImage checks that an image may be pulled and decrypted with opts without
+// pulling its blobs. Its manifest and keys are pulled and the keys are decrypted,
+// and the registry is asked whether it has each blob.
+func VerifyImage(
+	token dauth.Scope,
+	ref names.NamedTaggedRepository,
+	endpoint *registry.APIEndpoint,
+	opts *crypto.Opts,
+	downloadDir string,
+) (manifest *distribution.ImageManifest, err error) {
+	bldr := v2.NewURLBuilder(endpoint.URL, false)
+
+	if manifest, err = PullKeys(token, ref, bldr, opts, downloadDir); err != nil {
+		return nil, errors.Wrapf(err, "the keys of %s could not be decrypted", ref)
+	}
+
+	var missing []digest.Digest
+	seen := make(map[digest.Digest]bool)
+	for _, b := range append([]distribution.Blob{manifest.Config}, manifest.LayerBlobs()...) {
+		d := b.GetDigest()
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+
+		var exists bool
+		if exists, err = layerExists(token, names.AppendDigest(names.SeperateRepository(ref), d), bldr); err != nil {
+			return nil, err
+		} else if !exists {
+			log.Error().Msgf("Blob %s is missing from the registry.", d)
+			missing = append(missing, d)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, errors.Errorf("%d of the %d blobs of %s are missing from the registry", len(missing), len(seen), ref)
+	}
+	return manifest, nil
+}
@@ -16,6 +16,8 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 )
 
 // Error is an error type that may be used to turn off the stack trace
@@ -44,6 +46,84 @@ func (e Error) Error() string {
 	return e.errtext
 }
 
+// Class is a class of failure, which scripts may tell apart by the exit status
+type Class int
+
+const (
+	// ClassOther is any failure that is not of another class
+	ClassOther Class = iota
+	// ClassAuth is a failure to authenticate with a registry, or to be authorised
+	ClassAuth
+	// ClassLabel is an image that was not built with the LABEL
+	ClassLabel
+	// ClassDecrypt is a key that could not be decrypted, such as with the wrong
+	// passphrase
+	ClassDecrypt
+	// ClassNetwork is a failure to reach a registry, or of a registry itself
+	ClassNetwork
+	// ClassDaemon is a failure of the docker or podman daemon, or of containerd
+	ClassDaemon
+)
+
+// ClassError is an error of a class of failure
+type ClassError struct {
+	Class Class
+	Err   error
+}
+
+// WithClass marks err as of the class c, it returns nil if err is nil
+func WithClass(err error, c Class) error {
+	if err == nil {
+		return nil
+	}
+	return &ClassError{Class: c, Err: err}
+}
+
+func (e *ClassError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause is the error that is marked, so that errors.Cause finds what caused it
+func (e *ClassError) Cause() error {
+	return e.Err
+}
+
+// Format formats the error that is marked, so that its stack trace is kept
+func (e *ClassError) Format(s fmt.State, verb rune) {
+	if f, ok := e.Err.(fmt.Formatter); ok {
+		f.Format(s, verb)
+		return
+	}
+	_, _ = io.WriteString(s, e.Error())
+}
+
+// ClassOf is the class of the first error that is marked by WithClass in the
+// chain of causes of err, or in any of several Errors, or ClassOther if none is
+func ClassOf(err error) Class {
+	for err != nil {
+		switch e := err.(type) {
+		case *ClassError:
+			return e.Class
+		case Errors:
+			for _, err := range e {
+				if c := ClassOf(err); c != ClassOther {
+					return c
+				}
+			}
+			return ClassOther
+		}
+
+		cause, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return ClassOther
+}
+
 // Errors holds mutiple errors
 type Errors []error
 
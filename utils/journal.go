@@ -0,0 +1,186 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// journalDir is the directory in a temporary directory that records which of
+// the directories in it belong to runs that are in progress
+const journalDir = "journal"
+
+// ResumeDir is the directory in a temporary directory that holds the encrypted
+// images of pushes that may be resumed, which Sweep keeps, as they are kept on
+// purpose when a push fails
+const ResumeDir = "resume"
+
+// journalEntry records the directory of a session and the process that owns it
+type journalEntry struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+// Session is a directory for the temporary files of a run, in a temporary
+// directory whose journal records it for as long as the run is in progress.
+// The directories of runs that crash are left behind, but Sweep finds them by
+// their journal entries, as the processes that owned them are gone.
+type Session struct {
+	// Dir is the directory of the session
+	Dir string
+
+	entry string
+}
+
+// StartSession makes a new session directory in root and records it in the
+// journal of root
+func StartSession(root string) (_ *Session, err error) {
+	id := uuid.New().String()
+	s := &Session{
+		Dir:   filepath.Join(root, id),
+		entry: filepath.Join(root, journalDir, id+".json"),
+	}
+
+	if err = os.MkdirAll(filepath.Dir(s.entry), 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	data, err := json.Marshal(journalEntry{PID: os.Getpid(), Started: time.Now().UTC()})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// the entry is written before the directory is made, so that the directory is
+	// never unrecorded, and is renamed into place, so that it is never half written
+	tmp := s.entry + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = os.Rename(tmp, s.entry); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if err = os.MkdirAll(s.Dir, 0700); err != nil {
+		return nil, s.End(errors.WithStack(err))
+	}
+	return s, nil
+}
+
+// End removes the session directory and then its journal entry, adding any error
+// in doing so to err
+func (s *Session) End(err error) error {
+	if err = CleanUp(s.Dir, err); err != nil {
+		// the entry is kept, so that the directory is swept later
+		return err
+	}
+	if err2 := os.Remove(s.entry); err2 != nil && !os.IsNotExist(err2) {
+		return errors.WithStack(err2)
+	}
+	return nil
+}
+
+// ReadDirFunc is the function to list the files of a directory
+var ReadDirFunc = ioutil.ReadDir
+
+// Sweep removes the session directories in root that do not belong to a run in
+// progress, which are those of the sessions of processes that no longer run and
+// any others that are not recorded in the journal, such as those of older
+// versions, along with the journal entries of the former. Only directories that
+// are named by a UUID, as sessions are, are swept, so that the other files in root
+// are kept, whoever made them. It returns the paths that are removed, or that
+// would be if dryRun is set.
+func Sweep(root string, dryRun bool) (removed []string, err error) {
+	// root is listed before the journal is read, as the entry of a session is
+	// written before its directory is made, so that the directory of a session that
+	// is started in between is not listed, rather than listed without its entry
+	files, err := ReadDirFunc(root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	entries, err := ReadDirFunc(filepath.Join(root, journalDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	live := make(map[string]bool)
+	for _, e := range entries {
+		id := strings.TrimSuffix(strings.TrimSuffix(e.Name(), ".tmp"), ".json")
+		if !isSessionName(id) {
+			continue
+		}
+		fn := filepath.Join(root, journalDir, e.Name())
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			// a half written entry, whose session was never started if it is not
+			// being written now
+			if time.Since(e.ModTime()) > time.Minute {
+				removed = append(removed, fn)
+			}
+			continue
+		}
+
+		var entry journalEntry
+		// the journal is written by this program
+		data, err := ioutil.ReadFile(fn) // #nosec
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err = json.Unmarshal(data, &entry); err == nil && processRunning(entry.PID) {
+			live[id] = true
+			continue
+		}
+		removed = append(removed, fn)
+	}
+
+	for _, f := range files {
+		if f.IsDir() && isSessionName(f.Name()) && !live[f.Name()] {
+			// the directories are removed before their entries
+			removed = append([]string{filepath.Join(root, f.Name())}, removed...)
+		}
+	}
+
+	if dryRun {
+		return removed, nil
+	}
+	if err = RemoveAll(removed); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// RemoveAll removes the files of paths in order, as returned by Sweep
+func RemoveAll(paths []string) error {
+	for _, fn := range paths {
+		if err := RemoveFunc(fn); err != nil {
+			return errors.Wrapf(err, "could not remove: %s", fn)
+		}
+	}
+	return nil
+}
+
+// isSessionName reports whether name is that of a session directory, which is a
+// UUID in its canonical form
+func isSessionName(name string) bool {
+	id, err := uuid.Parse(name)
+	return err == nil && id.String() == name
+}
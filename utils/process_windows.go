@@ -0,0 +1,46 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// processRunning reports whether the process pid is running. Processes cannot be
+// signalled on windows, but one that is gone cannot be opened, which fails with
+// ERROR_INVALID_PARAMETER. It is assumed to run if it fails for any other reason,
+// such as being denied access, so that the files of a run are never swept while
+// it may be in progress.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return !isInvalidParameter(err)
+	}
+	_ = p.Release()
+	return true
+}
+
+// errorInvalidParameter is ERROR_INVALID_PARAMETER, which syscall does not name
+const errorInvalidParameter = syscall.Errno(87)
+
+func isInvalidParameter(err error) bool {
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	return err == errorInvalidParameter
+}
@@ -0,0 +1,252 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"io"
+	"sync"
+)
+
+// Operations whose progress is reported
+const (
+	ProgressEncrypt    = "encrypt"
+	ProgressDecrypt    = "decrypt"
+	ProgressCompress   = "compress"
+	ProgressDecompress = "decompress"
+	ProgressExtract    = "extract"
+	ProgressUpload     = "upload"
+	ProgressDownload   = "download"
+)
+
+// ProgressReporter observes the byte-level progress of operations on blobs. Start
+// is called when an operation begins, with the name of the blob and the number of
+// bytes expected, which is 0 if it is not known. Operations may run concurrently,
+// so each is reported to the Progress that Start returns for it.
+type ProgressReporter interface {
+	Start(op, name string, total int64) Progress
+}
+
+// Progress observes the progress of a single operation
+type Progress interface {
+	// Add is called with the number of bytes processed since it was last called
+	Add(n int64)
+	// Done is called once when the operation ends
+	Done()
+}
+
+// GroupReporter is a ProgressReporter that also shows the progress of each blob of
+// an operation on several blobs, as well as its total
+type GroupReporter interface {
+	ProgressReporter
+	StartGroup(op, name string, total int64) ProgressGroup
+}
+
+// ProgressGroup observes the progress of an operation on several blobs. What is
+// added to it directly only counts towards its total.
+type ProgressGroup interface {
+	Progress
+	// Start starts reporting the progress of one of the blobs, which also counts
+	// towards the total of the group
+	Start(name string, total int64) Progress
+}
+
+// SpinnerReporter is a ProgressReporter that also shows that an operation whose
+// progress is not measured in bytes is running, such as the encryption of an image
+type SpinnerReporter interface {
+	ProgressReporter
+	StartSpinner(title string) Progress
+}
+
+type nopProgress struct{}
+
+func (nopProgress) Start(op, name string, total int64) Progress { return nopProgress{} }
+func (nopProgress) Add(n int64)                                 {}
+func (nopProgress) Done()                                       {}
+
+var (
+	reporterMu sync.RWMutex
+	reporter   ProgressReporter = nopProgress{}
+)
+
+// SetProgressReporter sets the reporter that all operations report to, progress is
+// not reported if it is nil
+func SetProgressReporter(r ProgressReporter) {
+	reporterMu.Lock()
+	defer reporterMu.Unlock()
+	if r == nil {
+		r = nopProgress{}
+	}
+	reporter = r
+}
+
+// StartProgress starts reporting the progress of an operation
+func StartProgress(op, name string, total int64) Progress {
+	reporterMu.RLock()
+	defer reporterMu.RUnlock()
+	return reporter.Start(op, name, total)
+}
+
+// StartProgressGroup starts reporting the progress of an operation on several
+// blobs. If the reporter does not show blobs on their own, only the total is.
+func StartProgressGroup(op, name string, total int64) ProgressGroup {
+	reporterMu.RLock()
+	defer reporterMu.RUnlock()
+	return startGroup(reporter, op, name, total)
+}
+
+// StartSpinner shows that the operation title is running until Done is called on
+// the Progress it returns, if the reporter shows that at all
+func StartSpinner(title string) Progress {
+	reporterMu.RLock()
+	defer reporterMu.RUnlock()
+	return startSpinner(reporter, title)
+}
+
+func startSpinner(r ProgressReporter, title string) Progress {
+	if s, ok := r.(SpinnerReporter); ok {
+		return s.StartSpinner(title)
+	}
+	return nopProgress{}
+}
+
+func startGroup(r ProgressReporter, op, name string, total int64) ProgressGroup {
+	if g, ok := r.(GroupReporter); ok {
+		return g.StartGroup(op, name, total)
+	}
+	return totalOnly{r.Start(op, name, total)}
+}
+
+// totalOnly is a ProgressGroup that only reports its total
+type totalOnly struct{ Progress }
+
+func (t totalOnly) Start(name string, total int64) Progress {
+	return GroupMember(nopProgress{}, t.Progress)
+}
+
+// TeeProgress reports progress to each of reporters at once, such as to show it
+// and to stream it to another program. Reporters that are nil are skipped.
+func TeeProgress(reporters ...ProgressReporter) ProgressReporter {
+	var t teeReporter
+	for _, r := range reporters {
+		if r != nil {
+			t = append(t, r)
+		}
+	}
+	return t
+}
+
+type teeReporter []ProgressReporter
+
+func (t teeReporter) Start(op, name string, total int64) Progress {
+	ps := make(teeProgress, len(t))
+	for i, r := range t {
+		ps[i] = r.Start(op, name, total)
+	}
+	return ps
+}
+
+func (t teeReporter) StartGroup(op, name string, total int64) ProgressGroup {
+	gs := make(teeGroup, len(t))
+	for i, r := range t {
+		gs[i] = startGroup(r, op, name, total)
+	}
+	return gs
+}
+
+func (t teeReporter) StartSpinner(title string) Progress {
+	ps := make(teeProgress, len(t))
+	for i, r := range t {
+		ps[i] = startSpinner(r, title)
+	}
+	return ps
+}
+
+type teeProgress []Progress
+
+func (t teeProgress) Add(n int64) {
+	for _, p := range t {
+		p.Add(n)
+	}
+}
+
+func (t teeProgress) Done() {
+	for _, p := range t {
+		p.Done()
+	}
+}
+
+// teeGroup reports a group to each reporter, each of which counts the blobs of
+// the group towards its own total
+type teeGroup []ProgressGroup
+
+func (t teeGroup) Add(n int64) {
+	for _, g := range t {
+		g.Add(n)
+	}
+}
+
+func (t teeGroup) Done() {
+	for _, g := range t {
+		g.Done()
+	}
+}
+
+func (t teeGroup) Start(name string, total int64) Progress {
+	ps := make(teeProgress, len(t))
+	for i, g := range t {
+		ps[i] = g.Start(name, total)
+	}
+	return ps
+}
+
+// GroupMember makes p the Progress of a blob of a group, bytes added to which are
+// also added to total, the progress of the group, for implementations of ProgressGroup
+func GroupMember(p, total Progress) Progress {
+	return &member{Progress: p, total: total}
+}
+
+type member struct {
+	Progress
+	total Progress
+}
+
+func (m *member) Add(n int64) {
+	m.Progress.Add(n)
+	m.total.Add(n)
+}
+
+// ProgressReader is an io.Reader that reports the number of bytes read from it
+type ProgressReader struct {
+	io.Reader
+	Progress Progress
+}
+
+func (pr *ProgressReader) Read(p []byte) (n int, err error) {
+	n, err = pr.Reader.Read(p)
+	pr.Progress.Add(int64(n))
+	return
+}
+
+// ProgressWriter is an io.Writer that reports the number of bytes written to it
+type ProgressWriter struct {
+	io.Writer
+	Progress Progress
+}
+
+func (pw *ProgressWriter) Write(p []byte) (n int, err error) {
+	n, err = pw.Writer.Write(p)
+	pw.Progress.Add(int64(n))
+	return
+}
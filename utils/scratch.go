@@ -0,0 +1,38 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import "os"
+
+// MemoryDirs are the directories that are usually on a memory backed filesystem
+func MemoryDirs() []string {
+	dirs := []string{"/dev/shm"}
+	if d := os.Getenv("XDG_RUNTIME_DIR"); d != "" {
+		dirs = append(dirs, d)
+	}
+	return dirs
+}
+
+// FindMemoryDir returns the first of dirs that is on a memory backed filesystem
+// with at least min bytes free, and the number of bytes free on it
+func FindMemoryDir(min uint64, dirs ...string) (string, uint64, bool) {
+	for _, d := range dirs {
+		memory, free, err := statFS(d)
+		if err == nil && memory && free >= min {
+			return d, free, true
+		}
+	}
+	return "", 0, false
+}
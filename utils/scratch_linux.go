@@ -0,0 +1,34 @@
+// Copyright © 2018 SENETAS SECURITY PTY LTD
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// tmpfsMagic is the type of a tmpfs filesystem reported by statfs(2)
+const tmpfsMagic = 0x01021994
+
+// statFS reports whether dir is on a tmpfs filesystem and how many bytes are
+// free on it for unprivileged users
+func statFS(dir string) (memory bool, free uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(dir, &st); err != nil {
+		return false, 0, errors.Wrapf(err, "could not stat filesystem of %s", dir)
+	}
+	return st.Type == tmpfsMagic, st.Bavail * uint64(st.Bsize), nil
+}
@@ -18,8 +18,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -225,6 +227,29 @@ func TestErrors(t *testing.T) {
 	}
 }
 
+func TestClassOf(t *testing.T) {
+	assert := assert.New(t)
+
+	base := errors.New("authentication failed")
+	marked := utils.WithClass(base, utils.ClassAuth)
+
+	assert.Nil(utils.WithClass(nil, utils.ClassAuth))
+	assert.Equal(utils.ClassOther, utils.ClassOf(nil))
+	assert.Equal(utils.ClassOther, utils.ClassOf(base))
+	assert.Equal(utils.ClassAuth, utils.ClassOf(marked))
+	assert.Equal("authentication failed", marked.Error())
+
+	// the class is found through wrapping, and the cause is kept
+	wrapped := errors.Wrap(marked, "could not push")
+	assert.Equal(utils.ClassAuth, utils.ClassOf(wrapped))
+	assert.Equal(base, errors.Cause(wrapped))
+	assert.Contains(fmt.Sprintf("%+v", wrapped), "TestClassOf")
+
+	// the first that is marked of several concurrent errors
+	errs := utils.Errors{base, utils.WithClass(base, utils.ClassNetwork), wrapped}
+	assert.Equal(utils.ClassNetwork, utils.ClassOf(errors.WithStack(errs)))
+}
+
 func TestConcatErrChan(t *testing.T) {
 	assert := assert.New(t)
 
@@ -309,6 +334,7 @@ func TestCleanUp(t *testing.T) {
 		},
 	}
 
+	defer func(remove func(string) error) { utils.RemoveFunc = remove }(utils.RemoveFunc)
 	for _, test := range tests {
 		utils.RemoveFunc = test.remove
 		err := utils.CleanUp(test.dir, test.errIn)
@@ -319,3 +345,308 @@ func TestCleanUp(t *testing.T) {
 		}
 	}
 }
+
+type rawMarshaler struct{}
+
+func (rawMarshaler) MarshalJSON() ([]byte, error) {
+	return []byte(`{ "b": 1,  "a": {"d": 12345678901234567890, "c": "<&>"} }`), nil
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		in  interface{}
+		out string
+	}{
+		{map[string]int{"b": 2, "a": 1}, `{"a":1,"b":2}`},
+		{rawMarshaler{}, `{"a":{"c":"<&>","d":12345678901234567890},"b":1}`},
+		{[]interface{}{rawMarshaler{}, nil}, `[{"a":{"c":"<&>","d":12345678901234567890},"b":1},null]`},
+	}
+
+	for _, test := range tests {
+		out, err := utils.CanonicalJSON(test.in)
+		if assert.NoError(err) {
+			assert.Equal(test.out, string(out))
+		}
+	}
+
+	_, err := utils.CanonicalJSON(func() {})
+	assert.Error(err)
+}
+
+type recordedProgress struct {
+	op, name string
+	total, n int64
+	done     bool
+}
+
+type recordingReporter []*recordedProgress
+
+func (r *recordingReporter) Start(op, name string, total int64) utils.Progress {
+	p := &recordedProgress{op: op, name: name, total: total}
+	*r = append(*r, p)
+	return p
+}
+
+func (p *recordedProgress) Add(n int64) { p.n += n }
+func (p *recordedProgress) Done()       { p.done = true }
+
+func TestProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	reporter := &recordingReporter{}
+	utils.SetProgressReporter(reporter)
+	defer utils.SetProgressReporter(nil)
+
+	data := []byte("some bytes to read")
+
+	p := utils.StartProgress(utils.ProgressUpload, "blob", int64(len(data)))
+	n, err := io.Copy(&bytes.Buffer{}, &utils.ProgressReader{Reader: bytes.NewReader(data), Progress: p})
+	assert.NoError(err)
+	p.Done()
+
+	p = utils.StartProgress(utils.ProgressDownload, "blob", 0)
+	_, err = (&utils.ProgressWriter{Writer: &bytes.Buffer{}, Progress: p}).Write(data)
+	assert.NoError(err)
+
+	if assert.Len(*reporter, 2) {
+		assert.Equal(&recordedProgress{utils.ProgressUpload, "blob", n, n, true}, (*reporter)[0])
+		assert.Equal(&recordedProgress{utils.ProgressDownload, "blob", 0, n, false}, (*reporter)[1])
+	}
+
+	// nothing is reported without a reporter
+	utils.SetProgressReporter(nil)
+	utils.StartProgress(utils.ProgressUpload, "blob", 0).Done()
+	assert.Len(*reporter, 2)
+}
+
+type groupReporter struct{ recordingReporter }
+
+type recordedGroup struct {
+	*recordedProgress
+	r *groupReporter
+}
+
+func (r *groupReporter) StartGroup(op, name string, total int64) utils.ProgressGroup {
+	return recordedGroup{r.Start(op, name, total).(*recordedProgress), r}
+}
+
+func (g recordedGroup) Start(name string, total int64) utils.Progress {
+	return utils.GroupMember(g.r.Start(g.op, name, total), g)
+}
+
+func TestProgressGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	reporter := &recordingReporter{}
+	utils.SetProgressReporter(reporter)
+	defer utils.SetProgressReporter(nil)
+
+	// only the total is reported by a reporter that does not show blobs
+	g := utils.StartProgressGroup(utils.ProgressUpload, "image", 5)
+	p := g.Start("blob", 3)
+	p.Add(3)
+	p.Done()
+	g.Add(2)
+	g.Done()
+
+	if assert.Len(*reporter, 1) {
+		assert.Equal(&recordedProgress{utils.ProgressUpload, "image", 5, 5, true}, (*reporter)[0])
+	}
+
+	// blobs count towards the total as well as their own
+	grouped := &groupReporter{}
+	utils.SetProgressReporter(grouped)
+
+	g = utils.StartProgressGroup(utils.ProgressDownload, "image", 5)
+	p = g.Start("blob", 3)
+	p.Add(3)
+	p.Done()
+	g.Add(2)
+	g.Done()
+
+	if assert.Len(grouped.recordingReporter, 2) {
+		assert.Equal(&recordedProgress{utils.ProgressDownload, "image", 5, 5, true}, grouped.recordingReporter[0])
+		assert.Equal(&recordedProgress{utils.ProgressDownload, "blob", 3, 3, true}, grouped.recordingReporter[1])
+	}
+}
+
+func TestTeeProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	plain := &recordingReporter{}
+	grouped := &groupReporter{}
+	utils.SetProgressReporter(utils.TeeProgress(plain, nil, grouped))
+	defer utils.SetProgressReporter(nil)
+
+	p := utils.StartProgress(utils.ProgressEncrypt, "layer", 4)
+	p.Add(4)
+	p.Done()
+
+	g := utils.StartProgressGroup(utils.ProgressUpload, "image", 5)
+	p = g.Start("blob", 3)
+	p.Add(3)
+	p.Done()
+	g.Add(2)
+	g.Done()
+
+	// each reporter sees the group as it would on its own
+	if assert.Len(*plain, 2) {
+		assert.Equal(&recordedProgress{utils.ProgressEncrypt, "layer", 4, 4, true}, (*plain)[0])
+		assert.Equal(&recordedProgress{utils.ProgressUpload, "image", 5, 5, true}, (*plain)[1])
+	}
+	if assert.Len(grouped.recordingReporter, 3) {
+		assert.Equal(&recordedProgress{utils.ProgressEncrypt, "layer", 4, 4, true}, grouped.recordingReporter[0])
+		assert.Equal(&recordedProgress{utils.ProgressUpload, "image", 5, 5, true}, grouped.recordingReporter[1])
+		assert.Equal(&recordedProgress{utils.ProgressUpload, "blob", 3, 3, true}, grouped.recordingReporter[2])
+	}
+}
+
+type spinnerReporter struct{ recordingReporter }
+
+func (r *spinnerReporter) StartSpinner(title string) utils.Progress {
+	return r.Start("spinner", title, 0)
+}
+
+func TestSpinner(t *testing.T) {
+	assert := assert.New(t)
+
+	// spinners are only shown by reporters that show them, and not at all when
+	// progress is not reported
+	plain := &recordingReporter{}
+	spinning := &spinnerReporter{}
+	utils.SetProgressReporter(utils.TeeProgress(plain, spinning))
+	defer utils.SetProgressReporter(nil)
+
+	utils.StartSpinner("Encrypting...").Done()
+	assert.Empty(*plain)
+	if assert.Len(spinning.recordingReporter, 1) {
+		assert.Equal(&recordedProgress{"spinner", "Encrypting...", 0, 0, true}, spinning.recordingReporter[0])
+	}
+
+	utils.SetProgressReporter(nil)
+	utils.StartSpinner("Decrypting...").Done()
+	assert.Len(spinning.recordingReporter, 1)
+}
+
+func TestFindMemoryDir(t *testing.T) {
+	assert := assert.New(t)
+
+	// a missing directory is never used, nor is a tmpfs without enough space
+	_, _, ok := utils.FindMemoryDir(0, filepath.Join(os.TempDir(), uuid.New().String()))
+	assert.False(ok)
+
+	dir, free, ok := utils.FindMemoryDir(0, utils.MemoryDirs()...)
+	if ok {
+		_, _, ok = utils.FindMemoryDir(free+1, dir)
+		assert.False(ok)
+	}
+}
+
+func TestSession(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	root := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(root)) }()
+
+	s, err := utils.StartSession(root)
+	require.NoError(err)
+	assert.DirExists(s.Dir)
+
+	// the files of a crashed run, whose process is gone, and those that are not
+	// in the journal are swept, but those of a run in progress are not
+	crashed, err := utils.StartSession(root)
+	require.NoError(err)
+	dead := exec.Command("true")
+	require.NoError(dead.Run())
+	entry := filepath.Join(root, "journal", filepath.Base(crashed.Dir)+".json")
+	require.NoError(ioutil.WriteFile(entry, []byte(fmt.Sprintf(`{"pid":%d}`, dead.Process.Pid)), 0600))
+	stray := filepath.Join(root, uuid.New().String())
+	require.NoError(os.MkdirAll(stray, 0700))
+	// the images of pushes that may be resumed are kept
+	resume := filepath.Join(root, utils.ResumeDir)
+	require.NoError(os.MkdirAll(resume, 0700))
+
+	removed, err := utils.Sweep(root, true)
+	require.NoError(err)
+	assert.ElementsMatch([]string{crashed.Dir, entry, stray}, removed)
+	assert.DirExists(crashed.Dir)
+
+	removed, err = utils.Sweep(root, false)
+	require.NoError(err)
+	assert.Len(removed, 3)
+	for _, fn := range removed {
+		_, err = os.Stat(fn)
+		assert.True(os.IsNotExist(err))
+	}
+	assert.DirExists(s.Dir)
+	assert.DirExists(resume)
+
+	require.NoError(s.End(nil))
+	_, err = os.Stat(s.Dir)
+	assert.True(os.IsNotExist(err))
+	removed, err = utils.Sweep(root, true)
+	require.NoError(err)
+	assert.Empty(removed)
+}
+
+func TestSweepForeignFiles(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	root := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(root)) }()
+
+	// files in root that were not made by a session are kept, even those named by
+	// a UUID if they are not directories
+	notes := filepath.Join(root, "notes.txt")
+	important := filepath.Join(root, "important")
+	named := filepath.Join(root, uuid.New().String())
+	require.NoError(os.MkdirAll(important, 0700))
+	require.NoError(ioutil.WriteFile(notes, []byte("notes"), 0600))
+	require.NoError(ioutil.WriteFile(named, []byte("named"), 0600))
+	require.NoError(ioutil.WriteFile(filepath.Join(important, "data"), []byte("data"), 0600))
+	stray := filepath.Join(root, uuid.New().String())
+	require.NoError(os.MkdirAll(stray, 0700))
+
+	removed, err := utils.Sweep(root, false)
+	require.NoError(err)
+	assert.Equal([]string{stray}, removed)
+	assert.FileExists(notes)
+	assert.FileExists(named)
+	assert.FileExists(filepath.Join(important, "data"))
+	_, err = os.Stat(stray)
+	assert.True(os.IsNotExist(err))
+}
+
+func TestSweepStartedSession(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	root := filepath.Join(os.TempDir(), "com.senetas.crypto", uuid.New().String())
+	defer func() { assert.NoError(os.RemoveAll(root)) }()
+	require.NoError(os.MkdirAll(root, 0700))
+
+	// a session that is started between the listing of root and the reading of
+	// the journal is not swept
+	var started *utils.Session
+	defer func() { utils.ReadDirFunc = ioutil.ReadDir }()
+	utils.ReadDirFunc = func(dir string) ([]os.FileInfo, error) {
+		files, err := ioutil.ReadDir(dir)
+		if started == nil {
+			var err2 error
+			started, err2 = utils.StartSession(root)
+			require.NoError(err2)
+		}
+		return files, err
+	}
+
+	removed, err := utils.Sweep(root, false)
+	require.NoError(err)
+	assert.Empty(removed)
+	require.NotNil(started)
+	assert.DirExists(started.Dir)
+	require.NoError(started.End(nil))
+}